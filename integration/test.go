@@ -4,10 +4,16 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
 	"sync"
 	"time"
 
@@ -22,6 +28,21 @@ import (
 var (
 	testDuration = flag.Duration("duration", 10*time.Second, "duration of the test")
 	concurrency  = flag.Int("concurrency", 9, "number of concurrent http clients")
+	target       = flag.String("target", "localhost:18001", "host:port of the 'fast' nginx server; the 'slow' one should listen on the next port")
+	reloadCmd    = flag.String("reload_command", "", "shell command reloading nginx under test; the reload test is skipped if empty")
+)
+
+const (
+	// Values from 1 to summaryValues are observed once each by the summary
+	// test, so that the expected quantiles are known.
+	summaryValues = 1000
+	// Quantiles are estimated with relative error of up to 1% by the
+	// library; the rest is allowed for ranks that fall between two values.
+	summaryTolerance = 0.02
+	// Number of fast requests sent by the reload test after nginx is reloaded.
+	reloadRequests = 100
+	// Maximum time for all nginx workers to be replaced after a reload.
+	reloadTimeout = 10 * time.Second
 )
 
 type requestType int
@@ -36,10 +57,26 @@ const (
 // - 'fast' simply returns "ok" with a 200 response code;
 // - 'slow' waits for 10ms and returns "ok" with a 200 response code;
 // - 'error' returns a 500.
-var urls = map[requestType]string{
-	reqFast:  "http://localhost:18001/",
-	reqSlow:  "http://localhost:18002/",
-	reqError: "http://localhost:18001/error",
+// URLs are set by main once flags are parsed.
+var urls map[requestType]string
+
+// Port offsets of nginx servers from the port of -target.
+const (
+	fastServer = 0
+	slowServer = 1
+)
+
+// serverURL returns the URL of a path on one of the nginx servers.
+func serverURL(server int, path string) string {
+	host, port, err := net.SplitHostPort(*target)
+	if err != nil {
+		log.Fatalf("Invalid -target %q: %v", *target, err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		log.Fatalf("Invalid port in -target %q: %v", *target, err)
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(p+server)) + path
 }
 
 // getHistogramSum returns the 'sum' value for a given histogram metric.
@@ -62,6 +99,57 @@ func getHistogramSum(mfs map[string]*dto.MetricFamily, metric string, labels [][
 	return 0
 }
 
+// getValue returns the value of a counter or a gauge with given labels.
+func getValue(mfs map[string]*dto.MetricFamily, metric string, labels [][]string) (float64, bool) {
+	var lps []*dto.LabelPair
+	for _, lp := range labels {
+		lps = append(lps, &dto.LabelPair{Name: proto.String(lp[0]), Value: proto.String(lp[1])})
+	}
+
+	if mf, ok := mfs[metric]; ok {
+		for _, m := range mf.Metric {
+			if cmp.Equal(m.Label, lps) {
+				if m.Counter != nil {
+					return m.Counter.GetValue(), true
+				}
+				return m.Gauge.GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Label values with characters that need to be escaped in the text format,
+// as well as multi-byte UTF-8 characters.
+var unusualLabelValues = []string{
+	`back\slash`,
+	`trailing backslash\`,
+	`"quoted"`,
+	"new\nline",
+	"\\n is not a newline",
+	"multi-byte: é, ß, 日本語, 🙂",
+}
+
+// getSummary returns the summary metric with given labels, or nil if there is
+// no such metric.
+func getSummary(mfs map[string]*dto.MetricFamily, metric string, labels [][]string) *dto.Summary {
+	var lps []*dto.LabelPair
+	for _, lp := range labels {
+		lps = append(lps, &dto.LabelPair{Name: proto.String(lp[0]), Value: proto.String(lp[1])})
+	}
+
+	for _, mf := range mfs {
+		if *mf.Name == metric {
+			for _, m := range mf.Metric {
+				if cmp.Equal(m.Label, lps) {
+					return m.Summary
+				}
+			}
+		}
+	}
+	return nil
+}
+
 // hasMetricFamily verifies that a given MetricFamily exists in a passed list of
 // metric families.
 func hasMetricFamily(mfs map[string]*dto.MetricFamily, want *dto.MetricFamily) error {
@@ -79,11 +167,16 @@ func hasMetricFamily(mfs map[string]*dto.MetricFamily, want *dto.MetricFamily) e
 
 func main() {
 	flag.Parse()
+	urls = map[requestType]string{
+		reqFast:  serverURL(fastServer, "/"),
+		reqSlow:  serverURL(slowServer, "/"),
+		reqError: serverURL(fastServer, "/error"),
+	}
 
 	// Use a custom http client with a lower idle connection timeout.
 	client := &http.Client{Transport: &http.Transport{IdleConnTimeout: 400 * time.Millisecond}}
 
-	log.Printf("Starting the test with %d concurrent clients", *concurrency)
+	log.Printf("Starting the test against %s with %d concurrent clients", *target, *concurrency)
 	var wg sync.WaitGroup
 	results := make(chan map[requestType]int64, *concurrency)
 	for i := 1; i <= *concurrency; i++ {
@@ -134,18 +227,200 @@ func main() {
 	// to nginx get closed, and to allow for some eventual consistency in nginx-lua-prometheus.
 	time.Sleep(500 * time.Millisecond)
 
-	resp, err := client.Get("http://localhost:18001/metrics")
+	observeSummary(client)
+	sendUnusualLabels(client)
+	time.Sleep(500 * time.Millisecond)
+
+	// Clients outside of the allowlist should not be able to get metrics.
+	for url, want := range map[string]int{
+		serverURL(fastServer, "/metrics_allowed"): http.StatusOK,
+		serverURL(fastServer, "/metrics_denied"):  http.StatusForbidden,
+	} {
+		resp, err := client.Get(url)
+		if err != nil {
+			log.Fatalf("Could not fetch URL %s: %v", url, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			log.Fatalf("Unexpected status %d from %s; expected %d", resp.StatusCode, url, want)
+		}
+	}
+
+	// Metrics are checked in both the text and the protobuf format.
+	for _, format := range []expfmt.Format{expfmt.FmtText, expfmt.FmtProtoDelim} {
+		log.Printf("Checking metrics in %s format", format)
+		mfs := fetchMetrics(client, format)
+		checkMetrics(mfs, fast, slow, errors)
+		checkSummary(mfs)
+		checkUnusualLabels(mfs)
+		checkUnusualHelp(mfs)
+	}
+	checkReload(client, fast)
+	log.Print("All ok")
+}
+
+// observeSummary records values from 1 to summaryValues in a summary. Values
+// are shuffled and sent by concurrent clients, so that they get observed by
+// all nginx workers.
+func observeSummary(client *http.Client) {
+	values := make(chan int, summaryValues)
+	for _, v := range rand.Perm(summaryValues) {
+		values <- v + 1
+	}
+	close(values)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			for v := range values {
+				url := serverURL(fastServer, fmt.Sprintf("/observe?value=%d", v))
+				resp, err := client.Get(url)
+				if err != nil {
+					log.Fatalf("Could not fetch URL %s: %v", url, err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					log.Fatalf("Unexpected status %d from %s", resp.StatusCode, url)
+				}
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+// sendUnusualLabels sends each of unusualLabelValues once in a header that
+// nginx uses as a label value. Values are percent-encoded, since headers can't
+// contain newlines.
+func sendUnusualLabels(client *http.Client) {
+	for _, value := range unusualLabelValues {
+		req, err := http.NewRequest("GET", serverURL(fastServer, "/label"), nil)
+		if err != nil {
+			log.Fatalf("Could not create request: %v", err)
+		}
+		req.Header.Set("X-Label", url.PathEscape(value))
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Fatalf("Could not send label %q: %v", value, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Fatalf("Unexpected status %d for label %q", resp.StatusCode, value)
+		}
+	}
+}
+
+// fetchMetrics collects metrics from nginx in a given exposition format.
+func fetchMetrics(client *http.Client, format expfmt.Format) map[string]*dto.MetricFamily {
+	mfs, err := getMetrics(client, format)
 	if err != nil {
-		log.Fatalf("Could not collect metrics: %v", err)
+		log.Fatal(err)
 	}
-	defer resp.Body.Close()
+	return mfs
+}
 
-	var parser expfmt.TextParser
-	mfs, err := parser.TextToMetricFamilies(resp.Body)
+// getMetrics is like fetchMetrics, but returns an error instead of failing the
+// test, for requests that might fail while nginx is being reloaded.
+func getMetrics(client *http.Client, format expfmt.Format) (map[string]*dto.MetricFamily, error) {
+	req, err := http.NewRequest("GET", serverURL(fastServer, "/metrics"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create request: %v", err)
+	}
+	req.Header.Set("Accept", string(format))
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("Could not parse metrics: %v", err)
+		return nil, fmt.Errorf("Could not collect metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if got := expfmt.ResponseFormat(resp.Header); got != format {
+		return nil, fmt.Errorf("Metrics returned in %s format; expected %s", got, format)
+	}
+
+	mfs := make(map[string]*dto.MetricFamily)
+	decoder := expfmt.NewDecoder(resp.Body, format)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := decoder.Decode(mf); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not parse metrics: %v", err)
+		}
+		mfs[mf.GetName()] = mf
+	}
+	return mfs, nil
+}
+
+// checkReload reloads nginx with -reload_command, and verifies that counters
+// keep their values, since the shared dictionary survives reloads, and that
+// new workers keep incrementing them. The number of fast requests sent
+// before is passed, since none have been sent since metrics were checked.
+func checkReload(client *http.Client, fast int64) {
+	if *reloadCmd == "" {
+		log.Print("Skipping the reload test, since -reload_command is not set")
+		return
+	}
+	fastLabels := [][]string{{"host", "fast"}, {"status", "200"}}
+	mfs := fetchMetrics(client, expfmt.FmtText)
+	starts, _ := getValue(mfs, "worker_starts_total", nil)
+	workers, ok := getValue(mfs, "worker_processes", nil)
+	if !ok {
+		log.Fatalf("Metric worker_processes not found in %v", mfs)
+	}
+
+	log.Printf("Reloading nginx with %q", *reloadCmd)
+	if out, err := exec.Command("sh", "-c", *reloadCmd).CombinedOutput(); err != nil {
+		log.Fatalf("Could not reload nginx: %v\n%s", err, out)
+	}
+
+	// The reload command returns before workers are replaced. Old workers keep
+	// serving requests until new ones are started, and requests can fail in
+	// between, so metrics are polled until every new worker has reported its
+	// start.
+	for deadline := time.Now().Add(reloadTimeout); ; time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			log.Fatalf("New nginx workers did not start within %v", reloadTimeout)
+		}
+		mfs, err := getMetrics(client, expfmt.FmtText)
+		if err != nil {
+			log.Printf("Retrying while nginx is being reloaded: %v", err)
+			continue
+		}
+		if v, _ := getValue(mfs, "worker_starts_total", nil); v >= starts+workers {
+			break
+		}
+	}
+	// Allow old workers to finish shutting down, so that requests below are
+	// handled by new workers.
+	time.Sleep(500 * time.Millisecond)
+
+	mfs = fetchMetrics(client, expfmt.FmtText)
+	if v, _ := getValue(mfs, "requests_total", fastLabels); v != float64(fast) {
+		log.Fatalf("Counter of fast requests is %v after reload; expected %d", v, fast)
+	}
+
+	for i := 0; i < reloadRequests; i++ {
+		resp, err := client.Get(urls[reqFast])
+		if err != nil {
+			log.Fatalf("Could not fetch URL %s: %v", urls[reqFast], err)
+		}
+		resp.Body.Close()
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	mfs = fetchMetrics(client, expfmt.FmtText)
+	want := fast + reloadRequests
+	if v, _ := getValue(mfs, "requests_total", fastLabels); v != float64(want) {
+		log.Fatalf("Counter of fast requests is %v after reload and %d more requests; expected %d",
+			v, reloadRequests, want)
+	}
+	if v, _ := getValue(mfs, "nginx_metric_errors_total", nil); v != 0 {
+		log.Fatalf("%v errors reported by the library after reload; expected 0", v)
 	}
+}
 
+// checkMetrics verifies collected metrics against the number of requests sent.
+func checkMetrics(mfs map[string]*dto.MetricFamily, fast, slow, errors int64) {
 	// We expect all fast requests to take less than 1 second.
 	if v := getHistogramSum(mfs, "request_duration_seconds", [][]string{{"host", "fast"}}); v > 1 {
 		log.Fatalf("Total time to process all fast request is %f; expected <= 1", v)
@@ -202,6 +477,14 @@ func main() {
 				}, Gauge: &dto.Gauge{Value: proto.Float64(float64(1))}},
 			},
 		},
+		{
+			// Slow requests increment and decrement the gauge concurrently in
+			// all workers, and none of the updates should get lost.
+			Name:   proto.String("requests_in_flight"),
+			Help:   proto.String("Number of slow requests being processed"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(0)}}},
+		},
 	}
 
 	for _, mf := range expected {
@@ -209,5 +492,84 @@ func main() {
 			log.Fatal(err)
 		}
 	}
-	log.Print("All ok")
+}
+
+// checkSummary verifies the summary populated by observeSummary.
+func checkSummary(mfs map[string]*dto.MetricFamily) {
+	// Label sets that never received any observations should not be exposed,
+	// even though other label sets of the summary are.
+	if s := getSummary(mfs, "observed_values", [][]string{{"set", "empty"}}); s != nil {
+		log.Fatalf("Unexpected summary for a label set without observations: %v", s)
+	}
+
+	s := getSummary(mfs, "observed_values", [][]string{{"set", "uniform"}})
+	if s == nil {
+		log.Fatalf("Summary observed_values not found in %v", mfs)
+	}
+	// Count and sum are exact, no matter which worker observed each value.
+	if got := s.GetSampleCount(); got != summaryValues {
+		log.Fatalf("Summary count is %d; expected %d", got, summaryValues)
+	}
+	if got, want := s.GetSampleSum(), float64(summaryValues*(summaryValues+1)/2); got != want {
+		log.Fatalf("Summary sum is %f; expected %f", got, want)
+	}
+
+	want := map[float64]float64{0.5: 500, 0.9: 900, 0.99: 990}
+	if len(s.Quantile) != len(want) {
+		log.Fatalf("Summary has quantiles %v; expected %v", s.Quantile, want)
+	}
+	for _, q := range s.Quantile {
+		expected, ok := want[q.GetQuantile()]
+		if !ok {
+			log.Fatalf("Unexpected quantile %f in %v", q.GetQuantile(), s.Quantile)
+		}
+		if got := q.GetValue(); math.Abs(got-expected) > expected*summaryTolerance {
+			log.Fatalf("Quantile %f of the summary is %f; expected %f +-%.0f%%",
+				q.GetQuantile(), got, expected, summaryTolerance*100)
+		}
+	}
+}
+
+// checkUnusualLabels verifies that values sent by sendUnusualLabels are
+// returned unchanged. Since metrics have already been parsed, this also means
+// that they were escaped correctly.
+func checkUnusualLabels(mfs map[string]*dto.MetricFamily) {
+	want := &dto.MetricFamily{
+		Name: proto.String("unusual_labels_total"),
+		Help: proto.String("Number of requests with unusual label values"),
+		Type: dto.MetricType_COUNTER.Enum(),
+	}
+	for _, value := range unusualLabelValues {
+		want.Metric = append(want.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{
+				{Name: proto.String("value"), Value: proto.String(value)},
+			},
+			Counter: &dto.Counter{Value: proto.Float64(1)},
+		})
+	}
+	if err := hasMetricFamily(mfs, want); err != nil {
+		log.Fatal(err)
+	}
+	// Valid values should not be reported as errors by the library.
+	if err := hasMetricFamily(mfs, &dto.MetricFamily{
+		Name:   proto.String("nginx_metric_errors_total"),
+		Help:   proto.String("Number of nginx-lua-prometheus errors"),
+		Type:   dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(0)}}},
+	}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// checkUnusualHelp verifies that help text with characters that need to be
+// escaped in HELP comments is returned unchanged.
+func checkUnusualHelp(mfs map[string]*dto.MetricFamily) {
+	if err := hasMetricFamily(mfs, &dto.MetricFamily{
+		Name:   proto.String("unusual_help"),
+		Help:   proto.String("Help text with a\nnewline, a back\\slash and \"quotes\""),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+	}); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -20,7 +20,9 @@ docker run -d --name ${container_name} -p 18001:18001 -p 18002:18002 \
   -v "${base_dir}/../:/nginx-lua-prometheus" ${image_name} \
   nginx -c /nginx-lua-prometheus/integration/nginx.conf
 
-go run test.go
+go run test.go \
+  -reload_command="docker exec ${container_name} nginx -c /nginx-lua-prometheus/integration/nginx.conf -s reload" \
+  "$@"
 
 if docker logs ${container_name} 2>&1 | grep -q 'error'; then
   echo "There were unexpected errors in the log:"
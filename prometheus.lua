@@ -1,8 +1,12 @@
 --- @module Prometheus
 --
 -- vim: ts=2:sw=2:sts=2:expandtab:textwidth=80
--- This module uses a single dictionary shared between Nginx workers to keep
--- all metrics. Each metric is stored as a separate entry in that dictionary.
+-- This module uses a dictionary shared between Nginx workers to keep all
+-- metrics. Each metric is stored as a separate entry in that dictionary.
+-- Optionally, metrics of different types can be kept in separate dictionaries
+-- to reduce lock contention between them; each key is then stored in exactly
+-- one of the dictionaries, and data used internally by the module is kept in
+-- the default one.
 --
 -- In addition, each worker process has a separate set of counters within
 -- its lua runtime that are used to track increments to counte metrics, and
@@ -56,32 +60,199 @@
 -- increments. Copied from https://github.com/Kong/lua-resty-counter
 local resty_counter_lib = require("prometheus_resty_counter")
 local key_index_lib = require("prometheus_keys")
+local dict_lib = require("prometheus_dict")
+local protobuf_lib = require("prometheus_protobuf")
+local cidr_lib = require("prometheus_cidr")
 
 local Prometheus = {}
 local mt = { __index = Prometheus }
 
+-- Version of the library, which should match the rockspec. Exposed by the
+-- build information metric (see `build_info` option).
+Prometheus.VERSION = "0.20210206"
+
 local TYPE_COUNTER    = 0x1
 local TYPE_GAUGE      = 0x2
 local TYPE_HISTOGRAM  = 0x4
+local TYPE_SUMMARY    = 0x8
 local TYPE_LITERAL = {
   [TYPE_COUNTER]   = "counter",
   [TYPE_GAUGE]     = "gauge",
   [TYPE_HISTOGRAM] = "histogram",
+  [TYPE_SUMMARY]   = "summary",
 }
 
 -- Default name for error metric incremented by this library.
 local DEFAULT_ERROR_METRIC_NAME = "nginx_metric_errors_total"
 
+-- Name of the gauge with the timestamp of the last error.
+local LAST_ERROR_TIMESTAMP_METRIC_NAME =
+  "nginx_metric_last_error_timestamp_seconds"
+
+-- Name of the liveness metric added to the output of collect() if `up_metric`
+-- option is set.
+local UP_METRIC_NAME = "nginx_lua_prometheus_up"
+
+-- Name of the gauge with versions of the library, nginx and LuaJIT added to
+-- the output of collect() if `build_info` option is set.
+local BUILD_INFO_METRIC_NAME = "nginx_lua_prometheus_build_info"
+
+-- Names of the gauges describing the previous collection of metrics, which are
+-- exposed if `scrape_metrics` option is set.
+local SCRAPE_DURATION_METRIC_NAME = "nginx_metric_collect_duration_seconds"
+local SCRAPE_SERIES_METRIC_NAME = "nginx_metric_series_total"
+
+-- Names of the gauges describing usage of shared dictionaries added to the
+-- output of collect() if `dict_metrics` option is set.
+local DICT_BYTES_METRIC_NAME = "nginx_metric_dict_bytes"
+local DICT_KEYS_METRIC_NAME = "nginx_metric_dict_keys"
+
 -- Default value for per-worker counter sync interval (seconds).
 local DEFAULT_SYNC_INTERVAL = 1
 
+-- Default fraction of the sync interval by which each worker shortens the
+-- interval of its counter syncs (see `sync_jitter` option).
+local DEFAULT_SYNC_JITTER = 0.2
+
+-- Default maximum number of pending gauge updates kept by each worker when
+-- async mode is enabled.
+local DEFAULT_ASYNC_QUEUE_SIZE = 10000
+
+-- Operations that can be queued in async mode.
+local QUEUE_OP_SET = 1
+local QUEUE_OP_INC = 2
+
 -- Default set of latency buckets, 5ms to 10s:
 local DEFAULT_BUCKETS = {0.005, 0.01, 0.02, 0.03, 0.05, 0.075, 0.1, 0.2, 0.3,
                          0.4, 0.5, 0.75, 1, 1.5, 2, 3, 4, 5, 10}
 
+-- Default quantiles of summaries, and relative accuracy of their estimates.
+local DEFAULT_QUANTILES = {0.5, 0.9, 0.99}
+local DEFAULT_SUMMARY_EPSILON = 0.01
+
+-- Values of summary observations closer to zero than this are counted as 0.
+local MIN_SKETCH_VALUE = 1e-9
+
+-- Range of schemas of native histograms, and the default width of their zero
+-- bucket (same as in the Go client library).
+local MIN_NATIVE_SCHEMA = -4
+local MAX_NATIVE_SCHEMA = 8
+local DEFAULT_NATIVE_ZERO_THRESHOLD = 2^-128
+
+-- Default names of metrics populated by Prometheus:collect_nginx_status().
+local DEFAULT_NGINX_STATUS_METRIC_NAMES = {
+  connections = "nginx_connections",
+  accepted = "nginx_connections_accepted_total",
+  handled = "nginx_connections_handled_total",
+  requests = "nginx_http_requests_total",
+}
+
+-- Connection states reported by the nginx stub_status module.
+local NGINX_CONNECTION_STATES = {"active", "reading", "writing", "waiting"}
+
+-- Name and buckets of the histogram tracking duration of dictionary writes.
+local LOCK_WAIT_METRIC_NAME = "nginx_metric_dict_lock_wait_seconds"
+local LOCK_WAIT_BUCKETS = {0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005,
+                           0.01, 0.05, 0.1}
+
+-- Categories of metrics that can be stored in separate shared dictionaries
+-- (see Prometheus.init), and their metric types.
+local DICT_CATEGORIES = {counters = TYPE_COUNTER, gauges = TYPE_GAUGE,
+                         histograms = TYPE_HISTOGRAM, summaries = TYPE_SUMMARY}
+
+-- Maximum number of retries of failed dictionary writes (`write_retries`).
+-- Together with the delay before each retry (see prometheus_dict) this bounds
+-- the extra latency of a write to a few milliseconds.
+local MAX_WRITE_RETRIES = 5
+
+-- Help strings of process metrics, keyed by metric name. Metrics other than
+-- the number of workers have a `worker` label with the worker id.
+local PROCESS_METRIC_HELP = {
+  nginx_worker_processes = "Number of nginx worker processes",
+  process_start_time_seconds =
+    "Start time of the nginx worker process since unix epoch in seconds",
+  process_resident_memory_bytes =
+    "Resident memory size of the nginx worker process in bytes",
+  process_open_fds = "Number of open file descriptors of the nginx worker process",
+}
+
+-- C functions used to read process metrics.
+local PROCESS_METRIC_FFI_DECLARATIONS = {
+  getpagesize = "int getpagesize(void);",
+  opendir = "void *opendir(const char *name);",
+  readdir = "void *readdir(void *dirp);",
+  closedir = "int closedir(void *dirp);",
+}
+
 -- Prefix for internal shared dictionary items.
 local KEY_INDEX_PREFIX = "__ngx_prom__"
 
+-- Prefix for shared dictionary items keeping the time of the last update of
+-- series of metrics with `ttl_output` or `ttl_purge` options.
+local UPDATED_PREFIX = KEY_INDEX_PREFIX .. "updated_"
+
+-- Prefix for shared dictionary items keeping bins of summary sketches (see
+-- sketch_bin) and buckets of native histograms (see native_bin).
+local SKETCH_PREFIX = KEY_INDEX_PREFIX .. "sketch_"
+
+-- Maximum number of expired series deleted by each run of
+-- purge_expired_series, so that many series expiring at the same time don't
+-- block the worker for long. Expired series are not returned by collect()
+-- while they wait to be deleted.
+local PURGE_BATCH_SIZE = 500
+
+-- Policies applied when writes fail because the shared dictionary is full
+-- (see `on_dict_full` option of init()).
+local DICT_FULL_POLICIES = {
+  error = true,
+  evict_lru = true,
+  reset_histograms = true,
+}
+
+-- Number of least recently updated series deleted at once by the `evict_lru`
+-- policy.
+local EVICT_BATCH_SIZE = 10
+
+-- Minimum interval between attempts of a worker to free space in a full
+-- shared dictionary (seconds), so that a burst of failed writes doesn't scan
+-- the key index for each of them.
+local MIN_EVICTION_INTERVAL = 1
+
+-- Prefix of the index of metric families registered by any worker, and of
+-- shared dictionary items keeping their type and help text (see
+-- record_family).
+local FAMILIES_PREFIX = KEY_INDEX_PREFIX .. "families_"
+local FAMILY_PREFIX = KEY_INDEX_PREFIX .. "family_"
+
+-- Prefix of shared dictionary items counting series of metrics with
+-- `max_series` option (see check_series_limit).
+local SERIES_COUNT_PREFIX = KEY_INDEX_PREFIX .. "series_count_"
+
+-- Shared dictionary item marking that metric values have been restored by
+-- Prometheus:restore().
+local RESTORED_KEY = KEY_INDEX_PREFIX .. "restored"
+
+-- Shared dictionary item counting started and finished resets of all metrics
+-- (see Prometheus:reset). It is odd while a reset is in progress.
+local RESET_GENERATION_KEY = KEY_INDEX_PREFIX .. "reset_generation"
+
+-- Shared dictionary item counting started and finished resets of histogram
+-- values (see reset_histogram). Like RESET_GENERATION_KEY, it is odd while a
+-- reset is in progress.
+local HISTOGRAM_RESET_GENERATION_KEY = KEY_INDEX_PREFIX ..
+  "histogram_reset_generation"
+
+-- Current time in seconds.
+--
+-- This is the time source used for all timestamps recorded by this library.
+local function now()
+  return ngx.now()
+end
+
+-- Maximum combined length of label names and values of an exemplar (in
+-- characters), as defined by OpenMetrics.
+local MAX_EXEMPLAR_LABELS_LENGTH = 128
+
 -- Accepted range of byte values for tailing bytes of utf8 strings.
 -- This is defined outside of the validate_utf8_string function as a const
 -- variable to avoid creating and destroying table frequently.
@@ -148,39 +319,107 @@ local function validate_utf8_string(str)
   return true
 end
 
+-- Accepted values of the `invalid_utf8` option of init().
+local INVALID_UTF8_POLICIES = {truncate = true, replace = true, escape = true}
+
+-- Unicode replacement character, used instead of invalid bytes with the
+-- "replace" policy.
+local UTF8_REPLACEMENT_CHARACTER = "\239\191\189"
+
+-- Replace or escape invalid bytes of a string that is not valid utf8.
+--
+-- Args:
+--   str: string
+--   pos: (number) position of the first invalid byte.
+--   policy: (string) "replace" or "escape" (as `\xHH`).
+--
+-- Returns:
+--   (string) a valid utf8 string.
+local function sanitize_utf8_string(str, pos, policy)
+  local parts = {}
+  local valid = false
+  while not valid do
+    table.insert(parts, str:sub(1, pos - 1))
+    if policy == "replace" then
+      table.insert(parts, UTF8_REPLACEMENT_CHARACTER)
+    else
+      table.insert(parts, string.format("\\x%02X", str:byte(pos)))
+    end
+    str = str:sub(pos + 1)
+    valid, pos = validate_utf8_string(str)
+  end
+  table.insert(parts, str)
+  return table.concat(parts)
+end
+
 -- Generate full metric name that includes all labels.
 --
 -- Args:
 --   name: string
 --   label_names: (array) a list of label keys.
 --   label_values: (array) a list of label values.
+--   invalid_utf8: (string) what to do with label values that are not valid
+--     utf8 (see INVALID_UTF8_POLICIES). Values are truncated before the first
+--     invalid byte by default.
 --
 -- Returns:
 --   (string) full metric name.
-local function full_metric_name(name, label_names, label_values)
-  if not label_names then
+--   (bool) whether invalid utf8 was replaced or escaped.
+local function full_metric_name(name, label_names, label_values, invalid_utf8)
+  -- Metrics without labels are exposed without braces, since some parsers
+  -- reject empty label sets.
+  if not label_names or #label_names == 0 then
     return name
   end
   local label_parts = {}
+  local sanitized = false
   for idx, key in ipairs(label_names) do
     local label_value
     if type(label_values[idx]) == "string" then
       local valid, pos = validate_utf8_string(label_values[idx])
-      if not valid then
+      if not valid and invalid_utf8 and invalid_utf8 ~= "truncate" then
+        sanitized = true
+        label_value = sanitize_utf8_string(label_values[idx], pos,
+                                           invalid_utf8)
+                        :gsub("\\", "\\\\")
+                        :gsub('"', '\\"')
+                        :gsub("\n", "\\n")
+      elseif not valid then
         label_value = string.sub(label_values[idx], 1, pos - 1)
                         :gsub("\\", "\\\\")
                         :gsub('"', '\\"')
+                        :gsub("\n", "\\n")
       else
         label_value = label_values[idx]
                         :gsub("\\", "\\\\")
                         :gsub('"', '\\"')
+                        :gsub("\n", "\\n")
       end
     else
       label_value = tostring(label_values[idx])
     end
     table.insert(label_parts, key .. '="' .. label_value .. '"')
   end
-  return name .. "{" .. table.concat(label_parts, ",") .. "}"
+  return name .. "{" .. table.concat(label_parts, ",") .. "}", sanitized
+end
+
+-- Escape help text of a metric for a HELP comment.
+--
+-- Backslashes and newlines are escaped in both text formats, and OpenMetrics
+-- also requires double quotes to be escaped.
+--
+-- Args:
+--   help: (string) description of the metric.
+--   openmetrics: (boolean) escape for the OpenMetrics text format.
+--
+-- Returns:
+--   (string) escaped help text.
+local function escape_help(help, openmetrics)
+  help = help:gsub("\\", "\\\\"):gsub("\n", "\\n")
+  if openmetrics then
+    help = help:gsub('"', '\\"')
+  end
+  return help
 end
 
 -- Extract short metric name from the full one.
@@ -210,6 +449,226 @@ local function short_metric_name(full_name)
   return full_name:sub(1, labels_start - 1)
 end
 
+-- Find the sketch bin a value of a summary observation belongs to.
+--
+-- Summaries keep a sketch of observed values: bins with logarithmically
+-- growing boundaries, counting values that fall into each bin (see
+-- https://arxiv.org/abs/1908.10693). Positive values are counted in "p<i>"
+-- bins covering (gamma^(i-1), gamma^i], negative ones in "n<i>" bins with
+-- the same boundaries for absolute values, and values close to zero in the
+-- "z" bin. Bins are counters, so sketches of all workers are merged by the
+-- shared dictionary, and any value within a bin is at most `epsilon` away
+-- from its estimate (see sketch_bin_value) in relative terms.
+--
+-- Args:
+--   log_gamma: natural logarithm of gamma, (1 + epsilon) / (1 - epsilon).
+--   value: (number) observed value.
+--
+-- Returns:
+--   (string) bin name.
+local function sketch_bin(log_gamma, value)
+  if value > MIN_SKETCH_VALUE then
+    return "p" .. math.ceil(math.log(value) / log_gamma)
+  elseif value < -MIN_SKETCH_VALUE then
+    return "n" .. math.ceil(math.log(-value) / log_gamma)
+  end
+  return "z"
+end
+
+-- Estimate of values counted in a sketch bin.
+--
+-- Args:
+--   gamma: (number) sketch bin growth factor, see sketch_bin.
+--   sign: (string) "p", "n" or "z".
+--   index: (number) bin index.
+--
+-- Returns:
+--   (number) estimate of values counted in the bin.
+local function sketch_bin_value(gamma, sign, index)
+  if sign == "z" then
+    return 0
+  end
+  local value = 2 * gamma ^ index / (gamma + 1)
+  return sign == "n" and -value or value
+end
+
+-- Upper bounds of native histogram buckets, normalized to [0.5, 1).
+--
+-- Args:
+--   schema: (number) native histogram schema.
+--
+-- Returns:
+--   (array) bounds for positive schemas, which have several buckets between
+--     consecutive powers of two, or nil for other schemas.
+local function native_bucket_bounds(schema)
+  if schema <= 0 then
+    return
+  end
+  local count = 2 ^ schema
+  local bounds = {}
+  for i = 0, count - 1 do
+    bounds[i + 1] = 2 ^ (i / count) / 2
+  end
+  return bounds
+end
+
+-- Find the bucket of a native histogram a value belongs to.
+--
+-- Native histograms (see https://prometheus.io/docs/specs/native_histograms/)
+-- have exponential buckets, with boundaries defined by their schema: the
+-- bucket with index `i` covers (base^(i-1), base^i], where base is
+-- 2^(2^-schema). Buckets are stored as sketch bins (see sketch_bin) with the
+-- same names: "p<i>" for positive values, "n<i>" for negative ones, and "z"
+-- for values within `native_zero_threshold` from zero.
+--
+-- Args:
+--   m: a histogram `metric` object with `native_schema` option.
+--   value: (number) observed value.
+--
+-- Returns:
+--   (string) bin name, or nil for NaN values, which are not counted in any
+--     bucket.
+local function native_bin(m, value)
+  if value ~= value then
+    return
+  end
+  local abs = math.abs(value)
+  if abs <= m.native_zero_threshold then
+    return "z"
+  end
+  local sign = value > 0 and "p" or "n"
+  if abs == math.huge then
+    -- Same as in the Go client library.
+    return sign .. 2147483647
+  end
+  -- Bucket boundaries are powers of two or fractions of them, so the index
+  -- is found from the binary representation of the value to avoid rounding
+  -- errors of logarithms.
+  local frac, exp = math.frexp(abs)
+  local bounds = m.native_bounds
+  if bounds then
+    local lo, hi = 1, #bounds + 1
+    while lo < hi do
+      local mid = math.floor((lo + hi) / 2)
+      if bounds[mid] >= frac then
+        hi = mid
+      else
+        lo = mid + 1
+      end
+    end
+    return sign .. (lo - 1 + (exp - 1) * #bounds)
+  end
+  if frac == 0.5 then
+    exp = exp - 1
+  end
+  local width = 2 ^ -m.native_schema
+  return sign .. math.floor((exp + width - 1) / width)
+end
+
+-- Split a shared dictionary key of a sketch bin.
+--
+-- Args:
+--   key: (string) shared dictionary key.
+--
+-- Returns:
+--   (string) bin name and (string) series of a summary or a native histogram
+--     the bin belongs to, or nil if the key does not belong to a sketch.
+local function parse_sketch_key(key)
+  if key:sub(1, #SKETCH_PREFIX) ~= SKETCH_PREFIX then
+    return
+  end
+  return key:match("^([pnz]%-?%d*)_(.+)$", #SKETCH_PREFIX + 1)
+end
+
+-- Estimate quantiles of values counted in a sketch.
+--
+-- Args:
+--   m: a summary `metric` object.
+--   bins: (table) counts of values, keyed by bin name.
+--
+-- Returns:
+--   (array) estimates of `m.quantiles`, or "NaN" strings if the sketch is
+--     empty.
+local function sketch_quantiles(m, bins)
+  local sorted = {}
+  local total = 0
+  for bin, count in pairs(bins) do
+    local sign, index = bin:sub(1, 1), tonumber(bin:sub(2)) or 0
+    table.insert(sorted, {sketch_bin_value(m.gamma, sign, index), count})
+    total = total + count
+  end
+  table.sort(sorted, function(a, b) return a[1] < b[1] end)
+  local estimates = {}
+  for i, q in ipairs(m.quantiles) do
+    estimates[i] = "NaN"
+    local rank = q * (total - 1)
+    local seen = 0
+    for _, bin in ipairs(sorted) do
+      seen = seen + bin[2]
+      if seen > rank then
+        estimates[i] = bin[1]
+        break
+      end
+    end
+  end
+  return estimates
+end
+
+-- Find the metric and the series a shared dictionary key belongs to.
+--
+-- All keys of a histogram series (its buckets, _count and _sum) belong to the
+-- same series, which is identified by histogram name followed by labels other
+-- than "le". Similarly, _count, _sum and sketch bins of a summary belong to a
+-- series identified by summary name and labels. Series of other metrics are
+-- identified by the key itself.
+--
+-- Args:
+--   registry: table of registered metrics, keyed by name.
+--   key: (string) full metric name.
+--
+-- Returns:
+--   a `metric` object (or nil if the key does not belong to a registered
+--     metric) and the series (string).
+local function series_of_key(registry, key)
+  local _, sketch_series = parse_sketch_key(key)
+  if sketch_series then
+    return registry[short_metric_name(sketch_series)], sketch_series
+  end
+  local short_name = short_metric_name(key)
+  local m = registry[short_name]
+  if m then
+    if m.typ ~= TYPE_HISTOGRAM then
+      return m, key
+    end
+    local labels = key:sub(#short_name + 8)
+    if labels:find('^{le="') then
+      labels = ""
+    else
+      labels = labels:gsub(',le="[^"]*"}$', "}")
+    end
+    return m, short_name .. labels
+  end
+  local base = short_name:match("^(.*)_count$") or short_name:match("^(.*)_sum$")
+  m = base and registry[base]
+  if m and (m.typ == TYPE_HISTOGRAM or m.typ == TYPE_SUMMARY) then
+    return m, base .. key:sub(#short_name + 1)
+  end
+end
+
+-- Find the group of the metric a shared dictionary key belongs to.
+--
+-- Args:
+--   registry: table of registered metrics, keyed by name.
+--   key: (string) full metric name.
+--
+-- Returns:
+--   (string) group name, or an empty string if the metric does not belong to
+--     a group.
+local function group_of_key(registry, key)
+  local m = series_of_key(registry, key)
+  return m and m.group or ""
+end
+
 -- Check metric name and label names for correctness.
 --
 -- Regular expressions to validate metric and label names are
@@ -239,632 +698,6647 @@ local function check_metric_and_label_names(metric_name, label_names)
   end
 end
 
--- Construct bucket format for a list of buckets.
---
--- This receives a list of buckets and returns a sprintf template that should
--- be used for bucket boundaries to make them come in increasing order when
--- sorted alphabetically.
---
--- To re-phrase, this is where we detect how many leading and trailing zeros we
--- need.
+-- Format a table of labels.
 --
 -- Args:
---   buckets: a list of buckets
+--   labels: table of label values, keyed by label name.
 --
 -- Returns:
---   (string) a sprintf template.
-local function construct_bucket_format(buckets)
-  local max_order = 1
-  local max_precision = 1
-  for _, bucket in ipairs(buckets) do
-    assert(type(bucket) == "number", "bucket boundaries should be numeric")
-    -- floating point number with all trailing zeros removed
-    local as_string = string.format("%f", bucket):gsub("0*$", "")
-    local dot_idx = as_string:find(".", 1, true)
-    max_order = math.max(max_order, dot_idx - 1)
-    max_precision = math.max(max_precision, as_string:len() - dot_idx)
+--   (string) labels formatted as in a full metric name, sorted by name and
+--     without curly braces, or nil if there are no labels.
+local function format_labels(labels)
+  local names = {}
+  for label_name in pairs(labels) do
+    table.insert(names, label_name)
   end
-  return "%0" .. (max_order + max_precision + 1) .. "." .. max_precision .. "f"
+  if #names == 0 then
+    return
+  end
+  table.sort(names)
+  local values = {}
+  for i, label_name in ipairs(names) do
+    values[i] = labels[label_name]
+  end
+  return full_metric_name("", names, values):sub(2, -2)
 end
 
--- Format bucket format when exposing metrics.
+-- Format a sample value according to the `number_format` option of init().
 --
--- This function removes leading and trailing zeroes from `le` label values.
+-- Special values are always formatted as Prometheus expects them, whatever
+-- the format string is, unless replaced by the `special_values` option.
 --
 -- Args:
---   key: the metric key
+--   self: a Prometheus object.
+--   value: sample value (a number, or a string that is returned as is).
 --
 -- Returns:
---   (string) the formatted key
-local function fix_histogram_bucket_labels(key)
-  local part1, bucket, part2 = key:match('(.*[,{]le=")(.*)(".*)')
-  if part1 == nil then
-    return key
+--   formatted value, or the value itself if neither `number_format` nor
+--   `special_values` is set.
+local function format_value(self, value)
+  local special_values = self.special_values
+  if type(value) ~= "number" then
+    return special_values and special_values[value] or value
   end
-
-  if bucket == "Inf" then
-    return table.concat({part1, "+Inf", part2})
-  else
-    return table.concat({part1, tostring(tonumber(bucket)), part2})
+  if not self.number_format and not special_values then
+    return value
+  end
+  local special
+  if value ~= value then
+    special = "NaN"
+  elseif value == math.huge then
+    special = "+Inf"
+  elseif value == -math.huge then
+    special = "-Inf"
   end
+  if special then
+    return special_values and special_values[special] or special
+  end
+  if not self.number_format then
+    return value
+  end
+  return string.format(self.number_format, value)
 end
 
--- Return a full metric name for a given metric+label combination.
+-- Merge default labels (see Prometheus.init) with constant labels of a
+-- metric.
 --
--- This function calculates a full metric name (or, in case of a histogram
--- metric, several metric names) for a given combination of label values. It
--- stores the result in a tree of tables used as a cache (self.lookup) and
--- uses that cache to return results faster.
+-- Labels of the metric take precedence: default labels with the same names
+-- as any of them are not added.
 --
 -- Args:
---   self: a `metric` object, created by register().
---   label_values: a list of label values.
+--   self: a Prometheus object.
+--   label_names: label names of the metric (array of strings).
+--   const_labels: table of constant label values keyed by label name, or nil.
+--   typ: metric type.
 --
 -- Returns:
---   - If `self` is a counter or a gauge: full metric name as a string.
---   - If `self` is a histogram metric: a list of strings:
---     [0]: full name of the _count histogram metric;
---     [1]: full name of the _sum histogram metric;
---     [...]: full names of each _bucket metrics.
-local function lookup_or_create(self, label_values)
-  -- If one of the `label_values` is nil, #label_values will return the number
-  -- of non-nil labels in the beginning of the list. This will make us return an
-  -- error here as well.
-  local cnt = label_values and #label_values or 0
-  -- specially, if first element is nil, # will treat it as "non-empty"
-  if cnt ~= self.label_count or (self.label_count > 0 and not label_values[1]) then
-    return nil, string.format("inconsistent labels count, expected %d, got %d",
-                              self.label_count, cnt)
-  end
-  local t = self.lookup
-  if label_values then
-    -- Don't use ipairs here to avoid inner loop generates trace first
-    -- Otherwise the inner for loop below is likely to get JIT compiled before
-    -- the outer loop which include `lookup_or_create`, in this case the trace
-    -- for outer loop will be aborted. By not using ipairs, we will be able to
-    -- compile longer traces as possible.
-    local label
-    for i=1, self.label_count do
-      label = label_values[i]
-      if not t[label] then
-        t[label] = {}
-      end
-      t = t[label]
-    end
+--   table of label values, keyed by label name.
+local function merge_default_labels(self, label_names, const_labels, typ)
+  local taken = {}
+  for _, label_name in ipairs(label_names or {}) do
+    taken[label_name] = true
   end
-
-  local LEAF_KEY = mt -- key used to store full metric names in leaf tables.
-  local full_name = t[LEAF_KEY]
-  if full_name then
-    return full_name
+  if typ == TYPE_SUMMARY then
+    taken.quantile = true
   end
-
-  if self.typ == TYPE_HISTOGRAM then
-    -- Pass empty metric name to full_metric_name to just get the formatted
-    -- labels ({key1="value1",key2="value2",...}).
-    local labels = full_metric_name("", self.label_names, label_values)
-    full_name = {
-      self.name .. "_count" .. labels,
-      self.name .. "_sum" .. labels,
-    }
-
-    local bucket_pref
-    if self.label_count > 0 then
-      -- strip last }
-      bucket_pref = self.name .. "_bucket" .. string.sub(labels, 1, #labels-1) .. ","
-    else
-      bucket_pref = self.name .. "_bucket{"
-    end
-
-    for i, buc in ipairs(self.buckets) do
-      full_name[i+2] = string.format("%sle=\"%s\"}", bucket_pref, self.bucket_format:format(buc))
+  local merged = {}
+  for label_name, value in pairs(self.default_labels) do
+    if not taken[label_name] then
+      merged[label_name] = value
     end
-    -- Last bucket. Note, that the label value is "Inf" rather than "+Inf"
-    -- required by Prometheus. This is necessary for this bucket to be the last
-    -- one when all metrics are lexicographically sorted. "Inf" will get replaced
-    -- by "+Inf" in Prometheus:metric_data().
-    full_name[self.bucket_count+3] = string.format("%sle=\"Inf\"}", bucket_pref)
-  else
-    full_name = full_metric_name(self.name, self.label_names, label_values)
   end
-  t[LEAF_KEY] = full_name
-  local err = self._key_index:add(full_name)
-  if err then
-    return nil, err
+  for label_name, value in pairs(const_labels or {}) do
+    merged[label_name] = value
   end
-  return full_name
+  return merged
 end
 
--- Increment a gauge metric.
---
--- Gauges are incremented in the dictionary directly to provide strong ordering
--- of inc() and set() operations.
+-- Find labels added to samples of a metric when metrics are collected.
 --
 -- Args:
---   self: a `metric` object, created by register().
---   value: numeric value to increment by. Can be negative.
---   label_values: a list of label values, in the same order as label keys.
-local function inc_gauge(self, value, label_values)
-  local k, err, _
-  k, err = lookup_or_create(self, label_values)
+--   self: a Prometheus object.
+--   short_name: (string) short metric name of a sample.
+--
+-- Returns:
+--   (string) formatted labels (see format_labels), or nil.
+local function added_labels(self, short_name)
+  local labels = self._const_labels[short_name]
+  if labels == nil then
+    -- Keys that don't belong to registered metrics.
+    return self._default_labels
+  end
+  return labels or nil
+end
+
+-- Format constant labels of a metric.
+--
+-- Args:
+--   metric_name: (string) metric name.
+--   label_names: label names (array of strings), including the `error` label
+--     added by `error_label` option.
+--   const_labels: table of label values, keyed by label name.
+--   typ: metric type.
+--
+-- Returns:
+--   (string) formatted labels (see format_labels).
+--   (string) an error string, or nil of no errors were found.
+local function format_const_labels(metric_name, label_names, const_labels, typ)
+  if type(const_labels) ~= "table" then
+    return nil, "Metric '" .. metric_name .. "' const_labels should be a " ..
+      "table of label values keyed by label name"
+  end
+  local variable = {}
+  for _, label_name in ipairs(label_names or {}) do
+    variable[label_name] = true
+  end
+  local names = {}
+  for label_name, value in pairs(const_labels) do
+    if type(label_name) ~= "string" or
+        (type(value) ~= "string" and type(value) ~= "number") then
+      return nil, "Metric '" .. metric_name .. "' const_labels should be a " ..
+        "table of label values keyed by label name"
+    end
+    if variable[label_name] then
+      return nil, "Metric '" .. metric_name .. "' const label '" ..
+        label_name .. "' is also a variable label"
+    end
+    if label_name == "quantile" and typ == TYPE_SUMMARY then
+      return nil, "Invalid label name 'quantile' in " .. metric_name
+    end
+    table.insert(names, label_name)
+  end
+  local err = check_metric_and_label_names(metric_name, names)
   if err then
-    self._log_error(err)
+    return nil, err
+  end
+  return format_labels(const_labels)
+end
+
+-- Add labels to a full metric name, before any labels it already has.
+--
+-- Args:
+--   full_name: (string) full metric name that can include labels.
+--   labels: (string) labels formatted as in a full metric name, without curly
+--     braces.
+--
+-- Returns:
+--   (string) full metric name with the labels.
+local function add_labels(full_name, labels)
+  local labels_start = full_name:find("{", 1, true)
+  if not labels_start then
+    return full_name .. "{" .. labels .. "}"
+  end
+  return full_name:sub(1, labels_start) .. labels .. "," ..
+    full_name:sub(labels_start + 1)
+end
+
+-- Default value used instead of label values not matching a pattern.
+local DEFAULT_LABEL_PATTERN_FALLBACK = "invalid"
+
+-- Prepare label value patterns of a metric.
+--
+-- Args:
+--   metric_name: (string) metric name.
+--   label_names: label names (array of strings).
+--   label_patterns: table, keyed by label name, with values being either
+--     a regular expression, or a table with `pattern` and `fallback` fields.
+--
+-- Returns:
+--   (table) patterns keyed by label index, each being a table with `pattern`
+--     and `fallback` fields.
+--   (string) an error string, or nil of no errors were found.
+local function prepare_label_patterns(metric_name, label_names, label_patterns)
+  local result = {}
+  for label_name, pattern in pairs(label_patterns) do
+    local idx
+    for i, name in ipairs(label_names or {}) do
+      if name == label_name then
+        idx = i
+      end
+    end
+    if not idx then
+      return nil, "Metric '" .. metric_name .. "' has a pattern for " ..
+        "unknown label '" .. label_name .. "'"
+    end
+    if type(pattern) ~= "table" then
+      pattern = {pattern = pattern}
+    end
+    -- "o" flag makes ngx.re compile the expression only once and cache it.
+    local _, _, err = ngx.re.find("", pattern.pattern, "jo")
+    if err then
+      return nil, "Metric '" .. metric_name .. "' label '" .. label_name ..
+        "' pattern is invalid: " .. err
+    end
+    result[idx] = {
+      pattern = pattern.pattern,
+      fallback = pattern.fallback or DEFAULT_LABEL_PATTERN_FALLBACK,
+    }
+  end
+  return result
+end
+
+-- Replace label values not matching configured patterns with fallbacks.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   label_values: a list of label values.
+--
+-- Returns:
+--   a list of label values, which is either `label_values`, or its copy with
+--   some values replaced.
+local function apply_label_patterns(self, label_values)
+  local result = label_values
+  for idx, pattern in pairs(self.label_patterns) do
+    local value = tostring(label_values[idx])
+    if not ngx.re.find(value, pattern.pattern, "jo") then
+      self._log_error("Metric '", self.name, "' label '",
+        self.label_names[idx], "' value '", value, "' does not match '",
+        pattern.pattern, "'")
+      if result == label_values then
+        result = {}
+        for i = 1, self.label_count do
+          result[i] = label_values[i]
+        end
+      end
+      result[idx] = pattern.fallback
+    end
+  end
+  return result
+end
+
+-- Accepted values of the `on_unknown_label_value` metric option.
+local UNKNOWN_LABEL_VALUE_POLICIES = {reject = true, bucket_as_other = true}
+
+-- Value used instead of label values that are not allowed with the
+-- "bucket_as_other" policy.
+local OTHER_LABEL_VALUE = "other"
+
+-- Prepare sets of allowed label values of a metric.
+--
+-- Args:
+--   metric_name: (string) metric name.
+--   label_names: label names (array of strings).
+--   allowed: table of arrays of allowed values, keyed by label name.
+--
+-- Returns:
+--   (table) sets of allowed values (as strings) keyed by label index.
+--   (string) an error string, or nil of no errors were found.
+local function prepare_allowed_label_values(metric_name, label_names, allowed)
+  local result = {}
+  for label_name, values in pairs(allowed) do
+    local idx
+    for i, name in ipairs(label_names or {}) do
+      if name == label_name then
+        idx = i
+      end
+    end
+    if not idx then
+      return nil, "Metric '" .. metric_name .. "' has allowed values for " ..
+        "unknown label '" .. tostring(label_name) .. "'"
+    end
+    if type(values) ~= "table" or #values == 0 then
+      return nil, "Metric '" .. metric_name .. "' label '" .. label_name ..
+        "' allowed values should be a non-empty array"
+    end
+    result[idx] = {}
+    for _, value in ipairs(values) do
+      result[idx][tostring(value)] = true
+    end
+  end
+  return result
+end
+
+-- Apply the `on_unknown_label_value` policy to label values that are not in
+-- the sets of allowed values.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   label_values: a list of label values.
+--
+-- Returns:
+--   a list of label values, which is either `label_values`, or its copy with
+--     some values replaced.
+--   an error string if the observation should be rejected, or nil.
+local function apply_allowed_label_values(self, label_values)
+  local result = label_values
+  for idx, allowed in pairs(self.allowed_label_values) do
+    local value = tostring(label_values[idx])
+    if not allowed[value] then
+      if self.on_unknown_label_value == "reject" then
+        return nil, "Metric '" .. self.name .. "' label '" ..
+          self.label_names[idx] .. "' value '" .. value ..
+          "' is not allowed, dropping observation"
+      end
+      if result == label_values then
+        result = {}
+        for i = 1, self.label_count do
+          result[i] = label_values[i]
+        end
+      end
+      result[idx] = OTHER_LABEL_VALUE
+    end
+  end
+  return result
+end
+
+-- Accepted values of the `on_invalid_label` metric option.
+local INVALID_LABEL_POLICIES = {escape = true, drop = true, replace = true}
+
+-- Value used instead of invalid label values with the "replace" policy.
+local INVALID_LABEL_PLACEHOLDER = "invalid"
+
+-- Apply the `on_invalid_label` policy to label values containing newlines.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   label_values: a list of label values.
+--
+-- Returns:
+--   a list of label values, which is either `label_values`, or its copy with
+--     some values replaced.
+--   an error string if the observation should be dropped, or nil.
+local function apply_invalid_label_policy(self, label_values)
+  local result = label_values
+  for idx = 1, self.label_count do
+    local value = label_values[idx]
+    if type(value) == "string" and value:find("\n", 1, true) then
+      local msg = "Metric '" .. self.name .. "' label '" ..
+        self.label_names[idx] .. "' value contains a newline"
+      if self.on_invalid_label == "drop" then
+        return nil, msg .. ", dropping observation"
+      end
+      self._log_error(msg)
+      if self.on_invalid_label == "replace" then
+        if result == label_values then
+          result = {}
+          for i = 1, self.label_count do
+            result[i] = label_values[i]
+          end
+        end
+        result[idx] = INVALID_LABEL_PLACEHOLDER
+      end
+    end
+  end
+  return result
+end
+
+-- Marker appended to label values truncated to `max_label_value_length`.
+local TRUNCATED_LABEL_MARKER = "…"
+
+-- Truncate label values longer than `max_label_value_length` option of init().
+--
+-- Values are cut at a UTF-8 character boundary, so the result can be up to
+-- 3 bytes shorter than the limit, not counting the marker that is appended.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   label_values: a list of label values.
+--
+-- Returns:
+--   a list of label values, which is either `label_values`, or its copy with
+--   some values truncated.
+local function truncate_label_values(self, label_values)
+  local max_length = self.max_label_value_length
+  local result = label_values
+  for idx = 1, self.label_count do
+    local value = label_values[idx]
+    if type(value) == "string" and #value > max_length then
+      local cut = max_length
+      -- Bytes 0x80-0xBF continue a multi-byte character.
+      while cut > 0 and value:byte(cut + 1) >= 0x80 and
+          value:byte(cut + 1) <= 0xBF do
+        cut = cut - 1
+      end
+      self._log_error("Metric '", self.name, "' label '",
+        self.label_names[idx], "' value is truncated to ", max_length,
+        " bytes")
+      if result == label_values then
+        result = {}
+        for i = 1, self.label_count do
+          result[i] = label_values[i]
+        end
+      end
+      result[idx] = value:sub(1, cut) .. TRUNCATED_LABEL_MARKER
+    end
+  end
+  return result
+end
+
+-- Construct bucket format for a list of buckets.
+--
+-- This receives a list of buckets and returns a sprintf template that should
+-- be used for bucket boundaries to make them come in increasing order when
+-- sorted alphabetically.
+--
+-- To re-phrase, this is where we detect how many leading and trailing zeros we
+-- need.
+--
+-- Args:
+--   buckets: a list of buckets
+--
+-- Returns:
+--   (string) a sprintf template.
+local function construct_bucket_format(buckets)
+  local max_order = 1
+  local max_precision = 1
+  for _, bucket in ipairs(buckets) do
+    assert(type(bucket) == "number", "bucket boundaries should be numeric")
+    -- floating point number with all trailing zeros removed
+    local as_string = string.format("%f", bucket):gsub("0*$", "")
+    local dot_idx = as_string:find(".", 1, true)
+    max_order = math.max(max_order, dot_idx - 1)
+    max_precision = math.max(max_precision, as_string:len() - dot_idx)
+  end
+  return "%0" .. (max_order + max_precision + 1) .. "." .. max_precision .. "f"
+end
+
+-- Format bucket format when exposing metrics.
+--
+-- This function removes leading and trailing zeroes from `le` label values.
+--
+-- Args:
+--   key: the metric key
+--
+-- Returns:
+--   (string) the formatted key
+local function fix_histogram_bucket_labels(key)
+  local part1, bucket, part2 = key:match('(.*[,{]le=")(.*)(".*)')
+  if part1 == nil then
+    return key
+  end
+
+  if bucket == "Inf" then
+    return table.concat({part1, "+Inf", part2})
+  else
+    return table.concat({part1, tostring(tonumber(bucket)), part2})
+  end
+end
+
+-- Precompute exposed `le` labels of histogram buckets.
+--
+-- Bucket keys always end with the `le` label, so a key suffix can be swapped
+-- for its exposed version without parsing the key. The resulting labels are
+-- the same as those produced by fix_histogram_bucket_labels.
+--
+-- Args:
+--   buckets: a list of buckets
+--   bucket_format: sprintf template for bucket boundaries
+--
+-- Returns:
+--   (table) stored key suffix => {exposed key suffix, bucket boundary}
+--   (number) length of stored key suffixes of finite buckets
+local function construct_bucket_labels(buckets, bucket_format)
+  local labels = {['le="Inf"}'] = {'le="+Inf"}'}}
+  local length = #'le="Inf"}'
+  for _, bucket in ipairs(buckets) do
+    local stored = bucket_format:format(bucket)
+    local suffix = 'le="' .. stored .. '"}'
+    labels[suffix] = {'le="' .. tostring(tonumber(stored)) .. '"}',
+                      tonumber(stored)}
+    length = #suffix
+  end
+  return labels, length
+end
+
+-- Format the `le` label of a histogram bucket key when exposing metrics.
+--
+-- Args:
+--   metric: the histogram object
+--   key: the bucket key
+--
+-- Returns:
+--   (string) the formatted key
+--   (number) bucket boundary, or nil for the +Inf bucket
+local function expose_bucket_key(metric, key)
+  local length = metric.bucket_suffix_length
+  local label = metric.bucket_labels[key:sub(-length)]
+  if not label then
+    length = #'le="Inf"}'
+    label = metric.bucket_labels[key:sub(-length)]
+  end
+  if not label then
+    -- Not a key in the current bucket layout; parse it the slow way.
+    local le = key:match('[,{]le="([^"]*)"}$')
+    return fix_histogram_bucket_labels(key),
+      le and le ~= "Inf" and tonumber(le) or nil
+  end
+  return key:sub(1, -length - 1) .. label[1], label[2]
+end
+
+-- Split full metric name into metric name and label values.
+--
+-- This reverses full_metric_name, unescaping label values.
+--
+-- Args:
+--   full_name: (string) full metric name that can include labels.
+--
+-- Returns:
+--   (string) metric name without labels.
+--   (array) a list of {label_name, label_value} pairs, in the original order.
+local function parse_full_metric_name(full_name)
+  local labels_start = full_name:find("{", 1, true)
+  if not labels_start then
+    return full_name, {}
+  end
+  local labels = {}
+  local pos = labels_start + 1
+  while true do
+    local label_name, value_start = full_name:match('^([%w_]+)="()', pos)
+    if not label_name then
+      break
+    end
+    local parts = {}
+    pos = value_start
+    while true do
+      local special = full_name:find('["\\]', pos)
+      if not special then
+        -- unterminated label value, should never happen.
+        table.insert(parts, full_name:sub(pos))
+        pos = #full_name + 1
+        break
+      end
+      table.insert(parts, full_name:sub(pos, special - 1))
+      if full_name:sub(special, special) == '"' then
+        pos = special + 1
+        break
+      end
+      local escaped = full_name:sub(special + 1, special + 1)
+      table.insert(parts, escaped == "n" and "\n" or escaped)
+      pos = special + 2
+    end
+    table.insert(labels, {label_name, table.concat(parts)})
+    -- skip the comma separating labels.
+    pos = pos + 1
+  end
+  return full_name:sub(1, labels_start - 1), labels
+end
+
+-- Make a string safe to be used as a single component of a Graphite path.
+--
+-- Only letters, digits, underscores and dashes are kept; all other characters
+-- (including dots, which separate path components) are replaced by
+-- underscores. Empty strings are replaced by a single underscore.
+local function graphite_path_component(str)
+  if str == "" then
+    return "_"
+  end
+  return (str:gsub("[^%w_%-]", "_"))
+end
+
+-- Build a Graphite path for a metric.
+--
+-- If `template` is provided, `{name}` placeholder in it is replaced by metric
+-- name, and `{label}` placeholders by the values of corresponding labels.
+-- Placeholders for missing labels are removed. All labels not mentioned in
+-- the template (or all labels, if there is no template) are appended to the
+-- path as `.label_name.label_value`.
+--
+-- Args:
+--   template: (string) path template. Optional.
+--   name: (string) metric name.
+--   labels: (array) a list of {label_name, label_value} pairs.
+--
+-- Returns:
+--   (string) a Graphite path.
+local function graphite_path(template, name, labels)
+  if not template then
+    local parts = {graphite_path_component(name)}
+    for _, label in ipairs(labels) do
+      table.insert(parts, graphite_path_component(label[1]))
+      table.insert(parts, graphite_path_component(label[2]))
+    end
+    return table.concat(parts, ".")
+  end
+
+  local values = {}
+  for _, label in ipairs(labels) do
+    values[label[1]] = label[2]
+  end
+  local used = {}
+  local path = template:gsub("{([%w_]+)}", function(placeholder)
+    if placeholder == "name" then
+      return graphite_path_component(name)
+    end
+    used[placeholder] = true
+    if values[placeholder] == nil then
+      return ""
+    end
+    return graphite_path_component(values[placeholder])
+  end)
+  local parts = {path}
+  for _, label in ipairs(labels) do
+    if not used[label[1]] then
+      table.insert(parts, graphite_path_component(label[1]))
+      table.insert(parts, graphite_path_component(label[2]))
+    end
+  end
+  path = table.concat(parts, ".")
+  -- Remove empty path components left by missing labels.
+  return (path:gsub("%.%.+", "."):gsub("^%.", ""):gsub("%.$", ""))
+end
+
+-- Default status above which the derived `error` label is "true".
+local DEFAULT_ERROR_LABEL_THRESHOLD = 500
+
+-- Append the value of the derived `error` label to label values.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   label_values: a list of label values.
+--
+-- Returns:
+--   a copy of `label_values` with the `error` label value appended.
+local function append_error_label(self, label_values)
+  local result = {}
+  for i = 1, self.label_count do
+    result[i] = label_values[i]
+  end
+  local status = tonumber(label_values[self.error_label.status_idx])
+  result[self.label_count + 1] = tostring(
+    status ~= nil and status >= self.error_label.threshold)
+  return result
+end
+
+-- Key used to store series (see series_of_key) in leaf tables of the lookup
+-- tree of metrics with `ttl_output` or `ttl_purge` options.
+local SERIES_KEY = {}
+
+-- Check whether a new series can be created for a metric with `max_series`
+-- option.
+--
+-- Series are counted in the shared dictionary, so that the limit applies to
+-- all workers together. Workers creating new series at the same time can
+-- exceed it by a few series.
+--
+-- Args:
+--   self: a `metric` object.
+--   full_name: full name of the series, as returned by lookup_or_create.
+--
+-- Returns:
+--   an error string if the limit is reached and the series does not exist
+--   yet, or nil otherwise.
+local function check_series_limit(self, full_name)
+  local count = self._key_index.dict:get(self._series_count_key) or 0
+  if count < self.max_series then
+    return
+  end
+  -- The series might have been created by another worker.
+  self._key_index:sync()
+  if self._key_index.index[type(full_name) == "table" and full_name[1] or
+      full_name] then
+    return
+  end
+  return string.format("Metric '%s' reached the limit of %d series " ..
+    "(max_series), dropping new label values", self.name, self.max_series)
+end
+
+-- Update the series count of a metric with `max_series` option after a key
+-- is removed from the key index.
+--
+-- Series of histograms and summaries are counted by their _count keys.
+--
+-- Args:
+--   self: a `metric` object.
+--   key: (string) the removed key.
+local function forget_series(self, key)
+  if not self.max_series then
     return
   end
+  if (self.typ == TYPE_HISTOGRAM or self.typ == TYPE_SUMMARY) and
+      key:sub(1, #self.name + 6) ~= self.name .. "_count" then
+    return
+  end
+  self._key_index.dict:incr(self._series_count_key, -1, 0)
+end
+
+-- Return a full metric name for a given metric+label combination.
+--
+-- This function calculates a full metric name (or, in case of a histogram
+-- metric, several metric names) for a given combination of label values. It
+-- stores the result in a tree of tables used as a cache (self.lookup) and
+-- uses that cache to return results faster.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   label_values: a list of label values.
+--   no_create: (bool) if true, names that are not cached yet are returned
+--     without being cached or added to the key index. Optional.
+--
+-- Returns:
+--   - If `self` is a counter or a gauge: full metric name as a string.
+--   - If `self` is a histogram metric: a list of strings:
+--     [0]: full name of the _count histogram metric;
+--     [1]: full name of the _sum histogram metric;
+--     [...]: full names of each _bucket metrics.
+local function lookup_or_create(self, label_values, no_create)
+  -- If one of the `label_values` is nil, #label_values will return the number
+  -- of non-nil labels in the beginning of the list. This will make us return an
+  -- error here as well.
+  local cnt = label_values and #label_values or 0
+  -- specially, if first element is nil, # will treat it as "non-empty"
+  if cnt ~= self.label_count or (self.label_count > 0 and not label_values[1]) then
+    return nil, string.format("inconsistent labels count, expected %d, got %d",
+                              self.label_count, cnt)
+  end
+  local t = self.lookup
+  if label_values then
+    -- Don't use ipairs here to avoid inner loop generates trace first
+    -- Otherwise the inner for loop below is likely to get JIT compiled before
+    -- the outer loop which include `lookup_or_create`, in this case the trace
+    -- for outer loop will be aborted. By not using ipairs, we will be able to
+    -- compile longer traces as possible.
+    local label
+    for i=1, self.label_count do
+      label = label_values[i]
+      if not t[label] then
+        t[label] = {}
+      end
+      t = t[label]
+    end
+  end
+
+  local LEAF_KEY = mt -- key used to store full metric names in leaf tables.
+  local full_name = t[LEAF_KEY]
+  if full_name then
+    if self._touched then
+      self._touched[t[SERIES_KEY]] = true
+    end
+    return full_name
+  end
+
+  -- Long values are only truncated when a name is not cached yet, so that
+  -- updates of cached series don't copy and check their label values again.
+  if self.max_label_value_length and cnt > 0 then
+    label_values = truncate_label_values(self, label_values)
+  end
+  if self.label_patterns then
+    label_values = apply_label_patterns(self, label_values)
+  end
+  if self.allowed_label_values then
+    local err
+    label_values, err = apply_allowed_label_values(self, label_values)
+    if err then
+      -- Not cached, so that every rejected observation is counted as an error.
+      return nil, err
+    end
+  end
+  if self.label_count > 0 then
+    local err
+    label_values, err = apply_invalid_label_policy(self, label_values)
+    if err then
+      -- The full name is not cached, so that every dropped observation is
+      -- counted as an error.
+      return nil, err
+    end
+  end
+
+  local label_names = self.label_names
+  if self.error_label then
+    label_values = append_error_label(self, label_values)
+    label_names = self.error_label.label_names
+  end
+  if self.sorted_labels then
+    -- Label values are passed in the order labels were declared in.
+    local sorted_values = {}
+    for i, idx in ipairs(self.sorted_labels.order) do
+      sorted_values[i] = label_values[idx]
+    end
+    label_names, label_values = self.sorted_labels.names, sorted_values
+  end
+
+  local sanitized
+  if self.typ == TYPE_HISTOGRAM then
+    -- Pass empty metric name to full_metric_name to just get the formatted
+    -- labels ({key1="value1",key2="value2",...}).
+    local labels
+    labels, sanitized = full_metric_name("", label_names, label_values,
+      self.invalid_utf8)
+    full_name = {
+      self.name .. "_count" .. labels,
+      self.name .. "_sum" .. labels,
+    }
+
+    local bucket_pref
+    if self.label_count > 0 then
+      -- strip last }
+      bucket_pref = self.name .. "_bucket" .. string.sub(labels, 1, #labels-1) .. ","
+    else
+      bucket_pref = self.name .. "_bucket{"
+    end
+
+    for i, buc in ipairs(self.buckets) do
+      full_name[i+2] = string.format("%sle=\"%s\"}", bucket_pref, self.bucket_format:format(buc))
+    end
+    -- Last bucket. Note, that the label value is "Inf" rather than "+Inf"
+    -- required by Prometheus. This is necessary for this bucket to be the last
+    -- one when all metrics are lexicographically sorted. "Inf" will get replaced
+    -- by "+Inf" in Prometheus:metric_data().
+    full_name[self.bucket_count+3] = string.format("%sle=\"Inf\"}", bucket_pref)
+  elseif self.typ == TYPE_SUMMARY then
+    local labels
+    labels, sanitized = full_metric_name("", label_names, label_values,
+      self.invalid_utf8)
+    full_name = {
+      self.name .. "_count" .. labels,
+      self.name .. "_sum" .. labels,
+    }
+  else
+    full_name, sanitized = full_metric_name(self.name, label_names,
+      label_values, self.invalid_utf8)
+  end
+  if sanitized then
+    self._log_error("Metric '", self.name,
+      "' has label values that are not valid utf8")
+  end
+  if no_create then
+    return full_name
+  end
+  if self.max_series then
+    local err = check_series_limit(self, full_name)
+    if err then
+      -- Not cached either, so that every dropped update is counted.
+      return nil, err
+    end
+  end
+  t[LEAF_KEY] = full_name
+  local err, added = self._key_index:add(full_name)
+  if err then
+    if self._free_dict_space and err:find("no memory", 1, true) then
+      self._free_dict_space()
+    end
+    return nil, err
+  end
+  if self.max_series and added > 0 then
+    self._key_index.dict:incr(self._series_count_key, 1, 0)
+  end
+  if self.typ == TYPE_SUMMARY or self.native_schema then
+    -- Keys of sketch bins are only added to the index when a value falls into
+    -- them, and are cached here (see sketch_bin_key).
+    full_name.bins = {}
+    full_name.series = self.name .. full_name[1]:sub(#self.name + 7)
+  end
+  if self._touched then
+    if self.typ == TYPE_HISTOGRAM or self.typ == TYPE_SUMMARY then
+      t[SERIES_KEY] = self.name .. full_name[1]:sub(#self.name + 7)
+    else
+      t[SERIES_KEY] = full_name
+    end
+    self._touched[t[SERIES_KEY]] = true
+  end
+  return full_name
+end
+
+local ERR_MSG_COUNTER_NOT_INITIALIZED = "counter not initialized! " ..
+  "Have you called Prometheus:init() from the " ..
+  "init_worker_by_lua_block nginx phase?"
+
+-- Increment the error metric.
+--
+-- Args:
+--   self: a Prometheus object.
+--   count: number of errors.
+--   context: table describing where the error happened (see the `on_error`
+--     option of init()), or nil.
+--   ...: parts of the error message, which is logged or passed to the
+--     `on_error` callback.
+local function count_errors(self, count, context, ...)
+  if self.on_error then
+    local parts = {...}
+    for i = 1, select("#", ...) do
+      parts[i] = tostring(parts[i])
+    end
+    local message = table.concat(parts)
+    -- A failing callback should not break the request that hit the error.
+    local ok, err = pcall(self.on_error, message, context or {})
+    if not ok then
+      ngx.log(ngx.ERR, "on_error callback failed: ", tostring(err),
+        "; original error: ", message)
+    end
+  else
+    ngx.log(ngx.ERR, ...)
+  end
+  if self.error_metric_name then
+    self.dict:incr(self.error_metric_name, count, 0)
+  end
+  -- Errors counted by this worker, used by collect() to detect errors
+  -- that happened while generating the output.
+  self._errors_counted = (self._errors_counted or 0) + count
+  if self.last_error_timestamp then
+    self.dict:safe_set(LAST_ERROR_TIMESTAMP_METRIC_NAME, now())
+  end
+end
+
+-- Queue a gauge update in the per-worker queue (only used in async mode).
+--
+-- Queued updates are applied to the shared dictionary by flush_queue. If the
+-- queue is full, the update is dropped and counted as an error during the
+-- next flush.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   op: one of the QUEUE_OP_* constants.
+--   key: full metric name.
+--   value: numeric value.
+local function enqueue(self, op, key, value)
+  local q = self.parent._queue
+  if not q then
+    self._log_error(ERR_MSG_COUNTER_NOT_INITIALIZED)
+    return
+  end
+  if q.size >= q.max_size then
+    q.dropped = q.dropped + 1
+    return
+  end
+  local n = q.size + 1
+  q.ops[n] = op
+  q.keys[n] = key
+  q.values[n] = value
+  q.size = n
+end
+
+-- Apply all queued gauge updates to the shared dictionary.
+--
+-- This is called periodically by a per-worker timer (including when the worker
+-- is shutting down, in which case `premature` is set), and before metrics
+-- are collected.
+--
+-- Args:
+--   premature: whether the timer has expired prematurely. Ignored.
+--   self: a Prometheus object.
+local function flush_queue(_, self)
+  local q = self._queue
+  local dict = self.dict
+  local key, value, err, _
+  for i = 1, q.size do
+    key = q.keys[i]
+    value = q.values[i]
+    if q.ops[i] == QUEUE_OP_SET then
+      _, err = dict:safe_set(key, value)
+    else
+      _, err, _ = dict:incr(key, value, 0)
+    end
+    if err then
+      self:log_error_kv(key, value, err)
+    end
+    q.keys[i] = nil
+    q.values[i] = nil
+  end
+  q.size = 0
+
+  if q.dropped > 0 then
+    count_errors(self, q.dropped, {operation = "async_queue"},
+      "Async queue is full, dropped ", q.dropped, " gauge updates")
+    q.dropped = 0
+  end
+end
+
+-- Apply pending updates of a gauge with `min_update_interval` option to the
+-- shared dictionary.
+--
+-- This is called by a timer every `min_update_interval`, as well as when the
+-- worker exits and when metrics are collected.
+--
+-- Args:
+--   premature: whether the timer has expired prematurely. Ignored.
+--   self: a `metric` object, created by register().
+local function flush_throttled(_, self)
+  local pending, pending_set = self._pending, self._pending_set
+  local _, err
+  for key, value in pairs(pending) do
+    if pending_set[key] then
+      _, err = self._dict:safe_set(key, value)
+    else
+      _, err, _ = self._dict:incr(key, value, 0)
+    end
+    if err then
+      self._log_error_kv(key, value, err)
+    end
+    pending[key] = nil
+    pending_set[key] = nil
+  end
+end
+
+-- Wait until updates of a metric made by all workers reach the shared
+-- dictionary.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+local function wait_for_sync(self)
+  if self.typ == TYPE_GAUGE and not self._async and not self._pending then
+    return
+  end
+  local interval = math.max(self.sync_interval or self.parent.sync_interval,
+    self.min_update_interval or 0)
+  ngx.log(ngx.INFO, "waiting ", interval, "s for counter to sync")
+  ngx.sleep(interval)
+end
+
+-- Increment a gauge metric.
+--
+-- Gauges are incremented in the dictionary directly to provide strong ordering
+-- of inc() and set() operations. In async mode updates are queued per worker
+-- instead, which preserves their order within a given worker.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   value: numeric value to increment by. Can be negative.
+--   label_values: a list of label values, in the same order as label keys.
+local function inc_gauge(self, value, label_values)
+  local k, err, _
+  k, err = lookup_or_create(self, label_values)
+  if err then
+    self._log_error(err)
+    return
+  end
+
+  if self._pending then
+    self._pending[k] = (self._pending[k] or 0) + (value or 1)
+    return
+  end
+
+  if self._async then
+    enqueue(self, QUEUE_OP_INC, k, value or 1)
+    return
+  end
+
+  _, err, _ = self._dict:incr(k, value, 0)
+  if err then
+    self._log_error_kv(k, value, err)
+  end
+end
+
+-- Decrement a gauge metric.
+--
+-- Like inc_gauge(), this atomically updates the value in the dictionary, so
+-- concurrent increments and decrements from different workers never get lost.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   value: numeric value to decrement by. Defaults to 1.
+--   label_values: a list of label values, in the same order as label keys.
+local function dec_gauge(self, value, label_values)
+  inc_gauge(self, -(value or 1), label_values)
+end
+
+-- Keep an exemplar of a counter increment or a histogram observation.
+--
+-- Only the latest exemplar of each counter series or histogram bucket is
+-- kept, in the memory of the worker that recorded it, and it is exposed in
+-- the OpenMetrics format by the same worker (see write_metric_data). Invalid
+-- exemplars are counted in the error metric, without affecting the value.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   key: (string) full metric name the value was recorded in.
+--   exemplar: table of label values keyed by label name.
+--   value: the recorded value.
+local function record_exemplar(self, key, exemplar, value)
+  local err
+  if type(exemplar) ~= "table" then
+    err = "should be a table of label values keyed by label name"
+  else
+    local length = 0
+    for name, label_value in pairs(exemplar) do
+      if type(name) ~= "string" or not name:match("^[a-zA-Z_][a-zA-Z0-9_]*$") then
+        err = "has invalid label name '" .. tostring(name) .. "'"
+        break
+      elseif type(label_value) ~= "string" and type(label_value) ~= "number" then
+        err = "has invalid value of label '" .. name .. "'"
+        break
+      end
+      -- Continuation bytes of utf8 characters are not counted.
+      local _, chars = (name .. label_value):gsub("[^\128-\191]", "")
+      length = length + chars
+    end
+    if not err and length == 0 then
+      err = "should have at least one label"
+    elseif not err and length > MAX_EXEMPLAR_LABELS_LENGTH then
+      err = "has labels longer than " .. MAX_EXEMPLAR_LABELS_LENGTH ..
+        " characters"
+    end
+  end
+  if err then
+    self._log_error("Exemplar of '", self.name, "' ", err)
+    return
+  end
+  self.exemplars[key] = string.format("{%s} %s %.3f", format_labels(exemplar),
+    value, now())
+end
+
+-- Increment a counter metric.
+--
+-- Counters are incremented in the per-worker counter, which will eventually get
+-- flushed into the global shared dictionary.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   value: numeric value to increment by. Can't be negative.
+--   label_values: a list of label values, in the same order as label keys.
+--   options: table of options. Optional. Supported options are:
+--     exemplar: table of label values keyed by label name, attached to the
+--       increment (see record_exemplar).
+local function inc_counter(self, value, label_values, options)
+  -- counter is not allowed to decrease. NaN would also make it unusable, since
+  -- all later values would be NaN as well.
+  if value ~= nil and (type(value) ~= "number" or value < 0 or
+      value ~= value) then
+    self._log_error("Counter '", self.name, "' can't be incremented by '",
+      tostring(value), "': value should be a non-negative number")
+    return
+  end
+
+  local k, err
+  k, err = lookup_or_create(self, label_values)
+  if err then
+    self._log_error(err)
+    return
+  end
+
+  local c = self._counter
+  if not c then
+    c = self.parent._counter
+    if not c then
+      self._log_error(ERR_MSG_COUNTER_NOT_INITIALIZED)
+      return
+    end
+    self._counter = c
+  end
+  c:incr(k, value)
+  if options and options.exemplar ~= nil then
+    record_exemplar(self, k, options.exemplar, value or 1)
+  end
+end
+
+-- Create series of a metric with zero values, unless they already exist.
+--
+-- This makes series appear in the output before their first update, which is
+-- useful for alerts on counters that are rarely incremented (like errors).
+-- Values recorded in other workers (or before a configuration reload) are
+-- never reset, so this is safe to call from all workers.
+--
+-- Args:
+--   self: a counter, gauge or histogram `metric` object, created by register().
+--   label_sets: an array of lists of label values, in the same order as label
+--     keys. Optional for metrics without labels.
+--
+-- Returns:
+--   true, or nil if any of the series could not be created.
+local function initialize(self, label_sets)
+  if label_sets == nil and self.label_count == 0 then
+    label_sets = {{}}
+  end
+  if type(label_sets) ~= "table" then
+    self._log_error("Metric '", self.name, "' initialize() expects an array ",
+      "of label value lists")
+    return
+  end
+  local ok = true
+  for _, label_values in ipairs(label_sets) do
+    local keys, err = lookup_or_create(self, label_values)
+    if err then
+      self._log_error(err)
+      ok = false
+    else
+      -- Histograms have a key for each bucket, _count and _sum.
+      for _, key in ipairs(type(keys) == "table" and keys or {keys}) do
+        local added
+        added, err = self._dict:safe_add(key, 0)
+        if not added and err ~= "exists" then
+          self._log_error_kv(key, 0, err)
+          ok = false
+        end
+      end
+    end
+  end
+  return ok or nil
+end
+
+-- Delete a counter or a gauge metric.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   label_values: a list of label values, in the same order as label keys.
+local function del(self, label_values)
+  local k, _, err
+  k, err = lookup_or_create(self, label_values)
+  if err then
+    self._log_error(err)
+    return
+  end
+
+  -- `del` might be called immediately after a configuration change that stops a
+  -- given metric from being used, so we cannot guarantee that other workers
+  -- don't have unflushed counter values for a metric that is about to be
+  -- deleted. We wait for `sync_interval` here to ensure that those values are
+  -- synced (and deleted from worker-local counters) before a given metric is
+  -- removed.
+  -- Gauge metrics don't use per-worker counters, so for gauges we don't need to
+  -- wait for the counter to sync, unless gauge updates are queued (async mode)
+  -- or throttled (min_update_interval).
+  wait_for_sync(self)
+
+  if self._pending then
+    self._pending[k] = nil
+    self._pending_set[k] = nil
+  end
+  self._key_index:remove(k)
+  forget_series(self, k)
+  _, err = self._dict:delete(k)
+  if err then
+    self._log_error("Error deleting key: ".. k .. ": " .. err)
+  end
+  if self.exemplars then
+    self.exemplars[k] = nil
+  end
+  if self._touched then
+    self._touched[k] = nil
+    self._dict:delete(UPDATED_PREFIX .. k)
+  end
+
+  -- Forget the cached name (see del_histogram), so that the series gets added
+  -- to the key index again when it's updated.
+  local t = self.lookup
+  for i = 1, self.label_count do
+    t = t[label_values[i]]
+    if not t then
+      return
+    end
+  end
+  t[mt] = nil
+end
+
+-- Delete a single series of a histogram metric.
+--
+-- All keys of the series (its buckets, _count, _sum and native buckets) are
+-- removed from the key index first, and only then deleted from the
+-- dictionary, so that other workers collecting metrics at the same time are
+-- unlikely to see some of them without the others.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   label_values: a list of label values, in the same order as label keys.
+local function del_histogram(self, label_values)
+  local keys, err = lookup_or_create(self, label_values, true)
+  if err then
+    self._log_error(err)
+    return
+  end
+
+  -- Wait for other workers to sync their counters (see `del`).
+  wait_for_sync(self)
+  if self._aggregated then
+    self._aggregated[keys] = nil
+  end
+
+  self._key_index:sync()
+  local existing = {}
+  for _, key in ipairs(keys) do
+    if self._key_index.index[key] then
+      table.insert(existing, key)
+    end
+  end
+  if self.native_schema then
+    local series = self.name .. keys[1]:sub(#self.name + 7)
+    for _, key in ipairs(self._key_index:list()) do
+      local _, bin_series = parse_sketch_key(key)
+      if bin_series == series then
+        table.insert(existing, key)
+      end
+    end
+  end
+  for _, key in ipairs(existing) do
+    self._key_index:remove(key)
+    forget_series(self, key)
+  end
+  for _, key in ipairs(existing) do
+    local _
+    _, err = self._dict:delete(key)
+    if err then
+      self._log_error("Error deleting key: ".. key .. ": " .. err)
+    end
+    if self.sum_compensation then
+      self.sum_compensation[key] = nil
+    end
+    if self.exemplars then
+      self.exemplars[key] = nil
+    end
+  end
+  if #existing > 0 and self._touched then
+    local series = self.name .. keys[1]:sub(#self.name + 7)
+    self._touched[series] = nil
+    self._dict:delete(UPDATED_PREFIX .. series)
+  end
+  for _, gauge in pairs(self.extremes or {}) do
+    gauge:del(label_values)
+  end
+
+  -- Forget the cached names (stored under LEAF_KEY, see lookup_or_create), so
+  -- that the series gets added to the key index again when a new value is
+  -- observed.
+  local t = self.lookup
+  for i = 1, self.label_count do
+    t = t[label_values[i]]
+    if not t then
+      return
+    end
+  end
+  t[mt] = nil
+end
+
+-- Set the value of a gauge metric.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   value: numeric value.
+--   label_values: a list of label values, in the same order as label keys.
+local function set(self, value, label_values)
+  if not value then
+    self._log_error("No value passed for " .. self.name)
+    return
+  end
+
+  local k, _, err
+  k, err = lookup_or_create(self, label_values)
+  if err then
+    self._log_error(err)
+    return
+  end
+  if self._pending then
+    self._pending[k] = value
+    self._pending_set[k] = true
+    return
+  end
+  if self._async then
+    enqueue(self, QUEUE_OP_SET, k, value)
+    return
+  end
+  _, err = self._dict:safe_set(k, value)
+  if err then
+    self._log_error_kv(k, value, err)
+  end
+end
+
+-- Set the value of a gauge if it currently has a given value.
+--
+-- This is atomic relative to other cas() calls for the same series in all
+-- workers (see prometheus_dict.compare_and_set), but not relative to set(),
+-- inc() and dec().
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   expected: (number) expected current value. Series that don't exist yet
+--     have the value of 0.
+--   value: (number) value to set.
+--   label_values: an array of label values. Can be nil (i.e. not defined) for
+--     metrics that have no labels.
+--
+-- Returns:
+--   (boolean) whether the value was set, or nil in case of an error.
+--   (number) the current value if it was not set.
+local function cas(self, expected, value, label_values)
+  if type(expected) ~= "number" or type(value) ~= "number" then
+    self._log_error("Expected and new values of " .. self.name ..
+      " should be numbers")
+    return
+  end
+  if self._pending or self._async then
+    self._log_error("cas() of " .. self.name .. " is not supported with " ..
+      "min_update_interval and async options")
+    return
+  end
+
+  local k, err = lookup_or_create(self, label_values)
+  if err then
+    self._log_error(err)
+    return
+  end
+  local ok, current = dict_lib.compare_and_set(self.parent.dict,
+    KEY_INDEX_PREFIX .. "cas_lock_" .. k, k, expected, value)
+  if ok == nil then
+    self._log_error_kv(k, value, current)
+    return
+  end
+  return ok, current
+end
+
+-- Increment a per-worker counter using Kahan summation.
+--
+-- Adding small floating point values to a large running total loses their
+-- low-order bits, and over many observations this rounding error accumulates.
+-- Kahan (compensated) summation keeps track of the lost part in a separate
+-- compensation term and adds it back during the next increment. Compensation
+-- terms are kept per worker and survive counter syncs, so only the final
+-- addition of each synced increment to the shared dictionary is uncompensated.
+--
+-- Args:
+--   c: a per-worker counter (see prometheus_resty_counter).
+--   compensation: table with compensation terms, keyed by counter key.
+--   key: counter key.
+--   value: numeric value to increment by.
+local function incr_compensated(c, compensation, key, value)
+  local sum = c.increments[key] or 0
+  local y = value - (compensation[key] or 0)
+  local t = sum + y
+  compensation[key] = (t - sum) - y
+  c.increments[key] = t
+end
+
+-- Get the shared dictionary key of a sketch bin of a series.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   keys: full metric names of the series, as returned by lookup_or_create.
+--   bin: (string) bin name.
+--
+-- Returns:
+--   (string) the key, or nil in case of an error.
+local function sketch_bin_key(self, keys, bin)
+  local bin_key = keys.bins[bin]
+  if not bin_key then
+    bin_key = SKETCH_PREFIX .. bin .. "_" .. keys.series
+    local err = self._key_index:add(bin_key)
+    if err then
+      self._log_error(err)
+      return
+    end
+    keys.bins[bin] = bin_key
+  end
+  return bin_key
+end
+
+-- Check whether a given bucket is the smallest one a value fits into.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   value: numeric value.
+--   i: 1-based index of the bucket, up to the number of buckets plus one.
+--
+-- Returns:
+--   (bool) true if the value fits into the bucket, but not the previous one.
+local function bucket_matches(self, value, i)
+  return (i > self.bucket_count or value <= self.buckets[i]) and
+    (i == 1 or value > self.buckets[i - 1])
+end
+
+-- Find the smallest bucket of a histogram a value fits into.
+--
+-- With `bucket_cache` option, the bucket found for the previous value (kept
+-- per worker) and its neighbours are checked first, which is faster than a
+-- full search when values are similar. They can match at most one bucket, so
+-- the result is the same either way.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   value: numeric value.
+--
+-- Returns:
+--   (number) 1-based index of the bucket, with the +Inf bucket having index of
+--     the number of buckets plus one.
+local function find_bucket(self, value)
+  local last = self._last_bucket
+  if last then
+    if bucket_matches(self, value, last) then
+      return last
+    elseif last > 1 and bucket_matches(self, value, last - 1) then
+      self._last_bucket = last - 1
+      return last - 1
+    elseif last <= self.bucket_count and bucket_matches(self, value, last + 1) then
+      self._last_bucket = last + 1
+      return last + 1
+    end
+  end
+  local bucket = self.bucket_count + 1
+  -- check in reverse order, otherwise we will always
+  -- need to traverse the whole table.
+  for i=self.bucket_count, 1, -1 do
+    if value <= self.buckets[i] then
+      bucket = i
+    elseif bucket <= self.bucket_count then
+      break
+    end
+  end
+  if last then
+    self._last_bucket = bucket
+  end
+  return bucket
+end
+
+-- Update the minimum or the maximum of a histogram with `track_extremes`
+-- option.
+--
+-- Extremes are updated in the shared dictionary directly under a lock (see
+-- prometheus_dict.set_extreme), so that they are consistent across workers.
+--
+-- Args:
+--   gauge: the `_min` or `_max` gauge of a histogram.
+--   value: (number) observed value.
+--   label_values: a list of label values of the observation.
+--   max: (boolean) whether the gauge is the maximum.
+local function record_extreme(gauge, value, label_values, max)
+  local k, err = lookup_or_create(gauge, label_values)
+  if err then
+    gauge._log_error(err)
+    return
+  end
+  local _
+  _, err = dict_lib.set_extreme(gauge.parent.dict,
+    KEY_INDEX_PREFIX .. "cas_lock_" .. k, k, value, max)
+  if err then
+    gauge._log_error_kv(k, value, err)
+  end
+end
+
+-- Record a value in a histogram, given the bucket it fits into.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   value: numeric value to record. Should be defined.
+--   label_values: a list of label values, in the same order as label keys.
+--   bucket: index of the smallest bucket the value fits into, or nil if it
+--     should be found by find_bucket.
+--   exemplar: table of label values keyed by label name, attached to the
+--     observation (see record_exemplar). Optional.
+--   count: (number) number of observations of the value. Optional, defaults
+--     to 1.
+--
+-- Returns:
+--   (number) index of the bucket, or nil in case of an error.
+local function observe_bucket(self, value, label_values, bucket, exemplar,
+                              count)
+  local keys, err = lookup_or_create(self, label_values)
+  if err then
+    self._log_error(err)
+    return
+  end
+
+  local c = self._counter
+  if not c then
+    c = self.parent._counter
+    if not c then
+      self._log_error(ERR_MSG_COUNTER_NOT_INITIALIZED)
+      return
+    end
+    self._counter = c
+  end
+
+  local clamp = self.clamp
+  if clamp then
+    local bound = clamp.min and value < clamp.min and "min" or
+      clamp.max and value > clamp.max and "max"
+    if bound then
+      -- The bucket has to be found again for the clamped value.
+      value, bucket = clamp[bound], nil
+      if clamp.counter then
+        clamp.counter:inc(count or 1, {bound})
+      end
+    end
+  end
+
+  -- Nothing is recorded if the native bucket can't be, since bucket counts of
+  -- a native histogram should add up to its _count.
+  local bin_key
+  local bin = self.native_schema and native_bin(self, value)
+  if bin then
+    bin_key = sketch_bin_key(self, keys, bin)
+    if not bin_key then
+      return
+    end
+  end
+
+  count = count or 1
+  local sum = count == 1 and value or value * count
+  bucket = bucket or find_bucket(self, value)
+  if exemplar ~= nil then
+    record_exemplar(self, keys[2 + bucket], exemplar, value)
+  end
+
+  local aggregated = self._aggregated
+  if aggregated then
+    -- Only the bucket the value fits into is counted, and its count is added
+    -- to the following buckets when merged (see sync_aggregated).
+    local series = aggregated[keys]
+    if not series then
+      series = {sum = 0, bins = {}, min = value, max = value,
+                label_values = {}}
+      -- Label values are copied, since callers can reuse the table.
+      for i = 1, self.label_count do
+        series.label_values[i] = label_values[i]
+      end
+      aggregated[keys] = series
+    end
+    series[bucket] = (series[bucket] or 0) + count
+    series.sum = series.sum + sum
+    if bin_key then
+      series.bins[bin_key] = (series.bins[bin_key] or 0) + count
+    end
+    series.min = math.min(series.min, value)
+    series.max = math.max(series.max, value)
+    series.last = value
+    return bucket
+  end
+
+  -- _count metric.
+  c:incr(keys[1], count)
+
+  -- _sum metric.
+  if self.sum_compensation then
+    incr_compensated(c, self.sum_compensation, keys[2], sum)
+  else
+    c:incr(keys[2], sum)
+  end
+
+  -- buckets are cumulative, so all buckets starting from the smallest one the
+  -- value fits into are incremented.
+  for i=bucket, self.bucket_count do
+    c:incr(keys[2+i], count)
+  end
+  -- the last bucket (le="Inf").
+  c:incr(keys[self.bucket_count+3], count)
+  if bin_key then
+    c:incr(bin_key, count)
+  end
+  local extremes = self.extremes
+  if extremes then
+    record_extreme(extremes.min, value, label_values, false)
+    record_extreme(extremes.max, value, label_values, true)
+    extremes.last:set(value, label_values)
+  end
+  return bucket
+end
+
+-- Record a given value in a histogram.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   value: numeric value to record. Should be defined.
+--   label_values: a list of label values, in the same order as label keys.
+--   options: table of options. Optional. Supported options are:
+--     exemplar: table of label values keyed by label name, attached to the
+--       observation (see record_exemplar).
+--     count: (number) number of observations of the value, recorded at once.
+--       Should be a positive integer. Defaults to 1.
+--
+-- Returns:
+--   (number) 1-based index of the smallest bucket the value fits into, with
+--     the +Inf bucket having index of the number of buckets plus one. Nil in
+--     case of an error.
+--   (number) upper bound of that bucket (math.huge for the +Inf bucket).
+local function observe(self, value, label_values, options)
+  if not value then
+    self._log_error("No value passed for " .. self.name)
+    return
+  end
+  local count = options and options.count
+  if count ~= nil and (type(count) ~= "number" or count < 1 or
+      count % 1 ~= 0) then
+    self._log_error("Invalid count of observations of ", self.name, ": '",
+      tostring(count), "' (should be a positive integer)")
+    return
+  end
+
+  local bucket
+  if self.sample_rate and math.random() >= self.sample_rate then
+    -- Not recorded, values are scaled up during collection instead.
+    bucket = find_bucket(self, value)
+  else
+    bucket = observe_bucket(self, value, label_values, nil,
+      options and options.exemplar, count)
+  end
+  if bucket then
+    return bucket, self.buckets[bucket] or math.huge
+  end
+end
+
+-- Convert a request time to a number.
+--
+-- Times in nginx variables are strings, and $upstream_response_time can hold
+-- times of several upstream responses separated by commas and colons, with
+-- "-" for upstreams that did not respond. Times of all responses are added up.
+--
+-- Args:
+--   value: (number or string) the time, in seconds.
+--
+-- Returns:
+--   (number) the time, or nil if it is not valid.
+local function parse_latency(value)
+  if type(value) == "number" then
+    return value
+  elseif type(value) ~= "string" then
+    return
+  end
+  local latency = tonumber(value)
+  if latency then
+    return latency
+  end
+  for part in value:gmatch("[^,:]+") do
+    part = part:match("^%s*(.-)%s*$")
+    if part ~= "-" then
+      local time = tonumber(part)
+      if not time then
+        return
+      end
+      latency = (latency or 0) + time
+    end
+  end
+  return latency
+end
+
+-- Record the latency of a request in a histogram, linked to its trace.
+--
+-- This is observe() with an exemplar, taking values of nginx variables as
+-- they are. Options passed to observe() are reused between calls, as the
+-- exemplar is formatted when it is recorded (see record_exemplar).
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   value: (number or string) latency in seconds (see parse_latency).
+--   label_values: a list of label values, in the same order as label keys.
+--   trace_id: id of the trace of the request, kept as the `trace_id` label of
+--     an exemplar. Empty values and "-" (missing values in access logs) are
+--     ignored. Optional.
+--
+-- Returns:
+--   the same values as observe().
+local function observe_latency(self, value, label_values, trace_id)
+  local latency = parse_latency(value)
+  if not latency then
+    self._log_error("Invalid latency of ", self.name, ": '", tostring(value),
+      "'")
+    return
+  end
+  local options
+  if trace_id ~= nil and trace_id ~= "" and trace_id ~= "-" then
+    options = self._latency_options
+    options.exemplar.trace_id = trace_id
+  end
+  return observe(self, latency, label_values, options)
+end
+
+-- Record a given value in a summary.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   value: numeric value to record. Should be defined.
+--   label_values: a list of label values, in the same order as label keys.
+local function observe_summary(self, value, label_values)
+  if not value then
+    self._log_error("No value passed for " .. self.name)
+    return
+  end
+
+  local keys, err = lookup_or_create(self, label_values)
+  if err then
+    self._log_error(err)
+    return
+  end
+
+  local c = self._counter
+  if not c then
+    c = self.parent._counter
+    if not c then
+      self._log_error(ERR_MSG_COUNTER_NOT_INITIALIZED)
+      return
+    end
+    self._counter = c
+  end
+
+  local bin_key = sketch_bin_key(self, keys, sketch_bin(self.log_gamma, value))
+  if not bin_key then
+    return
+  end
+
+  c:incr(keys[1], 1)
+  c:incr(keys[2], value)
+  c:incr(bin_key, 1)
+end
+
+-- Delete all metrics for a given gauge, counter or a histogram.
+--
+-- This is like `del`, but will delete all time series for all previously
+-- recorded label values.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+local function reset(self)
+  -- Wait for other worker threads to sync their counters before removing the
+  -- metric (please see `del` for a more detailed comment).
+  -- Gauge metrics don't use per-worker counters, so for gauges we don't need to
+  -- wait for the counter to sync, unless gauge updates are queued (async mode)
+  -- or throttled (min_update_interval).
+  wait_for_sync(self)
+
+  local keys = self._key_index:list()
+  local name_prefixes = {}
+  local name_prefix_length_base = #self.name
+  if self.typ == TYPE_HISTOGRAM then
+    if self.label_count == 0 then
+      name_prefixes[self.name .. "_count"] = name_prefix_length_base + 6
+      name_prefixes[self.name .. "_sum"] = name_prefix_length_base + 4
+    else
+      name_prefixes[self.name .. "_count{"] = name_prefix_length_base + 7
+      name_prefixes[self.name .. "_sum{"] = name_prefix_length_base + 5
+    end
+    name_prefixes[self.name .. "_bucket{"] = name_prefix_length_base + 8
+  elseif self.typ == TYPE_SUMMARY then
+    if self.label_count == 0 then
+      name_prefixes[self.name .. "_count"] = name_prefix_length_base + 6
+      name_prefixes[self.name .. "_sum"] = name_prefix_length_base + 4
+    else
+      name_prefixes[self.name .. "_count{"] = name_prefix_length_base + 7
+      name_prefixes[self.name .. "_sum{"] = name_prefix_length_base + 5
+    end
+  else
+    name_prefixes[self.name .. "{"] = name_prefix_length_base + 1
+  end
+
+  for _, key in ipairs(keys) do
+    local value, key_err = self._dict:get(key)
+    if value then
+      -- For a metric to be deleted its name should either match exactly, or
+      -- have a prefix listed in `name_prefixes` (which ensures deletion of
+      -- metrics with label values).
+      local remove = key == self.name
+      if not remove then
+        for name_prefix, name_prefix_length in pairs(name_prefixes) do
+          if name_prefix == string.sub(key, 1, name_prefix_length) then
+            remove = true
+            break
+          end
+        end
+      end
+      if not remove and (self.typ == TYPE_SUMMARY or self.native_schema) then
+        local _, series = parse_sketch_key(key)
+        remove = series ~= nil and short_metric_name(series) == self.name
+      end
+      if remove then
+        self._key_index:remove(key)
+        forget_series(self, key)
+        local _, err = self._dict:safe_set(key, nil)
+        if err then
+          self._log_error("Error resetting '", key, "': ", err)
+        end
+        if self._touched then
+          local _, series = series_of_key(self.parent.registry, key)
+          self._touched[series] = nil
+          self._dict:delete(UPDATED_PREFIX .. series)
+        end
+      end
+    else
+      if type(key_err) == "string" then
+        self._log_error("Error getting '", key, "': ", key_err)
+      end
+    end
+  end
+
+  -- Clean up the full metric name lookup table as well.
+  self.lookup = {}
+  if self._pending then
+    self._pending = {}
+    self._pending_set = {}
+  end
+  if self.sum_compensation then
+    self.sum_compensation = {}
+  end
+  if self.exemplars then
+    self.exemplars = {}
+  end
+end
+
+-- Reset a counter.
+--
+-- With label values, the value of a single series is set to zero. Unlike
+-- `del`, the series is kept, so that it's still exposed without gaps. Without
+-- label values, all series are deleted (see `reset`).
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   label_values: a list of label values, in the same order as label keys.
+local function reset_counter(self, label_values)
+  if label_values == nil then
+    return reset(self)
+  end
+  local k, err = lookup_or_create(self, label_values)
+  if err then
+    self._log_error(err)
+    return
+  end
+
+  -- Wait for other workers to sync their counters (see `del`), so that
+  -- increments made before the reset are not added to the zeroed value.
+  wait_for_sync(self)
+
+  local _
+  _, err = self._dict:safe_set(k, 0)
+  if err then
+    self._log_error_kv(k, 0, err)
+  end
+end
+
+-- Reset a histogram.
+--
+-- Values of all buckets, _count and _sum of a single series (or of all series
+-- of the histogram without label values) are set to zero. Unlike `del` and
+-- `reset`, series are kept, so that they're still exposed without gaps.
+-- Metric data generated by collect() while a reset is in progress is generated
+-- again (see consistent_output), so that it never contains a series with only
+-- some of its values reset. Resetting a series that does not exist does not
+-- create it.
+--
+-- Args:
+--   self: a `metric` object, created by register().
+--   label_values: a list of label values, in the same order as label keys.
+--     Optional.
+local function reset_histogram(self, label_values)
+  local keys = {}
+  local names
+  if label_values ~= nil then
+    local err
+    names, err = lookup_or_create(self, label_values, true)
+    if err then
+      self._log_error(err)
+      return
+    end
+    for _, key in ipairs(names) do
+      table.insert(keys, key)
+    end
+  end
+
+  -- Wait for other workers to sync their counters (see `del`), so that
+  -- observations made before the reset are not added to the zeroed values.
+  wait_for_sync(self)
+  if self._aggregated and names then
+    self._aggregated[names] = nil
+  elseif self._aggregated then
+    self._aggregated = {}
+  end
+  if names and self._dict:get(names[1]) == nil then
+    return
+  end
+
+  if label_values == nil or self.native_schema then
+    local series = label_values and self.name .. keys[1]:sub(#self.name + 7)
+    for _, key in ipairs(self._key_index:list()) do
+      local m, key_series = series_of_key(self.parent.registry, key)
+      if m == self and (label_values == nil or
+          (key_series == series and parse_sketch_key(key))) then
+        table.insert(keys, key)
+      end
+    end
+  end
+
+  local dict = self.parent.dict
+  dict:incr(HISTOGRAM_RESET_GENERATION_KEY, 1, 0)
+  for _, key in ipairs(keys) do
+    local _, err = self._dict:safe_set(key, 0)
+    if err then
+      self._log_error_kv(key, 0, err)
+    end
+    if self.sum_compensation then
+      self.sum_compensation[key] = nil
+    end
+    if self.exemplars then
+      self.exemplars[key] = nil
+    end
+  end
+  dict:incr(HISTOGRAM_RESET_GENERATION_KEY, 1, 0)
+  -- Extremes of observations made before the reset are forgotten.
+  for _, gauge in pairs(self.extremes or {}) do
+    if label_values == nil then
+      gauge:reset()
+    else
+      gauge:del(label_values)
+    end
+  end
+end
+
+-- Sync increments of a per-worker counter to the shared dictionary.
+--
+-- Args:
+--   premature: whether the timer is being stopped because the worker exits.
+--     Increments are synced either way.
+--   c: a per-worker counter (see prometheus_resty_counter).
+local function sync_counter(_, c)
+  c:sync()
+end
+
+-- Merge observations of a histogram with `local_aggregation` option into its
+-- per-worker counter, and sync the counter to the shared dictionary.
+--
+-- Observations are aggregated in the worker by observe_bucket, which only
+-- counts the bucket each value fits into. Counts are made cumulative here, so
+-- the dictionary is written once per key of each observed series, and so are
+-- the `track_extremes` gauges, instead of on every observation.
+--
+-- Args:
+--   premature: whether the timer is being stopped because the worker exits.
+--     Observations are merged either way.
+--   self: a `metric` object, created by register().
+local function sync_aggregated(_, self)
+  local c = self._counter
+  local extremes = self.extremes
+  for keys, series in pairs(self._aggregated) do
+    local count = 0
+    for i = 1, self.bucket_count + 1 do
+      count = count + (series[i] or 0)
+      if count > 0 then
+        c:incr(keys[2 + i], count)
+      end
+    end
+    c:incr(keys[1], count)
+    if self.sum_compensation then
+      incr_compensated(c, self.sum_compensation, keys[2], series.sum)
+    else
+      c:incr(keys[2], series.sum)
+    end
+    for bin_key, bin_count in pairs(series.bins) do
+      c:incr(bin_key, bin_count)
+    end
+    if extremes then
+      record_extreme(extremes.min, series.min, series.label_values, false)
+      record_extreme(extremes.max, series.max, series.label_values, true)
+      extremes.last:set(series.last, series.label_values)
+    end
+    self._aggregated[keys] = nil
+  end
+  c:sync()
+end
+
+-- Give a metric with `sync_interval` or `local_aggregation` option its own
+-- per-worker counter.
+--
+-- The counter writes to the same dictionary as the per-worker counter shared
+-- by other metrics, but is synced by its own timer every `sync_interval` of
+-- the metric, or of init_worker (shortened by the jitter of the worker).
+-- Observations aggregated in the worker are merged into the counter before
+-- each sync (see sync_aggregated).
+--
+-- Args:
+--   self: a Prometheus object, with the shared per-worker counter created.
+--   metric: a `metric` object, created by register().
+local function start_metric_counter(self, metric)
+  local c = setmetatable({dict = self._counter.dict, increments = {}},
+    getmetatable(self._counter))
+  local interval = (metric.sync_interval or self.sync_interval) *
+    self._sync_factor
+  if metric._aggregated then
+    ngx.timer.every(interval, sync_aggregated, metric)
+  else
+    ngx.timer.every(interval, sync_counter, c)
+  end
+  metric._counter = c
+end
+
+-- Delete series of metrics with `ttl_purge` option that have not been updated
+-- for longer than their TTL.
+--
+-- Args:
+--   self: a Prometheus object.
+local function purge_expired_series(self)
+  local t = now()
+  local expired = {}
+  local failed = {}
+  local count = 0
+  local _, err
+  for _, key in ipairs(self.key_index:list()) do
+    local m, series = series_of_key(self.registry, key)
+    if m and m.ttl_purge then
+      if expired[series] == nil then
+        if count < PURGE_BATCH_SIZE then
+          local updated = self.dict:get(UPDATED_PREFIX .. series)
+          expired[series] = updated ~= nil and t - updated > m.ttl_purge
+          if expired[series] then
+            count = count + 1
+          end
+        else
+          -- Left for the following runs.
+          expired[series] = false
+        end
+      end
+      if expired[series] then
+        -- The key stays indexed if it can't be deleted, and the update time
+        -- of its series is kept, so that the next run retries.
+        _, err = self.dict:delete(key)
+        if err then
+          self:log_error("Error deleting expired key '", key, "': ", err)
+          failed[series] = true
+        else
+          self.key_index:remove(key)
+          forget_series(m, key)
+        end
+      end
+    end
+  end
+  for series, is_expired in pairs(expired) do
+    if is_expired and not failed[series] then
+      _, err = self.dict:delete(UPDATED_PREFIX .. series)
+      if err then
+        self:log_error("Error deleting update time of '", series, "': ", err)
+      end
+    end
+  end
+end
+
+-- Free space in a full shared dictionary according to `on_dict_full` option.
+--
+-- With `evict_lru`, EVICT_BATCH_SIZE series that have not been updated for
+-- the longest time are deleted. Series that don't have their update time
+-- recorded yet have been updated recently, so they are kept. With
+-- `reset_histograms`, all series of histograms are deleted. Internal metrics
+-- are never deleted. Other workers forget cached names of deleted series when
+-- they record update times (see record_updates), so deleted series get added
+-- back once they are updated again.
+--
+-- Args:
+--   self: a Prometheus object.
+local function free_dict_space(self)
+  local t = now()
+  if self._freed_at and t - self._freed_at < MIN_EVICTION_INTERVAL then
+    return
+  end
+  self._freed_at = t
+
+  local keys = self.key_index:list()
+  local evicted = {}
+  if self.on_dict_full == "evict_lru" then
+    local updated = {}
+    local candidates = {}
+    for _, key in ipairs(keys) do
+      local m, series = series_of_key(self.registry, key)
+      if m and not m.internal and updated[series] == nil then
+        updated[series] = self.dict:get(UPDATED_PREFIX .. series) or false
+        if updated[series] then
+          table.insert(candidates, series)
+        end
+      end
+    end
+    table.sort(candidates, function(a, b) return updated[a] < updated[b] end)
+    for i = 1, math.min(EVICT_BATCH_SIZE, #candidates) do
+      evicted[candidates[i]] = true
+    end
+  end
+
+  local count = 0
+  local _, err
+  for _, key in ipairs(keys) do
+    local m, series = series_of_key(self.registry, key)
+    if m and not m.internal and (evicted[series] or
+        (self.on_dict_full == "reset_histograms" and m.typ == TYPE_HISTOGRAM)) then
+      evicted[series] = true
+      self.key_index:remove(key)
+      forget_series(m, key)
+      _, err = self.dict:delete(key)
+      if err then
+        self:log_error("Error deleting key '", key, "': ", err)
+      end
+      if m.sum_compensation then
+        m.sum_compensation[key] = nil
+      end
+      m.lookup = {}
+      count = count + 1
+    end
+  end
+  for series in pairs(evicted) do
+    self.dict:delete(UPDATED_PREFIX .. series)
+    if self._touched then
+      self._touched[series] = nil
+    end
+  end
+  if count > 0 then
+    ngx.log(ngx.WARN, "Shared dictionary is full, deleted ", count,
+      " keys (on_dict_full: ", self.on_dict_full, ")")
+  end
+end
+
+-- Set update time of series updated by this worker to the current time.
+--
+-- Args:
+--   self: a Prometheus object.
+local function record_touched(self)
+  local t = now()
+  for series in pairs(self._touched) do
+    local ok, err = self.dict:safe_set(UPDATED_PREFIX .. series, t)
+    if not ok then
+      self:log_error_kv(UPDATED_PREFIX .. series, t, err)
+    end
+    self._touched[series] = nil
+  end
+end
+
+-- Record update times of series of metrics with TTL options, or of all
+-- metrics with `timestamps` option of init().
+--
+-- Series updated by this worker since the last call have their update time
+-- set to the current time. This is called regularly by a timer (see
+-- register()), which also purges expired series in worker 0.
+--
+-- Since other workers cache full metric names, they would not add purged
+-- series back to the key index if they get updated again. To prevent that,
+-- caches of metrics with `ttl_purge` are cleared when keys get deleted.
+--
+-- Args:
+--   premature: whether the timer is being stopped because the worker exits.
+--   self: a Prometheus object.
+local function record_updates(premature, self)
+  if premature then
+    return
+  end
+  record_touched(self)
+
+  if ngx.worker.id() == 0 then
+    purge_expired_series(self)
+  end
+
+  self.key_index:sync()
+  if self.key_index.deleted ~= self._ttl_deleted then
+    self._ttl_deleted = self.key_index.deleted
+    for _, m in pairs(self.registry) do
+      -- Series might also have been deleted to free space of a full
+      -- dictionary (see free_dict_space).
+      if m.ttl_purge or (self.on_dict_full ~= "error" and m._touched) then
+        m.lookup = {}
+      end
+    end
+  end
+end
+
+-- Forget names of series and updates cached by this worker for a metric,
+-- after all its series have been deleted by another worker or by a reset.
+--
+-- Args:
+--   m: a `metric` object, created by register().
+local function forget_local_state(m)
+  m.lookup = {}
+  if m._pending then
+    m._pending = {}
+    m._pending_set = {}
+  end
+  if m.sum_compensation then
+    m.sum_compensation = {}
+  end
+  if m.exemplars then
+    m.exemplars = {}
+  end
+end
+
+-- Forget cached names of all metrics of this worker if all metrics have been
+-- reset since the last check (see Prometheus:reset), so that the series get
+-- added to the key index again when they are updated.
+--
+-- Args:
+--   premature: (bool) whether the timer is being stopped.
+--   self: a Prometheus object.
+local function check_reset(premature, self)
+  if premature then
+    return
+  end
+  local generation = self.dict:get(RESET_GENERATION_KEY) or 0
+  if generation == self._reset_generation then
+    return
+  end
+  self._reset_generation = generation
+  for _, m in pairs(self.registry) do
+    if m.lookup and not m.internal then
+      forget_local_state(m)
+      if m._touched then
+        m._touched = {}
+      end
+    end
+  end
+end
+
+-- Create a metric in the shared dictionary unless it already exists.
+--
+-- This is safe to call concurrently from several workers.
+--
+-- Args:
+--   self: a Prometheus object.
+--   key: (string) full metric name.
+--   value: initial value.
+local function bootstrap_key(self, key, value)
+  local ok, err = self.dict:safe_add(key, value)
+  if not ok and err ~= "exists" then
+    self:log_error_kv(key, value, err)
+    return
+  end
+  err = self.key_index:add(key)
+  if err then
+    self:log_error(err)
+  end
+end
+
+-- Prepare functions reading process metrics that are available on the
+-- current platform.
+--
+-- Resident memory and open file descriptors are read from /proc using FFI, so
+-- they are only available on Linux with LuaJIT.
+--
+-- Returns:
+--   (table) functions returning the current value of a metric (or nil and an
+--     error string), keyed by metric name.
+--   (string) an error string, or nil of no errors were found.
+local function process_metric_readers()
+  local readers = {}
+  local ok, ffi = pcall(require, "ffi")
+  if not ok or ffi.os ~= "Linux" then
+    return readers
+  end
+  -- Functions might have already been declared by other modules (or by
+  -- previous calls of this function), and can't be declared twice.
+  for name, declaration in pairs(PROCESS_METRIC_FFI_DECLARATIONS) do
+    if not pcall(function() return ffi.C[name] end) then
+      local err
+      ok, err = pcall(ffi.cdef, declaration)
+      if not ok then
+        return readers, "Could not declare " .. name .. ": " .. tostring(err)
+      end
+    end
+  end
+  local page_size = ffi.C.getpagesize()
+
+  readers.process_resident_memory_bytes = function()
+    local f, open_err = io.open("/proc/self/statm")
+    if not f then
+      return nil, open_err
+    end
+    local pages = (f:read("*l") or ""):match("^%d+%s+(%d+)")
+    f:close()
+    if not pages then
+      return nil, "unexpected format of /proc/self/statm"
+    end
+    return tonumber(pages) * page_size
+  end
+
+  readers.process_open_fds = function()
+    local dir = ffi.C.opendir("/proc/self/fd")
+    if dir == nil then
+      return nil, "could not open /proc/self/fd"
+    end
+    local count = 0
+    while ffi.C.readdir(dir) ~= nil do
+      count = count + 1
+    end
+    ffi.C.closedir(dir)
+    -- Skip ".", ".." and the descriptor used by opendir itself.
+    return count - 3
+  end
+
+  return readers
+end
+
+-- Update process metrics of the current worker.
+--
+-- This is called regularly by a timer set up in Prometheus:init_worker().
+--
+-- Args:
+--   premature: whether the timer is being stopped because the worker exits.
+--   self: a Prometheus object.
+local function update_process_metrics(premature, self)
+  if premature then
+    return
+  end
+  local pm = self._process_metrics
+  local worker = {ngx.worker.id()}
+  if pm.gauges.nginx_worker_processes then
+    pm.gauges.nginx_worker_processes:set(ngx.worker.count())
+  end
+  for name, read in pairs(pm.readers) do
+    -- Gauges are nil if they could not be registered.
+    if pm.gauges[name] then
+      local value, err = read()
+      if value then
+        pm.gauges[name]:set(value, worker)
+      else
+        self:log_error("Could not read ", name, ": ", err)
+      end
+    end
+  end
+end
+
+-- Initialize the module.
+--
+-- This should be called once from the `init_by_lua` section in nginx
+-- configuration.
+--
+-- Args:
+--   dict_name: (string) name of the nginx shared dictionary which will be
+--     used to store all metrics. Can also be a table of dictionary names
+--     keyed by category of metrics (see DICT_CATEGORIES), with the `default`
+--     dictionary used for other metrics and internal data. Ignored if a
+--     storage backend is configured with the `backend` option.
+--   prefix: (optional string) if supplied, prefix is added to all
+--     metric names on output
+--
+-- Returns:
+--   an object that should be used to register metrics.
+function Prometheus.init(dict_name, options_or_prefix)
+  if ngx.get_phase() ~= 'init' and ngx.get_phase() ~= 'init_worker' then
+    error('Prometheus.init can only be called from ' ..
+      'init_by_lua_block or init_worker_by_lua_block', 2)
+  end
+
+  local self = setmetatable({}, mt)
+  local options = options_or_prefix
+  if type(options_or_prefix) ~= "table" then
+    options = {prefix = options_or_prefix}
+  end
+  local dicts_by_type
+  local dict_names_by_type = {}
+  if options.backend ~= nil then
+    if type(dict_name) == "table" then
+      error("Metrics can't be stored in separate dictionaries when using " ..
+        "a storage backend", 2)
+    end
+    if options.dict_metrics then
+      error("dict_metrics option is not supported with a storage backend", 2)
+    end
+    local backend, err = dict_lib.wrap_backend(options.backend)
+    if not backend then
+      error(err, 2)
+    end
+    self._backend = options.backend
+    self.dict = backend
+    -- Per-worker counters are synced to the backend too.
+    self._routed_dict = backend
+  end
+  dict_name = dict_name or "prometheus_metrics"
+  if type(dict_name) == "table" then
+    dicts_by_type = {}
+    for category, name in pairs(dict_name) do
+      if category ~= "default" then
+        if not DICT_CATEGORIES[category] then
+          error("Unknown category of metrics '" .. tostring(category) ..
+            "', expected one of: counters, gauges, histograms, summaries", 2)
+        end
+        local dict = ngx.shared[name]
+        if dict == nil then
+          error("Dictionary '" .. tostring(name) .. "' does not seem to " ..
+            "exist. Please define the dictionary using `lua_shared_dict`.", 2)
+        end
+        dicts_by_type[DICT_CATEGORIES[category]] = dict
+        dict_names_by_type[DICT_CATEGORIES[category]] = name
+      end
+    end
+    dict_name = dict_name.default
+    if dict_name == nil then
+      error("The default dictionary should be configured when storing " ..
+        "metrics in separate dictionaries", 2)
+    end
+  end
+  if not self._backend then
+    self.dict_name = dict_name
+    self.dict = ngx.shared[dict_name]
+    if self.dict == nil then
+      error("Dictionary '" .. dict_name .. "' does not seem to exist. " ..
+        "Please define the dictionary using `lua_shared_dict`.", 2)
+    end
+  end
+  self._dict_names_by_type = dict_names_by_type
+  if not self._backend and options.min_dict_size ~= false then
+    local min_size = options.min_dict_size or dict_lib.DEFAULT_MIN_SIZE
+    if type(min_size) ~= "number" or min_size < 0 then
+      error("min_dict_size should be a number of bytes or false", 2)
+    end
+    local dicts = {[dict_name] = self.dict}
+    for typ, name in pairs(dict_names_by_type) do
+      dicts[name] = dicts_by_type[typ]
+    end
+    for name, dict in pairs(dicts) do
+      local err = dict_lib.check_size(dict, name, min_size)
+      if err and options.strict then
+        error(err, 2)
+      elseif err then
+        ngx.log(ngx.WARN, err)
+      end
+    end
+  end
+
+  self.prefix = options.prefix or ''
+  if self.prefix ~= "" then
+    self.dict = dict_lib.wrap_prefixed(self.dict, self.prefix)
+    for typ, dict in pairs(dicts_by_type or {}) do
+      dicts_by_type[typ] = dict_lib.wrap_prefixed(dict, self.prefix)
+    end
+    -- Per-worker counters are synced through the same wrapper.
+    self._routed_dict = self.dict
+  end
+  if dicts_by_type then
+    self.dict = dict_lib.wrap_routed(self.dict, dicts_by_type,
+      function(key)
+        local m = series_of_key(self.registry, key)
+        return m and m.typ
+      end)
+    self._routed_dict = self.dict
+  end
+  -- False disables the error metric.
+  self.error_metric_name = options.error_metric_name
+  if self.error_metric_name == nil then
+    self.error_metric_name = DEFAULT_ERROR_METRIC_NAME
+  elseif self.error_metric_name ~= false and
+      (type(self.error_metric_name) ~= "string" or
+       self.error_metric_name == "") then
+    error("error_metric_name should be a non-empty string or false", 2)
+  end
+  self.sync_interval = options.sync_interval or DEFAULT_SYNC_INTERVAL
+  self.sync_jitter = options.sync_jitter or DEFAULT_SYNC_JITTER
+  if type(self.sync_jitter) ~= "number" or self.sync_jitter < 0 or
+      self.sync_jitter >= 1 then
+    error("sync_jitter should be a number between 0 and 1", 2)
+  end
+  self.async = options.async or false
+  self.async_queue_size = options.async_queue_size or DEFAULT_ASYNC_QUEUE_SIZE
+  self.graphite_template = options.graphite_template
+  self.lock_wait_sample_rate = options.lock_wait_sample_rate
+  self.last_error_timestamp = options.last_error_timestamp ~= false
+  self.default_help = options.default_help
+  self.require_help = options.require_help or false
+  self.verify_output = options.verify_output or false
+  self.timestamps = options.timestamps or false
+  self.emit_groups = options.emit_groups or false
+  self.up_metric = options.up_metric or false
+  self.build_info = options.build_info or false
+  self.dict_metrics = options.dict_metrics or false
+  self.scrape_metrics = options.scrape_metrics or false
+  self.strict = options.strict or false
+  self.strict_units = options.strict_units or false
+  self.max_metrics = options.max_metrics
+  self.protobuf = options.protobuf or false
+  if options.on_error ~= nil and type(options.on_error) ~= "function" then
+    error("on_error should be a function", 2)
+  end
+  self.on_error = options.on_error
+  self.on_dict_full = options.on_dict_full or "error"
+  if not DICT_FULL_POLICIES[self.on_dict_full] then
+    error("Invalid on_dict_full policy '" .. tostring(self.on_dict_full) ..
+      "', expected one of: error, evict_lru, reset_histograms", 2)
+  end
+  if options.default_labels ~= nil then
+    if type(options.default_labels) ~= "table" then
+      error("default_labels should be a table of label values keyed by " ..
+        "label name", 2)
+    end
+    -- Copied, so that later changes of the table don't affect metrics.
+    self.default_labels = {}
+    for label_name, value in pairs(options.default_labels) do
+      if type(label_name) ~= "string" or label_name == "le" or
+          not label_name:match("^[a-zA-Z_][a-zA-Z0-9_]*$") then
+        error("Invalid default label name '" .. tostring(label_name) .. "'",
+          2)
+      end
+      if type(value) ~= "string" and type(value) ~= "number" then
+        error("Value of default label '" .. label_name .. "' should be a " ..
+          "string or a number", 2)
+      end
+      self.default_labels[label_name] = value
+    end
+    -- Formatted labels added to samples that don't belong to any metric.
+    self._default_labels = format_labels(self.default_labels)
+  end
+  self.number_format = options.number_format
+  if self.number_format ~= nil then
+    local ok, formatted = pcall(string.format, tostring(self.number_format),
+      0.5)
+    if type(self.number_format) ~= "string" or not ok or
+        tonumber(formatted) == nil then
+      error("number_format should be a format string for a number, " ..
+        "e.g. \"%.6g\"", 2)
+    end
+  end
+  if options.special_values ~= nil then
+    local valid = type(options.special_values) == "table"
+    self.special_values = {}
+    for special, replacement in pairs(valid and options.special_values or {}) do
+      if (special ~= "+Inf" and special ~= "-Inf" and special ~= "NaN") or
+          tonumber(replacement) == nil then
+        valid = false
+        break
+      end
+      self.special_values[special] = tostring(replacement)
+    end
+    if not valid then
+      error("special_values should be a table of numbers replacing " ..
+        "\"+Inf\", \"-Inf\" and \"NaN\", e.g. {[\"+Inf\"] = 1e308}", 2)
+    end
+    -- Label of the +Inf bucket of histograms (see write_metric_data).
+    self._inf_bucket_label = self.special_values["+Inf"] and
+      'le="' .. self.special_values["+Inf"] .. '"'
+  end
+  self.stream_chunk_size = options.stream_chunk_size
+  if self.stream_chunk_size ~= nil and
+      (type(self.stream_chunk_size) ~= "number" or
+       self.stream_chunk_size <= 0) then
+    error("stream_chunk_size should be a positive number", 2)
+  end
+  self.gzip = options.gzip or false
+  if self.gzip then
+    local ok, zlib = pcall(require, "zlib")
+    if not ok or type(zlib) ~= "table" or not zlib.deflate then
+      error("gzip option requires the lua-zlib module", 2)
+    end
+    self._zlib = zlib
+  end
+  self.sort_labels = options.sort_labels or false
+  self.invalid_utf8 = options.invalid_utf8 or "truncate"
+  if not INVALID_UTF8_POLICIES[self.invalid_utf8] then
+    error("invalid_utf8 should be one of: truncate, replace, escape", 2)
+  end
+  self.max_label_value_length = options.max_label_value_length
+  if self.max_label_value_length ~= nil and
+      (type(self.max_label_value_length) ~= "number" or
+       self.max_label_value_length < 1 or
+       self.max_label_value_length % 1 ~= 0) then
+    error("max_label_value_length should be a positive integer", 2)
+  end
+
+  self.write_retries = options.write_retries or 0
+  if type(self.write_retries) ~= "number" or self.write_retries < 0 or
+      self.write_retries > MAX_WRITE_RETRIES then
+    error("write_retries should be a number between 0 and " ..
+      MAX_WRITE_RETRIES, 2)
+  end
+
+  if self.lock_wait_sample_rate then
+    self.dict = dict_lib.wrap_timed(self.dict, self.lock_wait_sample_rate,
+      function(duration)
+        if self._lock_wait_metric and self._counter then
+          self._lock_wait_metric:observe(duration)
+        end
+      end)
+  end
+  if self.write_retries > 0 then
+    self.dict = dict_lib.wrap_retrying(self.dict, self.write_retries)
+  end
+  -- Dictionary used by metrics to update their values.
+  self._metric_dict = self.dict
+  self.write_deadline = options.write_deadline
+  if self.write_deadline ~= nil and (type(self.write_deadline) ~= "number" or
+      self.write_deadline <= 0) then
+    error("write_deadline should be a positive number", 2)
+  end
+  if self.write_deadline then
+    self._metric_dict = dict_lib.wrap_deadline(self.dict, self.write_deadline,
+      function(duration)
+        ngx.log(ngx.WARN, "Shared dictionary update took ", duration,
+          "s, skipping metric updates for ",
+          dict_lib.WRITE_DEADLINE_BACKOFF, "s")
+      end,
+      function()
+        -- Skipped updates are counted in the per-worker counter, since
+        -- writing to the dictionary is exactly what should be avoided.
+        if self._counter and self.error_metric_name then
+          self._counter:incr(self.error_metric_name, 1)
+        end
+      end)
+  end
+
+  if self.build_info then
+    -- Versions don't change while nginx is running, so the output is
+    -- formatted once here.
+    local label_names, label_values = {"version"}, {Prometheus.VERSION}
+    local config = ngx.config or {}
+    for _, label_name in ipairs({"nginx_version", "ngx_lua_version"}) do
+      -- Versions are numbers like 1019003 for 1.19.3.
+      local version = config[label_name]
+      if type(version) == "number" then
+        table.insert(label_names, label_name)
+        table.insert(label_values, string.format("%d.%d.%d",
+          math.floor(version / 1000000), math.floor(version / 1000) % 1000,
+          version % 1000))
+      end
+    end
+    if jit and jit.version then
+      table.insert(label_names, "luajit_version")
+      table.insert(label_values, jit.version)
+    end
+    local key = full_metric_name(BUILD_INFO_METRIC_NAME, label_names,
+      label_values)
+    if self._default_labels then
+      key = add_labels(key, self._default_labels)
+    end
+    self._build_info_lines = {
+      string.format("# HELP %s%s Versions of nginx-lua-prometheus, nginx " ..
+        "and LuaJIT\n", self.prefix, BUILD_INFO_METRIC_NAME),
+      string.format("# TYPE %s%s gauge\n", self.prefix,
+        BUILD_INFO_METRIC_NAME),
+      string.format("%s%s 1\n", self.prefix, key),
+    }
+  end
+
+  self.registry = {}
+  -- Gauges with `min_update_interval` option.
+  self._throttled = {}
+  -- Metrics with `sync_interval` option (see start_metric_counter).
+  self._own_counters = {}
+  -- Ratios registered by Prometheus:ratio(), sorted by name.
+  self._ratios = {}
+  -- Bucket boundaries of histograms with `bucket_bounds` option, sorted by
+  -- name.
+  self._bucket_bounds = {}
+  -- Gauges of histograms with `emit_quantiles` option, sorted by name.
+  self._quantile_gauges = {}
+  -- Gauges with `collect_fn` option, sorted by name.
+  self._collected = {}
+  -- Aliases created by Prometheus:alias(), keyed by short metric names of
+  -- samples, and a set of their names.
+  self._aliases = {}
+  self._alias_names = {}
+  -- Views created by Prometheus:register_view(), keyed by name.
+  self._views = {}
+  -- Parsed ranges of allowlists passed to collect() (see client_allowed).
+  self._allowlists = setmetatable({}, {__mode = "k"})
+  -- Formatted constant labels (including default labels), keyed by short
+  -- metric names of samples (see added_labels).
+  self._const_labels = {}
+  self.key_index = key_index_lib.new(self.dict, KEY_INDEX_PREFIX)
+  self._families = key_index_lib.new(self.dict, FAMILIES_PREFIX)
+
+  self.initialized = true
+
+  -- All workers initialize the same internal metrics, possibly at the same
+  -- time. Values are only set if they don't exist yet, so that workers
+  -- starting later (or after a configuration reload) don't reset errors
+  -- counted by other workers.
+  if self.error_metric_name then
+    self:counter(self.error_metric_name,
+      "Number of nginx-lua-prometheus errors")
+    bootstrap_key(self, self.error_metric_name, 0)
+  end
+
+  if self.last_error_timestamp then
+    self:gauge(LAST_ERROR_TIMESTAMP_METRIC_NAME,
+      "Time of the last nginx-lua-prometheus error, in unixtime")
+    bootstrap_key(self, LAST_ERROR_TIMESTAMP_METRIC_NAME, 0)
+  end
+
+  if self.scrape_metrics then
+    self._scrape_metrics = {
+      duration = self:gauge(SCRAPE_DURATION_METRIC_NAME,
+        "Duration of the previous collection of metrics, in seconds"),
+      series = self:gauge(SCRAPE_SERIES_METRIC_NAME,
+        "Number of samples returned by the previous collection of metrics"),
+    }
+    bootstrap_key(self, SCRAPE_DURATION_METRIC_NAME, 0)
+    bootstrap_key(self, SCRAPE_SERIES_METRIC_NAME, 0)
+  end
+
+  if self.lock_wait_sample_rate then
+    self._lock_wait_metric = self:histogram(LOCK_WAIT_METRIC_NAME,
+      "Time spent in nginx-lua-prometheus shared dictionary write operations",
+      nil, LOCK_WAIT_BUCKETS)
+    -- Add keys of the histogram to the key index right away. Otherwise the
+    -- first observation would happen while adding another key to the index,
+    -- and would try to add its own keys in the middle of that.
+    local _, err = lookup_or_create(self._lock_wait_metric, nil)
+    if err then
+      self:log_error(err)
+    end
+  end
+
+  if options.process_metrics then
+    local readers, err = process_metric_readers()
+    if err then
+      self:log_error(err)
+    end
+    local gauges = {
+      nginx_worker_processes = self:gauge("nginx_worker_processes",
+        PROCESS_METRIC_HELP.nginx_worker_processes),
+      process_start_time_seconds = self:gauge("process_start_time_seconds",
+        PROCESS_METRIC_HELP.process_start_time_seconds, {"worker"}),
+    }
+    for name in pairs(readers) do
+      gauges[name] = self:gauge(name, PROCESS_METRIC_HELP[name], {"worker"})
+    end
+    self._process_metrics = {readers = readers, gauges = gauges}
+  end
+
+  -- Metrics registered so far are maintained by the library itself.
+  for _, m in pairs(self.registry) do
+    m.internal = true
+  end
+  -- Only metrics registered by users count towards `max_metrics`.
+  self._user_metric_count = 0
+
+  if ngx.get_phase() == 'init_worker' then
+    self:init_worker(self.sync_interval)
+  end
+  return self
+end
+
+-- Check that generated bucket boundaries are finite and strictly increasing,
+-- which might not be the case because of floating point precision.
+--
+-- Args:
+--   fn: (string) name of the generator, used in error messages.
+--   buckets: array of numbers.
+local function check_generated_buckets(fn, buckets)
+  local previous = -math.huge
+  for _, bucket in ipairs(buckets) do
+    if bucket == math.huge or not (bucket > previous) then
+      error(fn .. ": bucket boundaries are not finite and strictly " ..
+        "increasing (" .. tostring(previous) .. ", " .. tostring(bucket) ..
+        ")", 3)
+    end
+    previous = bucket
+  end
+end
+
+-- Check that `count` argument of a bucket generator is a positive integer.
+local function check_bucket_count(fn, count)
+  if type(count) ~= "number" or count < 1 or count % 1 ~= 0 then
+    error(fn .. ": count should be a positive integer, got " ..
+      tostring(count), 3)
+  end
+end
+
+-- Generate histogram buckets with exponentially growing boundaries.
+--
+-- Args:
+--   start: (number) the first boundary, which must be positive.
+--   factor: (number) ratio between adjacent boundaries, greater than 1.
+--   count: (number) number of boundaries.
+--
+-- Returns:
+--   array of numbers usable as the `buckets` option of histograms.
+function Prometheus.exponential_buckets(start, factor, count)
+  local fn = "exponential_buckets"
+  if type(start) ~= "number" or start <= 0 then
+    error(fn .. ": start should be a positive number, got " ..
+      tostring(start), 2)
+  end
+  if type(factor) ~= "number" or factor <= 1 then
+    error(fn .. ": factor should be a number greater than 1, got " ..
+      tostring(factor), 2)
+  end
+  check_bucket_count(fn, count)
+  local buckets = {}
+  for i = 1, count do
+    buckets[i] = start * factor ^ (i - 1)
+  end
+  check_generated_buckets(fn, buckets)
+  return buckets
+end
+
+-- Generate histogram buckets with evenly spaced boundaries.
+--
+-- Args:
+--   start: (number) the first boundary.
+--   width: (number) distance between adjacent boundaries, which must be
+--     positive.
+--   count: (number) number of boundaries.
+--
+-- Returns:
+--   array of numbers usable as the `buckets` option of histograms.
+function Prometheus.linear_buckets(start, width, count)
+  local fn = "linear_buckets"
+  if type(start) ~= "number" then
+    error(fn .. ": start should be a number, got " .. tostring(start), 2)
+  end
+  if type(width) ~= "number" or width <= 0 then
+    error(fn .. ": width should be a positive number, got " ..
+      tostring(width), 2)
+  end
+  check_bucket_count(fn, count)
+  local buckets = {}
+  for i = 1, count do
+    -- Multiplying instead of adding avoids accumulating rounding errors.
+    buckets[i] = start + width * (i - 1)
+  end
+  check_generated_buckets(fn, buckets)
+  return buckets
+end
+
+-- Initialize the worker counter.
+--
+-- This can call this function from the `init_worker_by_lua` if you are calling
+-- Prometheus.init() from `init_by_lua`, but this is deprecated. Instead, just
+-- call Prometheus.init() from `init_worker_by_lua_block` and pass sync_interval
+-- as part of the `options` argument if you need.
+--
+-- Args:
+--   sync_interval: per-worker counter sync interval (in seconds).
+function Prometheus:init_worker(sync_interval)
+  if ngx.get_phase() ~= 'init_worker' then
+    error('Prometheus:init_worker can only be called in ' ..
+      'init_worker_by_lua_block', 2)
+  end
+  if self._counter then
+    ngx.log(ngx.WARN, 'init_worker() has been called twice. ' ..
+      'Please do not explicitly call init_worker. ' ..
+      'Instead, call Prometheus:init() in the init_worker_by_lua_block')
+    return
+  end
+  self.sync_interval = sync_interval or DEFAULT_SYNC_INTERVAL
+  -- Counters of each worker are synced a bit more often than every
+  -- `sync_interval`, by a factor spread evenly across worker ids, so that
+  -- syncs of workers started at the same time drift apart instead of all
+  -- competing for the dictionary lock at once. Intervals are never longer
+  -- than configured, so functions waiting for counters to sync don't need to
+  -- wait longer. The global random generator is left alone, since it is
+  -- shared with the application.
+  local worker_id = tonumber(ngx.worker.id()) or 0
+  local worker_count = ngx.worker.count()
+  self._sync_factor = 1 - self.sync_jitter * (worker_id % worker_count) /
+    worker_count
+  -- Increments of per-worker counters are kept by dictionary name, so objects
+  -- with a prefix, which might share the dictionary with other objects, keep
+  -- their own increments and sync them with their own timer.
+  local counter_instance, err
+  if self._backend then
+    -- Storage backends are not shared dictionaries, so the counter is not
+    -- created by the library and always has its own increments and timer.
+    counter_instance = setmetatable({}, {__index = resty_counter_lib})
+  else
+    counter_instance, err = resty_counter_lib.new(self.dict_name,
+        self.prefix == "" and self.sync_interval * self._sync_factor or nil)
+    if err then
+      error(err, 2)
+    end
+  end
+  if self.prefix ~= "" or self._backend then
+    counter_instance.increments = {}
+    ngx.timer.every(self.sync_interval * self._sync_factor, sync_counter,
+      counter_instance)
+  end
+  if self._routed_dict then
+    counter_instance.dict = self._routed_dict
+  end
+  if self.write_retries > 0 then
+    -- Counters are synced by a timer, so retries don't delay requests.
+    counter_instance.dict = dict_lib.wrap_retrying(counter_instance.dict,
+      self.write_retries)
+  end
+  self._counter = counter_instance
+  for _, m in ipairs(self._own_counters) do
+    start_metric_counter(self, m)
+  end
+
+  if self.async then
+    self._queue = {
+      ops = {},
+      keys = {},
+      values = {},
+      size = 0,
+      max_size = self.async_queue_size,
+      dropped = 0,
+    }
+    ngx.timer.every(self.sync_interval, flush_queue, self)
+  end
+
+  if self._touched then
+    ngx.timer.every(self.sync_interval, record_updates, self)
+  end
+  for _, m in ipairs(self._throttled) do
+    ngx.timer.every(m.min_update_interval, flush_throttled, m)
+  end
+
+  if self._process_metrics then
+    local start_time = self._process_metrics.gauges.process_start_time_seconds
+    if start_time then
+      start_time:set(now(), {ngx.worker.id()})
+    end
+    update_process_metrics(false, self)
+    ngx.timer.every(self.sync_interval, update_process_metrics, self)
+  end
+
+  self._reset_generation = self.dict:get(RESET_GENERATION_KEY) or 0
+  ngx.timer.every(self.sync_interval, check_reset, self)
+end
+
+-- Log and count an error that prevents a metric from being registered.
+--
+-- In strict mode (see `strict` option of init()), a Lua error is raised as
+-- well, so that misconfigured metrics fail nginx startup.
+--
+-- Args:
+--   self: a Prometheus object.
+--   ...: parts of the error message.
+local function registration_error(self, ...)
+  self:log_error(...)
+  if self.strict then
+    local parts = {...}
+    for i = 1, select("#", ...) do
+      parts[i] = tostring(parts[i])
+    end
+    error("Could not register metric: " .. table.concat(parts), 0)
+  end
+end
+
+-- Check whether another metric can be registered without exceeding the
+-- `max_metrics` option of init(), logging an error if it can't.
+--
+-- Args:
+--   self: a Prometheus object.
+--   name: (string) name of the metric being registered.
+--
+-- Returns:
+--   (bool) whether the metric can be registered.
+local function check_metric_limit(self, name)
+  if self.max_metrics and self._user_metric_count and
+      self._user_metric_count >= self.max_metrics then
+    registration_error(self, "Metric '", name, "' can't be registered: ",
+      "the limit of ", self.max_metrics, " metrics (max_metrics) is reached")
+    return false
+  end
+  return true
+end
+
+-- Record a registered metric family in the shared dictionary, so that
+-- metric_names() also returns families registered only by other workers.
+--
+-- Args:
+--   self: a Prometheus object.
+--   name: (string) name of the metric family.
+--   typ: metric type (one of the TYPE_* constants).
+--   help: (string) description of the metric family, or nil.
+local function record_family(self, name, typ, help)
+  local err = self._families:add(name)
+  if err then
+    self:log_error(err)
+    return
+  end
+  -- The help text can contain spaces, but the type can't.
+  local descriptor = TYPE_LITERAL[typ] .. (help and " " .. help or "")
+  local ok
+  ok, err = self.dict:safe_set(FAMILY_PREFIX .. name, descriptor)
+  if not ok then
+    self:log_error_kv(FAMILY_PREFIX .. name, descriptor, err)
+  end
+end
+
+-- Register a gauge listing bucket boundaries of a histogram.
+--
+-- The gauge is not stored in the dictionary: it has a series with the value
+-- of 1 for each configured boundary, which never changes, so its keys are
+-- built once here.
+--
+-- Args:
+--   self: a Prometheus object.
+--   metric: a histogram `metric` object.
+local function register_bucket_bounds(self, metric)
+  local name = metric.name .. "_bucket_bounds"
+  local keys = {}
+  for _, bound in ipairs(metric.buckets) do
+    -- The `le` label is the same as the one of the bucket series.
+    local stored = 'le="' .. metric.bucket_format:format(bound) .. '"}'
+    local key = name .. "{" .. metric.bucket_labels[stored][1]
+    if self._default_labels then
+      key = add_labels(key, self._default_labels)
+    end
+    table.insert(keys, key)
+  end
+  local help = "Bucket boundaries of " .. self.prefix .. metric.name
+  local bounds = {name = name, help = help, typ = TYPE_GAUGE, keys = keys}
+  bounds.help_line = string.format("# HELP %s%s %s\n", self.prefix, name, help)
+  bounds.type_line = string.format("# TYPE %s%s gauge\n", self.prefix, name)
+  self.registry[name] = bounds
+  record_family(self, name, TYPE_GAUGE, help)
+  table.insert(self._bucket_bounds, bounds)
+  table.sort(self._bucket_bounds, function(a, b) return a.name < b.name end)
+end
+
+-- Register a gauge with quantiles estimated from buckets of a histogram.
+--
+-- The gauge is not stored in the dictionary: its values are computed from
+-- bucket counts of the histogram during collection (see
+-- quantile_gauge_values).
+--
+-- Args:
+--   self: a Prometheus object.
+--   metric: a histogram `metric` object.
+--   quantiles: array of numbers between 0 and 1.
+local function register_quantile_gauge(self, metric, quantiles)
+  local name = metric.name .. "_quantile"
+  local help = "Quantiles of " .. self.prefix .. metric.name ..
+    " estimated from its buckets"
+  local gauge = {name = name, help = help, typ = TYPE_GAUGE,
+                 histogram = metric, quantiles = quantiles}
+  gauge.help_line = string.format("# HELP %s%s %s\n", self.prefix, name, help)
+  gauge.type_line = string.format("# TYPE %s%s gauge\n", self.prefix, name)
+  metric.quantile_gauge = gauge
+  self.registry[name] = gauge
+  record_family(self, name, TYPE_GAUGE, help)
+  table.insert(self._quantile_gauges, gauge)
+  table.sort(self._quantile_gauges, function(a, b) return a.name < b.name end)
+end
+
+-- Replacement of set(), inc() and dec() of gauges with `collect_fn` option,
+-- which are never stored in the shared dictionary.
+local function update_collected_gauge(self)
+  self._log_error("Metric '", self.name, "' is computed by its collect_fn ",
+    "and can't be updated")
+end
+
+-- Call collect_fn of a gauge and return the values it returns.
+--
+-- The function should return either a number (for gauges without labels), or
+-- an array of `{label_values, value}` pairs. Errors raised by the function and
+-- invalid values are counted in the error metric, without failing collection
+-- of other metrics.
+--
+-- Args:
+--   self: a Prometheus object.
+--   metric: a `metric` object with `collect_fn` option.
+--
+-- Returns:
+--   Array of `{full_name, value}` pairs with samples of the gauge (without the
+--   prefix passed to init()), sorted by labels.
+local function collected_gauge_values(self, metric)
+  local ok, result = pcall(metric.collect_fn)
+  if not ok then
+    self:log_error("Error calling collect_fn of '", metric.name, "': ", result)
+    return {}
+  end
+  if type(result) == "number" then
+    result = {{nil, result}}
+  elseif type(result) ~= "table" then
+    if result ~= nil then
+      self:log_error("collect_fn of '", metric.name, "' returned ",
+        type(result), " instead of a table or a number")
+    end
+    return {}
+  end
+  local values = {}
+  local keys = {}
+  for _, pair in ipairs(result) do
+    local key, err
+    if type(pair) ~= "table" or type(pair[2]) ~= "number" then
+      err = "expected {label_values, value} pairs"
+    else
+      key, err = lookup_or_create(metric, pair[1], true)
+    end
+    if err then
+      self:log_error("Invalid value returned by collect_fn of '", metric.name,
+        "': ", err)
+    elseif values[key] == nil then
+      table.insert(keys, key)
+      values[key] = pair[2]
+    end
+  end
+  table.sort(keys)
+  local samples = {}
+  for i, key in ipairs(keys) do
+    local exposed_key = key
+    if metric.const_labels then
+      exposed_key = add_labels(key, metric.const_labels)
+    end
+    samples[i] = {exposed_key, values[key]}
+  end
+  return samples
+end
+
+-- Format gauges describing usage of the shared dictionaries storing metrics.
+--
+-- Values are read with capacity() and free_space() of each dictionary, and
+-- number of keys is counted from the key index, so no dictionary is locked
+-- for longer than a single read. Dictionaries that can't report their usage
+-- (for example, with nginx older than 1.11.7) are counted in the error metric
+-- and left out of the bytes gauge.
+--
+-- Args:
+--   self: a Prometheus object.
+--
+-- Returns:
+--   Array of strings with HELP, TYPE and sample lines of the gauges.
+local function dict_metric_lines(self)
+  local names = {self.dict_name}
+  local seen = {[self.dict_name] = true}
+  for _, name in pairs(self._dict_names_by_type) do
+    if not seen[name] then
+      seen[name] = true
+      table.insert(names, name)
+    end
+  end
+  table.sort(names)
+
+  local keys = {}
+  for _, name in ipairs(names) do
+    keys[name] = 0
+  end
+  for _, key in ipairs(self.key_index:list()) do
+    local m = series_of_key(self.registry, key)
+    local name = m and self._dict_names_by_type[m.typ] or self.dict_name
+    keys[name] = keys[name] + 1
+  end
+
+  local function sample(metric_name, labels, value)
+    local key = metric_name .. "{" .. labels .. "}"
+    if self._default_labels then
+      key = add_labels(key, self._default_labels)
+    end
+    return string.format("%s%s %d\n", self.prefix, key, value)
+  end
+
+  local lines = {
+    string.format("# HELP %s%s Memory of shared dictionaries storing " ..
+      "metrics in bytes\n", self.prefix, DICT_BYTES_METRIC_NAME),
+    string.format("# TYPE %s%s gauge\n", self.prefix, DICT_BYTES_METRIC_NAME),
+  }
+  for _, name in ipairs(names) do
+    local dict = ngx.shared[name]
+    local ok, capacity = pcall(dict.capacity, dict)
+    local free = capacity
+    if ok then
+      ok, free = pcall(dict.free_space, dict)
+    end
+    if ok then
+      local dict_label = 'dict="' .. name .. '"'
+      table.insert(lines, sample(DICT_BYTES_METRIC_NAME,
+        dict_label .. ',state="capacity"', capacity))
+      table.insert(lines, sample(DICT_BYTES_METRIC_NAME,
+        dict_label .. ',state="used"', capacity - free))
+    else
+      self:log_error("Can't get memory usage of dictionary '", name, "': ",
+        free)
+    end
+  end
+  table.insert(lines, string.format("# HELP %s%s Number of metric keys in " ..
+    "shared dictionaries\n", self.prefix, DICT_KEYS_METRIC_NAME))
+  table.insert(lines, string.format("# TYPE %s%s gauge\n", self.prefix,
+    DICT_KEYS_METRIC_NAME))
+  for _, name in ipairs(names) do
+    table.insert(lines, sample(DICT_KEYS_METRIC_NAME,
+      'dict="' .. name .. '"', keys[name]))
+  end
+  return lines
+end
+
+-- Format HELP, TYPE and UNIT comments of a metric in OpenMetrics format.
+--
+-- OpenMetrics names counter families without the `_total` suffix, which is
+-- required for counter samples instead. Samples of counters registered
+-- without the suffix get it appended (see metric.openmetrics_total).
+--
+-- Args:
+--   prefix: (string) prefix of all metric names.
+--   metric: a `metric` object, created by register().
+--   help: (string) description of the metric, or nil.
+--   unit: (string) unit of the metric, or nil.
+--
+-- Returns:
+--   (string) comments preceding samples of the metric.
+local function openmetrics_header(prefix, metric, help, unit)
+  local family = metric.name
+  if metric.typ == TYPE_COUNTER then
+    family = family:gsub("_total$", "")
+    metric.openmetrics_total = family == metric.name
+  end
+  local lines = {}
+  if help == "" then
+    table.insert(lines, string.format("# HELP %s%s\n", prefix, family))
+  elseif help then
+    table.insert(lines, string.format("# HELP %s%s %s\n", prefix, family,
+      escape_help(help, true)))
+  end
+  table.insert(lines, string.format("# TYPE %s%s %s\n", prefix, family,
+    TYPE_LITERAL[metric.typ]))
+  if unit then
+    table.insert(lines, string.format("# UNIT %s%s %s\n", prefix, family, unit))
+  end
+  return table.concat(lines)
+end
+
+-- Register a new metric.
+--
+-- Args:
+--   self: a Prometheus object.
+--   name: (string) name of the metric. Required.
+--   help: (string) description of the metric. Will be used for the HELP
+--     comment on the metrics page. Optional, unless `require_help` option of
+--     init() is set. Defaults to `default_help` option of init().
+--   label_names: array of strings, defining a list of metrics. Optional.
+--   options: table of metric options. Optional. Supported options are:
+--     buckets: array if numbers, defining bucket boundaries. Only used for
+--       histogram metrics.
+--     sample_rate: (number) probability of recording each observation in a
+--       histogram. Values are scaled up accordingly during collection.
+--     compensated_sum: (boolean) use compensated summation for the _sum
+--       of histogram metrics.
+--     bucket_cache: (boolean) check the bucket of the previous observation
+--       of a histogram first (see find_bucket).
+--     native_schema: (number) also record observations of a histogram in
+--       buckets of a native histogram with this schema (see native_bin),
+--       exposed in the protobuf format.
+--     native_zero_threshold: (number) width of the zero bucket of a native
+--       histogram.
+--     bucket_bounds: (boolean) expose bucket boundaries of a histogram as
+--       a separate gauge (see register_bucket_bounds).
+--     clamp: table with `min` and/or `max` numbers. Observations of a
+--       histogram outside of this range are recorded as the nearest bound,
+--       and counted in a separate counter if `count` is set in it.
+--     emit_quantiles: array of numbers between 0 and 1, defining quantiles
+--       of a histogram exposed as a separate gauge, estimated from its
+--       buckets (see register_quantile_gauge).
+--     track_extremes: (boolean) expose the minimum, maximum and last
+--       observed value of each series of a histogram as `_min`, `_max` and
+--       `_last` gauges (see record_extreme).
+--     local_aggregation: (boolean) aggregate observations of a histogram in
+--       the worker, merging them into the shared dictionary every
+--       `sync_interval` (see sync_aggregated).
+--     quantiles: array of numbers between 0 and 1, defining quantiles of
+--       summary metrics.
+--     epsilon: (number) relative accuracy of summary quantile estimates
+--       (see sketch_bin).
+--     label_patterns: table of regular expressions that label values should
+--       match (see prepare_label_patterns).
+--     label_values: table of arrays of allowed values of labels, keyed by
+--       label name (see prepare_allowed_label_values).
+--     on_unknown_label_value: (string) what to do with label values that are
+--       not allowed, either "reject" (default) or "bucket_as_other".
+--     on_invalid_label: (string) what to do with label values containing
+--       newlines: "escape" (default), "drop" or "replace".
+--     error_label: (boolean) add an `error` label, which is "true" when
+--       the value of the `status` label is at least `error_label_threshold`
+--       (500 by default).
+--     max_series: (number) maximum number of series of the metric; updates
+--       creating more series are dropped (see check_series_limit).
+--     sync_interval: (number) interval in seconds at which per-worker
+--       values of a counter, histogram or summary are synced to the shared
+--       dictionary (see start_metric_counter).
+--     min_update_interval: (number) interval in seconds at which updates of
+--       a gauge are applied to the shared dictionary (see flush_throttled).
+--     skip_zero: (boolean) omit series of a counter with the value of 0 from
+--       the output (see each_metric_value).
+--     collect_fn: (function) computes values of a gauge during collection
+--       instead of storing them in the shared dictionary (see
+--       collected_gauge_values).
+--     group: (string) name of the group of metrics this metric is shown in
+--       when `emit_groups` option of init() is set.
+--     unit: (string) unit of the metric, exposed in OpenMetrics format.
+--       Must be the suffix of the metric name.
+--     ttl: (number) shorthand for setting both `ttl_output` and `ttl_purge`.
+--     ttl_output: (number) seconds after the last update of a series during
+--       which it is returned by metric_data() and graphite_data().
+--     ttl_purge: (number) seconds after the last update of a series after
+--       which it is deleted from the shared dictionary.
+--   typ: metric type (one of the TYPE_* constants).
+--
+-- Returns:
+--   a new metric object.
+local function register(self, name, help, label_names, options, typ)
+  if not self.initialized then
+    ngx.log(ngx.ERR, "Prometheus module has not been initialized")
+    return
+  end
+
+  local err = check_metric_and_label_names(name, label_names)
+  if err then
+    registration_error(self, err)
+    return
+  end
+
+  if help == nil or help == "" then
+    if self.require_help then
+      registration_error(self, "Metric '" .. name .. "' has no help text")
+      return
+    end
+    help = self.default_help or help
+  end
+
+  local name_maybe_historgram = name:gsub("_bucket$", "")
+                                    :gsub("_count$", "")
+                                    :gsub("_sum$", "")
+  if (typ ~= TYPE_HISTOGRAM and (
+      self.registry[name] or self.registry[name_maybe_historgram]
+    )) or
+    ((typ == TYPE_HISTOGRAM or typ == TYPE_SUMMARY) and (
+      self.registry[name] or
+      self.registry[name .. "_count"] or
+      self.registry[name .. "_sum"] or self.registry[name .. "_bucket"]
+    )) then
+
+    registration_error(self, "Duplicate metric " .. name)
+    return
+  end
+  if self._alias_names[name] or self._alias_names[name_maybe_historgram] then
+    registration_error(self, "Metric " .. name .. " collides with an alias")
+    return
+  end
+  if not check_metric_limit(self, name) then
+    return
+  end
+
+  if typ == TYPE_HISTOGRAM and options.buckets ~= nil then
+    local buckets = options.buckets
+    if type(buckets) ~= "table" or #buckets == 0 then
+      err = "should be a non-empty array of numbers in increasing order"
+    end
+    for i = 1, err and 0 or #buckets do
+      local bucket = buckets[i]
+      if type(bucket) ~= "number" or bucket ~= bucket then
+        err = "should be a non-empty array of numbers in increasing order"
+      elseif bucket - bucket ~= 0 then
+        -- Subtracting an infinite value from itself gives NaN rather than 0.
+        err = bucket > 0 and
+          "should not include +Inf, which is added automatically" or
+          "should be finite"
+      elseif i > 1 and bucket == buckets[i - 1] then
+        err = "contain duplicate boundary " .. tostring(bucket)
+      elseif i > 1 and bucket < buckets[i - 1] then
+        err = "should be in increasing order, but " .. tostring(bucket) ..
+          " follows " .. tostring(buckets[i - 1])
+      end
+      if err then
+        break
+      end
+    end
+    if err then
+      registration_error(self, "Histogram '", name, "' buckets ", err)
+      return
+    end
+  end
+  if typ == TYPE_SUMMARY then
+    for _, label_name in ipairs(label_names or {}) do
+      if label_name == "quantile" then
+        registration_error(self, "Invalid label name 'quantile' in ", name)
+        return
+      end
+    end
+    local quantiles = options.quantiles or DEFAULT_QUANTILES
+    local valid = type(quantiles) == "table" and #quantiles > 0
+    for i = 1, valid and #quantiles or 0 do
+      if type(quantiles[i]) ~= "number" or quantiles[i] < 0 or
+          quantiles[i] > 1 then
+        valid = false
+        break
+      end
+    end
+    if not valid then
+      registration_error(self, "Summary '", name, "' quantiles should be a ",
+        "non-empty array of numbers between 0 and 1")
+      return
+    end
+    local epsilon = options.epsilon or DEFAULT_SUMMARY_EPSILON
+    if type(epsilon) ~= "number" or epsilon <= 0 or epsilon >= 1 then
+      registration_error(self, "Summary '", name, "' has invalid epsilon ",
+        "value '", tostring(epsilon), "'")
+      return
+    end
+  end
+  if typ == TYPE_HISTOGRAM and options.bucket_bounds and
+      self.registry[name .. "_bucket_bounds"] then
+    registration_error(self, "Duplicate metric " .. name .. "_bucket_bounds")
+    return
+  end
+  if options.emit_quantiles ~= nil then
+    local quantiles = options.emit_quantiles
+    local valid = typ == TYPE_HISTOGRAM and type(quantiles) == "table" and
+      #quantiles > 0
+    for i = 1, valid and #quantiles or 0 do
+      if type(quantiles[i]) ~= "number" or not (quantiles[i] >= 0) or
+          quantiles[i] > 1 then
+        valid = false
+        break
+      end
+    end
+    if not valid then
+      registration_error(self, "Metric '", name, "' has invalid ",
+        "emit_quantiles (only histograms support it, and it should be a ",
+        "non-empty array of numbers between 0 and 1)")
+      return
+    end
+    for _, label_name in ipairs(label_names or {}) do
+      if label_name == "quantile" then
+        registration_error(self, "Invalid label name 'quantile' in ", name)
+        return
+      end
+    end
+    if self.registry[name .. "_quantile"] then
+      registration_error(self, "Duplicate metric " .. name .. "_quantile")
+      return
+    end
+  end
+  if options.clamp ~= nil then
+    local clamp = options.clamp
+    local valid = typ == TYPE_HISTOGRAM and type(clamp) == "table" and
+      (clamp.min ~= nil or clamp.max ~= nil)
+    for _, bound in ipairs(valid and {"min", "max"} or {}) do
+      local limit = clamp[bound]
+      -- NaN is not equal to itself.
+      if limit ~= nil and (type(limit) ~= "number" or limit ~= limit) then
+        valid = false
+      end
+    end
+    if valid and clamp.min and clamp.max and clamp.min > clamp.max then
+      valid = false
+    end
+    if not valid then
+      registration_error(self, "Metric '", name, "' has invalid clamp ",
+        "(only histograms support it, and it should be a table with min ",
+        "and/or max numbers, min not greater than max)")
+      return
+    end
+    if clamp.count and self.registry[name .. "_clamped_total"] then
+      registration_error(self, "Duplicate metric " .. name .. "_clamped_total")
+      return
+    end
+  end
+  if options.track_extremes ~= nil then
+    if typ ~= TYPE_HISTOGRAM or type(options.track_extremes) ~= "boolean" then
+      registration_error(self, "Metric '", name, "' has invalid ",
+        "track_extremes (only histograms support it, and it should be a ",
+        "boolean)")
+      return
+    end
+    for _, extreme in ipairs(options.track_extremes and
+        {"_min", "_max", "_last"} or {}) do
+      if self.registry[name .. extreme] then
+        registration_error(self, "Duplicate metric " .. name .. extreme)
+        return
+      end
+    end
+  end
+
+  if options.local_aggregation ~= nil and (typ ~= TYPE_HISTOGRAM or
+      type(options.local_aggregation) ~= "boolean") then
+    registration_error(self, "Metric '", name, "' has invalid ",
+      "local_aggregation (only histograms support it, and it should be a ",
+      "boolean)")
+    return
+  end
+
+  local label_patterns
+  if options.label_patterns then
+    label_patterns, err = prepare_label_patterns(name, label_names,
+      options.label_patterns)
+    if err then
+      registration_error(self, err)
+      return
+    end
+  end
+
+  local allowed_label_values
+  if options.label_values then
+    allowed_label_values, err = prepare_allowed_label_values(name,
+      label_names, options.label_values)
+    if err then
+      registration_error(self, err)
+      return
+    end
+  end
+  local on_unknown_label_value = options.on_unknown_label_value or "reject"
+  if not UNKNOWN_LABEL_VALUE_POLICIES[on_unknown_label_value] then
+    registration_error(self, "Metric '", name,
+      "' has invalid on_unknown_label_value value '",
+      tostring(on_unknown_label_value), "'")
+    return
+  end
+
+  local unit = options.unit
+  if unit ~= nil then
+    if type(unit) ~= "string" or not unit:find("^[a-zA-Z0-9_]+$") then
+      registration_error(self, "Metric '", name, "' has invalid unit '",
+        tostring(unit), "' (should consist of letters, digits and ",
+        "underscores)")
+      return
+    end
+    -- OpenMetrics requires the unit to be the suffix of the metric family.
+    local family = name
+    if typ == TYPE_COUNTER then
+      family = name:gsub("_total$", "")
+    end
+    if family:sub(-#unit - 1) ~= "_" .. unit then
+      if self.strict_units then
+        registration_error(self, "Metric '", name, "' has unit '", unit,
+          "' which is not the suffix of the metric name")
+        return
+      end
+      ngx.log(ngx.WARN, "Metric '", name, "' has unit '", unit,
+        "' which is not the suffix of the metric name, leaving it out of ",
+        "the output")
+      unit = nil
+    end
+  end
+  for _, ttl in ipairs({"ttl", "ttl_output", "ttl_purge"}) do
+    if options[ttl] ~= nil and
+        (type(options[ttl]) ~= "number" or options[ttl] <= 0) then
+      registration_error(self, "Metric '", name, "' has invalid ", ttl,
+        " value '", tostring(options[ttl]), "'")
+      return
+    end
+  end
+
+  local error_label
+  if options.error_label then
+    local label_names_with_error = {}
+    for i, label_name in ipairs(label_names or {}) do
+      if label_name == "error" then
+        registration_error(self, "Metric '", name,
+          "' already has an 'error' label")
+        return
+      end
+      if label_name == "status" then
+        error_label = {status_idx = i}
+      end
+      label_names_with_error[i] = label_name
+    end
+    if not error_label then
+      registration_error(self, "Metric '", name, "' needs a 'status' label ",
+        "to derive the 'error' label from")
+      return
+    end
+    table.insert(label_names_with_error, "error")
+    error_label.label_names = label_names_with_error
+    error_label.threshold = options.error_label_threshold or
+      DEFAULT_ERROR_LABEL_THRESHOLD
+  end
+
+  local const_labels
+  local all_label_names = error_label and error_label.label_names or
+    label_names
+  -- With `sort_labels` option of init(), labels are sorted by name in series
+  -- keys. The order is found once here, since keys of new series are built
+  -- on the request path (see lookup_or_create).
+  local sorted_labels
+  if self.sort_labels and all_label_names and #all_label_names > 1 then
+    sorted_labels = {names = {}, order = {}}
+    for i = 1, #all_label_names do
+      sorted_labels.order[i] = i
+    end
+    table.sort(sorted_labels.order, function(a, b)
+      return all_label_names[a] < all_label_names[b]
+    end)
+    for i, idx in ipairs(sorted_labels.order) do
+      sorted_labels.names[i] = all_label_names[idx]
+    end
+  end
+  if options.const_labels ~= nil then
+    const_labels, err = format_const_labels(name, all_label_names,
+      options.const_labels, typ)
+    if err then
+      registration_error(self, err)
+      return
+    end
+  end
+  if self.default_labels then
+    const_labels = format_labels(merge_default_labels(self, all_label_names,
+      options.const_labels, typ))
+  end
+
+  if options.min_update_interval ~= nil and (typ ~= TYPE_GAUGE or
+      type(options.min_update_interval) ~= "number" or
+      options.min_update_interval <= 0) then
+    registration_error(self, "Metric '", name, "' has invalid ",
+      "min_update_interval value '", tostring(options.min_update_interval),
+      "' (only gauges support it)")
+    return
+  end
+  if options.sync_interval ~= nil and (typ == TYPE_GAUGE or
+      type(options.sync_interval) ~= "number" or
+      options.sync_interval <= 0) then
+    registration_error(self, "Metric '", name, "' has invalid ",
+      "sync_interval value '", tostring(options.sync_interval),
+      "' (gauges don't support it, see min_update_interval)")
+    return
+  end
+
+  if options.skip_zero ~= nil and (typ ~= TYPE_COUNTER or
+      type(options.skip_zero) ~= "boolean") then
+    registration_error(self, "Metric '", name, "' has invalid skip_zero ",
+      "value '", tostring(options.skip_zero), "' (only counters support it)")
+    return
+  end
+
+  if options.max_series ~= nil and (type(options.max_series) ~= "number" or
+      options.max_series < 1 or options.max_series % 1 ~= 0) then
+    registration_error(self, "Metric '", name, "' has invalid max_series ",
+      "value '", tostring(options.max_series), "' (should be a positive ",
+      "integer)")
+    return
+  end
+
+  if options.sample_rate ~= nil and (typ ~= TYPE_HISTOGRAM or
+      type(options.sample_rate) ~= "number" or options.sample_rate <= 0 or
+      options.sample_rate > 1) then
+    registration_error(self, "Metric '", name, "' has invalid sample_rate ",
+      "value '", tostring(options.sample_rate), "' (only histograms support ",
+      "it)")
+    return
+  end
+
+  local native_schema = options.native_schema
+  if native_schema ~= nil and (typ ~= TYPE_HISTOGRAM or
+      type(native_schema) ~= "number" or native_schema % 1 ~= 0 or
+      native_schema < MIN_NATIVE_SCHEMA or
+      native_schema > MAX_NATIVE_SCHEMA) then
+    registration_error(self, "Metric '", name, "' has invalid native_schema ",
+      "value '", tostring(native_schema), "' (only histograms support it, ",
+      "and it should be an integer between ", MIN_NATIVE_SCHEMA, " and ",
+      MAX_NATIVE_SCHEMA, ")")
+    return
+  end
+  local zero_threshold = options.native_zero_threshold
+  if zero_threshold ~= nil and (native_schema == nil or
+      type(zero_threshold) ~= "number" or zero_threshold < 0) then
+    registration_error(self, "Metric '", name, "' has invalid ",
+      "native_zero_threshold value '", tostring(zero_threshold),
+      "' (only native histograms support it)")
+    return
+  end
+  if native_schema and options.sample_rate then
+    -- Bucket counts of native histograms are integers, so they can't be
+    -- scaled up like the ones of classic histograms.
+    registration_error(self, "Native histogram '", name, "' can not have ",
+      "sample_rate")
+    return
+  end
+
+  if options.collect_fn ~= nil and (typ ~= TYPE_GAUGE or
+      type(options.collect_fn) ~= "function") then
+    registration_error(self, "Metric '", name, "' has invalid collect_fn ",
+      "(only gauges support it, and it should be a function)")
+    return
+  end
+
+  local on_invalid_label = options.on_invalid_label or "escape"
+  if not INVALID_LABEL_POLICIES[on_invalid_label] then
+    registration_error(self, "Metric '", name,
+      "' has invalid on_invalid_label value '", tostring(on_invalid_label),
+      "'")
+    return
+  end
+
+  local metric = {
+    name = name,
+    help = help,
+    typ = typ,
+    label_names = label_names,
+    label_count = label_names and #label_names or 0,
+    -- Lookup is a tree of lua tables that contain label values, with leaf
+    -- tables containing full metric names. For example, given a metric
+    -- `http_count` and labels `host` and `status`, it might contain the
+    -- following values:
+    -- ['me.com']['200'][LEAF_KEY] = 'http_count{host="me.com",status="200"}'
+    -- ['me.com']['500'][LEAF_KEY] = 'http_count{host="me.com",status="500"}'
+    -- ['my.net']['200'][LEAF_KEY] = 'http_count{host="my.net",status="200"}'
+    -- ['my.net']['500'][LEAF_KEY] = 'http_count{host="my.net",status="500"}'
+    lookup = {},
+    label_patterns = label_patterns,
+    on_invalid_label = on_invalid_label,
+    allowed_label_values = allowed_label_values,
+    on_unknown_label_value = on_unknown_label_value,
+    error_label = error_label,
+    sorted_labels = sorted_labels,
+    group = options.group,
+    parent = self,
+    -- Store a reference for logging functions for faster lookup.
+    _log_error = function(...)
+      count_errors(self, 1, {metric = name}, ...)
+    end,
+    _log_error_kv = function(key, value, err)
+      self:log_error_kv(key, value, err, {metric = name})
+    end,
+    _key_index = self.key_index,
+    _free_dict_space = self.on_dict_full ~= "error" and
+      function() free_dict_space(self) end or nil,
+    max_label_value_length = self.max_label_value_length,
+    invalid_utf8 = self.invalid_utf8,
+    max_series = options.max_series,
+    skip_zero = options.skip_zero,
+    _series_count_key = options.max_series and SERIES_COUNT_PREFIX .. name,
+    _dict = self._metric_dict,
+    _async = self.async,
+    reset = reset,
+  }
+  if typ < TYPE_HISTOGRAM then
+    if typ == TYPE_GAUGE then
+      metric.set = set
+      metric.cas = cas
+      metric.inc = inc_gauge
+      metric.dec = dec_gauge
+    else
+      metric.inc = inc_counter
+      metric.reset = reset_counter
+      -- Latest exemplars recorded by this worker (see record_exemplar).
+      metric.exemplars = {}
+      if options.skip_zero then
+        self._skip_zero = true
+      end
+    end
+    metric.del = del
+    metric.initialize = initialize
+  elseif typ == TYPE_SUMMARY then
+    metric.observe = observe_summary
+    metric.quantiles = options.quantiles or DEFAULT_QUANTILES
+    metric.epsilon = options.epsilon or DEFAULT_SUMMARY_EPSILON
+    metric.gamma = (1 + metric.epsilon) / (1 - metric.epsilon)
+    metric.log_gamma = math.log(metric.gamma)
+    self._summaries = true
+  else
+    metric.observe = observe
+    metric.observe_latency = observe_latency
+    -- Options passed to observe() by observe_latency.
+    metric._latency_options = {exemplar = {}}
+    metric.del = del_histogram
+    metric.reset = reset_histogram
+    metric.initialize = initialize
+    metric.exemplars = {}
+    metric.buckets = options.buckets or DEFAULT_BUCKETS
+    metric.bucket_count = #metric.buckets
+    metric.bucket_format = construct_bucket_format(metric.buckets)
+    metric.bucket_labels, metric.bucket_suffix_length =
+      construct_bucket_labels(metric.buckets, metric.bucket_format)
+    -- Histograms with the same layout share bucket search in observe_many.
+    metric.bucket_layout = table.concat(metric.buckets, ",")
+    if options.sample_rate then
+      metric.sample_rate = options.sample_rate
+      -- Recorded values are multiplied by this during collection.
+      metric.sample_scale = 1 / options.sample_rate
+      self._sampled = true
+    end
+    if native_schema then
+      metric.native_schema = native_schema
+      metric.native_zero_threshold = zero_threshold or
+        DEFAULT_NATIVE_ZERO_THRESHOLD
+      metric.native_bounds = native_bucket_bounds(native_schema)
+      self._native = true
+    end
+    if options.bucket_cache then
+      -- Bucket found by the last call of find_bucket in this worker.
+      metric._last_bucket = 1
+    end
+    if options.compensated_sum then
+      -- Per-worker compensation terms of _sum metrics, keyed by full metric
+      -- name (see incr_compensated).
+      metric.sum_compensation = {}
+    end
+    if options.local_aggregation then
+      -- Observations of this worker that are not merged into the per-worker
+      -- counter yet, keyed by full metric names of the series (see
+      -- sync_aggregated).
+      metric._aggregated = {}
+    end
+  end
+
+  if options.collect_fn then
+    metric.collect_fn = options.collect_fn
+    metric.set = update_collected_gauge
+    metric.inc = update_collected_gauge
+    metric.dec = update_collected_gauge
+    metric.initialize = update_collected_gauge
+    table.insert(self._collected, metric)
+    table.sort(self._collected, function(a, b) return a.name < b.name end)
+  end
+
+  if options.min_update_interval then
+    -- Pending updates, applied to the dictionary by flush_throttled. Values
+    -- are either increments, or new values if `_pending_set` is true.
+    metric.min_update_interval = options.min_update_interval
+    metric._pending = {}
+    metric._pending_set = {}
+    table.insert(self._throttled, metric)
+    if self._counter then
+      ngx.timer.every(metric.min_update_interval, flush_throttled, metric)
+    end
+  end
+
+  if options.sync_interval or options.local_aggregation then
+    metric.sync_interval = options.sync_interval
+    table.insert(self._own_counters, metric)
+    if self._counter then
+      start_metric_counter(self, metric)
+    end
+  end
+
+  local ttl_output = options.ttl_output or options.ttl
+  local ttl_purge = options.ttl_purge or options.ttl
+  -- Update times are also needed to evict series when the dictionary is full,
+  -- and the timer recording them clears caches of names of deleted series.
+  if ttl_output or ttl_purge or
+      ((self.timestamps or self.on_dict_full ~= "error") and
+        not metric.collect_fn) then
+    metric.ttl_output = ttl_output
+    metric.ttl_purge = ttl_purge
+    if ttl_output then
+      self._ttl_output = true
+    end
+    if not self._touched then
+      -- Series updated since the last run of record_updates, shared by all
+      -- metrics with TTL options (or all metrics with `timestamps` option).
+      self._touched = {}
+      self._ttl_deleted = self.key_index.deleted
+      if self._counter then
+        ngx.timer.every(self.sync_interval, record_updates, self)
+      end
+    end
+    metric._touched = self._touched
+  end
+
+  -- HELP and TYPE comments never change for a registered metric, so they are
+  -- formatted once here instead of during every collection.
+  if help == "" then
+    metric.help_line = string.format("# HELP %s%s\n", self.prefix, name)
+  elseif help then
+    metric.help_line = string.format("# HELP %s%s %s\n", self.prefix, name,
+      escape_help(help))
+  end
+  metric.type_line = string.format("# TYPE %s%s %s\n", self.prefix, name,
+    TYPE_LITERAL[typ])
+  metric.openmetrics_header = openmetrics_header(self.prefix, metric, help,
+    unit)
+
+  if const_labels or self.default_labels then
+    -- False means that the metric overrides all default labels.
+    metric.const_labels = const_labels
+    self._const_labels[name] = const_labels or false
+    if typ == TYPE_HISTOGRAM or typ == TYPE_SUMMARY then
+      -- _count and _sum samples have their own short metric names.
+      self._const_labels[name .. "_count"] = const_labels or false
+      self._const_labels[name .. "_sum"] = const_labels or false
+    end
+  end
+
+  self.registry[name] = metric
+  record_family(self, name, typ, help)
+  if self._user_metric_count then
+    self._user_metric_count = self._user_metric_count + 1
+  end
+  if typ == TYPE_HISTOGRAM and options.bucket_bounds then
+    register_bucket_bounds(self, metric)
+  end
+  if options.emit_quantiles then
+    register_quantile_gauge(self, metric, options.emit_quantiles)
+  end
+  if options.clamp then
+    metric.clamp = {min = options.clamp.min, max = options.clamp.max}
+    if options.clamp.count then
+      metric.clamp.counter = register(self, name .. "_clamped_total",
+        "Number of observations of " .. self.prefix .. name ..
+        " clamped to its range", {"bound"}, {}, TYPE_COUNTER)
+    end
+  end
+  if options.track_extremes then
+    -- Gauges have the same labels as the histogram, with label values
+    -- validated and transformed the same way.
+    local gauge_options = {}
+    for _, option in ipairs({"label_patterns", "label_values",
+        "on_unknown_label_value", "on_invalid_label", "error_label",
+        "error_label_threshold", "group", "ttl", "ttl_output", "ttl_purge"}) do
+      gauge_options[option] = options[option]
+    end
+    metric.extremes = {}
+    for extreme, help in pairs({min = "Minimum", max = "Maximum",
+        last = "Last"}) do
+      metric.extremes[extreme] = register(self, name .. "_" .. extreme,
+        help .. " observed value of " .. self.prefix .. name, label_names,
+        gauge_options, TYPE_GAUGE)
+    end
+  end
+  return metric
+end
+
+-- Public function to register a counter.
+function Prometheus:counter(name, help, label_names, options)
+  return register(self, name, help, label_names, options or {}, TYPE_COUNTER)
+end
+
+-- Public function to register a gauge.
+function Prometheus:gauge(name, help, label_names, options)
+  return register(self, name, help, label_names, options or {}, TYPE_GAUGE)
+end
+
+-- Public function to register a histogram.
+--
+-- The last argument can either be a table of metric options (see register),
+-- or an array of bucket boundaries.
+function Prometheus:histogram(name, help, label_names, buckets_or_options)
+  local options = buckets_or_options or {}
+  if options[1] ~= nil then
+    options = {buckets = buckets_or_options}
+  end
+  return register(self, name, help, label_names, options, TYPE_HISTOGRAM)
+end
+
+-- Public function to register a summary.
+function Prometheus:summary(name, help, label_names, quantiles_or_options)
+  local options = quantiles_or_options or {}
+  if options[1] ~= nil then
+    options = {quantiles = quantiles_or_options}
+  end
+  return register(self, name, help, label_names, options, TYPE_SUMMARY)
+end
+
+-- Register an info metric: a gauge with the value of 1 and a single series,
+-- labels of which describe something (e.g. version of the application).
+--
+-- The returned object has a `set` method taking a new table of label values,
+-- which replaces the previous series. Other methods of gauges are not
+-- supported.
+--
+-- Args:
+--   name: (string) name of the metric, which should end with `_info`.
+--   help: (string) description of the metric.
+--   labels: table of label values keyed by label name.
+--
+-- Returns:
+--   a `metric` object, or nil in case of an error.
+function Prometheus:info(name, help, labels)
+  if type(name) ~= "string" or name:sub(-5) ~= "_info" then
+    registration_error(self, "Info metric '", tostring(name), "' name ",
+      "should end with _info")
+    return
+  end
+  if type(labels) ~= "table" or next(labels) == nil then
+    registration_error(self, "Info metric '", name, "' labels should be a ",
+      "non-empty table of label values keyed by label name")
+    return
+  end
+  local label_names = {}
+  for label_name in pairs(labels) do
+    table.insert(label_names, label_name)
+  end
+  table.sort(label_names)
+  local metric = register(self, name, help, label_names, {}, TYPE_GAUGE)
+  if not metric then
+    return
+  end
+
+  -- OpenMetrics has a separate type for info metrics, with family names
+  -- having no _info suffix.
+  local family = name:sub(1, -6)
+  metric.openmetrics_header = (help and help ~= "" and
+    string.format("# HELP %s%s %s\n", self.prefix, family,
+      escape_help(help, true)) or "") ..
+    string.format("# TYPE %s%s info\n", self.prefix, family)
+  local function unsupported()
+    metric._log_error("Info metric '", name, "' can only be updated with set()")
+  end
+  metric.inc, metric.dec, metric.cas = unsupported, unsupported, unsupported
+  metric.initialize = unsupported
+  metric.set = function(m, new_labels)
+    local label_values = {}
+    for idx, label_name in ipairs(m.label_names) do
+      label_values[idx] = (new_labels or {})[label_name]
+    end
+    local key, err = lookup_or_create(m, label_values)
+    if err then
+      m._log_error(err)
+      return
+    end
+    -- The new series is written first, so that the metric is never missing
+    -- from the output. Series written by other workers are removed too.
+    local _, set_err = m._dict:safe_set(key, 1)
+    if set_err then
+      m._log_error_kv(key, 1, set_err)
+      return
+    end
+    local name_prefix = m.name .. "{"
+    for _, other in ipairs(m._key_index:list()) do
+      if other ~= key and other:sub(1, #name_prefix) == name_prefix then
+        m._key_index:remove(other)
+        forget_series(m, other)
+        m._dict:delete(other)
+      end
+    end
+    -- Removed label values should be added to the key index again when set.
+    m.lookup = {}
+  end
+  metric:set(labels)
+  return metric
+end
+
+-- Register a ratio of two counters, computed during collection.
+--
+-- Ratios are exposed as gauges and don't have any values of their own: for
+-- each label set, the sum of numerator series with these label values is
+-- divided by the sum of denominator series. Label sets for which the
+-- denominator is zero are omitted.
+--
+-- Args:
+--   name: (string) name of the ratio metric.
+--   help: (string) description of the ratio metric.
+--   numerator: a counter, created by Prometheus:counter().
+--   denominator: a counter, created by Prometheus:counter().
+--   label_names: (array) names of labels the ratio is computed by. All of them
+--     should be labels of both counters. Optional, defaults to label names of
+--     the numerator.
+--
+-- Returns:
+--   a `ratio` object, or nil in case of an error.
+function Prometheus:ratio(name, help, numerator, denominator, label_names)
+  if not self.initialized then
+    ngx.log(ngx.ERR, "Prometheus module has not been initialized")
+    return
+  end
+
+  for _, counter in ipairs({numerator, denominator}) do
+    if type(counter) ~= "table" or counter.typ ~= TYPE_COUNTER or
+        counter.parent ~= self then
+      registration_error(self, "Ratio '", tostring(name), "' should be ",
+        "computed from counters registered by the same Prometheus object")
+      return
+    end
+  end
+
+  label_names = label_names or numerator.label_names or {}
+  local err = check_metric_and_label_names(name, label_names)
+  if err then
+    registration_error(self, err)
+    return
+  end
+  if self.registry[name] then
+    registration_error(self, "Duplicate metric " .. name)
+    return
+  end
+  if not check_metric_limit(self, name) then
+    return
+  end
+
+  for _, counter in ipairs({numerator, denominator}) do
+    local counter_labels = {}
+    local counter_label_names = counter.error_label and
+      counter.error_label.label_names or counter.label_names or {}
+    for _, label_name in ipairs(counter_label_names) do
+      counter_labels[label_name] = true
+    end
+    for _, label_name in ipairs(label_names) do
+      if not counter_labels[label_name] then
+        registration_error(self, "Ratio '", name, "' label '", label_name,
+          "' is not a label of counter '", counter.name, "'")
+        return
+      end
+    end
+  end
+
+  if self.sort_labels then
+    local sorted = {}
+    for i, label_name in ipairs(label_names) do
+      sorted[i] = label_name
+    end
+    table.sort(sorted)
+    label_names = sorted
+  end
+  local ratio = {
+    name = name,
+    help = help,
+    typ = TYPE_GAUGE,
+    label_names = label_names,
+    numerator = numerator,
+    denominator = denominator,
+    help_line = help and string.format("# HELP %s%s %s\n", self.prefix, name,
+      escape_help(help)),
+    type_line = string.format("# TYPE %s%s gauge\n", self.prefix, name),
+  }
+  if self.default_labels then
+    ratio.const_labels = format_labels(merge_default_labels(self, label_names))
+  end
+  for _, counter in ipairs({numerator, denominator}) do
+    counter.ratios = counter.ratios or {}
+    table.insert(counter.ratios, ratio)
+  end
+  self.registry[name] = ratio
+  record_family(self, name, TYPE_GAUGE, help)
+  if self._user_metric_count then
+    self._user_metric_count = self._user_metric_count + 1
+  end
+  table.insert(self._ratios, ratio)
+  table.sort(self._ratios, function(a, b) return a.name < b.name end)
+  return ratio
+end
+
+-- Expose a metric under a different name.
+--
+-- Only the output changes: the metric is still updated, stored and passed to
+-- other functions under its registered name.
+--
+-- Args:
+--   old_name: (string) name of a registered metric.
+--   new_name: (string) name the metric is exposed with. It should not be used
+--     by any other metric or alias.
+--   options: table of options. Optional.
+--     labels: table of new label names keyed by label name, or `false` for
+--       labels that should not be exposed.
+--
+-- Returns:
+--   true, or nil in case of an error.
+function Prometheus:alias(old_name, new_name, options)
+  if not self.initialized then
+    ngx.log(ngx.ERR, "Prometheus module has not been initialized")
+    return
+  end
+
+  options = options or {}
+  local m = self.registry[old_name]
+  if not m or m.internal or m.collect_fn or not m.lookup then
+    registration_error(self, "Metric '", tostring(old_name), "' can't be ",
+      "aliased: only counters, gauges, histograms and summaries registered ",
+      "by this object can be")
+    return
+  end
+  local label_names = {}
+  for _, label_name in ipairs(m.label_names or {}) do
+    label_names[label_name] = true
+  end
+  local labels = options.labels or {}
+  local exposed_labels = {}
+  for label_name, exposed in pairs(labels) do
+    if not label_names[label_name] or
+        exposed ~= false and type(exposed) ~= "string" then
+      registration_error(self, "Alias '", tostring(new_name), "' has ",
+        "invalid new name of label '", tostring(label_name), "'")
+      return
+    end
+  end
+  local exposed_names = {}
+  for _, label_name in ipairs(m.label_names or {}) do
+    local exposed = labels[label_name]
+    if exposed == nil then
+      exposed = label_name
+    end
+    if exposed then
+      table.insert(exposed_names, exposed)
+      if exposed_labels[exposed] then
+        registration_error(self, "Alias '", tostring(new_name), "' has ",
+          "duplicate label '", exposed, "'")
+        return
+      end
+      exposed_labels[exposed] = true
+    end
+  end
+  local err = check_metric_and_label_names(new_name, exposed_names)
+  if err then
+    registration_error(self, err)
+    return
+  end
+  local family = new_name:gsub("_bucket$", ""):gsub("_count$", "")
+                         :gsub("_sum$", "")
+  for _, name in ipairs({new_name, family, new_name .. "_count",
+                         new_name .. "_sum", new_name .. "_bucket"}) do
+    if self.registry[name] or self._alias_names[name] then
+      registration_error(self, "Alias '", new_name, "' of metric '", old_name,
+        "' would collide with metric ", name)
+      return
+    end
+  end
+  if self._aliases[old_name] then
+    registration_error(self, "Metric '", old_name, "' is already aliased")
+    return
+  end
+
+  local alias = {name = new_name, source = old_name, typ = m.typ,
+                 labels = labels}
+  if m.help_line then
+    alias.help_line = string.format("# HELP %s%s%s\n", self.prefix, new_name,
+      m.help ~= "" and " " .. escape_help(m.help) or "")
+  end
+  alias.type_line = string.format("# TYPE %s%s %s\n", self.prefix, new_name,
+    TYPE_LITERAL[m.typ])
+  alias.openmetrics_header = openmetrics_header(self.prefix, alias, m.help)
+  self._aliases[old_name] = alias
+  if m.typ == TYPE_HISTOGRAM or m.typ == TYPE_SUMMARY then
+    -- _count and _sum samples have their own short metric names.
+    self._aliases[old_name .. "_count"] = alias
+    self._aliases[old_name .. "_sum"] = alias
+  end
+  self._alias_names[new_name] = true
+  return true
+end
+
+-- Define a named subset of metric families that collect() can expose.
+--
+-- Views are meant to be defined once in `init_worker_by_lua_block`. Their
+-- families are looked up on each collection, so metrics registered after the
+-- view is defined are included if they match.
+--
+-- Args:
+--   name: (string) name of the view, passed as the `view` option of collect().
+--   options: table of options. Supported options are:
+--     include: array of exposed metric family names (including the prefix
+--       passed to init()).
+--     prefixes: array of exposed metric family name prefixes.
+--
+-- Returns:
+--   true, or nil in case of an error.
+function Prometheus:register_view(name, options)
+  if not self.initialized then
+    ngx.log(ngx.ERR, "Prometheus module has not been initialized")
+    return
+  end
+
+  if type(name) ~= "string" or name == "" then
+    registration_error(self, "View name should be a non-empty string")
+    return
+  end
+  if self._views[name] then
+    registration_error(self, "Duplicate view '", name, "'")
+    return
+  end
+  options = options or {}
+  local view = {}
+  for _, option in ipairs({"include", "prefixes"}) do
+    local values = options[option] or {}
+    if type(values) ~= "table" then
+      registration_error(self, "View '", name, "' has invalid ", option,
+        " (it should be an array of strings)")
+      return
+    end
+    for _, value in ipairs(values) do
+      if type(value) ~= "string" or value == "" then
+        registration_error(self, "View '", name, "' has invalid ", option,
+          " (it should be an array of strings)")
+        return
+      end
+    end
+    view[option] = values
+  end
+  if #view.include == 0 and #view.prefixes == 0 then
+    registration_error(self, "View '", name, "' should include at least ",
+      "one metric name or prefix")
+    return
+  end
+  self._views[name] = view
+  return true
+end
+
+-- Add a counter value to the sums that ratios are computed from.
+--
+-- Args:
+--   sums: (table) sums of numerator and denominator values, keyed by ratio
+--     and then by full metric name of the ratio.
+--   m: a counter metric object with ratios.
+--   key: (string) full metric name of the counter series.
+--   value: (number) value of the counter series.
+local function add_ratio_source(sums, m, key, value)
+  local _, labels = parse_full_metric_name(key)
+  local label_values = {}
+  for _, pair in ipairs(labels) do
+    label_values[pair[1]] = pair[2]
+  end
+  for _, ratio in ipairs(m.ratios) do
+    local values = {}
+    for idx, label_name in ipairs(ratio.label_names) do
+      values[idx] = label_values[label_name]
+    end
+    local ratio_key = full_metric_name(ratio.name, ratio.label_names, values)
+    sums[ratio] = sums[ratio] or {}
+    local sum = sums[ratio][ratio_key] or {0, 0}
+    if ratio.numerator == m then
+      sum[1] = sum[1] + value
+    end
+    if ratio.denominator == m then
+      sum[2] = sum[2] + value
+    end
+    sums[ratio][ratio_key] = sum
+  end
+end
+
+-- Add a bucket count of a histogram to the counts that quantiles of its
+-- `emit_quantiles` option are estimated from.
+--
+-- Args:
+--   counts: (table) bucket counts keyed by histogram and then by labels of
+--     the histogram series (formatted as in a full metric name, followed by
+--     a comma unless empty). Each series is an array of {upper bound,
+--     cumulative count} pairs, with the +Inf bucket stored as `total`.
+--   m: a histogram metric object with `emit_quantiles` option.
+--   key: (string) full metric name of the histogram sample.
+--   value: (number) value of the histogram sample.
+local function add_quantile_source(counts, m, key, value)
+  local labels, le = key:match('^[^{]*_bucket{(.-)le="([^"]*)"}$')
+  if not labels then
+    -- _count and _sum samples.
+    return
+  end
+  counts[m] = counts[m] or {}
+  local series = counts[m][labels] or {}
+  counts[m][labels] = series
+  if le == "Inf" then
+    series.total = value
+  else
+    table.insert(series, {tonumber(le), value})
+  end
+end
+
+-- Estimate quantiles of a histogram from its bucket counts.
+--
+-- Like histogram_quantile() of Prometheus, this assumes that values are
+-- distributed linearly within each bucket, so accuracy depends on how
+-- granular the buckets are. Quantiles falling into the +Inf bucket are
+-- estimated as the highest finite bucket boundary.
+--
+-- Args:
+--   self: a Prometheus object.
+--   gauge: a quantile gauge object (see register_quantile_gauge).
+--   counts: (table) bucket counts read during collection (see
+--     add_quantile_source).
+--
+-- Returns:
+--   Array of `{full_name, value}` pairs with samples of the gauge (without the
+--   prefix passed to init()), sorted by labels. Series without observations
+--   are skipped.
+local function quantile_gauge_values(self, gauge, counts)
+  local histogram_counts = counts[gauge.histogram] or {}
+  local series_labels = {}
+  for labels in pairs(histogram_counts) do
+    table.insert(series_labels, labels)
+  end
+  table.sort(series_labels)
+  local const_labels = added_labels(self, gauge.histogram.name)
+  local values = {}
+  for _, labels in ipairs(series_labels) do
+    local series = histogram_counts[labels]
+    local total = series.total or 0
+    table.sort(series, function(a, b) return a[1] < b[1] end)
+    for _, q in ipairs(total > 0 and #series > 0 and gauge.quantiles or {}) do
+      local rank = q * total
+      local estimate = series[#series][1]
+      local lower, below = 0, 0
+      for i, bucket in ipairs(series) do
+        if bucket[2] >= rank then
+          if i == 1 and bucket[1] <= 0 then
+            estimate = bucket[1]
+          elseif bucket[2] == below then
+            estimate = lower
+          else
+            estimate = lower + (bucket[1] - lower) *
+              (rank - below) / (bucket[2] - below)
+          end
+          break
+        end
+        lower, below = bucket[1], bucket[2]
+      end
+      local key = string.format('%s{%squantile="%s"}', gauge.name, labels, q)
+      if const_labels then
+        key = add_labels(key, const_labels)
+      end
+      table.insert(values, {key, estimate})
+    end
+  end
+  return values
+end
+
+-- Record a given value in several histograms.
+--
+-- The bucket the value fits into is only found again when bucket boundaries
+-- differ from the previous histogram, so it's best to group histograms with
+-- the same buckets together. Since all histograms are updated without
+-- yielding, values are flushed to the shared dictionary together.
+--
+-- Args:
+--   value: numeric value to record. Should be defined.
+--   observations: (array) a list of {histogram, label_values} pairs, where
+--     histogram is a `metric` object created by Prometheus:histogram(), and
+--     label_values is a list of its label values (or nil).
+function Prometheus:observe_many(value, observations)
+  if not value then
+    self:log_error("No value passed to observe_many")
+    return
+  end
+  -- Histograms usually share the same layout (e.g. default buckets), so only
+  -- the last computed bucket is kept to avoid allocating a table.
+  local layout, bucket
+  for _, observation in ipairs(observations) do
+    local m = observation[1]
+    if type(m) ~= "table" or m.typ ~= TYPE_HISTOGRAM then
+      self:log_error("observe_many can only record values in histograms")
+    else
+      if m.bucket_layout ~= layout then
+        layout = m.bucket_layout
+        bucket = find_bucket(m, value)
+      end
+      if not m.sample_rate or math.random() < m.sample_rate then
+        observe_bucket(m, value, observation[2], bucket)
+      end
+    end
+  end
+end
+
+-- Updates of counters and gauges queued by Prometheus:batch(), and applied
+-- together by commit(). Updates of the same series are coalesced, so that
+-- each series is only updated once.
+local Batch = {}
+Batch.__index = Batch
+
+-- Find the pending update of a series, creating it if necessary.
+--
+-- Args:
+--   self: a Batch object.
+--   metric: a `metric` object, created by register().
+--   label_values: a list of label values, in the same order as label keys.
+--   gauges_only: (bool) whether counters can't be updated.
+--
+-- Returns:
+--   (table) pending update of the series, or nil in case of an error.
+local function batch_entry(self, metric, label_values, gauges_only)
+  if type(metric) ~= "table" or not (metric.typ == TYPE_GAUGE or
+      (metric.typ == TYPE_COUNTER and not gauges_only)) then
+    self.prometheus:log_error("Batches can only ",
+      gauges_only and "set gauges" or "update counters and gauges")
+    return
+  end
+  local key, err = lookup_or_create(metric, label_values, true)
+  if err then
+    metric._log_error(err)
+    return
+  end
+  local entry = self.entries[key]
+  if not entry then
+    -- Label values are copied, since callers often reuse the table.
+    local values = {}
+    for i = 1, metric.label_count do
+      values[i] = label_values[i]
+    end
+    entry = {metric = metric, label_values = values, delta = 0}
+    self.entries[key] = entry
+    table.insert(self.order, entry)
+  end
+  return entry
+end
+
+-- Queue an increment of a counter or a gauge.
+--
+-- Args:
+--   metric: a counter or a gauge object.
+--   value: numeric value to increment by. Defaults to 1.
+--   label_values: a list of label values, in the same order as label keys.
+function Batch:inc(metric, value, label_values)
+  value = value or 1
+  if type(value) ~= "number" or value ~= value or
+      (value < 0 and type(metric) == "table" and metric.typ == TYPE_COUNTER) then
+    self.prometheus:log_error("Metric '", type(metric) == "table" and
+      metric.name or tostring(metric), "' can't be incremented by '",
+      tostring(value), "'")
+    return
+  end
+  local entry = batch_entry(self, metric, label_values)
+  if entry then
+    entry.delta = entry.delta + value
+  end
+end
+
+-- Queue a decrement of a gauge.
+--
+-- Args:
+--   metric: a gauge object.
+--   value: numeric value to decrement by. Defaults to 1.
+--   label_values: a list of label values, in the same order as label keys.
+function Batch:dec(metric, value, label_values)
+  if type(metric) == "table" and metric.typ == TYPE_COUNTER then
+    self.prometheus:log_error("Counter '", metric.name, "' can't be ",
+      "decremented")
+    return
+  end
+  self:inc(metric, -(value or 1), label_values)
+end
+
+-- Queue setting a value of a gauge. Increments queued before are discarded,
+-- and increments queued after are added to the value.
+--
+-- Args:
+--   metric: a gauge object.
+--   value: numeric value.
+--   label_values: a list of label values, in the same order as label keys.
+function Batch:set(metric, value, label_values)
+  if type(value) ~= "number" then
+    self.prometheus:log_error("No value passed for ", type(metric) == "table"
+      and metric.name or tostring(metric))
+    return
+  end
+  local entry = batch_entry(self, metric, label_values, true)
+  if entry then
+    entry.set = value
+    entry.delta = 0
+  end
+end
+
+-- Apply all queued updates, and empty the batch.
+--
+-- Each series is updated once, with all updates queued for it combined.
+-- Counters are incremented in the per-worker counter as usual, so they are
+-- only written to the shared dictionary during the next sync.
+--
+-- Returns:
+--   (number) number of writes made to the shared dictionary.
+function Batch:commit()
+  local writes = 0
+  for _, entry in ipairs(self.order) do
+    local m = entry.metric
+    if entry.set then
+      m:set(entry.set + entry.delta, entry.label_values)
+    else
+      m:inc(entry.delta, entry.label_values)
+    end
+    -- Queued and throttled gauge updates are written by timers.
+    if m.typ == TYPE_GAUGE and not (m._async or m._pending or
+        m.collect_fn) then
+      writes = writes + 1
+    end
+  end
+  self.entries = {}
+  self.order = {}
+  return writes
+end
+
+-- Create a batch of counter and gauge updates.
+--
+-- Updates are queued with inc(), dec() and set() methods of the batch, taking
+-- a metric as the first argument, and applied by commit().
+--
+-- Returns:
+--   a Batch object.
+function Prometheus:batch()
+  return setmetatable({prometheus = self, entries = {}, order = {}}, Batch)
+end
+
+-- Check whether a key belongs to a series that should not be returned
+-- because it has not been updated for longer than its `ttl_output`.
+--
+-- Args:
+--   self: a Prometheus object.
+--   key: (string) full metric name.
+--   t: current time.
+--   cache: table of already checked series.
+--
+-- Returns:
+--   (bool) whether the key should not be returned.
+local function is_stale(self, key, t, cache)
+  local m, series = series_of_key(self.registry, key)
+  if not (m and m.ttl_output) then
+    return false
+  end
+  if cache[series] == nil then
+    local updated = self.dict:get(UPDATED_PREFIX .. series)
+    cache[series] = updated ~= nil and t - updated > m.ttl_output
+  end
+  return cache[series]
+end
+
+-- Apply updates accumulated in this worker to the shared dictionary.
+--
+-- Args:
+--   self: a Prometheus object.
+local function flush_local_state(self)
+  self._counter:sync()
+  for _, m in ipairs(self._own_counters) do
+    if m._aggregated and m._counter then
+      sync_aggregated(false, m)
+    elseif m._counter then
+      m._counter:sync()
+    end
+  end
+  if self._queue then
+    flush_queue(false, self)
+  end
+  for _, m in ipairs(self._throttled) do
+    flush_throttled(false, m)
+  end
+  if self.timestamps then
+    record_touched(self)
+  end
+end
+
+-- Read bins of all sketches (of summaries and native histograms) from the
+-- shared dictionary.
+--
+-- Args:
+--   self: a Prometheus object.
+--   keys: (array) all shared dictionary keys of metrics.
+--
+-- Returns:
+--   (array) keys that don't belong to sketches.
+--   (table) counts of values in sketch bins, keyed by series and then bin
+--     name (see sketch_bin and native_bin).
+local function read_sketches(self, keys)
+  local other_keys = {}
+  local sketches = {}
+  for _, key in ipairs(keys) do
+    local bin, series = parse_sketch_key(key)
+    if bin then
+      local value, err = self.dict:get(key)
+      if value then
+        sketches[series] = sketches[series] or {}
+        sketches[series][bin] = value
+      elseif type(err) == "string" then
+        self:log_error("Error getting '", key, "': ", err)
+      end
+    else
+      table.insert(other_keys, key)
+    end
+  end
+  return other_keys, sketches
+end
+
+-- Call a function for each quantile of a summary, if a key is the _count
+-- metric of a summary series.
+--
+-- Quantiles are not stored in the shared dictionary, so they are estimated
+-- from a sketch and returned right before the _count metric, which is the
+-- first key of a summary series in sorted order.
+--
+-- Args:
+--   self: a Prometheus object.
+--   short_name: (string) short metric name of the key.
+--   key: (string) full metric name.
+--   sketches: (table) sketch bins, as returned by read_sketches.
+--   fn: function called with short metric name, full metric name and value
+--     of each quantile.
+local function each_quantile(self, short_name, key, sketches, fn)
+  if short_name:sub(-6) ~= "_count" then
+    return
+  end
+  local m = self.registry[short_name:sub(1, -7)]
+  if not m or m.typ ~= TYPE_SUMMARY then
+    return
+  end
+  local labels = key:sub(#short_name + 1)
+  local estimates = sketch_quantiles(m, sketches[m.name .. labels] or {})
+  local quantile_prefix = labels == "" and m.name .. "{" or
+    m.name .. labels:sub(1, -2) .. ","
+  for i, q in ipairs(m.quantiles) do
+    fn(m.name, string.format('%squantile="%s"}', quantile_prefix, q),
+      estimates[i])
+  end
+end
+
+-- Build a set of metric families requested by a client.
+--
+-- Families can be requested by their names or by name prefixes, both
+-- including the prefix of all metric names passed to init(). Requested names
+-- and prefixes that don't match any metric family are ignored.
+--
+-- Args:
+--   self: a Prometheus object.
+--   prefixes: a string or an array of strings with requested name prefixes,
+--     or nil.
+--   names: a string or an array of strings with requested names, or nil.
+--   quiet: (bool) whether requested names that don't match any family should
+--     be ignored without logging a warning.
+--
+-- Returns:
+--   (table) a set of metric family names (without the prefix of all metric
+--     names), or nil if all families should be returned.
+local function family_filter(self, prefixes, names, quiet)
+  local requested = {}
+  for is_prefix, values in pairs({[true] = prefixes, [false] = names}) do
+    if type(values) ~= "table" then
+      values = {values}
+    end
+    for _, value in ipairs(values) do
+      -- Parameters passed without a value are true rather than strings.
+      if type(value) == "string" and value ~= "" then
+        table.insert(requested, {value, is_prefix})
+      end
+    end
+  end
+  if #requested == 0 then
+    return nil
+  end
+
+  local known = {DICT_BYTES_METRIC_NAME, DICT_KEYS_METRIC_NAME,
+    UP_METRIC_NAME, BUILD_INFO_METRIC_NAME}
+  for name in pairs(self.registry) do
+    table.insert(known, name)
+  end
+  for _, name in ipairs(self._families:list()) do
+    table.insert(known, name)
+  end
+  local filter
+  for _, pair in ipairs(requested) do
+    local value, is_prefix = pair[1], pair[2]
+    local found = false
+    for _, name in ipairs(known) do
+      local exposed = self.prefix .. name
+      if exposed == value or
+          (is_prefix and exposed:sub(1, #value) == value) then
+        filter = filter or {}
+        filter[name] = true
+        found = true
+      end
+    end
+    if not found and not quiet then
+      ngx.log(ngx.WARN, "Ignoring unknown metric ",
+        is_prefix and "prefix '" or "name '", value, "'")
+    end
+  end
+  return filter
+end
+
+-- Check whether a key needs to be read to return requested metric families.
+--
+-- Args:
+--   self: a Prometheus object.
+--   families: a set of metric family names (see family_filter).
+--   key: (string) full metric name.
+--
+-- Returns:
+--   (bool) whether the key belongs to a requested family, to a counter that
+--     a requested ratio is computed from, or to a histogram that requested
+--     quantiles are estimated from.
+local function family_wanted(self, families, key)
+  local m = series_of_key(self.registry, key)
+  if not m then
+    return families[short_metric_name(key)] or false
+  end
+  if families[m.name] then
+    return true
+  end
+  for _, ratio in ipairs(m.ratios or {}) do
+    if families[ratio.name] then
+      return true
+    end
+  end
+  -- Quantiles are only estimated from buckets.
+  return m.quantile_gauge and families[m.quantile_gauge.name] and
+    key:sub(#m.name + 1, #m.name + 8) == "_bucket{" or false
+end
+
+-- Iterate over all stored metric values in the order they should be exposed.
+--
+-- Args:
+--   self: a Prometheus object.
+--   fn: function that will be called for each metric value with the following
+--     arguments: short metric name (see short_metric_name), full metric name,
+--     and the value.
+--   families: a set of metric family names (see family_filter). Values of
+--     other families are skipped without reading them, unless a requested
+--     ratio is computed from them. Optional, all values are iterated over by
+--     default.
+--
+-- Returns:
+--   (table) sketch bins read before any of the values (see read_sketches), or
+--     nil if there are no summaries or native histograms.
+local function each_metric_value(self, fn, families)
+  -- Force a manual sync of counter local state (mostly to make tests work).
+  flush_local_state(self)
+
+  local keys = self.key_index:list()
+  local sketches
+  if self._summaries or self._native then
+    keys, sketches = read_sketches(self, keys)
+  end
+  -- Prometheus server expects buckets of a histogram to appear in increasing
+  -- numerical order of their label values.
+  if self.emit_groups then
+    -- Keys of metrics in the same group go together, with metrics that don't
+    -- belong to any group first. Since all keys of a metric family belong to
+    -- the same group, families stay contiguous.
+    local groups = {}
+    for _, key in ipairs(keys) do
+      groups[key] = group_of_key(self.registry, key)
+    end
+    table.sort(keys, function(a, b)
+      if groups[a] ~= groups[b] then
+        return groups[a] < groups[b]
+      end
+      return a < b
+    end)
+  else
+    table.sort(keys)
+  end
+
+  local t = self._ttl_output and now()
+  local stale = {}
+  for _, key in ipairs(keys) do
+    local value, err
+    if not families or family_wanted(self, families, key) then
+      value, err = self.dict:get(key)
+    end
+    if value then
+      local short_name = short_metric_name(key)
+      -- Zero series of counters with `skip_zero` option don't change sums of
+      -- ratios either, so they are skipped altogether.
+      local skipped = self._skip_zero and value == 0 and
+        (self.registry[short_name] or {}).skip_zero
+      if not skipped and
+          not (self._ttl_output and is_stale(self, key, t, stale)) then
+        if sketches then
+          each_quantile(self, short_name, key, sketches, fn)
+        end
+        fn(short_name, key, value)
+      end
+    else
+      if type(err) == "string" then
+        self:log_error("Error getting '", key, "': ", err)
+      end
+    end
+  end
+  return sketches
+end
+
+-- Format the time a series was last updated as a sample timestamp.
+--
+-- All keys of a series (e.g. buckets of a histogram) share the same update
+-- time, which is recorded with `sync_interval` precision (see
+-- record_updates).
+--
+-- Args:
+--   self: a Prometheus object.
+--   key: (string) full metric name.
+--   openmetrics: (boolean) whether OpenMetrics format is used, which has
+--     timestamps in seconds rather than in milliseconds.
+--   cache: table of already formatted timestamps, keyed by series.
+--
+-- Returns:
+--   (string) the timestamp preceded by a space, or an empty string if the
+--     update time is not known.
+local function sample_timestamp(self, key, openmetrics, cache)
+  local m, series = series_of_key(self.registry, key)
+  if not m then
+    return ""
+  end
+  if m.typ == TYPE_SUMMARY then
+    -- Quantiles are not stored, and their label goes last like "le".
+    series = series:gsub('{quantile="[^"]*"}$', "")
+      :gsub(',quantile="[^"]*"}$', "}")
+  end
+  local timestamp = cache[series]
+  if timestamp == nil then
+    local updated = self.dict:get(UPDATED_PREFIX .. series)
+    if not updated then
+      timestamp = ""
+    elseif openmetrics then
+      timestamp = string.format(" %.3f", updated)
+    else
+      timestamp = string.format(" %d", math.floor(updated * 1000))
+    end
+    cache[series] = timestamp
+  end
+  return timestamp
+end
+
+-- Scale up a value of a histogram with `sample_rate` option, estimating the
+-- value that would have been recorded without sampling.
+--
+-- Args:
+--   self: a Prometheus object.
+--   key: (string) full metric name.
+--   value: (number) value stored in the shared dictionary.
+--
+-- Returns:
+--   (number) the estimated value.
+local function sampled_value(self, key, value)
+  local m = series_of_key(self.registry, key)
+  if m and m.sample_scale then
+    return value * m.sample_scale
+  end
+  return value
+end
+
+-- Build a set of histogram buckets requested by a client.
+--
+-- Requested values that are not bucket boundaries of any registered histogram
+-- are ignored.
+--
+-- Args:
+--   self: a Prometheus object.
+--   requested: a string or an array of strings with requested bucket
+--     boundaries, or nil.
+--
+-- Returns:
+--   (table) a set of bucket boundaries (numbers), or nil if all buckets should
+--     be returned.
+local function bucket_filter(self, requested)
+  if requested == nil then
+    return nil
+  end
+  if type(requested) ~= "table" then
+    requested = {requested}
+  end
+  local known = {}
+  for _, m in pairs(self.registry) do
+    if m.typ == TYPE_HISTOGRAM then
+      for _, bucket in ipairs(m.buckets) do
+        known[bucket] = true
+      end
+    end
+  end
+  local filter = {}
+  for _, value in ipairs(requested) do
+    local bucket = tonumber(value)
+    if bucket and known[bucket] then
+      filter[bucket] = true
+    elseif value ~= "+Inf" then
+      ngx.log(ngx.WARN, "Ignoring unknown histogram bucket '",
+        tostring(value), "'")
+    end
+  end
+  return filter
+end
+
+-- Full metric name of a sample as it is exposed.
+--
+-- Args:
+--   self: a Prometheus object.
+--   short_name: (string) short metric name of a sample.
+--   key: (string) full metric name, as stored in the dictionary.
+--
+-- Returns:
+--   (string) full metric name with formatted bucket boundaries, constant
+--     labels and alias names (see Prometheus:alias), without the prefix
+--     passed to init().
+--   (number) bucket boundary of a histogram bucket, or nil.
+local function exposed_sample_key(self, short_name, key)
+  local m = self.registry[short_name]
+  local exposed_key, bucket
+  if m and m.typ == TYPE_HISTOGRAM then
+    exposed_key, bucket = expose_bucket_key(m, key)
+  else
+    exposed_key = fix_histogram_bucket_labels(key)
+  end
+  local const_labels = added_labels(self, short_name)
+  if const_labels then
+    exposed_key = add_labels(exposed_key, const_labels)
+  end
+  local alias = self._aliases[short_name]
+  if alias then
+    local name, label_pairs = parse_full_metric_name(exposed_key)
+    local label_names, label_values = {}, {}
+    for _, pair in ipairs(label_pairs) do
+      local label_name = alias.labels[pair[1]]
+      if label_name == nil then
+        label_name = pair[1]
+      end
+      if label_name then
+        table.insert(label_names, label_name)
+        table.insert(label_values, pair[2])
+      end
+    end
+    exposed_key = full_metric_name(alias.name .. name:sub(#alias.source + 1),
+      label_names, label_values)
+  end
+  return exposed_key, bucket
+end
+
+-- Iterate over all exposed samples in the order they should be exposed.
+--
+-- Stored metric values go first (see each_metric_value), followed by
+-- samples that are not stored in the dictionary: ratios, histogram quantiles,
+-- bucket boundaries and gauges with `collect_fn`.
+--
+-- Args:
+--   self: a Prometheus object.
+--   fn: function that will be called for each sample with the following
+--     arguments: short name of the metric family the sample belongs to (the
+--     short metric name for stored values), the metric object describing the
+--     family (nil for stored values of _count and _sum metrics), full metric
+--     name as it is exposed (see exposed_sample_key), the value, and, for
+--     stored values only, full metric name as it is stored and the bucket
+--     boundary of a histogram bucket.
+--   families: a set of metric family names (see family_filter). Optional, all
+--     samples are iterated over by default.
+--
+-- Returns:
+--   (table) sketch bins, as returned by each_metric_value.
+local function each_sample(self, fn, families)
+  local ratio_sums = {}
+  local quantile_counts = {}
+  local sketches = each_metric_value(self, function(short_name, key, value)
+    local m = self.registry[short_name]
+    if m and (m.ratios or m.quantile_gauge) then
+      if m.ratios then
+        add_ratio_source(ratio_sums, m, key, value)
+      else
+        add_quantile_source(quantile_counts, m, key, value)
+      end
+      -- Metrics only read to compute requested ratios or quantiles.
+      if families and not families[m.name] then
+        return
+      end
+    end
+    if self._sampled then
+      value = sampled_value(self, key, value)
+    end
+    local exposed_key, bucket = exposed_sample_key(self, short_name, key)
+    fn(short_name, m, exposed_key, value, key, bucket)
+  end, families)
+
+  for _, ratio in ipairs(self._ratios) do
+    local sums = (not families or families[ratio.name]) and
+      ratio_sums[ratio] or {}
+    local keys = {}
+    for key, sum in pairs(sums) do
+      if sum[2] ~= 0 then
+        table.insert(keys, key)
+      end
+    end
+    table.sort(keys)
+    for _, key in ipairs(keys) do
+      local exposed_key = key
+      if ratio.const_labels then
+        exposed_key = add_labels(key, ratio.const_labels)
+      end
+      fn(ratio.name, ratio, exposed_key, sums[key][1] / sums[key][2])
+    end
+  end
+  for _, gauge in ipairs(self._quantile_gauges) do
+    if not families or families[gauge.name] then
+      for _, sample in ipairs(quantile_gauge_values(self, gauge,
+          quantile_counts)) do
+        fn(gauge.name, gauge, sample[1], sample[2])
+      end
+    end
+  end
+  for _, bounds in ipairs(self._bucket_bounds) do
+    if not families or families[bounds.name] then
+      for _, key in ipairs(bounds.keys) do
+        fn(bounds.name, bounds, key, 1)
+      end
+    end
+  end
+  for _, m in ipairs(self._collected) do
+    if not families or families[m.name] then
+      for _, sample in ipairs(collected_gauge_values(self, m)) do
+        fn(m.name, m, sample[1], sample[2])
+      end
+    end
+  end
+  return sketches
+end
+
+-- Write Prometheus compatible metric data.
+--
+-- With `scrape_metrics` option, the number of written samples is remembered to
+-- be exposed by the next collection (see record_scrape).
+--
+-- Args:
+--   self: a Prometheus object.
+--   buckets: a set of histogram bucket boundaries (numbers) that should be
+--     returned. The +Inf bucket, as well as _count and _sum metrics, are always
+--     returned. Optional, all buckets are returned by default.
+--   openmetrics: (boolean) use OpenMetrics text format instead of the classic
+--     Prometheus one. The terminating `# EOF` line is not included.
+--   write: function called with each string of metric data, in order.
+--   families: a set of metric family names that should be returned (see
+--     family_filter). Optional, all families are returned by default.
+--   protobuf: (boolean) the data is converted to protobuf (see
+--     protobuf_data), which parses values back as numbers, so they are not
+--     formatted for text output (see format_value).
+--   no_timestamps: (boolean) leave out sample timestamps even with
+--     `timestamps` option of init(). Optional.
+--
+-- Returns:
+--   (table) sketch bins, as returned by each_metric_value.
+local function write_metric_data(self, buckets, openmetrics, write, families,
+                                 protobuf, no_timestamps)
+  local format = protobuf and function(_, value) return value end or
+    format_value
+  local samples = 0
+  if self._scrape_metrics then
+    local write_data = write
+    write = function(str)
+      -- Comments are written separately from samples (and start with "#").
+      if str:byte(1) ~= 35 then
+        samples = samples + 1
+      end
+      write_data(str)
+    end
+  end
+  local seen_metrics = {}
+  local group = ""
+  local timestamps = self.timestamps and not no_timestamps and {}
+  local sketches = each_sample(self, function(short_name, m, exposed_key,
+                                              value, key, bucket)
+    -- Exemplars are only supported by OpenMetrics.
+    local exemplar = openmetrics and key and m and m.exemplars and
+      m.exemplars[key]
+    -- OpenMetrics does not allow arbitrary comments.
+    if key and self.emit_groups and not openmetrics then
+      local key_group = group_of_key(self.registry, key)
+      if key_group ~= group then
+        write(string.format("# --- %s ---\n", key_group))
+        group = key_group
+      end
+    end
+    -- Comments of aliased metrics use the alias name.
+    local header = m and (key and self._aliases[short_name] or m)
+    if not seen_metrics[short_name] then
+      if header and openmetrics and header.openmetrics_header then
+        write(header.openmetrics_header)
+      elseif header then
+        if header.help_line then
+          write(header.help_line)
+        end
+        write(header.type_line)
+      end
+      seen_metrics[short_name] = true
+    end
+    -- Buckets are cumulative, so any subset of them is still consistent.
+    if buckets and bucket and not buckets[bucket] then
+      return
+    end
+    if key and self._inf_bucket_label and bucket == nil and not protobuf then
+      exposed_key = exposed_key:gsub('le="%+Inf"', self._inf_bucket_label, 1)
+    end
+    local timestamp = timestamps and key and
+      sample_timestamp(self, key, openmetrics, timestamps) or ""
+    if openmetrics and header and header.openmetrics_total then
+      exposed_key = header.name .. "_total" ..
+        exposed_key:sub(#header.name + 1)
+    end
+    write(string.format("%s%s %s%s%s\n", self.prefix, exposed_key,
+      format(self, value), timestamp,
+      exemplar and " # " .. exemplar or ""))
+  end, families)
+  -- Exposed by the next collection (see record_scrape).
+  self._scrape_samples = samples
+  return sketches
+end
+
+-- List registered metric families.
+--
+-- Families registered by other workers (for example, registered dynamically
+-- while handling requests) are included as well, since register() records
+-- all families in the shared dictionary (see record_family).
+--
+-- Returns:
+--   Array of tables with `name` (including the prefix), `type` and `help`
+--   (nil for metrics without help text) of each metric family, sorted by
+--   name.
+function Prometheus:metric_names()
+  local families = {}
+  for name, m in pairs(self.registry) do
+    families[name] = {name = self.prefix .. name, type = TYPE_LITERAL[m.typ],
+      help = m.help}
+  end
+  for _, name in ipairs(self._families:list()) do
+    if not families[name] then
+      local descriptor = self.dict:get(FAMILY_PREFIX .. name)
+      if descriptor then
+        local typ, separator, help = descriptor:match("^(%S+)( ?)(.*)$")
+        families[name] = {name = self.prefix .. name, type = typ,
+          help = separator == " " and help or nil}
+      end
+    end
+  end
+  local result = {}
+  for _, family in pairs(families) do
+    table.insert(result, family)
+  end
+  table.sort(result, function(a, b) return a.name < b.name end)
+  return result
+end
+
+-- Prometheus compatible metric data as an array of strings.
+--
+-- Args:
+--   buckets: a set of histogram bucket boundaries (numbers) that should be
+--     returned. The +Inf bucket, as well as _count and _sum metrics, are always
+--     returned. Optional, all buckets are returned by default.
+--   openmetrics: (boolean) use OpenMetrics text format instead of the classic
+--     Prometheus one. The terminating `# EOF` line is not included.
+--   families: a set of names of metric families (without the prefix passed
+--     to init()) that should be returned. Optional, all metric families are
+--     returned by default.
+--
+-- Returns:
+--   Array of strings with all metrics in a text format compatible with
+--   Prometheus.
+function Prometheus:metric_data(buckets, openmetrics, families)
+  if not self.initialized then
+    ngx.log(ngx.ERR, "Prometheus module has not been initialized")
+    return
+  end
+
+  local output = {}
+  write_metric_data(self, buckets, openmetrics, function(str)
+    table.insert(output, str)
+  end, families)
+  return output
+end
+
+-- Metric data as a Lua table.
+--
+-- This returns the same metrics as metric_data() without formatting them, for
+-- callers that serialize, transform or merge them on their own. Sample
+-- timestamps and exemplars are not included.
+--
+-- Returns:
+--   Array of metric families in the same order as metric_data() returns them.
+--   Each family is a table with `name` (including the prefix), `help` (nil for
+--   metrics without help text), `type` and `samples` fields. Samples are
+--   tables with `name` (e.g. with `_bucket` suffix for histogram buckets),
+--   `labels` (a table of label values keyed by label name) and `value`.
+function Prometheus:collect_table()
+  if not self.initialized then
+    ngx.log(ngx.ERR, "Prometheus module has not been initialized")
+    return
+  end
+
+  local result = {}
+  local family
+  local function add_sample(name, m, key, value)
+    if not family or family.short_name ~= name then
+      local alias = self._aliases[name]
+      family = {short_name = name,
+                name = self.prefix .. (alias and alias.name or name),
+                help = m and m.help, type = m and TYPE_LITERAL[m.typ] or
+                "untyped", samples = {}}
+      table.insert(result, family)
+    end
+    local sample_name, label_pairs = parse_full_metric_name(key)
+    local labels = {}
+    for _, pair in ipairs(label_pairs) do
+      labels[pair[1]] = pair[2]
+    end
+    table.insert(family.samples, {name = self.prefix .. sample_name,
+      labels = labels, value = value})
+  end
+
+  each_sample(self, function(short_name, m, exposed_key, value, key)
+    local name = short_name
+    if key and not m then
+      -- _count and _sum of histograms and summaries.
+      local base = short_name:match("^(.+)_count$") or
+        short_name:match("^(.+)_sum$")
+      local parent = base and self.registry[base]
+      if parent and (parent.typ == TYPE_HISTOGRAM or
+          parent.typ == TYPE_SUMMARY) then
+        name, m = base, parent
+      end
+    end
+    add_sample(name, m, exposed_key, value)
+  end)
+  for _, f in ipairs(result) do
+    f.short_name = nil
+  end
+  return result
+end
+
+-- Metric data in Graphite plaintext format as an array of strings.
+--
+-- Each metric value is presented as a `path value timestamp` line, with the
+-- path built from metric name and labels (see graphite_path).
+--
+-- Args:
+--   families: a set of names of metric families (without the prefix passed
+--     to init()) that should be returned. Optional, all metric families are
+--     returned by default.
+--
+-- Returns:
+--   Array of strings with all metrics in Graphite plaintext format.
+function Prometheus:graphite_data(families)
+  if not self.initialized then
+    ngx.log(ngx.ERR, "Prometheus module has not been initialized")
+    return
+  end
+
+  local timestamp = ngx.time()
+  local output = {}
+  each_metric_value(self, function(short_name, key, value)
+    -- Counters that requested ratios are computed from are iterated over
+    -- too, but not returned.
+    if families and not families[(series_of_key(self.registry, key) or
+        {name = short_name}).name] then
+      return
+    end
+    if self._sampled then
+      value = sampled_value(self, key, value)
+    end
+    key = exposed_sample_key(self, short_name, key)
+    local name, labels = parse_full_metric_name(key)
+    table.insert(output, string.format("%s %s %d\n",
+      graphite_path(self.graphite_template, self.prefix .. name, labels),
+      value, timestamp))
+  end, families)
+  return output
+end
+
+-- Metric types accepted in TYPE comments of the text exposition format.
+local EXPOSITION_TYPES = {counter = true, gauge = true, histogram = true,
+                          summary = true, untyped = true}
+
+-- Check whether a sample value is valid in the text exposition format.
+local function valid_sample_value(value)
+  local lower = value:lower()
+  if lower == "nan" or lower == "inf" or lower == "+inf" or lower == "-inf" then
+    return true
+  end
+  return value:find("^[+-]?%d*%.?%d*[eE]?[+-]?%d*$") ~= nil and
+    tonumber(value) ~= nil
+end
+
+-- Check that labels of a sample are correctly formatted and escaped.
+--
+-- Args:
+--   labels: (string) labels of a sample including curly braces, or an empty
+--     string.
+--
+-- Returns:
+--   (bool) whether labels are valid.
+local function valid_sample_labels(labels)
+  if labels == "" then
+    return true
+  end
+  local pos = 2
+  while true do
+    local value_start = labels:match('^[a-zA-Z_][a-zA-Z0-9_]*="()', pos)
+    if not value_start then
+      return false
+    end
+    pos = value_start
+    while true do
+      local c = labels:sub(pos, pos)
+      if c == "" or c == "\n" then
+        return false
+      elseif c == "\\" then
+        local escaped = labels:sub(pos + 1, pos + 1)
+        if escaped ~= "\\" and escaped ~= '"' and escaped ~= "n" then
+          return false
+        end
+        pos = pos + 2
+      elseif c == '"' then
+        pos = pos + 1
+        break
+      else
+        pos = pos + 1
+      end
+    end
+    local c = labels:sub(pos, pos)
+    if c == "}" then
+      return pos == #labels
+    elseif c ~= "," then
+      return false
+    end
+    pos = pos + 1
+  end
+end
+
+-- Split a sample line of the text exposition format.
+--
+-- Args:
+--   line: (string) a line that is not a comment.
+--
+-- Returns:
+--   (string) metric name, (string) labels including curly braces or an empty
+--     string, (string) value and (string) timestamp or nil. Nothing is
+--     returned if the line is malformed.
+local function parse_sample(line)
+  -- Samples might have a timestamp after the value. Since label values can
+  -- contain spaces, labels are only trusted if they are valid.
+  local name, labels, value, timestamp = line:match(
+    "^([a-zA-Z_:][a-zA-Z0-9_:]*)(.-) ([^ ]+) ([^ ]+)$")
+  if name and tonumber(timestamp) and valid_sample_labels(labels) then
+    return name, labels, value, timestamp
+  end
+  return line:match("^([a-zA-Z_:][a-zA-Z0-9_:]*)(.-) ([^ ]+)$")
+end
+
+-- Validate metric data in the text exposition format.
+--
+-- This checks label escaping, format of sample values, that samples of each
+-- metric family are not interleaved with other families, and that each family
+-- has at most one HELP and TYPE comment, which precede its samples.
+--
+-- Args:
+--   output: array of strings, as returned by Prometheus:metric_data().
+--
+-- Returns:
+--   (string) an error message, or nil if the output is valid.
+--   (string) the offending line.
+local function verify_exposition(output)
+  local types = {}
+  local headers = {}
+  local finished = {}
+  local current
+  for _, str in ipairs(output) do
+    for line in str:gmatch("([^\n]*)\n") do
+      local kind, family, rest = line:match("^# (%u+) ([^ ]+) ?(.*)$")
+      if kind == "HELP" or kind == "TYPE" then
+        if finished[family] or family == current then
+          return kind .. " comment after samples", line
+        end
+        if headers[kind .. family] then
+          return "duplicate " .. kind .. " comment", line
+        end
+        headers[kind .. family] = true
+        if kind == "TYPE" then
+          if not EXPOSITION_TYPES[rest] then
+            return "unknown metric type", line
+          end
+          types[family] = rest
+        end
+      elseif line:sub(1, 1) ~= "#" then
+        -- Exemplars in OpenMetrics format follow the sample after " # ".
+        local sample, exemplar = line:match("^(.*) # ({.*)$")
+        if sample then
+          local exemplar_labels, exemplar_value = exemplar:match(
+            "^({.*}) ([^ ]+)")
+          if not (exemplar_labels and valid_sample_labels(exemplar_labels) and
+              valid_sample_value(exemplar_value)) then
+            return "malformed exemplar", line
+          end
+          line = sample
+        end
+        local name, labels, value = parse_sample(line)
+        if not name then
+          return "malformed sample", line
+        end
+        if not valid_sample_labels(labels) then
+          return "malformed labels", line
+        end
+        if not valid_sample_value(value) then
+          return "malformed value", line
+        end
+        local base = name:match("^(.*)_bucket$") or name:match("^(.*)_count$")
+          or name:match("^(.*)_sum$")
+        if base and (types[base] == "histogram" or types[base] == "summary") then
+          name = base
+        end
+        if name ~= current then
+          if finished[name] then
+            return "samples of a metric family are not contiguous", line
+          end
+          if current then
+            finished[current] = true
+          end
+          current = name
+        end
+      end
+    end
+  end
+end
+
+-- Content type of the OpenMetrics text format.
+local OPENMETRICS_CONTENT_TYPE =
+  "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+-- Content type of the protobuf format, with length-delimited MetricFamily
+-- messages.
+local PROTOBUF_CONTENT_TYPE = "application/vnd.google.protobuf; " ..
+  "proto=io.prometheus.client.MetricFamily; encoding=delimited"
+
+-- Pick the exposition format preferred by a client.
+--
+-- Args:
+--   accept: (string) value of the Accept request header, or nil.
+--   protobuf: (bool) whether the protobuf format can be used.
+--
+-- Returns:
+--   (string) "protobuf" or "openmetrics" if the client gives it at least the
+--     quality value of text/plain, and "text" otherwise.
+local function preferred_format(accept, protobuf)
+  if not accept then
+    return "text"
+  end
+  local protobuf_q, openmetrics_q, text_q = 0, 0, 0
+  for range in accept:gmatch("[^,]+") do
+    local media = (range:match("^%s*([^;%s]+)") or ""):lower()
+    local q = tonumber(range:match(";%s*q=([%d.]+)") or 1)
+    if media == "application/vnd.google.protobuf" then
+      local params = range:lower()
+      if protobuf and
+          params:find("proto=io.prometheus.client.metricfamily", 1, true) and
+          params:find("encoding=delimited", 1, true) then
+        protobuf_q = math.max(protobuf_q, q)
+      end
+    elseif media == "application/openmetrics-text" then
+      openmetrics_q = math.max(openmetrics_q, q)
+    elseif media == "text/plain" or media == "text/*" or media == "*/*" then
+      text_q = math.max(text_q, q)
+    end
+  end
+  if protobuf_q > 0 and protobuf_q >= openmetrics_q and protobuf_q >= text_q then
+    return "protobuf"
+  elseif openmetrics_q > 0 and openmetrics_q >= text_q then
+    return "openmetrics"
+  end
+  return "text"
+end
 
-  _, err, _ = self._dict:incr(k, value, 0)
-  if err then
-    self._log_error_kv(k, value, err)
+-- Compression level and window bits (selecting the gzip format) used to
+-- compress responses with `gzip` option of init().
+local GZIP_LEVEL = 6
+local GZIP_WINDOW_BITS = 31
+
+-- Check whether the client accepts gzip-compressed responses.
+--
+-- Args:
+--   accept_encoding: (string) value of the Accept-Encoding request header, or
+--     nil.
+--
+-- Returns:
+--   (bool) whether gzip is listed with a non-zero quality value.
+local function accepts_gzip(accept_encoding)
+  if not accept_encoding then
+    return false
+  end
+  for coding in accept_encoding:gmatch("[^,]+") do
+    local name = (coding:match("^%s*([^;%s]+)") or ""):lower()
+    if name == "gzip" or name == "x-gzip" then
+      local q = tonumber(coding:match(";%s*q=([%d.]+)") or 1)
+      return q ~= nil and q > 0
+    end
   end
+  return false
 end
 
-local ERR_MSG_COUNTER_NOT_INITIALIZED = "counter not initialized! " ..
-  "Have you called Prometheus:init() from the " ..
-  "init_worker_by_lua_block nginx phase?"
+-- Convert metric data in the text exposition format to the protobuf one.
+--
+-- Histograms with `native_schema` option have their native buckets exposed
+-- alongside the classic ones.
+--
+-- Args:
+--   self: a Prometheus object.
+--   output: array of strings in the text format (not OpenMetrics).
+--   sketches: (table) sketch bins, as returned by write_metric_data.
+--
+-- Returns:
+--   (array) length-delimited MetricFamily messages.
+local function protobuf_data(self, output, sketches)
+  return protobuf_lib.encode(output, parse_sample, parse_full_metric_name,
+    function(family_name, series)
+      local m = self.registry[family_name:sub(#self.prefix + 1)]
+      if m and m.native_schema then
+        return {schema = m.native_schema,
+                zero_threshold = m.native_zero_threshold,
+                bins = sketches and sketches[m.name .. series]}
+      end
+    end)
+end
 
--- Increment a counter metric.
+-- Create a function sending strings to the client in chunks.
 --
--- Counters are incremented in the per-worker counter, which will eventually get
--- flushed into the global shared dictionary.
+-- Strings are buffered until their total size reaches `chunk_size` bytes, and
+-- then passed to ngx.print together, so that the whole response never needs
+-- to be kept in memory.
 --
 -- Args:
---   self: a `metric` object, created by register().
---   value: numeric value to increment by. Can't be negative.
---   label_values: a list of label values, in the same order as label keys.
-local function inc_counter(self, value, label_values)
-  -- counter is not allowed to decrease
-  if value and value < 0 then
-    self._log_error_kv(self.name, value, "Value should not be negative")
-    return
+--   chunk_size: (number) minimum size of each chunk, in bytes.
+--   deflate: a lua-zlib deflate stream compressing the chunks. Optional.
+--
+-- Returns:
+--   a function buffering a given string.
+--   a function sending the remaining buffered strings.
+local function chunked_writer(chunk_size, deflate)
+  local chunk, size = {}, 0
+  local function send(final)
+    if deflate then
+      -- Each chunk is flushed, so that the client gets it right away.
+      local compressed = deflate(table.concat(chunk),
+        final and "finish" or "sync")
+      ngx.print({compressed})
+    else
+      ngx.print(chunk)
+    end
   end
-
-  local k, err
-  k, err = lookup_or_create(self, label_values)
-  if err then
-    self._log_error(err)
-    return
+  local function write(str)
+    chunk[#chunk + 1] = str
+    size = size + #str
+    if size >= chunk_size then
+      send(false)
+      chunk, size = {}, 0
+    end
   end
-
-  local c = self._counter
-  if not c then
-    c = self.parent._counter
-    if not c then
-      self._log_error(ERR_MSG_COUNTER_NOT_INITIALIZED)
-      return
+  local function flush()
+    if size > 0 or deflate then
+      send(true)
     end
-    self._counter = c
   end
-  c:incr(k, value)
+  return write, flush
 end
 
--- Delete a counter or a gauge metric.
+-- Generate metric data that is not affected by a concurrent reset of all
+-- metrics (see Prometheus:reset) or of histogram values (see
+-- reset_histogram).
+--
+-- Data is generated again if a reset was in progress, or has happened while
+-- it was being generated, so that it reflects either the state before the
+-- reset or after it.
 --
 -- Args:
---   self: a `metric` object, created by register().
---   label_values: a list of label values, in the same order as label keys.
-local function del(self, label_values)
-  local k, _, err
-  k, err = lookup_or_create(self, label_values)
-  if err then
-    self._log_error(err)
-    return
-  end
+--   self: a Prometheus object.
+--   generate: function returning generated data.
+--
+-- Returns:
+--   values returned by `generate`.
+local consistent_output
+do
+  -- Number of times metric data is generated again when it races with a
+  -- reset, and the delay before each attempt (seconds).
+  local RESET_RETRIES = 5
+  local RESET_RETRY_DELAY = 0.01
 
-  -- `del` might be called immediately after a configuration change that stops a
-  -- given metric from being used, so we cannot guarantee that other workers
-  -- don't have unflushed counter values for a metric that is about to be
-  -- deleted. We wait for `sync_interval` here to ensure that those values are
-  -- synced (and deleted from worker-local counters) before a given metric is
-  -- removed.
-  -- Gauge metrics don't use per-worker counters, so for gauges we don't need to
-  -- wait for the counter to sync.
-  if self.typ ~= TYPE_GAUGE then
-    ngx.log(ngx.INFO, "waiting ", self.parent.sync_interval, "s for counter to sync")
-    ngx.sleep(self.parent.sync_interval)
+  function consistent_output(self, generate)
+    for _ = 1, RESET_RETRIES do
+      local all = self.dict:get(RESET_GENERATION_KEY) or 0
+      local histograms = self.dict:get(HISTOGRAM_RESET_GENERATION_KEY) or 0
+      if all % 2 == 0 and histograms % 2 == 0 then
+        local output, sketches = generate()
+        if (self.dict:get(RESET_GENERATION_KEY) or 0) == all and
+            (self.dict:get(HISTOGRAM_RESET_GENERATION_KEY) or 0) ==
+              histograms then
+          return output, sketches
+        end
+      end
+      ngx.sleep(RESET_RETRY_DELAY)
+    end
+    self:log_error("Metrics are being reset, returned data might be partial")
+    return generate()
   end
+end
 
-  self._key_index:remove(k)
-  _, err = self._dict:delete(k)
-  if err then
-    self._log_error("Error deleting key: ".. k .. ": " .. err)
+-- Check whether the client of the current request is allowed to get metrics.
+--
+-- Parsed ranges are cached for each allowlist table, so invalid ranges are
+-- only logged (and counted in the error metric) once per worker.
+--
+-- Args:
+--   self: a Prometheus object.
+--   allow: array of CIDR ranges (strings).
+--
+-- Returns:
+--   (bool) whether the client address belongs to any of the ranges.
+local function client_allowed(self, allow)
+  local ranges = self._allowlists[allow]
+  if not ranges then
+    ranges = {}
+    for _, cidr in ipairs(allow) do
+      local range = cidr_lib.parse(cidr)
+      if range then
+        table.insert(ranges, range)
+      else
+        self:log_error("Invalid CIDR range '", tostring(cidr),
+          "' in the allowlist")
+      end
+    end
+    self._allowlists[allow] = ranges
   end
+  return cidr_lib.contains(ranges, ngx.var.remote_addr or "")
 end
 
--- Set the value of a gauge metric.
+-- Record duration and number of samples of a collection of metrics, which
+-- are exposed by the next one, since a collection can't measure its own
+-- output. Samples of `dict_metrics`, `build_info` and `up_metric` gauges are
+-- not counted.
 --
 -- Args:
---   self: a `metric` object, created by register().
---   value: numeric value.
---   label_values: a list of label values, in the same order as label keys.
-local function set(self, value, label_values)
-  if not value then
-    self._log_error("No value passed for " .. self.name)
+--   self: a Prometheus object with `scrape_metrics` option.
+--   started: (number) time when the collection started, as returned by
+--     ngx.now().
+local function record_scrape(self, started)
+  ngx.update_time()
+  self._scrape_metrics.duration:set(ngx.now() - started)
+  self._scrape_metrics.series:set(self._scrape_samples or 0)
+end
+
+-- Present all metrics in a text format compatible with Prometheus.
+--
+-- This function should be used to expose the metrics on a separate HTTP page.
+-- It will get the metrics from the dictionary, sort them, and expose them
+-- aling with TYPE and HELP comments. Graphite plaintext format is used instead
+-- if `format=graphite` query parameter is present. If `buckets[]` query
+-- parameters are present, only the listed histogram buckets are returned, and
+-- `prefix` and `name[]` query parameters limit the output to metric families
+-- with given name prefixes or names.
+-- With `dict_metrics` option, gauges describing usage of shared dictionaries
+-- are added, and with `up_metric` option, a gauge reporting whether any errors
+-- occurred while collecting metrics is added at the end. With `scrape_metrics`
+-- option, duration and number of samples of each collection are recorded.
+-- OpenMetrics text format is used for clients that prefer it in the Accept
+-- header, and the protobuf format for clients that prefer it if `protobuf`
+-- option is set or any histograms have `native_schema` option. With `gzip`
+-- option, the response is compressed for clients accepting gzip encoding.
+--
+-- Args:
+--   options: table of options. Optional. Supported options are:
+--     allow: array of CIDR ranges. Clients with addresses outside of them get
+--       a 403 response instead of metrics.
+--     view: (string) name of a view created by register_view(). Only metric
+--       families included in the view are returned.
+function Prometheus:collect(options)
+  -- Rejected clients are not an error of the library, so they are not
+  -- counted in the error metric.
+  if options and options.allow and not client_allowed(self, options.allow) then
+    ngx.exit(ngx.HTTP_FORBIDDEN)
     return
   end
-
-  local k, _, err
-  k, err = lookup_or_create(self, label_values)
-  if err then
-    self._log_error(err)
+  -- Families of the view, which limit the families that can be requested
+  -- with query parameters. An empty set if no family matches the view yet.
+  local visible
+  if options and options.view ~= nil then
+    local view = self._views and self._views[options.view]
+    if not view then
+      self:log_error("Unknown view '", tostring(options.view), "'")
+      ngx.exit(ngx.HTTP_INTERNAL_SERVER_ERROR)
+      return
+    end
+    visible = family_filter(self, view.prefixes, view.include, true) or {}
+  end
+  -- The error metric is always returned, so the response is never empty, but
+  -- a registry without any other metrics is most likely misconfigured.
+  if not self._warned_no_metrics then
+    local found = false
+    for _, m in pairs(self.registry) do
+      if not m.internal then
+        found = true
+        break
+      end
+    end
+    if not found then
+      ngx.log(ngx.WARN, "No metrics have been registered")
+      self._warned_no_metrics = true
+    end
+  end
+  local started
+  if self._scrape_metrics then
+    ngx.update_time()
+    started = ngx.now()
+  end
+  local args = ngx.req.get_uri_args()
+  if args.format == "graphite" then
+    ngx.header.content_type = "text/plain"
+    ngx.print(self:graphite_data(visible))
     return
   end
-  _, err = self._dict:safe_set(k, value)
-  if err then
-    self._log_error_kv(k, value, err)
+  if not self.initialized then
+    ngx.log(ngx.ERR, "Prometheus module has not been initialized")
+    return
+  end
+  -- Native histograms can only be exposed in the protobuf format.
+  local format = preferred_format(ngx.var.http_accept,
+    self.protobuf or self._native)
+  local openmetrics = format == "openmetrics"
+  if format == "protobuf" then
+    ngx.header.content_type = PROTOBUF_CONTENT_TYPE
+  else
+    ngx.header.content_type = openmetrics and OPENMETRICS_CONTENT_TYPE or
+      "text/plain"
   end
-end
 
--- Record a given value in a histogram.
---
--- Args:
---   self: a `metric` object, created by register().
---   value: numeric value to record. Should be defined.
---   label_values: a list of label values, in the same order as label keys.
-local function observe(self, value, label_values)
-  if not value then
-    self._log_error("No value passed for " .. self.name)
-    return
+  local deflate
+  if self.gzip then
+    ngx.header["Vary"] = "Accept-Encoding"
+    if accepts_gzip(ngx.var.http_accept_encoding) then
+      deflate = self._zlib.deflate(GZIP_LEVEL, GZIP_WINDOW_BITS)
+    end
   end
 
-  local keys, err = lookup_or_create(self, label_values)
-  if err then
-    self._log_error(err)
+  local buckets = bucket_filter(self, args["buckets[]"])
+  local families = family_filter(self, args.prefix, args["name[]"])
+  if visible then
+    for name in pairs(families or {}) do
+      families[name] = visible[name]
+    end
+    families = families or visible
+  end
+  local errors_before = self._errors_counted
+  local output, write, flush, sketches
+  -- Output needs to be buffered to be verified or converted to protobuf.
+  if self.stream_chunk_size and not self.verify_output and
+      format ~= "protobuf" then
+    if deflate then
+      ngx.header.content_encoding = "gzip"
+    end
+    write, flush = chunked_writer(self.stream_chunk_size, deflate)
+    write_metric_data(self, buckets, openmetrics, write, families)
+  else
+    output, sketches = consistent_output(self, function()
+      if format ~= "protobuf" then
+        return self:metric_data(buckets, openmetrics, families)
+      end
+      -- Native histogram buckets are not part of the text output.
+      local data = {}
+      local data_sketches = write_metric_data(self, buckets, openmetrics,
+        function(str)
+          table.insert(data, str)
+        end, families, true)
+      return data, data_sketches
+    end)
+  end
+  if output then
+    write = function(str)
+      table.insert(output, str)
+    end
+  end
+  -- Both gauges describing dictionaries are returned if any of them is
+  -- requested.
+  if self.dict_metrics and (not families or
+      families[DICT_BYTES_METRIC_NAME] or families[DICT_KEYS_METRIC_NAME]) then
+    for _, line in ipairs(dict_metric_lines(self)) do
+      write(line)
+    end
+  end
+  if self.build_info and (not families or families[BUILD_INFO_METRIC_NAME]) then
+    for _, line in ipairs(self._build_info_lines) do
+      write(line)
+    end
+  end
+  if self.up_metric and (not families or families[UP_METRIC_NAME]) then
+    -- Not stored in the dictionary, since it describes this very response.
+    local up = self._errors_counted == errors_before and 1 or 0
+    write(string.format(
+      "# HELP %s%s Whether metrics were collected without errors\n",
+      self.prefix, UP_METRIC_NAME))
+    write(string.format("# TYPE %s%s gauge\n", self.prefix, UP_METRIC_NAME))
+    local key = UP_METRIC_NAME
+    if self._default_labels then
+      key = add_labels(key, self._default_labels)
+    end
+    write(string.format("%s%s %d\n", self.prefix, key, up))
+  end
+  if openmetrics then
+    write("# EOF\n")
+  end
+  if flush then
+    flush()
+    if started then
+      record_scrape(self, started)
+    end
     return
   end
-
-  local c = self._counter
-  if not c then
-    c = self.parent._counter
-    if not c then
-      self._log_error(ERR_MSG_COUNTER_NOT_INITIALIZED)
+  if self.verify_output then
+    local err, line = verify_exposition(output)
+    if err then
+      self:log_error("Invalid metric output: ", err, ": ", line)
+      ngx.status = 500
+      ngx.print({"Invalid metric output\n"})
       return
     end
-    self._counter = c
   end
+  if format == "protobuf" then
+    output = protobuf_data(self, output, sketches)
+  end
+  if deflate then
+    local compressed = deflate(table.concat(output), "finish")
+    output = {compressed}
+    ngx.header.content_encoding = "gzip"
+  end
+  -- The response is buffered, so its length is known in advance.
+  local length = 0
+  for _, str in ipairs(output) do
+    length = length + #str
+  end
+  ngx.header.content_length = length
+  ngx.print(output)
+  if started then
+    record_scrape(self, started)
+  end
+end
 
-  -- _count metric.
-  c:incr(keys[1], 1)
+-- Default realm of HTTP basic authentication (see Prometheus.basic_auth).
+local DEFAULT_BASIC_AUTH_REALM = "metrics"
 
-  -- _sum metric.
-  c:incr(keys[2], value)
+-- Compare two strings in constant time.
+--
+-- Both strings are hashed first, so that comparison time depends neither on
+-- where they differ nor on their lengths.
+--
+-- Args:
+--   a: (string) first string.
+--   b: (string) second string.
+--
+-- Returns:
+--   (bool) whether the strings are equal.
+local function constant_time_equals(a, b)
+  local hash_a, hash_b = ngx.sha1_bin(a), ngx.sha1_bin(b)
+  local diff = 0
+  for i = 1, #hash_a do
+    diff = diff + math.abs(hash_a:byte(i) - hash_b:byte(i))
+  end
+  return diff == 0
+end
 
-  local seen = false
-  -- check in reverse order, otherwise we will always
-  -- need to traverse the whole table.
-  for i=self.bucket_count, 1, -1 do
-    if value <= self.buckets[i] then
-      c:incr(keys[2+i], 1)
-      seen = true
-    elseif seen then
-      break
+-- Check HTTP basic authentication credentials of the current request.
+--
+-- Args:
+--   users: table of passwords keyed by user name. Passwords can also be
+--     given as SHA1 hashes in htpasswd format: "{SHA}" followed by base64
+--     encoded hash.
+--   realm: (string) authentication realm. Optional.
+--
+-- Returns:
+--   (bool) true if the request is authenticated. Otherwise, a 401 response is
+--     sent, and the caller should not send anything else.
+function Prometheus.basic_auth(users, realm)
+  local header = ngx.var.http_authorization
+  local encoded = header and header:match("^[Bb]asic%s+(%S+)%s*$")
+  local credentials = encoded and ngx.decode_base64(encoded)
+  local user, password
+  if credentials then
+    user, password = credentials:match("^([^:]*):(.*)$")
+  end
+  if user then
+    -- Unknown users are compared with a dummy password, so that they take
+    -- just as long to reject.
+    local expected = users[user]
+    if type(expected) ~= "string" then
+      expected = nil
+    end
+    local given = password
+    if expected and expected:sub(1, 5) == "{SHA}" then
+      expected = expected:sub(6)
+      given = ngx.encode_base64(ngx.sha1_bin(password))
+    end
+    if constant_time_equals(given, expected or "\0") and expected then
+      return true
     end
   end
-  -- the last bucket (le="Inf").
-  c:incr(keys[self.bucket_count+3], 1)
+  ngx.header["WWW-Authenticate"] = string.format('Basic realm="%s"',
+    realm or DEFAULT_BASIC_AUTH_REALM)
+  ngx.exit(ngx.HTTP_UNAUTHORIZED)
+  return false
 end
 
--- Delete all metrics for a given gauge, counter or a histogram.
+-- Present all metrics (see Prometheus:collect) to authenticated clients.
 --
--- This is like `del`, but will delete all time series for all previously
--- recorded label values.
+-- Args:
+--   users: table of passwords keyed by user name (see Prometheus.basic_auth).
+--   realm: (string) authentication realm. Optional.
+function Prometheus:collect_protected(users, realm)
+  if Prometheus.basic_auth(users, realm) then
+    self:collect()
+  end
+end
+
+-- Set the value of a counter metric with no labels.
+--
+-- This bypasses per-worker counters and should only be used for counters that
+-- are incremented outside of this library, with their current value obtained
+-- from elsewhere.
 --
 -- Args:
---   self: a `metric` object, created by register().
-local function reset(self)
-  -- Wait for other worker threads to sync their counters before removing the
-  -- metric (please see `del` for a more detailed comment).
-  -- Gauge metrics don't use per-worker counters, so for gauges we don't need to
-  -- wait for the counter to sync.
-  if self.typ ~= TYPE_GAUGE then
-    ngx.log(ngx.INFO, "waiting ", self.parent.sync_interval, "s for counter to sync")
-    ngx.sleep(self.parent.sync_interval)
+--   metric: a `metric` object, created by register().
+--   value: numeric value.
+local function set_counter_value(metric, value)
+  local k, err, _
+  k, err = lookup_or_create(metric, nil)
+  if err then
+    metric._log_error(err)
+    return
+  end
+  _, err = metric._dict:safe_set(k, value)
+  if err then
+    metric._log_error_kv(k, value, err)
   end
+end
 
-  local keys = self._key_index:list()
-  local name_prefixes = {}
-  local name_prefix_length_base = #self.name
-  if self.typ == TYPE_HISTOGRAM then
-    if self.label_count == 0 then
-      name_prefixes[self.name .. "_count"] = name_prefix_length_base + 6
-      name_prefixes[self.name .. "_sum"] = name_prefix_length_base + 4
-    else
-      name_prefixes[self.name .. "_count{"] = name_prefix_length_base + 7
-      name_prefixes[self.name .. "_sum{"] = name_prefix_length_base + 5
+-- Populate metrics with values reported by the nginx stub_status module.
+--
+-- Connection counts are obtained from stub_status nginx variables. Total
+-- numbers of accepted and handled connections and HTTP requests are not
+-- available as variables, so they are only collected if `stub_status_location`
+-- option points to a location with `stub_status` enabled.
+--
+-- Metrics are registered during the first call of this function.
+--
+-- Args:
+--   options: table of options. Optional. Supported options are:
+--     stub_status_location: (string) URI of a location with stub_status.
+--     names: table overriding default metric names (see
+--       DEFAULT_NGINX_STATUS_METRIC_NAMES).
+function Prometheus:collect_nginx_status(options)
+  options = options or {}
+  local metrics = self._nginx_status_metrics
+  if not metrics then
+    local names = {}
+    for key, name in pairs(DEFAULT_NGINX_STATUS_METRIC_NAMES) do
+      names[key] = options.names and options.names[key] or name
     end
-    name_prefixes[self.name .. "_bucket{"] = name_prefix_length_base + 8
-  else
-    name_prefixes[self.name .. "{"] = name_prefix_length_base + 1
+    metrics = {
+      connections = self:gauge(names.connections,
+        "Number of HTTP connections", {"state"}),
+    }
+    if options.stub_status_location then
+      metrics.accepted = self:counter(names.accepted,
+        "Number of accepted client connections")
+      metrics.handled = self:counter(names.handled,
+        "Number of handled client connections")
+      metrics.requests = self:counter(names.requests,
+        "Number of client requests")
+    end
+    self._nginx_status_metrics = metrics
   end
 
-  for _, key in ipairs(keys) do
-    local value, key_err = self._dict:get(key)
-    if value then
-      -- For a metric to be deleted its name should either match exactly, or
-      -- have a prefix listed in `name_prefixes` (which ensures deletion of
-      -- metrics with label values).
-      local remove = key == self.name
-      if not remove then
-        for name_prefix, name_prefix_length in pairs(name_prefixes) do
-          if name_prefix == string.sub(key, 1, name_prefix_length) then
-            remove = true
-            break
-          end
-        end
-      end
-      if remove then
-        self._key_index:remove(key)
-        local _, err = self._dict:safe_set(key, nil)
-        if err then
-          self._log_error("Error resetting '", key, "': ", err)
-        end
+  if metrics.connections then
+    for _, state in ipairs(NGINX_CONNECTION_STATES) do
+      local value = tonumber(ngx.var["connections_" .. state])
+      if not value then
+        self:log_error("Variable $connections_", state, " is not defined. ",
+          "Is nginx built with ngx_http_stub_status_module?")
+        break
       end
-    else
-      if type(key_err) == "string" then
-        self._log_error("Error getting '", key, "': ", key_err)
+      metrics.connections:set(value, {state})
+    end
+  end
+
+  if options.stub_status_location then
+    local res = ngx.location.capture(options.stub_status_location)
+    local accepted, handled, requests
+    if res.status == 200 then
+      accepted, handled, requests = string.match(res.body,
+        "server accepts handled requests%s+(%d+)%s+(%d+)%s+(%d+)")
+    end
+    if not accepted then
+      self:log_error("Could not get nginx status from ",
+        options.stub_status_location, " (status ", res.status, ")")
+      return
+    end
+    for key, value in pairs({accepted = accepted, handled = handled,
+                             requests = requests}) do
+      if metrics[key] then
+        set_counter_value(metrics[key], tonumber(value))
       end
     end
   end
-
-  -- Clean up the full metric name lookup table as well.
-  self.lookup = {}
 end
 
--- Initialize the module.
+-- Write current metric data to a file.
 --
--- This should be called once from the `init_by_lua` section in nginx
--- configuration.
+-- Data is written to a temporary file first, which is then renamed, so that
+-- readers never observe a partially written file.
 --
 -- Args:
---   dict_name: (string) name of the nginx shared dictionary which will be
---     used to store all metrics
---   prefix: (optional string) if supplied, prefix is added to all
---     metric names on output
---
--- Returns:
---   an object that should be used to register metrics.
-function Prometheus.init(dict_name, options_or_prefix)
-  if ngx.get_phase() ~= 'init' and ngx.get_phase() ~= 'init_worker' then
-    error('Prometheus.init can only be called from ' ..
-      'init_by_lua_block or init_worker_by_lua_block', 2)
+--   premature: whether the timer is being stopped because the worker exits.
+--   self: a Prometheus object.
+--   path: (string) path of the file.
+--   format: (string) "text", "graphite" or "gzip".
+local function export_to_file(premature, self, path, format)
+  if premature then
+    return
   end
-
-  local self = setmetatable({}, mt)
-  dict_name = dict_name or "prometheus_metrics"
-  self.dict_name = dict_name
-  self.dict = ngx.shared[dict_name]
-  if self.dict == nil then
-    error("Dictionary '" .. dict_name .. "' does not seem to exist. " ..
-      "Please define the dictionary using `lua_shared_dict`.", 2)
-  end
-
-  if type(options_or_prefix) == "table" then
-    self.prefix = options_or_prefix.prefix or ''
-    self.error_metric_name = options_or_prefix.error_metric_name or
-      DEFAULT_ERROR_METRIC_NAME
-    self.sync_interval = options_or_prefix.sync_interval or
-      DEFAULT_SYNC_INTERVAL
+  local data
+  if format == "graphite" then
+    data = table.concat(self:graphite_data())
   else
-    self.prefix = options_or_prefix or ''
-    self.error_metric_name = DEFAULT_ERROR_METRIC_NAME
-    self.sync_interval = DEFAULT_SYNC_INTERVAL
+    data = table.concat(self:metric_data())
   end
-
-  self.registry = {}
-  self.key_index = key_index_lib.new(self.dict, KEY_INDEX_PREFIX)
-
-  self.initialized = true
-
-  self:counter(self.error_metric_name, "Number of nginx-lua-prometheus errors")
-  self.dict:set(self.error_metric_name, 0)
-  local err = self.key_index:add(self.error_metric_name)
-  if err then
-    self:log_error(err)
+  if format == "gzip" then
+    local deflate = self._zlib.deflate(GZIP_LEVEL, GZIP_WINDOW_BITS)
+    data = deflate(data, "finish")
   end
 
-  if ngx.get_phase() == 'init_worker' then
-    self:init_worker(self.sync_interval)
+  local tmp_path = path .. ".tmp"
+  local f, err = io.open(tmp_path, "wb")
+  if not f then
+    self:log_error("Could not open ", tmp_path, ": ", err)
+    return
+  end
+  local ok
+  ok, err = f:write(data)
+  f:close()
+  if not ok then
+    self:log_error("Could not write ", tmp_path, ": ", err)
+    os.remove(tmp_path)
+    return
+  end
+  ok, err = os.rename(tmp_path, path)
+  if not ok then
+    self:log_error("Could not rename ", tmp_path, " to ", path, ": ", err)
+    os.remove(tmp_path)
   end
-  return self
 end
 
--- Initialize the worker counter.
+-- Periodically export metric data to a file.
 --
--- This can call this function from the `init_worker_by_lua` if you are calling
--- Prometheus.init() from `init_by_lua`, but this is deprecated. Instead, just
--- call Prometheus.init() from `init_worker_by_lua_block` and pass sync_interval
--- as part of the `options` argument if you need.
+-- This is intended for hosts that can't be scraped, with the file shipped
+-- elsewhere by a separate process. The file is only written by the worker
+-- with id 0, so that workers don't overwrite each other's output. This should
+-- be called from the init_worker_by_lua_block nginx phase.
 --
 -- Args:
---   sync_interval: per-worker counter sync interval (in seconds).
-function Prometheus:init_worker(sync_interval)
-  if ngx.get_phase() ~= 'init_worker' then
-    error('Prometheus:init_worker can only be called in ' ..
-      'init_worker_by_lua_block', 2)
+--   path: (string) path of the file.
+--   interval: (number) export interval in seconds.
+--   opts: table of options. Optional. Supported options are:
+--     format: (string) "text" (default) for Prometheus text format,
+--       "graphite" for Graphite plaintext format, or "gzip" for
+--       gzip-compressed Prometheus text format (requires lua-zlib).
+function Prometheus:start_file_export(path, interval, opts)
+  if not self.initialized then
+    ngx.log(ngx.ERR, "Prometheus module has not been initialized")
+    return
   end
-  if self._counter then
-    ngx.log(ngx.WARN, 'init_worker() has been called twice. ' ..
-      'Please do not explicitly call init_worker. ' ..
-      'Instead, call Prometheus:init() in the init_worker_by_lua_block')
+  opts = opts or {}
+  local format = opts.format or "text"
+  if format ~= "text" and format ~= "graphite" and format ~= "gzip" then
+    self:log_error("Unknown file export format '", tostring(format),
+      "', should be one of: text, graphite, gzip")
     return
   end
-  self.sync_interval = sync_interval or DEFAULT_SYNC_INTERVAL
-  local counter_instance, err = resty_counter_lib.new(
-      self.dict_name, self.sync_interval)
-  if err then
-    error(err, 2)
+  if format == "gzip" and not self._zlib then
+    local ok, zlib = pcall(require, "zlib")
+    if not ok or type(zlib) ~= "table" or not zlib.deflate then
+      self:log_error("gzip file export format requires the lua-zlib module")
+      return
+    end
+    self._zlib = zlib
+  end
+  if not path or not interval or interval <= 0 then
+    self:log_error("File export needs a path and a positive interval")
+    return
+  end
+
+  if ngx.worker.id() ~= 0 then
+    return
+  end
+  local ok, err = ngx.timer.every(interval, export_to_file, self, path, format)
+  if not ok then
+    self:log_error("Could not start file export timer: ", err)
   end
-  self._counter = counter_instance
 end
 
--- Register a new metric.
+-- Format a grouping label of a Pushgateway URL path.
+--
+-- Values that can't be a path segment (empty ones, or those containing a
+-- slash) are encoded with URL-safe base64, as Pushgateway expects them.
+-- Other values are percent-encoded.
+--
+-- Args:
+--   name: (string) label name.
+--   value: label value.
+--
+-- Returns:
+--   (string) path segments with the label name and value.
+local function pushgateway_label(name, value)
+  value = tostring(value)
+  if value == "" or value:find("/", 1, true) then
+    local encoded = ngx.encode_base64(value):gsub("%+", "-"):gsub("/", "_")
+    return name .. "@base64/" .. (encoded == "" and "=" or encoded)
+  end
+  return name .. "/" .. value:gsub("[^%w%-%._~]", function(c)
+    return string.format("%%%02X", c:byte())
+  end)
+end
+
+-- Send current metric data to Pushgateway.
 --
 -- Args:
 --   self: a Prometheus object.
---   name: (string) name of the metric. Required.
---   help: (string) description of the metric. Will be used for the HELP
---     comment on the metrics page. Optional.
---   label_names: array of strings, defining a list of metrics. Optional.
---   buckets: array if numbers, defining bucket boundaries. Only used for
---     histogram metrics.
---   typ: metric type (one of the TYPE_* constants).
+--   push: push configuration (see Prometheus:push).
 --
 -- Returns:
---   a new metric object.
-local function register(self, name, help, label_names, buckets, typ)
+--   (string) error message, or nil if metrics were pushed.
+local function send_push(self, push)
+  -- Pushgateway rejects samples with timestamps.
+  local output = {}
+  write_metric_data(self, nil, false, function(str)
+    table.insert(output, str)
+  end, nil, false, true)
+  local body = table.concat(output)
+  local sock = ngx.socket.tcp()
+  sock:settimeout(push.timeout * 1000)
+  local ok, err = sock:connect(push.host, push.port)
+  if not ok then
+    return "could not connect: " .. tostring(err)
+  end
+  if push.https then
+    ok, err = sock:sslhandshake(nil, push.host, push.ssl_verify)
+    if not ok then
+      sock:close()
+      return "TLS handshake failed: " .. tostring(err)
+    end
+  end
+  ok, err = sock:send({"POST ", push.path, " HTTP/1.1\r\nHost: ",
+    push.host_header,
+    "\r\nContent-Type: text/plain; version=0.0.4\r\nContent-Length: ",
+    #body, "\r\nConnection: close\r\n\r\n", body})
+  if not ok then
+    sock:close()
+    return "could not send metrics: " .. tostring(err)
+  end
+  local line
+  line, err = sock:receive("*l")
+  sock:close()
+  if not line then
+    return "could not read response: " .. tostring(err)
+  end
+  local status = tonumber(line:match("^HTTP/%d%.%d (%d%d%d)"))
+  if not status then
+    return "invalid response '" .. line .. "'"
+  end
+  if status < 200 or status >= 300 then
+    return "unexpected response status " .. status
+  end
+end
+
+-- Timer function pushing metric data to Pushgateway.
+--
+-- A push is skipped if the previous one is still in progress. Failed pushes
+-- are counted as errors, and retried with fresh data on the next tick.
+--
+-- Args:
+--   premature: whether the timer is being stopped because the worker exits.
+--   self: a Prometheus object.
+--   push: push configuration (see Prometheus:push).
+local function push_metrics(premature, self, push)
+  if premature or push.busy then
+    return
+  end
+  push.busy = true
+  local ok, err = pcall(send_push, self, push)
+  push.busy = false
+  if not ok or err then
+    self:log_error("Could not push metrics to ", push.url, ": ", err)
+  end
+end
+
+-- Periodically push metric data to Pushgateway.
+--
+-- This is intended for hosts that are behind NAT or otherwise can't be
+-- scraped. Metrics are pushed in the text format with a POST request, which
+-- replaces metrics with the same names in the group. Like file export, this is
+-- only done by the worker with id 0, so that metrics are not pushed several
+-- times. This should be called from the init_worker_by_lua_block nginx phase.
+--
+-- Args:
+--   url: (string) base URL of Pushgateway, e.g. "http://pushgateway:9091".
+--   job: (string) value of the `job` grouping label.
+--   instance: (string) value of the `instance` grouping label. Optional.
+--   opts: table of options. Optional. Supported options are:
+--     interval: (number) push interval in seconds. Defaults to 15.
+--     timeout: (number) timeout of network operations in seconds. Defaults
+--       to 5.
+--     ssl_verify: (boolean) verify the certificate of HTTPS URLs. Defaults to
+--       true.
+function Prometheus:push(url, job, instance, opts)
   if not self.initialized then
     ngx.log(ngx.ERR, "Prometheus module has not been initialized")
     return
   end
-
-  local err = check_metric_and_label_names(name, label_names)
-  if err then
-    self:log_error(err)
+  opts = opts or {}
+  local interval = opts.interval or 15
+  local timeout = opts.timeout or 5
+  if type(interval) ~= "number" or interval <= 0 or
+      type(timeout) ~= "number" or timeout <= 0 then
+    self:log_error("Push interval and timeout should be positive numbers")
+    return
+  end
+  local scheme, host, port, base = tostring(url):match(
+    "^(https?)://([^/:]+):?(%d*)(.-)/*$")
+  if not scheme or (base ~= "" and base:sub(1, 1) ~= "/") then
+    self:log_error("Invalid Pushgateway URL '", tostring(url), "'")
+    return
+  end
+  if job == nil or job == "" then
+    self:log_error("Pushing metrics needs a job name")
     return
   end
 
-  local name_maybe_historgram = name:gsub("_bucket$", "")
-                                    :gsub("_count$", "")
-                                    :gsub("_sum$", "")
-  if (typ ~= TYPE_HISTOGRAM and (
-      self.registry[name] or self.registry[name_maybe_historgram]
-    )) or
-    (typ == TYPE_HISTOGRAM and (
-      self.registry[name] or
-      self.registry[name .. "_count"] or
-      self.registry[name .. "_sum"] or self.registry[name .. "_bucket"]
-    )) then
+  local path = base .. "/metrics/" .. pushgateway_label("job", job)
+  if instance ~= nil then
+    path = path .. "/" .. pushgateway_label("instance", instance)
+  end
+  local default_port = scheme == "https" and 443 or 80
+  port = tonumber(port) or default_port
+  local push = {
+    url = url,
+    https = scheme == "https",
+    host = host,
+    port = port,
+    -- The port is only left out of the Host header if it's the default one.
+    host_header = port == default_port and host or host .. ":" .. port,
+    path = path,
+    timeout = timeout,
+    ssl_verify = opts.ssl_verify ~= false,
+  }
+  if ngx.worker.id() ~= 0 then
+    return
+  end
+  local ok, err = ngx.timer.every(interval, push_metrics, self, push)
+  if not ok then
+    self:log_error("Could not start push timer: ", err)
+  end
+end
 
-    self:log_error("Duplicate metric " .. name)
+-- Reset the error metric (and the last error timestamp) to zero.
+--
+-- This is mostly useful in tests and for manual intervention. Like other
+-- resets, this waits for `sync_interval` first, so that errors which have
+-- already been counted by other workers (e.g. updates dropped from async
+-- queues that have not been flushed yet) are not applied after the reset.
+function Prometheus:reset_errors()
+  if not self.initialized then
+    ngx.log(ngx.ERR, "Prometheus module has not been initialized")
     return
   end
 
-  local metric = {
-    name = name,
-    help = help,
-    typ = typ,
-    label_names = label_names,
-    label_count = label_names and #label_names or 0,
-    -- Lookup is a tree of lua tables that contain label values, with leaf
-    -- tables containing full metric names. For example, given a metric
-    -- `http_count` and labels `host` and `status`, it might contain the
-    -- following values:
-    -- ['me.com']['200'][LEAF_KEY] = 'http_count{host="me.com",status="200"}'
-    -- ['me.com']['500'][LEAF_KEY] = 'http_count{host="me.com",status="500"}'
-    -- ['my.net']['200'][LEAF_KEY] = 'http_count{host="my.net",status="200"}'
-    -- ['my.net']['500'][LEAF_KEY] = 'http_count{host="my.net",status="500"}'
-    lookup = {},
-    parent = self,
-    -- Store a reference for logging functions for faster lookup.
-    _log_error = function(...) self:log_error(...) end,
-    _log_error_kv = function(...) self:log_error_kv(...) end,
-    _key_index = self.key_index,
-    _dict = self.dict,
-    reset = reset,
-  }
-  if typ < TYPE_HISTOGRAM then
-    if typ == TYPE_GAUGE then
-      metric.set = set
-      metric.inc = inc_gauge
-    else
-      metric.inc = inc_counter
+  ngx.log(ngx.INFO, "waiting ", self.sync_interval, "s for counter to sync")
+  ngx.sleep(self.sync_interval)
+
+  local ok, err
+  if self.error_metric_name then
+    ok, err = self.dict:safe_set(self.error_metric_name, 0)
+    if not ok then
+      self:log_error_kv(self.error_metric_name, 0, err)
+    end
+  end
+  if self.last_error_timestamp then
+    ok, err = self.dict:safe_set(LAST_ERROR_TIMESTAMP_METRIC_NAME, 0)
+    if not ok then
+      self:log_error_kv(LAST_ERROR_TIMESTAMP_METRIC_NAME, 0, err)
     end
-    metric.del = del
-  else
-    metric.observe = observe
-    metric.buckets = buckets or DEFAULT_BUCKETS
-    metric.bucket_count = #metric.buckets
-    metric.bucket_format = construct_bucket_format(metric.buckets)
   end
-
-  self.registry[name] = metric
-  return metric
 end
 
--- Public function to register a counter.
-function Prometheus:counter(name, help, label_names)
-  return register(self, name, help, label_names, nil, TYPE_COUNTER)
+-- Delete all series of all metrics.
+--
+-- Internal metrics (like the error metric) are kept. Like other resets, this
+-- waits for `sync_interval` first, so that values accumulated by other
+-- workers get synced (and then deleted) rather than applied after the reset.
+-- Keys are removed from the key index before they are deleted, and the reset
+-- is tracked by RESET_GENERATION_KEY, so that collect() in other workers
+-- returns either old values or none of them (see consistent_output). Other
+-- workers forget their cached names of series within `sync_interval` (see
+-- check_reset).
+--
+-- Returns:
+--   (number) number of deleted keys.
+function Prometheus:reset()
+  if not self.initialized then
+    ngx.log(ngx.ERR, "Prometheus module has not been initialized")
+    return
+  end
+
+  local wait = self.sync_interval
+  for _, m in ipairs(self._own_counters) do
+    wait = math.max(wait, m.sync_interval or self.sync_interval)
+  end
+  ngx.log(ngx.INFO, "waiting ", wait, "s for counter to sync")
+  ngx.sleep(wait)
+  flush_local_state(self)
+
+  local generation = self.dict:incr(RESET_GENERATION_KEY, 1, 0)
+  local deleted = {}
+  local updated = {}
+  for _, key in ipairs(self.key_index:list()) do
+    local m, series = series_of_key(self.registry, key)
+    if not (m and m.internal) then
+      self.key_index:remove(key)
+      table.insert(deleted, key)
+      if series then
+        updated[UPDATED_PREFIX .. series] = true
+      end
+    end
+  end
+  for _, key in ipairs(deleted) do
+    local _, err = self.dict:delete(key)
+    if err then
+      self:log_error("Error deleting key '", key, "': ", err)
+    end
+  end
+  for key in pairs(updated) do
+    self.dict:delete(key)
+  end
+  for _, m in pairs(self.registry) do
+    if m.max_series then
+      self.dict:delete(m._series_count_key)
+    end
+  end
+  self.dict:incr(RESET_GENERATION_KEY, 1, 0)
+  -- This worker does not need to wait for check_reset.
+  self._reset_generation = generation and generation + 1
+  for _, m in pairs(self.registry) do
+    if m.lookup and not m.internal then
+      forget_local_state(m)
+      if m._touched then
+        m._touched = {}
+      end
+    end
+  end
+  ngx.log(ngx.INFO, "Reset all metrics, deleted ", #deleted, " keys")
+  return #deleted
 end
 
--- Public function to register a gauge.
-function Prometheus:gauge(name, help, label_names)
-  return register(self, name, help, label_names, nil, TYPE_GAUGE)
+-- Serialize current values of all metrics.
+--
+-- Returns:
+--   (string) a blob that can be passed to Prometheus:restore(), with a
+--     `full_metric_name value` line for each stored value. Values are
+--     formatted with enough digits to be parsed back exactly.
+function Prometheus:snapshot()
+  if not self.initialized then
+    ngx.log(ngx.ERR, "Prometheus module has not been initialized")
+    return
+  end
+
+  flush_local_state(self)
+  local lines = {}
+  for _, key in ipairs(self.key_index:list()) do
+    local value = self.dict:get(key)
+    if value then
+      table.insert(lines, string.format("%s %.17g\n", key, value))
+    end
+  end
+  return table.concat(lines)
 end
 
--- Public function to register a histogram.
-function Prometheus:histogram(name, help, label_names, buckets)
-  return register(self, name, help, label_names, buckets, TYPE_HISTOGRAM)
+-- Check whether a key from a snapshot belongs to a registered metric.
+--
+-- Args:
+--   registry: table of registered metrics, keyed by name.
+--   key: (string) full metric name.
+--
+-- Returns:
+--   a `metric` object (or nil if the key can not be restored), the key to
+--     restore the value into, and the series (string).
+local function restorable_metric(registry, key)
+  local m, series = series_of_key(registry, key)
+  if not m or not m.lookup then
+    return
+  end
+  if m.typ == TYPE_HISTOGRAM and not m.native_schema and
+      parse_sketch_key(key) then
+    return
+  end
+  local le = key:match('[,{]le="([^"]*)"}$')
+  if m.typ == TYPE_HISTOGRAM and le and le ~= "Inf" then
+    -- Bucket boundaries (and therefore their formatting) might have changed
+    -- since the snapshot was taken.
+    local bound = tonumber(le)
+    for _, bucket in ipairs(m.buckets) do
+      if bucket == bound then
+        return m, key:sub(1, -#le - 3) .. m.bucket_format:format(bucket) ..
+          '"}', series
+      end
+    end
+    return
+  end
+  return m, key, series
 end
 
--- Prometheus compatible metric data as an array of strings.
+-- Restore metric values from a snapshot created by Prometheus:snapshot().
+--
+-- Values are only restored once for the shared dictionary: the first worker
+-- to call this function restores them, and calls in other workers (or after
+-- nginx reloads, which keep the dictionary) do nothing. Values of metrics that
+-- are not registered (or histogram buckets that don't exist any more) are
+-- skipped, so this should be called after registering all metrics. Each
+-- series (e.g. all keys of a histogram series) is restored as a unit: if any
+-- of its keys has been updated since the dictionary was created, none of them
+-- are restored, so that the series stays consistent.
+--
+-- Args:
+--   blob: (string) a snapshot.
 --
 -- Returns:
---   Array of strings with all metrics in a text format compatible with
---   Prometheus.
-function Prometheus:metric_data()
+--   (number) number of restored values, or nil if values have already been
+--     restored.
+function Prometheus:restore(blob)
   if not self.initialized then
     ngx.log(ngx.ERR, "Prometheus module has not been initialized")
     return
   end
 
-  -- Force a manual sync of counter local state (mostly to make tests work).
-  self._counter:sync()
+  local ok, err = self.dict:safe_add(RESTORED_KEY, now())
+  if not ok then
+    if err ~= "exists" then
+      self:log_error("Error restoring metrics: ", err)
+    end
+    return
+  end
 
-  local keys = self.key_index:list()
-  -- Prometheus server expects buckets of a histogram to appear in increasing
-  -- numerical order of their label values.
-  table.sort(keys)
+  -- Restorable values, grouped by series in the order of the snapshot.
+  local series_list, by_series = {}, {}
+  for line in blob:gmatch("[^\n]+") do
+    local key, value = line:match("^(.*) (%S+)$")
+    value = tonumber(value)
+    if not key or not value then
+      self:log_error("Invalid metric snapshot line: ", line)
+    else
+      local m, series
+      m, key, series = restorable_metric(self.registry, key)
+      if m then
+        local values = by_series[series]
+        if not values then
+          values = {metric = m, keys = {}}
+          by_series[series] = values
+          table.insert(series_list, series)
+        end
+        table.insert(values.keys, key)
+        values[key] = value
+      end
+    end
+  end
 
-  local seen_metrics = {}
-  local output = {}
-  for _, key in ipairs(keys) do
-    local value, err = self.dict:get(key)
-    if value then
-      local short_name = short_metric_name(key)
-      if not seen_metrics[short_name] then
-        local m = self.registry[short_name]
-        if m then
-          if m.help then
-            table.insert(output, string.format("# HELP %s%s %s\n",
-            self.prefix, short_name, m.help))
-          end
-          if m.typ then
-            table.insert(output, string.format("# TYPE %s%s %s\n",
-              self.prefix, short_name, TYPE_LITERAL[m.typ]))
+  local restored = 0
+  for _, series in ipairs(series_list) do
+    local values = by_series[series]
+    -- Series with any values updated since the dictionary was created are
+    -- kept as is.
+    local updated = false
+    for _, key in ipairs(values.keys) do
+      if self.dict:get(key) ~= nil then
+        updated = true
+        break
+      end
+    end
+    if not updated then
+      for _, key in ipairs(values.keys) do
+        ok, err = self.dict:safe_add(key, values[key])
+        if ok then
+          err = self.key_index:add(key)
+          if err then
+            self:log_error(err)
+          else
+            restored = restored + 1
           end
+        elseif err ~= "exists" then
+          self:log_error_kv(key, values[key], err)
         end
-        seen_metrics[short_name] = true
       end
-      key = fix_histogram_bucket_labels(key)
-      table.insert(output, string.format("%s%s %s\n", self.prefix, key, value))
-    else
-      if type(err) == "string" then
-        self:log_error("Error getting '", key, "': ", err)
+      if values.metric._touched then
+        values.metric._touched[series] = true
       end
     end
   end
-  return output
-end
-
--- Present all metrics in a text format compatible with Prometheus.
---
--- This function should be used to expose the metrics on a separate HTTP page.
--- It will get the metrics from the dictionary, sort them, and expose them
--- aling with TYPE and HELP comments.
-function Prometheus:collect()
-  ngx.header.content_type = "text/plain"
-  ngx.print(self:metric_data())
+  ngx.log(ngx.INFO, "Restored ", restored, " metric values")
+  return restored
 end
 
--- Log an error, incrementing the error counter.
+-- Log an error (or pass it to the `on_error` callback), incrementing the
+-- error counter.
 function Prometheus:log_error(...)
-  ngx.log(ngx.ERR, ...)
-  self.dict:incr(self.error_metric_name, 1, 0)
+  count_errors(self, 1, nil, ...)
 end
 
 -- Log an error that happened while setting up a dictionary key.
-function Prometheus:log_error_kv(key, value, err)
-  self:log_error(
+--
+-- Args:
+--   key: dictionary key.
+--   value: value that could not be written.
+--   err: error returned by the dictionary.
+--   context: (optional) table passed to the `on_error` callback, the key and
+--     the value are added to it.
+function Prometheus:log_error_kv(key, value, err, context)
+  if err == dict_lib.DEADLINE_EXCEEDED then
+    -- Already counted when the update was skipped (see write_deadline).
+    return
+  end
+  context = context or {}
+  context.key = key
+  context.value = value
+  count_errors(self, 1, context,
     "Error while setting '", key, "' to '", value, "': '", err, "'")
+  if err == "no memory" and self.on_dict_full ~= "error" then
+    free_dict_space(self)
+  end
 end
 
 return Prometheus
@@ -0,0 +1,253 @@
+-- vim: ts=2:sw=2:sts=2:expandtab
+-- Simple benchmarks for nginx-lua-prometheus.
+--
+-- These run outside of nginx, using a trivial implementation of the shared
+-- dictionary, so absolute numbers are only useful for comparing different
+-- versions of the library with each other. Run with:
+--
+--   lua prometheus_bench.lua [benchmark name]
+
+-- Simple implementation of a nginx shared dictionary. Writes are counted,
+-- since each of them takes the lock shared by all nginx workers.
+local SimpleDict = {}
+SimpleDict.__index = SimpleDict
+local dict_writes = 0
+function SimpleDict:set(k, v)
+  dict_writes = dict_writes + 1
+  self.dict[k] = v
+  return true, nil, false
+end
+function SimpleDict:safe_set(k, v)
+  dict_writes = dict_writes + 1
+  self.dict[k] = v
+  return true, nil
+end
+function SimpleDict:safe_add(k, v)
+  dict_writes = dict_writes + 1
+  if self.dict[k] ~= nil then
+    return nil, "exists"
+  end
+  self.dict[k] = v
+  return true, nil
+end
+function SimpleDict:incr(k, v, init)
+  dict_writes = dict_writes + 1
+  if not self.dict[k] then self.dict[k] = init end
+  self.dict[k] = self.dict[k] + (v or 1)
+  return self.dict[k], nil
+end
+function SimpleDict:get(k)
+  return self.dict[k], nil
+end
+function SimpleDict:delete(k)
+  self.dict[k] = nil
+end
+
+ngx = {
+  shared = {},
+  ERR = 1,
+  WARN = 2,
+  INFO = 3,
+  DEBUG = 4,
+  header = {},
+  log = function() end,
+  print = function() end,
+  sleep = function() end,
+  time = function() return os.time() end,
+  now = function() return os.time() end,
+  get_phase = function() return "init_worker" end,
+  worker = {id = function() return 0 end, count = function() return 1 end},
+  timer = {every = function() end},
+  req = {get_uri_args = function() return {} end},
+}
+
+local function new_prometheus()
+  ngx.shared.metrics = setmetatable({dict = {}}, SimpleDict)
+  package.loaded.prometheus = nil
+  return require("prometheus").init("metrics")
+end
+
+-- Run `fn` `iterations` times and report average time and number of shared
+-- dictionary writes per iteration.
+local function measure(name, iterations, fn)
+  local writes = dict_writes
+  local start = os.clock()
+  for _ = 1, iterations do
+    fn()
+  end
+  local elapsed = os.clock() - start
+  print(string.format("%-40s %8d iterations %12.3f us/iteration %8.3f " ..
+    "dict writes/iteration", name, iterations, elapsed / iterations * 1e6,
+    (dict_writes - writes) / iterations))
+end
+
+local benchmarks = {}
+
+-- Collection from a registry with many metric families, with a single series
+-- each.
+function benchmarks.collect_many_families()
+  local p = new_prometheus()
+  for i = 1, 500 do
+    p:counter("counter_" .. i, "Counter number " .. i):inc(i)
+    p:gauge("gauge_" .. i, "Gauge number " .. i):set(i)
+  end
+  measure("collect_many_families", 200, function() p:metric_data() end)
+end
+
+-- Collection of histograms with many labeled series, which is dominated by
+-- formatting of bucket keys.
+function benchmarks.collect_histograms()
+  local p = new_prometheus()
+  local latency = p:histogram("latency", "Latency", {"host"},
+    {0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10})
+  for i = 1, 100 do
+    latency:observe(i / 100, {"host" .. i})
+  end
+  p._counter:sync()
+  measure("collect_histograms", 200, function() p:metric_data() end)
+end
+
+-- Observing a value in two histograms with the same buckets, separately and
+-- with observe_many.
+function benchmarks.observe_two_histograms()
+  local p = new_prometheus()
+  local overall = p:histogram("overall", "Overall")
+  local by_host = p:histogram("by_host", "By host", {"host"})
+  measure("observe_two_histograms", 100000, function()
+    overall:observe(0.3)
+    by_host:observe(0.3, {"example.com"})
+  end)
+  measure("observe_two_histograms_many", 100000, function()
+    p:observe_many(0.3, {{overall}, {by_host, {"example.com"}}})
+  end)
+end
+
+-- Observing similar values in a histogram with many buckets, with and
+-- without bucket_cache.
+function benchmarks.observe_clustered()
+  local p = new_prometheus()
+  local buckets = {}
+  for i = 1, 40 do
+    buckets[i] = i / 100
+  end
+  local plain = p:histogram("plain", "Plain", nil, {buckets = buckets})
+  local cached = p:histogram("cached", "Cached", nil,
+    {buckets = buckets, bucket_cache = true})
+  local i = 0
+  measure("observe_clustered", 100000, function()
+    i = i + 1
+    plain:observe(0.1 + (i % 3) / 1000)
+  end)
+  measure("observe_clustered_cached", 100000, function()
+    i = i + 1
+    cached:observe(0.1 + (i % 3) / 1000)
+  end)
+end
+
+-- Recording request latency with a trace exemplar, with observe_latency and
+-- assembled from observe and an exemplar table.
+function benchmarks.observe_latency()
+  local p = new_prometheus()
+  local latency = p:histogram("latency", "Latency", {"status", "path"})
+  measure("observe_latency", 100000, function()
+    latency:observe_latency("0.300", {"200", "/"}, "4bf92f3577b34da6")
+  end)
+  measure("observe_latency_assembled", 100000, function()
+    latency:observe(tonumber("0.300"), {"200", "/"},
+      {exemplar = {trace_id = "4bf92f3577b34da6"}})
+  end)
+end
+
+-- Observing values in a histogram, which are aggregated in a per-worker table
+-- and written to the shared dictionary every `sync_interval`, compared to
+-- writing each observation to the dictionary, as in versions that did not
+-- aggregate them. Syncs are simulated every 1000 observations (1000 requests
+-- per second per worker with the default `sync_interval`). Dictionary writes
+-- per observation show how much lock contention between workers is avoided.
+function benchmarks.observe_dict_writes()
+  local p = new_prometheus()
+  local hist = p:histogram("latency", "Latency", {"host"})
+  local dict = ngx.shared.metrics
+  local i = 0
+  measure("observe_dict_writes_aggregated", 100000, function()
+    i = i + 1
+    hist:observe((i % 100) / 10, {"example.com"})
+    if i % 1000 == 0 then
+      p._counter:sync()
+    end
+  end)
+
+  -- Keys of the series, without going through the library.
+  local keys = {'latency_count{host="example.com"}',
+                'latency_sum{host="example.com"}'}
+  for _, bucket in ipairs(hist.buckets) do
+    table.insert(keys, string.format('latency_bucket{host="example.com",' ..
+      'le="%s"}', bucket))
+  end
+  table.insert(keys, 'latency_bucket{host="example.com",le="Inf"}')
+  measure("observe_dict_writes_direct", 100000, function()
+    i = i + 1
+    local value = (i % 100) / 10
+    dict:incr(keys[1], 1, 0)
+    dict:incr(keys[2], value, 0)
+    for b, bucket in ipairs(hist.buckets) do
+      if value <= bucket then
+        dict:incr(keys[b + 2], 1, 0)
+      end
+    end
+    dict:incr(keys[#keys], 1, 0)
+  end)
+end
+
+-- Observing values in histograms with `track_extremes` option and many
+-- buckets, with observations recorded in per-worker counters (before) and
+-- aggregated in the worker with `local_aggregation` option (after). Like in
+-- observe_dict_writes, syncs are simulated every 1000 observations. Without
+-- aggregation, extremes are written to the dictionary on every observation.
+function benchmarks.observe_local_aggregation()
+  local p = new_prometheus()
+  local buckets = {}
+  for i = 1, 40 do
+    buckets[i] = i / 100
+  end
+  local counted = p:histogram("counted", "Counted", {"host"},
+    {buckets = buckets, track_extremes = true})
+  -- The timer merging observations of the histogram, which is started when
+  -- it's registered.
+  local every = ngx.timer.every
+  local merge
+  ngx.timer.every = function(_, fn, ...)
+    local args = {...}
+    merge = function() fn(false, unpack(args)) end
+  end
+  local aggregated = p:histogram("aggregated", "Aggregated", {"host"},
+    {buckets = buckets, track_extremes = true, local_aggregation = true})
+  ngx.timer.every = every
+  local i = 0
+  measure("observe_local_aggregation_before", 100000, function()
+    i = i + 1
+    counted:observe((i % 100) / 200, {"example.com"})
+    if i % 1000 == 0 then
+      p._counter:sync()
+    end
+  end)
+  measure("observe_local_aggregation_after", 100000, function()
+    i = i + 1
+    aggregated:observe((i % 100) / 200, {"example.com"})
+    if i % 1000 == 0 then
+      merge()
+    end
+  end)
+end
+
+local filter = arg and arg[1]
+local names = {}
+for name in pairs(benchmarks) do
+  table.insert(names, name)
+end
+table.sort(names)
+for _, name in ipairs(names) do
+  if not filter or name:find(filter, 1, true) then
+    benchmarks[name]()
+  end
+end
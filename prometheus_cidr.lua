@@ -0,0 +1,165 @@
+-- Parser of CIDR ranges used by the prometheus module to check addresses of
+-- clients against the `allow` option of collect().
+
+local _M = {}
+
+-- Parse an IPv4 or IPv6 address.
+--
+-- Args:
+--   addr: (string) address, such as "10.0.0.1" or "2001:db8::1".
+--
+-- Returns:
+--   (array) address bytes, 4 for IPv4 and 16 for IPv6 addresses, or nil if
+--     the address is invalid.
+local function parse_ip(addr)
+  local a, b, c, d = addr:match("^(%d+)%.(%d+)%.(%d+)%.(%d+)$")
+  if a then
+    local bytes = {tonumber(a), tonumber(b), tonumber(c), tonumber(d)}
+    for _, byte in ipairs(bytes) do
+      if byte > 255 then
+        return
+      end
+    end
+    return bytes
+  end
+  if not addr:find(":", 1, true) then
+    return
+  end
+  -- The last 32 bits can be written as an IPv4 address.
+  local head, ipv4 = addr:match("^(.*:)(%d+%.%d+%.%d+%.%d+)$")
+  if ipv4 then
+    local bytes = parse_ip(ipv4)
+    if not bytes then
+      return
+    end
+    addr = head .. string.format("%x:%x", bytes[1] * 256 + bytes[2],
+      bytes[3] * 256 + bytes[4])
+  end
+  local function parse_groups(str)
+    local groups = {}
+    if str == "" then
+      return groups
+    end
+    for group in (str .. ":"):gmatch("([^:]*):") do
+      if not group:match("^%x%x?%x?%x?$") then
+        return
+      end
+      table.insert(groups, tonumber(group, 16))
+    end
+    return groups
+  end
+  -- "::" replaces one or more groups of zeroes.
+  local left, right = addr, ""
+  local gap = addr:find("::", 1, true)
+  if gap then
+    left, right = addr:sub(1, gap - 1), addr:sub(gap + 2)
+  end
+  local left_groups, right_groups = parse_groups(left), parse_groups(right)
+  if not left_groups or not right_groups then
+    return
+  end
+  local missing = 8 - #left_groups - #right_groups
+  if (gap and missing < 1) or (not gap and missing ~= 0) then
+    return
+  end
+  local bytes = {}
+  local function add_group(group)
+    table.insert(bytes, math.floor(group / 256))
+    table.insert(bytes, group % 256)
+  end
+  for _, group in ipairs(left_groups) do
+    add_group(group)
+  end
+  for _ = 1, missing do
+    add_group(0)
+  end
+  for _, group in ipairs(right_groups) do
+    add_group(group)
+  end
+  return bytes
+end
+
+-- Parse a CIDR range, such as "10.0.0.0/8" or "2001:db8::/32".
+--
+-- Args:
+--   cidr: (string) the range. A single address is a range of its own.
+--
+-- Returns:
+--   (table) `bytes` of the network address and `prefix` length, or nil if the
+--     range is invalid.
+function _M.parse(cidr)
+  if type(cidr) ~= "string" then
+    return
+  end
+  local addr, prefix = cidr:match("^([^/]+)/(%d+)$")
+  local bytes = parse_ip(addr or cidr)
+  if not bytes then
+    return
+  end
+  prefix = tonumber(prefix) or #bytes * 8
+  if prefix > #bytes * 8 then
+    return
+  end
+  return {bytes = bytes, prefix = prefix}
+end
+
+-- Check whether an address belongs to a CIDR range.
+--
+-- Args:
+--   bytes: (array) address bytes, as returned by parse_ip.
+--   range: (table) CIDR range, as returned by parse().
+--
+-- Returns:
+--   (bool) whether the address is in the range.
+local function ip_in_range(bytes, range)
+  if #bytes ~= #range.bytes then
+    return false
+  end
+  local full_bytes = math.floor(range.prefix / 8)
+  for i = 1, full_bytes do
+    if bytes[i] ~= range.bytes[i] then
+      return false
+    end
+  end
+  local bits = range.prefix % 8
+  if bits == 0 then
+    return true
+  end
+  local divisor = 2 ^ (8 - bits)
+  return math.floor(bytes[full_bytes + 1] / divisor) ==
+    math.floor(range.bytes[full_bytes + 1] / divisor)
+end
+
+-- Check whether an address belongs to any of the CIDR ranges.
+--
+-- IPv4-mapped IPv6 addresses (::ffff:0:0/96) are matched as IPv4 addresses.
+--
+-- Args:
+--   ranges: (array) CIDR ranges, as returned by parse().
+--   addr: (string) the address.
+--
+-- Returns:
+--   (bool) whether the address is valid and belongs to any of the ranges.
+function _M.contains(ranges, addr)
+  local bytes = parse_ip(addr)
+  if not bytes then
+    return false
+  end
+  if #bytes == 16 then
+    local mapped = bytes[11] == 255 and bytes[12] == 255
+    for i = 1, 10 do
+      mapped = mapped and bytes[i] == 0
+    end
+    if mapped then
+      bytes = {bytes[13], bytes[14], bytes[15], bytes[16]}
+    end
+  end
+  for _, range in ipairs(ranges) do
+    if ip_in_range(bytes, range) then
+      return true
+    end
+  end
+  return false
+end
+
+return _M
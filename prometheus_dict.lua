@@ -0,0 +1,463 @@
+-- Wrappers of nginx shared dictionaries used by the prometheus module.
+--
+-- Each wrapper adds some behavior to methods of a shared dictionary (or of
+-- another wrapper), and has the same interface as the shared dictionary, so
+-- that wrappers can be stacked on top of each other. Only the methods used by
+-- the prometheus module are wrapped.
+
+local _M = {}
+
+-- Methods of a shared dictionary that modify it and therefore need to acquire
+-- the dictionary lock, and methods that only read it.
+local DICT_WRITE_METHODS = {"set", "safe_set", "add", "safe_add", "incr",
+                            "delete"}
+local DICT_READ_METHODS = {"get", "get_keys", "capacity", "free_space"}
+
+-- Methods of shared dictionaries operating on a single key.
+local DICT_KEY_METHODS = {"get", "set", "safe_set", "add", "safe_add", "incr",
+                          "delete"}
+
+-- Methods that storage backends passed as `backend` option of
+-- Prometheus.init should implement.
+local BACKEND_METHODS = {"get", "set", "incr", "get_keys", "delete"}
+
+-- Delay before each retry of a failed write (seconds, see wrap_retrying).
+local WRITE_RETRY_DELAY = 0.001
+
+-- Dictionary methods used to update metric values, which are skipped for
+-- WRITE_DEADLINE_BACKOFF seconds after a write exceeds the deadline (see
+-- wrap_deadline).
+local DEADLINE_METHODS = {set = true, safe_set = true, incr = true}
+_M.WRITE_DEADLINE_BACKOFF = 1
+-- Error returned for skipped updates (see wrap_deadline).
+_M.DEADLINE_EXCEEDED = "deadline exceeded"
+
+-- Default minimum size of shared dictionaries storing metrics (bytes, see
+-- check_size).
+_M.DEFAULT_MIN_SIZE = 1024 * 1024
+
+-- Key written to check that a dictionary is writable (see check_size).
+local PROBE_KEY = "__ngx_prom__probe"
+
+-- Number of attempts to acquire the lock of a key (see compare_and_set), and
+-- the time after which a lock abandoned by a crashed worker expires
+-- (seconds). Locks are only held while a single value is read and written,
+-- without yielding, so waiting for them does not need to sleep.
+local LOCK_ATTEMPTS = 1000
+local LOCK_TTL = 0.1
+
+-- Dictionary errors that retrying a write would not fix.
+local PERMANENT_DICT_ERRORS = {
+  ["exists"] = true,
+  ["not found"] = true,
+  ["not a number"] = true,
+}
+
+-- Wrap a shared dictionary to measure duration of write operations.
+--
+-- Each write operation is timed with a given probability, and its duration
+-- (which under contention is dominated by waiting for the dictionary lock)
+-- is passed to the `observe` function. Operations performed while `observe`
+-- is running are never timed to avoid recursion.
+--
+-- Note that per-worker counters (see prometheus_resty_counter) write to the
+-- original dictionary, so their syncs are not timed. They happen in a
+-- background timer rather than on the request path, and observing a value
+-- while a counter is being synced would modify the table being iterated.
+--
+-- Args:
+--   dict: a shared dictionary.
+--   sample_rate: (number) probability of timing each write operation.
+--   observe: function that will be called with the duration (in seconds).
+--
+-- Returns:
+--   an object with the same interface as the shared dictionary.
+function _M.wrap_timed(dict, sample_rate, observe)
+  local wrapper = {}
+  local observing = false
+  for _, method in ipairs(DICT_READ_METHODS) do
+    wrapper[method] = function(_, ...)
+      return dict[method](dict, ...)
+    end
+  end
+  for _, method in ipairs(DICT_WRITE_METHODS) do
+    wrapper[method] = function(_, ...)
+      if observing or math.random() >= sample_rate then
+        return dict[method](dict, ...)
+      end
+      ngx.update_time()
+      local start = ngx.now()
+      local r1, r2, r3 = dict[method](dict, ...)
+      ngx.update_time()
+      observing = true
+      observe(ngx.now() - start)
+      observing = false
+      return r1, r2, r3
+    end
+  end
+  return wrapper
+end
+
+-- Wrap a shared dictionary to store all keys with a prefix.
+--
+-- This is used for Prometheus objects with `prefix` option, so that objects
+-- with different prefixes can share a dictionary without their metrics (and
+-- their key indexes, which are stored with internal keys) colliding. Stored
+-- keys of metrics match their exposed names.
+--
+-- Args:
+--   dict: a shared dictionary.
+--   prefix: (string) prefix of all keys.
+--
+-- Returns:
+--   an object with the same interface as the shared dictionary.
+function _M.wrap_prefixed(dict, prefix)
+  local wrapper = {}
+  for _, method in ipairs(DICT_READ_METHODS) do
+    wrapper[method] = function(_, ...)
+      return dict[method](dict, ...)
+    end
+  end
+  for _, method in ipairs(DICT_KEY_METHODS) do
+    wrapper[method] = function(_, key, ...)
+      return dict[method](dict, prefix .. key, ...)
+    end
+  end
+  return wrapper
+end
+
+-- Wrap a storage backend to be used instead of a shared dictionary.
+--
+-- Backends implement a subset of the shared dictionary interface (see
+-- BACKEND_METHODS) with the same arguments and return values. Other methods
+-- used by the library only differ from these in how they handle a full
+-- dictionary, so they are implemented on top of the backend methods.
+--
+-- Args:
+--   backend: an object implementing BACKEND_METHODS.
+--
+-- Returns:
+--   an object with the same interface as the shared dictionary, or nil and an
+--   error message if the backend does not implement all of BACKEND_METHODS.
+function _M.wrap_backend(backend)
+  for _, method in ipairs(BACKEND_METHODS) do
+    if type(backend) ~= "table" or type(backend[method]) ~= "function" then
+      return nil, "Storage backend should implement method '" .. method ..
+        "' (" .. table.concat(BACKEND_METHODS, ", ") .. " are required)"
+    end
+  end
+  local wrapper = {}
+  for _, method in ipairs(BACKEND_METHODS) do
+    wrapper[method] = function(_, ...)
+      return backend[method](backend, ...)
+    end
+  end
+  wrapper.safe_set = wrapper.set
+  wrapper.add = function(_, key, ...)
+    if backend:get(key) ~= nil then
+      return false, "exists", false
+    end
+    return backend:set(key, ...)
+  end
+  wrapper.safe_add = wrapper.add
+  return wrapper
+end
+
+-- Wrap a shared dictionary to retry failed write operations.
+--
+-- Writes that fail with an error other than PERMANENT_DICT_ERRORS are retried
+-- up to `retries` times, waiting WRITE_RETRY_DELAY before each retry. In
+-- phases where yielding is not allowed (e.g. log_by_lua), writes are retried
+-- immediately instead.
+--
+-- Args:
+--   dict: a shared dictionary.
+--   retries: (number) maximum number of retries of each write operation.
+--
+-- Returns:
+--   an object with the same interface as the shared dictionary.
+function _M.wrap_retrying(dict, retries)
+  local wrapper = {}
+  for _, method in ipairs(DICT_READ_METHODS) do
+    wrapper[method] = function(_, ...)
+      return dict[method](dict, ...)
+    end
+  end
+  for _, method in ipairs(DICT_WRITE_METHODS) do
+    wrapper[method] = function(_, ...)
+      local r1, r2, r3 = dict[method](dict, ...)
+      local attempt = 0
+      while type(r2) == "string" and not PERMANENT_DICT_ERRORS[r2] and
+          attempt < retries do
+        attempt = attempt + 1
+        pcall(ngx.sleep, WRITE_RETRY_DELAY)
+        r1, r2, r3 = dict[method](dict, ...)
+      end
+      return r1, r2, r3
+    end
+  end
+  return wrapper
+end
+
+-- Wrap a shared dictionary to skip value updates under lock contention.
+--
+-- Dictionary operations don't support timeouts, so this is an approximation:
+-- duration of each update is measured, and once an update takes longer than
+-- `deadline` (which under contention is dominated by waiting for the lock),
+-- subsequent updates are skipped for WRITE_DEADLINE_BACKOFF seconds instead
+-- of waiting for the lock as well. Other write operations (such as deletions)
+-- are never skipped. Skipped updates return nil and DEADLINE_EXCEEDED.
+--
+-- Args:
+--   dict: a shared dictionary.
+--   deadline: (number) maximum expected duration of an update in seconds.
+--   on_slow: function called with the duration of an update that exceeded
+--     the deadline.
+--   on_skip: function called for each skipped update.
+--
+-- Returns:
+--   an object with the same interface as the shared dictionary.
+function _M.wrap_deadline(dict, deadline, on_slow, on_skip)
+  local wrapper = {}
+  local skip_until = 0
+  for _, method in ipairs(DICT_READ_METHODS) do
+    wrapper[method] = function(_, ...)
+      return dict[method](dict, ...)
+    end
+  end
+  for _, method in ipairs(DICT_WRITE_METHODS) do
+    if DEADLINE_METHODS[method] then
+      wrapper[method] = function(_, ...)
+        if skip_until > 0 then
+          if ngx.now() < skip_until then
+            on_skip()
+            return nil, _M.DEADLINE_EXCEEDED
+          end
+          skip_until = 0
+        end
+        ngx.update_time()
+        local start = ngx.now()
+        local r1, r2, r3 = dict[method](dict, ...)
+        ngx.update_time()
+        local duration = ngx.now() - start
+        if duration > deadline then
+          skip_until = ngx.now() + _M.WRITE_DEADLINE_BACKOFF
+          on_slow(duration)
+        end
+        return r1, r2, r3
+      end
+    else
+      wrapper[method] = function(_, ...)
+        return dict[method](dict, ...)
+      end
+    end
+  end
+  return wrapper
+end
+
+-- Wrap several shared dictionaries to store metrics of different types in
+-- separate dictionaries.
+--
+-- Each key is stored in the dictionary configured for the type of the metric
+-- it belongs to, and all other keys (e.g. the key index) in the default
+-- dictionary. Since every key goes to a single dictionary, keys never collide,
+-- and reading them back through the wrapper merges all dictionaries together.
+-- The dictionary is cached by the name part of keys (before labels), so the
+-- cache is bounded by the number of registered metrics. Keys that don't belong
+-- to a metric (yet) are not cached, since their metric can be registered
+-- later. capacity() and free_space() of the wrapper only report the default
+-- dictionary; usage of each dictionary is exposed by `dict_metrics` option of
+-- Prometheus.init.
+--
+-- Args:
+--   default: the default shared dictionary.
+--   by_type: table of shared dictionaries keyed by metric type.
+--   type_of_key: function returning the type of the metric a key belongs to,
+--     or nil for keys that don't belong to a metric.
+--
+-- Returns:
+--   an object with the same interface as the shared dictionary.
+function _M.wrap_routed(default, by_type, type_of_key)
+  local routes = {}
+  local function route(key)
+    local name = key:match("^[^{]*")
+    local dict = routes[name]
+    if not dict then
+      local typ = type_of_key(key)
+      if not typ then
+        return default
+      end
+      dict = by_type[typ] or default
+      routes[name] = dict
+    end
+    return dict
+  end
+  local wrapper = {}
+  for _, method in ipairs(DICT_READ_METHODS) do
+    wrapper[method] = function(_, ...)
+      return default[method](default, ...)
+    end
+  end
+  for _, method in ipairs(DICT_KEY_METHODS) do
+    wrapper[method] = function(_, key, ...)
+      local dict = route(key)
+      return dict[method](dict, key, ...)
+    end
+  end
+  return wrapper
+end
+
+-- Acquire the lock of a key (see compare_and_set).
+--
+-- Args:
+--   dict: a shared dictionary.
+--   lock_key: (string) key used to lock `key`.
+--   key: (string) the locked key, used in the error message.
+--
+-- Returns:
+--   (boolean) true if the lock was acquired, nil otherwise.
+--   (string) error message.
+local function lock(dict, lock_key, key)
+  local ok, err
+  for _ = 1, LOCK_ATTEMPTS do
+    ok, err = dict:safe_add(lock_key, true, LOCK_TTL)
+    if ok or err ~= "exists" then
+      break
+    end
+  end
+  if not ok then
+    return nil, "failed to lock '" .. key .. "': " .. tostring(err)
+  end
+  return true
+end
+
+-- Set the value of a key if it currently has a given value.
+--
+-- Shared dictionaries have no compare-and-set operation, so the key is
+-- locked with another key added next to it. This only makes the operation
+-- atomic relative to other compare_and_set calls for the same key: other
+-- writes to the key don't wait for the lock.
+--
+-- Args:
+--   dict: a shared dictionary.
+--   lock_key: (string) key used to lock `key`.
+--   key: (string) key to set.
+--   expected: (number) expected current value. Keys that don't exist have the
+--     value of 0.
+--   new: (number) value to set.
+--
+-- Returns:
+--   (boolean) whether the value was set, or nil in case of an error.
+--   (number) the current value if it was not set, or an error string.
+function _M.compare_and_set(dict, lock_key, key, expected, new)
+  local ok, err = lock(dict, lock_key, key)
+  if not ok then
+    return nil, err
+  end
+  local current
+  current, err = dict:get(key)
+  if err then
+    dict:delete(lock_key)
+    return nil, err
+  end
+  current = current or 0
+  if current == expected then
+    ok, err = dict:safe_set(key, new)
+  else
+    ok = false
+  end
+  dict:delete(lock_key)
+  if err then
+    return nil, err
+  end
+  return ok, not ok and current or nil
+end
+
+-- Whether a value is a new minimum or maximum (see set_extreme).
+local function is_extreme(value, current, max)
+  if current == nil then
+    return true
+  end
+  if max then
+    return value > current
+  end
+  return value < current
+end
+
+-- Set the value of a key if it's a new minimum or maximum.
+--
+-- The key is locked like in compare_and_set, which makes this atomic relative
+-- to other set_extreme calls for the same key. The lock is only taken if the
+-- current value (read without it) doesn't already exceed the new one, so most
+-- updates of a settled extreme don't write to the dictionary at all.
+--
+-- Args:
+--   dict: a shared dictionary.
+--   lock_key: (string) key used to lock `key`.
+--   key: (string) key to set.
+--   value: (number) new value. Keys that don't exist are always set.
+--   max: (boolean) whether the key stores the maximum, rather than the
+--     minimum.
+--
+-- Returns:
+--   (boolean) whether the value was set, or nil in case of an error.
+--   (string) error message.
+function _M.set_extreme(dict, lock_key, key, value, max)
+  local current, err = dict:get(key)
+  if err then
+    return nil, err
+  end
+  if not is_extreme(value, current, max) then
+    return false
+  end
+  local ok
+  ok, err = lock(dict, lock_key, key)
+  if not ok then
+    return nil, err
+  end
+  -- Another worker might have updated the key before the lock was taken.
+  current, err = dict:get(key)
+  if not err then
+    if not is_extreme(value, current, max) then
+      dict:delete(lock_key)
+      return false
+    end
+    ok, err = dict:safe_set(key, value)
+  end
+  dict:delete(lock_key)
+  if err then
+    return nil, err
+  end
+  return true
+end
+
+-- Check that a shared dictionary is large enough to store metrics.
+--
+-- Capacity of the dictionary is compared with `min_size`, and a probe key is
+-- written (and deleted right away) to check that the dictionary is writable.
+-- Dictionaries that can't report their capacity (for example, with nginx
+-- older than 1.11.7) are only probed.
+--
+-- Args:
+--   dict: a shared dictionary.
+--   name: (string) name of the dictionary, used in the error message.
+--   min_size: (number) minimum capacity, in bytes.
+--
+-- Returns:
+--   (string) an error message, or nil if the dictionary seems fine.
+function _M.check_size(dict, name, min_size)
+  local ok, capacity = pcall(dict.capacity, dict)
+  if ok and type(capacity) == "number" and capacity < min_size then
+    return "Dictionary '" .. name .. "' is only " .. capacity .. " bytes, " ..
+      "which is less than " .. min_size .. " bytes. Metrics might not fit " ..
+      "into it, please increase its size in `lua_shared_dict`."
+  end
+  local err
+  ok, err = dict:safe_set(PROBE_KEY, true)
+  if not ok then
+    return "Dictionary '" .. name .. "' is not writable: " .. tostring(err)
+  end
+  dict:delete(PROBE_KEY)
+end
+
+return _M
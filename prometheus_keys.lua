@@ -70,13 +70,16 @@ end
 --   key_or_keys: Single string or a list of strings containing keys to add.
 --
 -- Returns:
---   nil on success, string with error message otherwise
+--   nil on success, string with error message otherwise. On success, the
+--   number of keys that did not exist before is returned as well.
 function KeyIndex:add(key_or_keys)
   local keys = key_or_keys
   if type(key_or_keys) == "string" then
     keys = { key_or_keys }
   end
 
+  local added = 0
+
   for _, key in pairs(keys) do
     while true do
       local N = self:sync()
@@ -90,12 +93,14 @@ function KeyIndex:add(key_or_keys)
         self.dict:incr(self.key_count, 1, 0)
         self.keys[N] = key
         self.index[key] = N
+        added = added + 1
         break
       elseif err ~= "exists" then
         return "Unexpected error adding a key: " .. err
       end
     end
   end
+  return nil, added
 end
 
 -- Removes a key based on its value.
@@ -0,0 +1,379 @@
+-- Encoder of the protobuf exposition format used by the prometheus module.
+--
+-- Only the messages needed to expose metrics are implemented (see
+-- io/prometheus/client/metrics.proto in github.com/prometheus/client_model).
+
+local _M = {}
+
+-- Values of the MetricType enum of the protobuf format.
+local PROTOBUF_TYPES = {counter = 0, gauge = 1, summary = 2, untyped = 3,
+                        histogram = 4}
+
+-- Encode a non-negative integer as a protocol buffer varint.
+local function pb_varint(n)
+  local bytes = {}
+  while n >= 128 do
+    table.insert(bytes, string.char(n % 128 + 128))
+    n = math.floor(n / 128)
+  end
+  table.insert(bytes, string.char(n))
+  return table.concat(bytes)
+end
+
+-- Encode a number as a little-endian IEEE 754 double.
+local function pb_double(value)
+  local sign = 0
+  if value < 0 or (value == 0 and 1 / value < 0) then
+    sign = 128
+    value = -value
+  end
+  local exponent, mantissa
+  if value ~= value then
+    exponent, mantissa = 2047, 2 ^ 51
+  elseif value == math.huge then
+    exponent, mantissa = 2047, 0
+  elseif value == 0 then
+    exponent, mantissa = 0, 0
+  else
+    local frac, exp = math.frexp(value)
+    exponent = exp + 1022
+    if exponent > 0 then
+      mantissa = (frac * 2 - 1) * 2 ^ 52
+    else
+      -- Subnormal numbers are multiples of 2^-1074.
+      exponent, mantissa = 0, frac * 2 ^ (exp + 1074)
+    end
+  end
+  local bytes = {}
+  for i = 1, 6 do
+    bytes[i] = string.char(mantissa % 256)
+    mantissa = math.floor(mantissa / 256)
+  end
+  bytes[7] = string.char(exponent % 16 * 16 + mantissa)
+  bytes[8] = string.char(sign + math.floor(exponent / 16))
+  return table.concat(bytes)
+end
+
+-- Encode a protocol buffer field with an unsigned integer value.
+local function pb_uint(field, n)
+  return pb_varint(field * 8) .. pb_varint(n)
+end
+
+-- Encode a protocol buffer field with a signed (sint32 or sint64) value.
+local function pb_sint(field, n)
+  return pb_varint(field * 8) .. pb_varint(n >= 0 and 2 * n or -2 * n - 1)
+end
+
+-- Encode a protocol buffer field with a double value.
+local function pb_double_field(field, value)
+  return pb_varint(field * 8 + 1) .. pb_double(value)
+end
+
+-- Encode a protocol buffer field with a string or an embedded message.
+local function pb_bytes(field, str)
+  return pb_varint(field * 8 + 2) .. pb_varint(#str) .. str
+end
+
+-- Encode a count, which can be either an integer or a double field.
+local function pb_count(int_field, float_field, count)
+  if count >= 0 and count % 1 == 0 then
+    return pb_uint(int_field, count)
+  end
+  return pb_double_field(float_field, count)
+end
+
+-- Convert a sample value of the text exposition format to a number.
+local function sample_number(value)
+  local lower = value:lower()
+  if lower == "nan" or lower == "-nan" then
+    return 0 / 0
+  elseif lower == "inf" or lower == "+inf" then
+    return math.huge
+  elseif lower == "-inf" then
+    return -math.huge
+  end
+  return tonumber(value)
+end
+
+-- Remove the last label from labels of a sample, if it has a given name.
+--
+-- Args:
+--   labels: (string) labels including curly braces, or an empty string.
+--   label_name: (string) label name, such as "le" or "quantile".
+--
+-- Returns:
+--   (string) the remaining labels.
+--   (string) value of the removed label, or nil.
+local function strip_last_label(labels, label_name)
+  local start, value = labels:match("()[{,]" .. label_name ..
+    '="([^"]*)"}$')
+  if not start then
+    return labels
+  elseif start == 1 then
+    return "", value
+  end
+  return labels:sub(1, start - 1) .. "}", value
+end
+
+-- Encode buckets of a native histogram with one sign as protocol buffer
+-- fields: spans of consecutive buckets followed by deltas of their counts.
+--
+-- Args:
+--   bins: array of {bucket index, count} pairs, sorted by index.
+--   span_field: (number) field number of spans.
+--   delta_field: (number) field number of deltas.
+--
+-- Returns:
+--   (array) encoded fields.
+local function pb_native_buckets(bins, span_field, delta_field)
+  local spans, deltas = {}, {}
+  local previous_index, previous_count
+  for _, bin in ipairs(bins) do
+    local index, count = bin[1], bin[2]
+    if previous_index and index == previous_index + 1 then
+      spans[#spans][2] = spans[#spans][2] + 1
+    else
+      -- The first span is offset from zero, and the others from the end of
+      -- the previous span.
+      local offset = previous_index and index - previous_index - 1 or index
+      table.insert(spans, {offset, 1})
+    end
+    table.insert(deltas, pb_sint(delta_field, count - (previous_count or 0)))
+    previous_index, previous_count = index, count
+  end
+  local fields = {}
+  for _, span in ipairs(spans) do
+    table.insert(fields, pb_bytes(span_field,
+      pb_sint(1, span[1]) .. pb_uint(2, span[2])))
+  end
+  table.insert(fields, table.concat(deltas))
+  return fields
+end
+
+-- Encode a Histogram message of the protobuf format.
+--
+-- Args:
+--   sample: table with `count`, `sum` and `buckets` (array of {upper bound,
+--     cumulative count} pairs) of a histogram series.
+--   native: (table) native buckets of the series, as returned by the
+--     `native_histogram` function passed to encode(). Optional.
+--
+-- Returns:
+--   (string) the message.
+local function pb_histogram(sample, native)
+  local count = sample.count or 0
+  local sum = sample.sum or 0
+  local native_fields = {}
+  if native then
+    local positive, negative = {}, {}
+    local zero_count, total = 0, 0
+    for bin, bin_count in pairs(native.bins or {}) do
+      local sign, index = bin:sub(1, 1), tonumber(bin:sub(2))
+      if sign == "z" then
+        zero_count = bin_count
+      elseif sign == "p" then
+        table.insert(positive, {index, bin_count})
+      else
+        table.insert(negative, {index, bin_count})
+      end
+      total = total + bin_count
+    end
+    -- Bucket counts are read before _count, so under concurrent
+    -- observations _count might already include values that are not in the
+    -- buckets. Prometheus only accepts this if the sum is NaN, as NaN values
+    -- are not counted in any bucket.
+    if sum == sum then
+      count = total
+    else
+      count = math.max(count, total)
+    end
+    local function by_index(a, b) return a[1] < b[1] end
+    table.sort(positive, by_index)
+    table.sort(negative, by_index)
+    table.insert(native_fields, pb_sint(5, native.schema))
+    table.insert(native_fields, pb_double_field(6, native.zero_threshold))
+    table.insert(native_fields, pb_uint(7, zero_count))
+    if #negative > 0 then
+      table.insert(native_fields,
+        table.concat(pb_native_buckets(negative, 9, 10)))
+    end
+    if #positive > 0 then
+      table.insert(native_fields,
+        table.concat(pb_native_buckets(positive, 12, 13)))
+    elseif #negative == 0 then
+      -- An empty span marks a histogram without observations as native.
+      table.insert(native_fields,
+        pb_bytes(12, pb_sint(1, 0) .. pb_uint(2, 0)))
+    end
+  end
+  local fields = {pb_count(1, 4, count), pb_double_field(2, sum)}
+  for _, bucket in ipairs(sample.buckets) do
+    -- The +Inf bucket is implied by the count.
+    if bucket[1] ~= math.huge then
+      table.insert(fields, pb_bytes(3,
+        pb_count(1, 4, bucket[2]) .. pb_double_field(2, bucket[1])))
+    end
+  end
+  table.insert(fields, table.concat(native_fields))
+  return table.concat(fields)
+end
+
+-- Encode a Metric message of the protobuf format.
+--
+-- Args:
+--   family: table describing a metric family, see encode().
+--   sample: table with `labels`, `series` and `timestamp` of a series, as
+--     well as its value or, for histograms and summaries, their components.
+--   native_histogram: function passed to encode().
+--
+-- Returns:
+--   (string) the message.
+local function pb_metric(family, sample, native_histogram)
+  local fields = {}
+  for _, label in ipairs(sample.labels) do
+    table.insert(fields, pb_bytes(1,
+      pb_bytes(1, label[1]) .. pb_bytes(2, label[2])))
+  end
+  if family.typ == "histogram" then
+    table.insert(fields, pb_bytes(7, pb_histogram(sample,
+      native_histogram(family.name, sample.series))))
+  elseif family.typ == "summary" then
+    local summary = {pb_uint(1, sample.count or 0),
+                     pb_double_field(2, sample.sum or 0)}
+    for _, quantile in ipairs(sample.quantiles) do
+      table.insert(summary, pb_bytes(3, pb_double_field(1, quantile[1]) ..
+        pb_double_field(2, quantile[2])))
+    end
+    table.insert(fields, pb_bytes(4, table.concat(summary)))
+  else
+    local value_field = ({counter = 3, gauge = 2})[family.typ] or 5
+    table.insert(fields, pb_bytes(value_field,
+      pb_double_field(1, sample.value or 0)))
+  end
+  if sample.timestamp then
+    table.insert(fields, pb_uint(6, sample.timestamp))
+  end
+  return table.concat(fields)
+end
+
+-- Find the suffix of a sample name relative to its metric family name.
+--
+-- Args:
+--   family: table describing a metric family, see encode().
+--   sample_name: (string) metric name of a sample.
+--
+-- Returns:
+--   (string) the suffix, such as "_count" or an empty string, or nil if the
+--     sample does not belong to the family.
+local function family_suffix(family, sample_name)
+  if sample_name == family.name then
+    return ""
+  elseif sample_name:sub(1, #family.name) ~= family.name then
+    return
+  end
+  local suffix = sample_name:sub(#family.name + 1)
+  if ((suffix == "_count" or suffix == "_sum") and
+      (family.typ == "histogram" or family.typ == "summary")) or
+      (suffix == "_bucket" and family.typ == "histogram") then
+    return suffix
+  end
+end
+
+-- Convert metric data in the text exposition format to the protobuf one.
+--
+-- Metric data is always produced in the text format first, so that all
+-- metrics are exposed in the same way in both formats.
+--
+-- Args:
+--   output: array of strings in the text format (not OpenMetrics).
+--   parse_sample: function splitting a sample line into metric name, labels
+--     including curly braces, value and timestamp (all strings).
+--   parse_labels: function returning a list of {label_name, label_value}
+--     pairs as the second value, given labels including curly braces.
+--   native_histogram: function returning a table with `schema`,
+--     `zero_threshold` and `bins` (counts keyed by bin name) of the native
+--     buckets of a histogram series, given the name of its family and its
+--     labels, or nil if the histogram has no native buckets.
+--
+-- Returns:
+--   (array) length-delimited MetricFamily messages.
+function _M.encode(output, parse_sample, parse_labels, native_histogram)
+  local families = {}
+  local family
+  local function get_family(name)
+    if not family or family.name ~= name then
+      family = {name = name, typ = "untyped", samples = {}, series = {}}
+      table.insert(families, family)
+    end
+    return family
+  end
+  for _, str in ipairs(output) do
+    for line in str:gmatch("([^\n]*)\n") do
+      local kind, name, rest = line:match("^# (%u+) ([^ ]+) ?(.*)$")
+      if kind == "HELP" then
+        get_family(name).help = rest:gsub("\\([n\\])", function(c)
+          return c == "n" and "\n" or "\\"
+        end)
+      elseif kind == "TYPE" then
+        get_family(name).typ = rest
+      elseif line:sub(1, 1) ~= "#" then
+        local sample_name, labels, value, timestamp = parse_sample(line)
+        if sample_name then
+          local suffix = family and family_suffix(family, sample_name)
+          if not suffix then
+            get_family(sample_name)
+            suffix = ""
+          end
+          local series, bound = labels
+          if suffix == "_bucket" then
+            series, bound = strip_last_label(labels, "le")
+          elseif family.typ == "summary" and suffix == "" then
+            series, bound = strip_last_label(labels, "quantile")
+          end
+          local sample = family.series[series]
+          if not sample then
+            local _, label_pairs = parse_labels(series)
+            sample = {labels = label_pairs, series = series, buckets = {},
+                      quantiles = {}}
+            family.series[series] = sample
+            table.insert(family.samples, sample)
+          end
+          sample.timestamp = tonumber(timestamp)
+          value = sample_number(value)
+          if suffix == "_bucket" then
+            table.insert(sample.buckets, {sample_number(bound), value})
+          elseif suffix == "_count" then
+            sample.count = value
+          elseif suffix == "_sum" then
+            sample.sum = value
+          elseif bound then
+            table.insert(sample.quantiles, {sample_number(bound), value})
+          else
+            sample.value = value
+          end
+        end
+      end
+    end
+  end
+
+  local messages = {}
+  for _, f in ipairs(families) do
+    if #f.samples > 0 then
+      local fields = {pb_bytes(1, f.name)}
+      if f.help then
+        table.insert(fields, pb_bytes(2, f.help))
+      end
+      table.insert(fields, pb_uint(3, PROTOBUF_TYPES[f.typ] or
+        PROTOBUF_TYPES.untyped))
+      for _, sample in ipairs(f.samples) do
+        table.insert(fields,
+          pb_bytes(4, pb_metric(f, sample, native_histogram)))
+      end
+      local message = table.concat(fields)
+      table.insert(messages, pb_varint(#message) .. message)
+    end
+  end
+  return messages
+end
+
+return _M
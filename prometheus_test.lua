@@ -17,6 +17,9 @@ function SimpleDict:safe_add(k, v)
   if k == "willnotfit" or v == "willnotfit" then
     return nil, "no memory"
   end
+  if self:get(k) ~= nil then
+    return nil, "exists"
+  end
   self:set(k, v)
   return true, nil  -- ok, err
 end
@@ -29,12 +32,12 @@ function SimpleDict:incr(k, v, init)
   return self.dict[k], nil  -- newval, err
 end
 function SimpleDict:get(k)
-  -- simulate key not exist
-  if k == "gauge2{f2=\"key_not_exist\",f1=\"key_not_exist\"}" then
+  -- simulate key not exist (keys might be stored with a prefix)
+  if k:find("gauge2{f2=\"key_not_exist\",f1=\"key_not_exist\"}$") then
     return nil, nil
   end
   -- simulate an error
-  if k == "gauge2{f2=\"dict_error\",f1=\"dict_error\"}" then
+  if k:find("gauge2{f2=\"dict_error\",f1=\"dict_error\"}$") then
     return nil, "dict error"
   end
   if not self.dict then self.dict = {} end
@@ -64,14 +67,103 @@ function Nginx.print(printed)
 end
 Nginx.worker = {}
 function Nginx.worker.id()
-  return 'testworker'
+  return ngx.worker_id or 'testworker'
+end
+function Nginx.worker.count()
+  return 4
 end
 function Nginx.sleep() end
 Nginx.timer = {}
-function Nginx.timer.every(_, _, _) end
+-- Timers are recorded in ngx.timers, and can be fired manually.
+function Nginx.timer.every(interval, fn, ...)
+  if not ngx.timers then ngx.timers = {} end
+  table.insert(ngx.timers, {interval = interval, fn = fn, args = {...}})
+  return true
+end
 function Nginx.get_phase()
   return 'init_worker'
 end
+function Nginx.time()
+  return 1600000000
+end
+-- ngx.now() advances by ngx.clock_step seconds on each ngx.update_time() call.
+function Nginx.now()
+  return ngx.clock or 1600000000
+end
+Nginx.location = {}
+function Nginx.location.capture(uri)
+  return (ngx.captured or {})[uri] or {status = 404, body = ""}
+end
+Nginx.re = {}
+-- Lua patterns are close enough to regular expressions for tests.
+function Nginx.re.find(subject, regex)
+  local ok, from, to = pcall(string.find, subject, regex)
+  if not ok then
+    return nil, nil, from
+  end
+  return from, to
+end
+function Nginx.update_time()
+  ngx.clock = Nginx.now() + (ngx.clock_step or 0)
+end
+Nginx.var = {}
+Nginx.HTTP_UNAUTHORIZED = 401
+Nginx.HTTP_FORBIDDEN = 403
+Nginx.HTTP_INTERNAL_SERVER_ERROR = 500
+function Nginx.exit(status)
+  ngx.status = status
+end
+-- Not SHA1, but a fixed-length digest is enough for tests.
+function Nginx.sha1_bin(str)
+  local bytes = {}
+  for i = 1, 20 do
+    local h = i
+    for j = 1, #str do
+      h = (h * 31 + str:byte(j) + i) % 256
+    end
+    bytes[i] = string.char(h)
+  end
+  return table.concat(bytes)
+end
+local BASE64_CHARS =
+  "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+function Nginx.encode_base64(str)
+  local out = {}
+  for i = 1, #str, 3 do
+    local a, b, c = str:byte(i, i + 2)
+    local n = a * 65536 + (b or 0) * 256 + (c or 0)
+    for j = 1, 4 do
+      local idx = math.floor(n / 64 ^ (4 - j)) % 64 + 1
+      local pad = (j == 3 and not b) or (j == 4 and not c)
+      table.insert(out, pad and "=" or BASE64_CHARS:sub(idx, idx))
+    end
+  end
+  return table.concat(out)
+end
+function Nginx.decode_base64(str)
+  if #str % 4 ~= 0 or not str:match("^[%w+/]*=?=?$") then
+    return nil
+  end
+  local out = {}
+  for i = 1, #str, 4 do
+    local n, pad = 0, 0
+    for j = i, i + 3 do
+      local c = str:sub(j, j)
+      if c == "=" then
+        pad = pad + 1
+      end
+      n = n * 64 + (c == "=" and 0 or BASE64_CHARS:find(c, 1, true) - 1)
+    end
+    local bytes = string.char(math.floor(n / 65536), math.floor(n / 256) % 256,
+      n % 256)
+    table.insert(out, bytes:sub(1, 3 - pad))
+  end
+  return table.concat(out)
+end
+Nginx.req = {}
+function Nginx.req.get_uri_args()
+  return ngx.uri_args or {}
+end
 
 ngx = setmetatable({shared={}}, Nginx)
 
@@ -96,539 +188,4081 @@ function TestPrometheus:setUp()
   self.gauge2 = self.p:gauge("gauge2", "Gauge 2", {"f2", "f1"})
   self.hist1 = self.p:histogram("l1", "Histogram 1")
   self.hist2 = self.p:histogram("l2", "Histogram 2", {"var", "site"})
+  -- Only keep timers started by each test.
+  ngx.timers = nil
 end
 function TestPrometheus.tearDown()
   ngx.logs = nil
+  ngx.printed = nil
+  ngx.uri_args = nil
+  ngx.clock = nil
+  ngx.clock_step = nil
+  ngx.var = nil
+  ngx.captured = nil
+  ngx.timers = nil
+  ngx.worker_id = nil
+  ngx.status = nil
+  ngx.socket = nil
 end
 function TestPrometheus:testInit()
   luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
   luaunit.assertEquals(ngx.logs, nil)
 end
-function TestPrometheus:testInitOptions()
-  self.dict = setmetatable({}, SimpleDict)
-  ngx.shared.metrics = self.dict
-
-  local p1 = require('prometheus').init("metrics")
-  assert(p1.prefix == "")
-  assert(p1.sync_interval == 1)
-  assert(p1.error_metric_name == "nginx_metric_errors_total")
-
-  local p2 = require('prometheus').init("metrics", "test_pref_")
-  assert(p2.prefix == "test_pref_")
-  assert(p2.sync_interval == 1)
-  assert(p2.error_metric_name == "nginx_metric_errors_total")
-
-  local p3 = require('prometheus').init("metrics", {sync_interval=3})
-  assert(p3.prefix == "")
-  assert(p3.sync_interval == 3)
-  assert(p3.error_metric_name == "nginx_metric_errors_total")
+function TestPrometheus:testLastErrorTimestamp()
+  luaunit.assertEquals(self.dict:get("nginx_metric_last_error_timestamp_seconds"), 0)
 
-  local p4 = require('prometheus').init("metrics", {
-    prefix="foo", sync_interval=3, error_metric_name="foobar"})
-  assert(p4.prefix == "foo")
-  assert(p4.sync_interval == 3)
-  assert(p4.error_metric_name == "foobar")
+  ngx.clock = 1600000123.5
+  self.counter1:inc(-1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_last_error_timestamp_seconds"),
+    1600000123.5)
 
-  luaunit.assertEquals(ngx.logs, nil)
+  self.p:collect()
+  assert(find_idx(ngx.printed,
+    "# TYPE nginx_metric_last_error_timestamp_seconds gauge") ~= nil)
+  assert(find_idx(ngx.printed,
+    "nginx_metric_last_error_timestamp_seconds 1600000123.5") ~= nil)
 end
-function TestPrometheus:testInitWorker()
+function TestPrometheus:testLastErrorTimestampDisabled()
   self.dict = setmetatable({}, SimpleDict)
   ngx.shared.metrics = self.dict
-
-  local p1 = require('prometheus').init("metrics")
-  p1:init_worker(3)
-
-  luaunit.assertEquals(#ngx.logs, 1)
-  luaunit.assertStrContains(ngx.logs[1], "do not explicitly call init_worker")
+  local p = require('prometheus').init("metrics", {last_error_timestamp=false})
+  p:counter("metric1", "Metric 1"):inc(-1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_last_error_timestamp_seconds"), nil)
+  p:collect()
+  assert(find_idx(ngx.printed,
+    "# TYPE nginx_metric_last_error_timestamp_seconds gauge") == nil)
 end
-function TestPrometheus.testErrorUnitialized()
-  local p = require('prometheus')
-  p:counter("metric1")
-  p:histogram("metric2")
-  p:gauge("metric3")
-  p:metric_data()
+function TestPrometheus:testFileExport()
+  local path = os.tmpname()
+  self.p:start_file_export(path, 10)
+  -- only worker 0 exports metrics.
+  luaunit.assertEquals(ngx.timers, nil)
 
-  luaunit.assertEquals(#ngx.logs, 4)
-end
-function TestPrometheus.testErrorUnknownDict()
-  local pok, perr = pcall(require('prometheus').init, "nonexistent")
-  luaunit.assertEquals(pok, false)
-  luaunit.assertStrContains(perr, "does not seem to exist")
-end
-function TestPrometheus:testErrorNoMemory()
-  local gauge3 = self.p:gauge("willnotfit")
-  self.counter1:inc(5)
-  gauge3:inc(1)
+  ngx.worker_id = 0
+  self.p:start_file_export(path, 10)
+  luaunit.assertEquals(#ngx.timers, 1)
+  luaunit.assertEquals(ngx.timers[1].interval, 10)
 
-  self.p._counter:sync()
-  luaunit.assertEquals(self.dict:get("metric1"), 5)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
-  luaunit.assertEquals(self.dict:get("willnotfit"), nil)
-  luaunit.assertEquals(#ngx.logs, 1)
+  self.counter1:inc(5)
+  local timer = ngx.timers[1]
+  timer.fn(false, unpack(timer.args))
+  local f = io.open(path)
+  local content = f:read("*a")
+  f:close()
+  os.remove(path)
+  luaunit.assertStrContains(content, "# TYPE metric1 counter\nmetric1 5\n")
+  luaunit.assertEquals(io.open(path .. ".tmp"), nil)
+  luaunit.assertEquals(ngx.logs, nil)
 end
-function TestPrometheus:testErrorInvalidMetricName()
-  self.p:histogram("name with a space", "Histogram")
-  self.p:gauge("nonprintable\004characters", "Gauge")
-  self.p:counter("0startswithadigit", "Counter")
-  self.p:counter("__ngx_prom__usesinternalprefix", "Counter no.2")
+function TestPrometheus:testFileExportGzip()
+  ngx.worker_id = 0
+  self.p:start_file_export("/tmp/metrics.prom.gz", 10, {format = "gzip"})
+  luaunit.assertEquals(ngx.timers, nil)
+  luaunit.assertStrContains(ngx.logs[1], "requires the lua-zlib module")
+  ngx.logs = nil
 
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 4)
-  luaunit.assertEquals(#ngx.logs, 4)
-end
-function TestPrometheus:testErrorInvalidLabels()
-  self.p:histogram("hist1", "Histogram", {"le"})
-  self.p:gauge("count1", "Gauge", {"le"})
-  self.p:counter("count1", "Counter", {"foo\002"})
+  -- Fake compression, marking the compressed data.
+  local stream
+  package.loaded.zlib = {deflate = function(level, window_bits)
+    stream = {level = level, window_bits = window_bits}
+    return function(input, flush)
+      stream.flush = flush
+      return "<" .. input .. ">", true
+    end
+  end}
+  local path = os.tmpname()
+  self.p:start_file_export(path, 10, {format = "gzip"})
+  package.loaded.zlib = nil
+  luaunit.assertEquals(#ngx.timers, 1)
 
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
-  luaunit.assertEquals(#ngx.logs, 3)
+  self.counter1:inc(5)
+  local timer = ngx.timers[1]
+  timer.fn(false, unpack(timer.args))
+  local f = io.open(path, "rb")
+  local content = f:read("*a")
+  f:close()
+  os.remove(path)
+  luaunit.assertEquals(stream.level, 6)
+  luaunit.assertEquals(stream.window_bits, 31)
+  luaunit.assertEquals(stream.flush, "finish")
+  luaunit.assertStrContains(content, "<# HELP")
+  luaunit.assertStrContains(content, "metric1 5\n")
+  luaunit.assertEquals(content:sub(-1), ">")
+  luaunit.assertEquals(ngx.logs, nil)
 end
-function TestPrometheus:testErrorDuplicateMetrics()
-  self.p:counter("metric1", "Another metric 1")
-  self.p:counter("l1_count", "Conflicts with Histogram 1")
-  self.p:counter("l2_sum", "Conflicts with Histogram 2")
-  self.p:counter("l2_bucket", "Conflicts with Histogram 2")
-  self.p:gauge("metric1", "Conflicts with Metric 1")
-  self.p:histogram("l1", "Conflicts with Histogram 1")
-  self.p:histogram("metric2", "Conflicts with Metric 2")
-  self.p:counter("metric_A_count", "Metric ending with _count")
-  self.p:histogram("metric_A", "Conflicts with metric_A_count")
-  self.p:counter("metric_B_sum", "Metric ending with _sum")
-  self.p:histogram("metric_B", "Conflicts with metric_B_sum")
-  self.p:counter("metric_C_bucket", "Metric ending with _bucket")
-  self.p:histogram("metric_C", "Conflicts with metric_C_bucket")
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 10)
-  luaunit.assertEquals(#ngx.logs, 10)
+function TestPrometheus:testFileExportErrors()
+  ngx.worker_id = 0
+  self.p:start_file_export("/tmp/metrics.prom", 10, {format = "json"})
+  self.p:start_file_export("/tmp/metrics.prom", 0)
+  self.p:start_file_export("/nonexistent/metrics.prom", 10)
+  luaunit.assertEquals(#ngx.timers, 1)
+  local timer = ngx.timers[1]
+  timer.fn(false, unpack(timer.args))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+  luaunit.assertStrContains(ngx.logs[1], "Unknown file export format")
+  luaunit.assertStrContains(ngx.logs[1], "should be one of: text, graphite, gzip")
+  luaunit.assertStrContains(ngx.logs[2], "positive interval")
+  luaunit.assertStrContains(ngx.logs[3], "Could not open")
 end
-function TestPrometheus:testErrorNegativeValue()
-  self.counter1:inc(-5)
+function TestPrometheus:testPush()
+  -- A fake cosocket which records sent data and returns a given status line.
+  local sent, connected, status_line
+  ngx.socket = {tcp = function()
+    return {
+      settimeout = function() end,
+      connect = function(_, host, port)
+        connected = host .. ":" .. port
+        if host == "unreachable" then
+          return nil, "connection refused"
+        end
+        return true
+      end,
+      send = function(_, data)
+        sent = table.concat(data)
+        return #sent
+      end,
+      receive = function() return status_line end,
+      close = function() end,
+    }
+  end}
+
+  self.p:push("http://pushgateway:9091", "nginx", "edge-1")
+  -- only worker 0 pushes metrics.
+  luaunit.assertEquals(ngx.timers, nil)
 
+  ngx.worker_id = 0
+  self.p:push("http://pushgateway:9091/", "nginx", "edge/1", {interval = 30})
+  luaunit.assertEquals(#ngx.timers, 1)
+  luaunit.assertEquals(ngx.timers[1].interval, 30)
+
+  self.counter1:inc(5)
   self.p._counter:sync()
-  luaunit.assertEquals(self.dict:get("metric1"), nil)
+  status_line = "HTTP/1.1 200 OK"
+  local timer = ngx.timers[1]
+  timer.fn(false, unpack(timer.args))
+  luaunit.assertEquals(connected, "pushgateway:9091")
+  luaunit.assertStrContains(sent,
+    "POST /metrics/job/nginx/instance@base64/ZWRnZS8x HTTP/1.1\r\n")
+  luaunit.assertStrContains(sent, "Host: pushgateway:9091\r\n")
+  luaunit.assertStrContains(sent, "# TYPE metric1 counter\nmetric1 5\n")
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  -- failed pushes are counted as errors, and retried on the next tick.
+  status_line = "HTTP/1.1 400 Bad Request"
+  timer.fn(false, unpack(timer.args))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+  luaunit.assertStrContains(ngx.logs[1], "unexpected response status 400")
+  status_line = "HTTP/1.1 202 Accepted"
+  timer.fn(false, unpack(timer.args))
   luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
-  luaunit.assertEquals(#ngx.logs, 1)
-end
-function TestPrometheus:testErrorIncorrectLabels()
-  self.counter1:inc(1, {"should-be-no-labels"})
-  self.counter2:inc(1, {"too-few-labels"})
-  self.counter2:inc(1, {nil, "v"})
-  self.counter2:inc(1, {"v", nil})
-  self.counter2:inc(1)
-  self.counter3:inc(1, {nil})
-  self.gauge1:set(1, {"should-be-no-labels"})
-  self.gauge2:set(1, {"too-few-labels"})
-  self.gauge2:set(1)
-  self.hist2:observe(1, {"too", "many", "labels"})
-  self.hist2:observe(1, {nil, "label"})
-  self.hist2:observe(1, {"label", nil})
 
-  self.p._counter:sync()
-  luaunit.assertEquals(self.dict:get("metric1"), nil)
-  luaunit.assertEquals(self.dict:get("l1_count"), nil)
-  luaunit.assertEquals(self.dict:get("gauge1"), nil)
-  luaunit.assertEquals(self.dict:get("gauge2"), nil)
-  luaunit.assertEquals(self.dict:get("l1_count"), nil)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 12)
-  luaunit.assertEquals(#ngx.logs, 12)
+  self.p:push("https://unreachable/prefix", "my job")
+  timer = ngx.timers[2]
+  timer.fn(false, unpack(timer.args))
+  luaunit.assertEquals(connected, "unreachable:443")
+  luaunit.assertEquals(timer.args[2].host_header, "unreachable")
+  luaunit.assertEquals(timer.args[2].path, "/prefix/metrics/job/my%20job")
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  luaunit.assertStrContains(ngx.logs[2], "connection refused")
+
+  self.p:push("pushgateway:9091", "nginx")
+  self.p:push("http://pushgateway:9091", "")
+  self.p:push("http://pushgateway:9091", "nginx", nil, {interval = 0})
+  luaunit.assertEquals(#ngx.timers, 2)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 5)
+
+  -- samples are pushed without timestamps, which Pushgateway rejects.
+  ngx.clock = 1000.5
+  local p = require('prometheus').init("metrics", {timestamps = true})
+  p:counter("stamped", "Stamped"):inc(1)
+  p:push("http://pushgateway", "nginx")
+  timer = ngx.timers[#ngx.timers]
+  timer.fn(false, unpack(timer.args))
+  luaunit.assertStrContains(sent, "Host: pushgateway\r\n")
+  luaunit.assertStrContains(sent, "\nstamped 1\n")
+  luaunit.assertStrContains(table.concat(p:metric_data()), "\nstamped 1 1000500\n")
 end
-function TestPrometheus:testNumericLabelValues()
-  self.counter2:inc(1, {0, 15.5})
-  self.gauge2:set(1, {0, 15.5})
-  self.hist2:observe(1, {-3, 90000})
+function TestPrometheus:testProcessMetrics()
+  -- A fake FFI library which reports 2 open file descriptors.
+  local entries = 0
+  package.loaded.ffi = {os = "Linux", cdef = function() end, C = {
+    getpagesize = function() return 4096 end,
+    opendir = function() entries = 5; return {} end,
+    readdir = function()
+      entries = entries - 1
+      if entries >= 0 then return {} end
+    end,
+    closedir = function() end,
+  }}
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  ngx.clock = 1600000123
+  -- no globals are assigned by init.
+  local globals = {}
+  setmetatable(_G, {__newindex = function(t, k, v)
+    table.insert(globals, k)
+    rawset(t, k, v)
+  end})
+  local p = require('prometheus').init("metrics", {process_metrics=true})
+  setmetatable(_G, nil)
+  package.loaded.ffi = nil
+  luaunit.assertEquals(globals, {})
 
-  self.p._counter:sync()
-  luaunit.assertEquals(self.dict:get('metric2{f2="0",f1="15.5"}'), 1)
-  luaunit.assertEquals(self.dict:get('gauge2{f2="0",f1="15.5"}'), 1)
-  luaunit.assertEquals(self.dict:get('l2_sum{var="-3",site="90000"}'), 1)
+  luaunit.assertEquals(self.dict:get("nginx_worker_processes"), 4)
+  luaunit.assertEquals(
+    self.dict:get('process_start_time_seconds{worker="testworker"}'), 1600000123)
+  luaunit.assertEquals(
+    self.dict:get('process_open_fds{worker="testworker"}'), 2)
+  local rss = self.dict:get('process_resident_memory_bytes{worker="testworker"}')
+  luaunit.assertTrue(rss > 0 and rss % 4096 == 0)
   luaunit.assertEquals(ngx.logs, nil)
-end
-function TestPrometheus:testMultibyteLabelValues()
-  self.counter2:inc(1, {"foo", "baz\189\166qux"})
-  self.counter2:inc(1, {"bad1\195\195bad", "bad2\224\161\209bad"})
-  self.counter2:inc(1, {"bad3\240\144\129\192bad", "bad4\242\129\210bad"})
-  self.counter2:inc(1, {"¢€𤭢", "Pay in €. Thanks."})
-  self.gauge2:set(1, {"z\001", "\002"})
-  self.gauge2:set(1, {"\224\143\175", "\237\129\128"})
-  self.hist2:observe(1, {"\166omg", "fooшbar"})
-  self.hist2:observe(1, {"\244\143\143\143", "\244"})
 
-  self.p._counter:sync()
-  luaunit.assertEquals(self.dict:get('metric2{f2="foo",f1="baz"}'), 1)
-  luaunit.assertEquals(self.dict:get('metric2{f2="bad1",f1="bad2"}'), 1)
-  luaunit.assertEquals(self.dict:get('metric2{f2="bad3",f1="bad4"}'), 1)
-  luaunit.assertEquals(self.dict:get('metric2{f2="¢€𤭢",f1="Pay in €. Thanks."}'), 1)
-  luaunit.assertEquals(self.dict:get('gauge2{f2="z\001",f1="\002"}'), 1)
-  luaunit.assertEquals(self.dict:get('gauge2{f2="",f1="\237\129\128"}'), 1)
-  luaunit.assertEquals(self.dict:get('l2_sum{var="",site="fooшbar"}'), 1)
-  luaunit.assertEquals(self.dict:get('l2_sum{var="\244\143\143\143",site=""}'), 1)
+  -- metrics are refreshed by a timer (the other one is check_reset).
+  luaunit.assertEquals(#ngx.timers, 2)
+  p._process_metrics.readers.process_open_fds = function()
+    return nil, "no such file"
+  end
+  ngx.timers[1].fn(false, unpack(ngx.timers[1].args))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+  luaunit.assertStrContains(ngx.logs[1], "no such file")
+end
+function TestPrometheus:testProcessMetricsWithoutFFI()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  require('prometheus').init("metrics", {process_metrics=true})
+  luaunit.assertEquals(self.dict:get("nginx_worker_processes"), 4)
+  luaunit.assertNotNil(
+    self.dict:get('process_start_time_seconds{worker="testworker"}'))
+  luaunit.assertNil(
+    self.dict:get('process_open_fds{worker="testworker"}'))
   luaunit.assertEquals(ngx.logs, nil)
 end
-function TestPrometheus:testNoValues()
-  self.counter1:inc()  -- defaults to 1
-  self.gauge1:set()  -- should produce an error
-  self.hist1:observe()  -- should produce an error
+function TestPrometheus:testMetricSyncInterval()
+  local slow = self.p:counter("slow", "Slow", {"f1"}, {sync_interval = 5})
+  local hist = self.p:histogram("slow_hist", "Slow", nil,
+    {buckets = {1}, sync_interval = 5})
+  luaunit.assertEquals(#ngx.timers, 2)
+  -- shortened by up to 20% (see testSyncJitter).
+  assert(ngx.timers[1].interval <= 5 and ngx.timers[1].interval > 4)
+  slow:inc(2, {"a"})
+  hist:observe(0.5)
+  self.counter1:inc(1)
 
+  -- values are not synced together with other metrics.
   self.p._counter:sync()
   luaunit.assertEquals(self.dict:get("metric1"), 1)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  luaunit.assertNil(self.dict:get('slow{f1="a"}'))
+  for _, timer in ipairs(ngx.timers) do
+    timer.fn(false, unpack(timer.args))
+  end
+  luaunit.assertEquals(self.dict:get('slow{f1="a"}'), 2)
+  luaunit.assertEquals(self.dict:get("slow_hist_count"), 1)
+
+  -- collect() syncs values of its worker.
+  slow:inc(1, {"a"})
+  self.p:collect()
+  assert(find_idx(ngx.printed, 'slow{f1="a"} 3') ~= nil)
+
+  luaunit.assertNil(self.p:gauge("slow_gauge", "Gauge", nil,
+    {sync_interval = 5}))
+  luaunit.assertNil(self.p:counter("slow2", "Counter", nil,
+    {sync_interval = 0}))
   luaunit.assertEquals(#ngx.logs, 2)
 end
-function TestPrometheus:testCounters()
-  self.counter1:inc()
-  self.counter1:inc(4)
-  self.counter2:inc(1, {"v2", "v1"})
-  self.counter2:inc(3, {"v2", "v1"})
+function TestPrometheus:testHistogramLocalAggregation()
+  local hist = self.p:histogram("agg", "Aggregated", {"site"},
+    {buckets = {1, 2}, local_aggregation = true, track_extremes = true})
+  luaunit.assertEquals(#ngx.timers, 1)
+  luaunit.assertEquals({hist:observe(0.5, {"a"})}, {1, 1})
+  luaunit.assertEquals({hist:observe(1.5, {"a"})}, {2, 2})
+  hist:observe(5, {"a"})
+  hist:observe(1.2, {"a"})
+  hist:observe(3, {"b"})
 
+  -- nothing is written to the dictionary until observations are merged.
   self.p._counter:sync()
-  luaunit.assertEquals(self.dict:get("metric1"), 5)
-  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="v1"}'), 4)
-  luaunit.assertEquals(ngx.logs, nil)
-end
-function TestPrometheus:testGaugeIncDec()
-  self.gauge1:inc(-1)
-  luaunit.assertEquals(self.dict:get("gauge1"), -1)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  luaunit.assertNil(self.dict:get('agg_count{site="a"}'))
+  luaunit.assertNil(self.dict:get('agg_max{site="a"}'))
+  ngx.timers[1].fn(false, unpack(ngx.timers[1].args))
+  luaunit.assertEquals(self.dict:get('agg_bucket{site="a",le="1.0"}'), 1)
+  luaunit.assertEquals(self.dict:get('agg_bucket{site="a",le="2.0"}'), 3)
+  luaunit.assertEquals(self.dict:get('agg_bucket{site="a",le="Inf"}'), 4)
+  luaunit.assertEquals(self.dict:get('agg_count{site="a"}'), 4)
+  luaunit.assertEquals(self.dict:get('agg_sum{site="a"}'), 8.2)
+  luaunit.assertNil(self.dict:get('agg_bucket{site="b",le="2.0"}'))
+  luaunit.assertEquals(self.dict:get('agg_bucket{site="b",le="Inf"}'), 1)
+  luaunit.assertEquals(self.dict:get('agg_min{site="a"}'), 0.5)
+  luaunit.assertEquals(self.dict:get('agg_max{site="a"}'), 5)
+  luaunit.assertEquals(self.dict:get('agg_last{site="a"}'), 1.2)
 
-  self.gauge1:inc(3)
-  luaunit.assertEquals(self.dict:get("gauge1"), 2)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  -- collect() merges observations of its worker.
+  hist:observe(0.1, {"b"})
+  self.p:collect()
+  assert(find_idx(ngx.printed, 'agg_bucket{site="b",le="1"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'agg_count{site="b"} 2') ~= nil)
+  assert(find_idx(ngx.printed, 'agg_min{site="b"} 0.1') ~= nil)
 
-  self.gauge1:inc()
-  luaunit.assertEquals(self.dict:get("gauge1"), 3)
+  -- observations that are not merged yet are dropped with their series.
+  hist:observe(1, {"a"})
+  hist:observe(1, {"b"})
+  hist:del({"a"})
+  hist:reset({"b"})
+  ngx.timers[1].fn(false, unpack(ngx.timers[1].args))
+  luaunit.assertNil(self.dict:get('agg_count{site="a"}'))
+  luaunit.assertEquals(self.dict:get('agg_count{site="b"}'), 0)
   luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
 
-  self.gauge2:inc(1, {"f2value", "f1value"})
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), 1)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  luaunit.assertNil(self.p:counter("agg_total", "Counter", nil,
+    {local_aggregation = true}))
+  luaunit.assertNil(self.p:histogram("agg2", "Histogram", nil,
+    {local_aggregation = "yes"}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+end
+function TestPrometheus:testTTL()
+  local gauge = self.p:gauge("ttl_gauge", "Gauge", {"f1"}, {ttl_output = 300})
+  local counter = self.p:counter("ttl_counter", "Counter", {"f1"},
+    {ttl_purge = 600})
+  local hist = self.p:histogram("ttl_hist", "Histogram", {"f1"},
+    {buckets = {1}, ttl_output = 60, ttl_purge = 120})
+  -- a single timer records update times for all metrics.
+  luaunit.assertEquals(#ngx.timers, 1)
+  local timer = ngx.timers[1]
+  local function tick()
+    timer.fn(false, unpack(timer.args))
+  end
+  local function collect()
+    ngx.printed = nil
+    self.p:collect()
+    return ngx.printed
+  end
 
-  self.gauge2:inc(5, {"f2value", "f1value"})
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), 6)
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="othervalue"}'), nil)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  ngx.clock = 1000
+  gauge:set(1, {"a"})
+  counter:inc(1, {"a"})
+  hist:observe(0.5, {"a"})
+  tick()
+  local printed = collect()
+  assert(find_idx(printed, 'ttl_gauge{f1="a"} 1') ~= nil)
+  assert(find_idx(printed, 'ttl_counter{f1="a"} 1') ~= nil)
+  assert(find_idx(printed, 'ttl_hist_bucket{f1="a",le="1"} 1') ~= nil)
+  assert(find_idx(printed, 'ttl_hist_count{f1="a"} 1') ~= nil)
 
-  self.gauge2:inc(-2, {"f2value", "f1value"})
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), 4)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  -- stale series are hidden from output, but are kept in the dictionary.
+  ngx.clock = 1301
+  printed = collect()
+  assert(find_idx(printed, '# TYPE ttl_gauge gauge') == nil)
+  assert(find_idx(printed, 'ttl_gauge{f1="a"} 1') == nil)
+  assert(find_idx(printed, 'ttl_counter{f1="a"} 1') ~= nil)
+  assert(find_idx(printed, 'ttl_hist_sum{f1="a"} 0.5') == nil)
+  assert(find_idx(printed, 'ttl_hist_bucket{f1="a",le="Inf"} 1') == nil)
+  luaunit.assertEquals(self.dict:get('ttl_gauge{f1="a"}'), 1)
+  luaunit.assertEquals(self.dict:get('ttl_hist_count{f1="a"}'), 1)
 
-  self.gauge2:inc(-5, {"f2value", "f1value"})
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), -1)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  -- expired series are purged by worker 0 only.
+  ngx.clock = 1601
+  tick()
+  luaunit.assertEquals(self.dict:get('ttl_counter{f1="a"}'), 1)
+  ngx.worker_id = 0
+  tick()
+  luaunit.assertNil(self.dict:get('ttl_counter{f1="a"}'))
+  luaunit.assertNil(self.dict:get('ttl_hist_count{f1="a"}'))
+  luaunit.assertNil(self.dict:get('ttl_hist_bucket{f1="a",le="Inf"}'))
+  luaunit.assertEquals(self.dict:get('ttl_gauge{f1="a"}'), 1)
+  printed = collect()
+  assert(find_idx(printed, 'ttl_counter{f1="a"} 1') == nil)
 
-  self.gauge1:inc(1, {"should-be-no-labels"})
-  self.gauge2:inc(1, {"too-few-labels"})
-  luaunit.assertEquals(self.dict:get("gauge1"), 3)
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), -1)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  -- updated series are returned again.
+  gauge:set(2, {"a"})
+  counter:inc(3, {"a"})
+  tick()
+  printed = collect()
+  assert(find_idx(printed, 'ttl_gauge{f1="a"} 2') ~= nil)
+  assert(find_idx(printed, 'ttl_counter{f1="a"} 3') ~= nil)
+  luaunit.assertEquals(ngx.logs, nil)
 end
-function TestPrometheus:testGaugeDel()
-  self.gauge1:inc(1)
-  luaunit.assertEquals(self.dict:get("gauge1"), 1)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
-
-  self.gauge1:del()
-  luaunit.assertEquals(self.dict:get("gauge1"), nil)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+function TestPrometheus:testOnDictFullEvictLRU()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {on_dict_full = "evict_lru"})
+  local gauge = p:gauge("gauge", "Gauge", {"f1"})
+  local hist = p:histogram("hist", "Histogram", {"f1"}, {buckets = {1}})
+  -- record_updates, followed by check_reset.
+  local timer = ngx.timers[#ngx.timers - 1]
+  local function tick()
+    timer.fn(false, unpack(timer.args))
+  end
 
-  self.gauge2:inc(1, {"f2value", "f1value"})
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), 1)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  ngx.clock = 1000
+  for i = 1, 9 do
+    gauge:set(1, {"old" .. i})
+  end
+  hist:observe(0.5, {"old"})
+  p._counter:sync()
+  tick()
+  luaunit.assertEquals(self.dict:get('hist_count{f1="old"}'), 1)
+  ngx.clock = 1100
+  gauge:set(1, {"new"})
+  hist:observe(0.5, {"new"})
+  p._counter:sync()
+  tick()
 
-  self.gauge2:del({"f2value"})
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), 1)
+  -- a write that doesn't fit evicts 10 least recently updated series.
+  ngx.clock = 1200
+  gauge:inc(1, {"willnotfit"})
   luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
-
-  self.gauge2:del({"f2value", "f1value"})
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), nil)
+  luaunit.assertNil(self.dict:get('gauge{f1="old1"}'))
+  luaunit.assertNil(self.dict:get('gauge{f1="old9"}'))
+  luaunit.assertNil(self.dict:get('hist_count{f1="old"}'))
+  luaunit.assertNil(self.dict:get('hist_bucket{f1="old",le="Inf"}'))
+  luaunit.assertEquals(self.dict:get('gauge{f1="new"}'), 1)
+  luaunit.assertEquals(self.dict:get('hist_count{f1="new"}'), 1)
   luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+  luaunit.assertStrContains(ngx.logs[#ngx.logs], "Shared dictionary is full")
+
+  -- evicted series are added back once updated again.
+  gauge:set(2, {"old1"})
+  ngx.printed = nil
+  p:collect()
+  assert(find_idx(ngx.printed, 'gauge{f1="old1"} 2') ~= nil)
+  luaunit.assertEquals(find_idx(ngx.printed, 'gauge{f1="old2"} 1'), nil)
+  assert(find_idx(ngx.printed, 'gauge{f1="new"} 1') ~= nil)
+  ngx.logs = nil
+end
+function TestPrometheus:testOnDictFullResetHistograms()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics",
+    {on_dict_full = "reset_histograms"})
+  local gauge = p:gauge("gauge", "Gauge", {"f1"})
+  local hist = p:histogram("hist", "Histogram", {"f1"}, {buckets = {1}})
+  gauge:set(1, {"a"})
+  hist:observe(0.5, {"a"})
+  p._counter:sync()
+
+  gauge:inc(1, {"willnotfit"})
+  luaunit.assertNil(self.dict:get('hist_count{f1="a"}'))
+  luaunit.assertNil(self.dict:get('hist_bucket{f1="a",le="1"}'))
+  luaunit.assertEquals(self.dict:get('gauge{f1="a"}'), 1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+  ngx.logs = nil
+
+  luaunit.assertErrorMsgContains("Invalid on_dict_full policy",
+    require('prometheus').init, "metrics", {on_dict_full = "drop"})
+end
+function TestPrometheus:testTTLShorthand()
+  local gauge = self.p:gauge("ttl_gauge", "Gauge", {"f1"}, {ttl = 60})
+  local timer = ngx.timers[1]
+  local function tick()
+    timer.fn(false, unpack(timer.args))
+  end
+  ngx.worker_id = 0
+  ngx.clock = 1000
+  for i = 1, 501 do
+    gauge:set(i, {tostring(i)})
+  end
+  tick()
+  self.dict.delete = function(d, k)
+    if k == 'ttl_gauge{f1="7"}' then return false, "locked" end
+    d.dict[k] = nil
+  end
+
+  -- expired series are deleted incrementally, and hidden in the meantime.
+  ngx.clock = 1061
+  tick()
+  local remaining = 0
+  for i = 1, 501 do
+    if self.dict:get('ttl_gauge{f1="' .. i .. '"}') then
+      remaining = remaining + 1
+    end
+  end
+  luaunit.assertEquals(remaining, 2)
+  ngx.printed = nil
+  self.p:collect()
+  assert(find_idx(ngx.printed, '# TYPE ttl_gauge gauge') == nil)
+  tick()
+  luaunit.assertNil(self.dict:get('ttl_gauge{f1="501"}'))
+
+  -- keys that could not be deleted are counted as errors, and stay indexed
+  -- so that following runs retry.
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  luaunit.assertStrContains(ngx.logs[1], 'ttl_gauge{f1="7"}')
+  assert(find_idx(self.p.key_index:list(), 'ttl_gauge{f1="7"}') ~= nil)
+  self.dict.delete = nil
+  tick()
+  luaunit.assertNil(self.dict:get('ttl_gauge{f1="7"}'))
+  luaunit.assertNil(find_idx(self.p.key_index:list(), 'ttl_gauge{f1="7"}'))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+end
+function TestPrometheus:testTTLInvalid()
+  luaunit.assertNil(self.p:gauge("g1", "G1", nil, {ttl_output = 0}))
+  luaunit.assertNil(self.p:gauge("g2", "G2", nil, {ttl_purge = "1m"}))
+  luaunit.assertNil(self.p:gauge("g3", "G3", nil, {ttl = -1}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+  luaunit.assertStrContains(ngx.logs[1], "ttl_output")
+end
+function TestPrometheus:testSyncJitter()
+  -- each worker syncs its counters with a different interval, so that syncs of
+  -- workers don't happen at the same time.
+  local intervals = {}
+  for worker = 1, 4 do
+    ngx.worker_id = worker - 1
+    local name = "jitter" .. worker
+    ngx.shared[name] = setmetatable({}, SimpleDict)
+    ngx.timers = nil
+    require('prometheus').init(name, {sync_interval = 10})
+    table.insert(intervals, ngx.timers[1].interval)
+  end
+  ngx.worker_id = nil
+  luaunit.assertEquals(intervals, {10, 9.5, 9, 8.5})
+
+  -- count flushes of the first 100 seconds that happen within 100ms of the
+  -- previous flush, which would be 30 of 40 without jitter.
+  local flushes = {}
+  for worker, interval in ipairs(intervals) do
+    for t = interval, 100, interval do
+      table.insert(flushes, {t = t, worker = worker})
+    end
+  end
+  table.sort(flushes, function(a, b) return a.t < b.t end)
+  local close = 0
+  for i = 2, #flushes do
+    if flushes[i].t - flushes[i - 1].t < 0.1 then
+      close = close + 1
+    end
+  end
+  luaunit.assertEquals(#flushes, 42)
+  assert(close < 5, "too many simultaneous flushes: " .. close)
+
+  ngx.shared.nojitter = setmetatable({}, SimpleDict)
+  ngx.timers = nil
+  require('prometheus').init("nojitter", {sync_interval = 10, sync_jitter = 0})
+  luaunit.assertEquals(ngx.timers[1].interval, 10)
+
+  luaunit.assertErrorMsgContains(
+    "sync_jitter should be a number between 0 and 1", require('prometheus').init, "metrics", {sync_jitter = 1})
+end
+function TestPrometheus:testMinUpdateInterval()
+  local gauge = self.p:gauge("throttled", "Gauge", {"f1"},
+    {min_update_interval = 5})
+  luaunit.assertEquals(#ngx.timers, 1)
+  luaunit.assertEquals(ngx.timers[1].interval, 5)
+  local timer = ngx.timers[1]
+
+  -- updates are coalesced in the worker until the timer fires.
+  gauge:set(3, {"a"})
+  gauge:inc(2, {"a"})
+  gauge:inc(1, {"b"})
+  gauge:inc(4, {"b"})
+  luaunit.assertNil(self.dict:get('throttled{f1="a"}'))
+  luaunit.assertNil(self.dict:get('throttled{f1="b"}'))
+  timer.fn(false, unpack(timer.args))
+  luaunit.assertEquals(self.dict:get('throttled{f1="a"}'), 5)
+  luaunit.assertEquals(self.dict:get('throttled{f1="b"}'), 5)
+
+  -- pending updates are flushed during collection.
+  gauge:inc(1, {"b"})
+  self.p:collect()
+  assert(find_idx(ngx.printed, 'throttled{f1="b"} 6') ~= nil)
+
+  -- deleted series are not resurrected by pending updates.
+  gauge:set(7, {"a"})
+  gauge:del({"a"})
+  timer.fn(true, unpack(timer.args))
+  luaunit.assertNil(self.dict:get('throttled{f1="a"}'))
+
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  luaunit.assertNil(self.p:counter("c", "C", nil, {min_update_interval = 5}))
+  luaunit.assertNil(self.p:gauge("g", "G", nil, {min_update_interval = 0}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+end
+function TestPrometheus:testNumberFormat()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {number_format = "%.3g"})
+  local gauge = p:gauge("gauge", "Gauge", {"value"})
+  local hist = p:histogram("hist", "Histogram", nil, {1})
+  gauge:set(1/3, {"third"})
+  gauge:set(math.huge, {"inf"})
+  gauge:set(-math.huge, {"minus_inf"})
+  gauge:set(0/0, {"nan"})
+  hist:observe(0.1)
+  hist:observe(0.2)
+  p._counter:sync()
+  p:collect()
+  assert(find_idx(ngx.printed, 'gauge{value="third"} 0.333') ~= nil)
+  assert(find_idx(ngx.printed, 'gauge{value="inf"} +Inf') ~= nil)
+  assert(find_idx(ngx.printed, 'gauge{value="minus_inf"} -Inf') ~= nil)
+  assert(find_idx(ngx.printed, 'gauge{value="nan"} NaN') ~= nil)
+  assert(find_idx(ngx.printed, 'hist_sum 0.3') ~= nil)
+  assert(find_idx(ngx.printed, 'hist_count 2') ~= nil)
+
+  luaunit.assertErrorMsgContains("number_format should be a format string",
+    function() require('prometheus').init("metrics", {number_format = "%g %g"}) end)
+  luaunit.assertErrorMsgContains("number_format should be a format string",
+    function() require('prometheus').init("metrics", {number_format = 3}) end)
+end
+function TestPrometheus:testNumberFormatProtobuf()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics",
+    {number_format = "%.3g", protobuf = true})
+  local requests = p:counter("requests_total", "Requests")
+  requests:inc(12345)
+  p._counter:sync()
+
+  local print = Nginx.print
+  local raw
+  Nginx.print = function(chunk)
+    raw = table.concat(chunk)
+  end
+  ngx.var = {http_accept = "application/vnd.google.protobuf;" ..
+    "proto=io.prometheus.client.MetricFamily;encoding=delimited"}
+  p:collect()
+  Nginx.print = print
+  ngx.var = nil
+  -- values are not rounded: a Counter with the value of 12345.
+  luaunit.assertStrContains(raw, "\26\9\9\0\0\0\0\128\28\200\64")
+
+  p:collect()
+  assert(find_idx(ngx.printed, "requests_total 1.23e+04") ~= nil)
+end
+function TestPrometheus:testSpecialValues()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics",
+    {special_values = {["+Inf"] = 1e308, ["-Inf"] = "-99999999"}})
+  local gauge = p:gauge("gauge", "Gauge", {"value"})
+  local hist = p:histogram("hist", "Histogram", {"site"}, {1})
+  gauge:set(1/4, {"quarter"})
+  gauge:set(math.huge, {"inf"})
+  gauge:set(-math.huge, {"minus_inf"})
+  gauge:set(0/0, {"nan"})
+  hist:observe(0.5, {"a"})
+  hist:observe(2, {"a"})
+  p._counter:sync()
+  p:collect()
+  assert(find_idx(ngx.printed, 'gauge{value="quarter"} 0.25') ~= nil)
+  assert(find_idx(ngx.printed, 'gauge{value="inf"} 1e+308') ~= nil)
+  assert(find_idx(ngx.printed, 'gauge{value="minus_inf"} -99999999') ~= nil)
+  -- values that are not replaced are formatted as usual.
+  assert(find_idx(ngx.printed, 'gauge{value="nan"} NaN') ~= nil)
+  assert(find_idx(ngx.printed, 'hist_bucket{site="a",le="1"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'hist_bucket{site="a",le="1e+308"} 2') ~= nil)
+  luaunit.assertNil(find_idx(ngx.printed, 'hist_bucket{site="a",le="+Inf"} 2'))
+
+  ngx.var = {http_accept = "application/openmetrics-text"}
+  ngx.printed = nil
+  p:collect()
+  ngx.var = nil
+  assert(find_idx(ngx.printed, 'hist_bucket{site="a",le="1e+308"} 2') ~= nil)
+
+  -- stored data is not affected.
+  luaunit.assertEquals(self.dict:get('hist_bucket{site="a",le="Inf"}'), 2)
+  luaunit.assertEquals(self.dict:get('gauge{value="inf"}'), math.huge)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  luaunit.assertErrorMsgContains("special_values should be a table",
+    function() require('prometheus').init("metrics",
+      {special_values = {Inf = 1e308}}) end)
+  luaunit.assertErrorMsgContains("special_values should be a table",
+    function() require('prometheus').init("metrics",
+      {special_values = {NaN = "none"}}) end)
+  luaunit.assertErrorMsgContains("special_values should be a table",
+    function() require('prometheus').init("metrics",
+      {special_values = "1e308"}) end)
+end
+function TestPrometheus:testSpecialValuesProtobuf()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics",
+    {special_values = {["+Inf"] = 1e308}, protobuf = true})
+  local gauge = p:gauge("gauge", "Gauge")
+  local hist = p:histogram("hist", "Histogram", nil, {1})
+  gauge:set(math.huge)
+  hist:observe(2)
+  p._counter:sync()
+
+  local print = Nginx.print
+  local raw
+  Nginx.print = function(chunk)
+    raw = table.concat(chunk)
+  end
+  ngx.var = {http_accept = "application/vnd.google.protobuf;" ..
+    "proto=io.prometheus.client.MetricFamily;encoding=delimited"}
+  p:collect()
+  Nginx.print = print
+  ngx.var = nil
+  -- a Gauge with the value of +Inf.
+  luaunit.assertStrContains(raw, "\18\9\9\0\0\0\0\0\0\240\127")
+  -- the +Inf bucket is implied by the count, rather than exposed as a bucket
+  -- with the upper bound of 1e308.
+  luaunit.assertNotStrContains(raw, "\160\200\235\133\243\204\225\127")
+end
+function TestPrometheus:testMaxSeries()
+  local counter = self.p:counter("paths", "Paths", {"path"}, {max_series = 2})
+  local hist = self.p:histogram("latency", "Latency", {"path"},
+    {buckets = {1}, max_series = 1})
+  counter:inc(1, {"/a"})
+  counter:inc(1, {"/b"})
+  counter:inc(1, {"/c"})
+  counter:inc(1, {"/d"})
+  -- existing series keep being updated.
+  counter:inc(1, {"/a"})
+  hist:observe(0.5, {"/a"})
+  hist:observe(0.5, {"/b"})
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('paths{path="/a"}'), 2)
+  luaunit.assertEquals(self.dict:get('paths{path="/b"}'), 1)
+  luaunit.assertNil(self.dict:get('paths{path="/c"}'))
+  luaunit.assertEquals(self.dict:get('latency_count{path="/a"}'), 1)
+  luaunit.assertNil(self.dict:get('latency_count{path="/b"}'))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+  luaunit.assertStrContains(ngx.logs[1], "limit of 2 series")
+
+  -- series created by another worker are not new.
+  local other = require('prometheus').init("metrics")
+  local other_counter = other:counter("paths", "Paths", {"path"},
+    {max_series = 2})
+  other_counter:inc(1, {"/b"})
+  other_counter:inc(1, {"/e"})
+  other._counter:sync()
+  luaunit.assertEquals(self.dict:get('paths{path="/b"}'), 2)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 4)
+
+  -- deleted series make room for new ones.
+  counter:del({"/a"})
+  hist:del({"/a"})
+  counter:inc(1, {"/c"})
+  hist:observe(0.5, {"/b"})
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('paths{path="/c"}'), 1)
+  luaunit.assertEquals(self.dict:get('latency_count{path="/b"}'), 1)
+  counter:reset()
+  counter:inc(1, {"/d"})
+  counter:inc(1, {"/e"})
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('paths{path="/e"}'), 1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 4)
+
+  luaunit.assertNil(self.p:counter("c1", "C", nil, {max_series = 0}))
+  luaunit.assertNil(self.p:counter("c2", "C", nil, {max_series = 1.5}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 6)
+end
+function TestPrometheus:testStrict()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {strict = true})
+  assert(p:counter("requests_total", "Requests") ~= nil)
+  luaunit.assertErrorMsgContains(
+    "Could not register metric: Duplicate metric requests_total",
+    function() p:gauge("requests_total", "Gauge") end)
+  luaunit.assertErrorMsgContains("Metric name '1abc' is invalid",
+    function() p:counter("1abc", "Counter") end)
+  luaunit.assertErrorMsgContains("Histogram 'latency' buckets",
+    function() p:histogram("latency", "Latency", nil, {3, 2, 1}) end)
+  luaunit.assertErrorMsgContains("Invalid label name 'le' in latency",
+    function() p:histogram("latency", "Latency", {"le"}) end)
+  luaunit.assertErrorMsgContains("Metric 'requests' label name 'a-b' is invalid",
+    function() p:counter("requests", "Requests", {"a-b"}) end)
+  -- errors are still counted, in case they are caught.
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 5)
+  -- errors when updating metrics are only logged.
+  p:counter("labelled", "Counter", {"host"}):inc(1, {"a", "b"})
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 6)
+end
+function TestPrometheus:testMaxMetrics()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  -- internal metrics don't count towards the limit.
+  local p = require('prometheus').init("metrics", {max_metrics = 2,
+    process_metrics = true, lock_wait_sample_rate = 0.1})
+  local counter = p:counter("c1", "Counter")
+  assert(counter ~= nil)
+  assert(p:histogram("h1", "Histogram") ~= nil)
+  luaunit.assertNil(p:gauge("g1", "Gauge"))
+  luaunit.assertNil(p:ratio("r1", "Ratio", counter, counter))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  luaunit.assertStrContains(ngx.logs[1], "g1")
+  luaunit.assertStrContains(ngx.logs[1], "limit of  2  metrics")
+end
+function TestPrometheus:testInvalidBuckets()
+  luaunit.assertNil(self.p:histogram("h1", "H", nil, {buckets = {}}))
+  luaunit.assertNil(self.p:histogram("h2", "H", nil, {1, "2"}))
+  luaunit.assertNil(self.p:histogram("h3", "H", nil, {1, 1}))
+  luaunit.assertNil(self.p:histogram("h4", "H", nil, {buckets = 5}))
+  luaunit.assertNil(self.p:histogram("h5", "H", nil, {1, 3, 2}))
+  luaunit.assertNil(self.p:histogram("h6", "H", nil, {1, 2, 1/0}))
+  luaunit.assertNil(self.p:histogram("h7", "H", nil, {0/0, 1}))
+  luaunit.assertNil(self.p:histogram("h8", "H", nil, {-1/0, 1}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 8)
+  luaunit.assertStrContains(ngx.logs[1], "increasing order")
+  luaunit.assertStrContains(ngx.logs[3], "contain duplicate boundary 1")
+  luaunit.assertStrContains(ngx.logs[5], "but 2 follows 3")
+  luaunit.assertStrContains(ngx.logs[6], "should not include +Inf")
+  luaunit.assertStrContains(ngx.logs[7], "increasing order")
+  luaunit.assertStrContains(ngx.logs[8], "should be finite")
+
+  local p = require('prometheus').init("metrics", {strict = true})
+  luaunit.assertErrorMsgContains("contain duplicate boundary 0.5",
+    p.histogram, p, "h9", "H", nil, {0.1, 0.5, 0.5})
+end
+function TestPrometheus:testResetAll()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics",
+    {ttl_output = 60})
+  local other = require('prometheus').init("metrics")
+  local counter = p:counter("requests", "Requests", {"host"})
+  local gauge = p:gauge("connections", "Connections")
+  local hist = p:histogram("latency", "Latency", nil, {buckets = {1}})
+  local other_counter = other:counter("requests", "Requests", {"host"})
+  counter:inc(1, {"a"})
+  gauge:set(5)
+  hist:observe(0.5)
+  other_counter:inc(2, {"b"})
+  other._counter:sync()
+  p:log_error("test error")
+  ngx.logs = nil
+
+  luaunit.assertEquals(p:reset(), 7)
+  ngx.logs = nil
+  luaunit.assertNil(self.dict:get('requests{host="a"}'))
+  luaunit.assertNil(self.dict:get('requests{host="b"}'))
+  luaunit.assertNil(self.dict:get("latency_count"))
+  for _, key in ipairs(p.key_index:list()) do
+    luaunit.assertEquals(key:find("nginx_metric_"), 1)
+  end
+  -- internal metrics are kept.
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+
+  -- series are added back when updated again.
+  counter:inc(3, {"a"})
+  p:collect()
+  assert(find_idx(ngx.printed, 'requests{host="a"} 3') ~= nil)
+  assert(find_idx(ngx.printed, "# TYPE latency histogram") == nil)
+
+  -- other workers forget their cached names once they notice the reset.
+  other_counter:inc(1, {"b"})
+  other._counter:sync()
+  ngx.printed = nil
+  p:collect()
+  assert(find_idx(ngx.printed, 'requests{host="b"} 1') == nil)
+  for _, timer in ipairs(ngx.timers) do
+    if timer.args[1] == other then
+      timer.fn(false, unpack(timer.args))
+    end
+  end
+  other_counter:inc(1, {"b"})
+  other._counter:sync()
+  ngx.printed = nil
+  p:collect()
+  assert(find_idx(ngx.printed, 'requests{host="b"} 2') ~= nil)
+  luaunit.assertNil(ngx.logs)
+
+  -- collection is retried while a reset is in progress.
+  local generation = self.dict:get("__ngx_prom__reset_generation")
+  self.dict:set("__ngx_prom__reset_generation", generation + 1)
+  ngx.printed = nil
+  p:collect()
+  assert(find_idx(ngx.printed, 'requests{host="a"} 3') ~= nil)
+  luaunit.assertStrContains(ngx.logs[1], "Metrics are being reset")
+end
+function TestPrometheus:testResetErrors()
+  ngx.clock = 1600000123.5
+  self.counter1:inc(-1)
+  self.counter1:inc(-1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+
+  self.p:reset_errors()
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  luaunit.assertEquals(self.dict:get("nginx_metric_last_error_timestamp_seconds"), 0)
+
+  self.p:collect()
+  assert(find_idx(ngx.printed, "nginx_metric_errors_total 0") ~= nil)
+  assert(find_idx(ngx.printed, "nginx_metric_last_error_timestamp_seconds 0") ~= nil)
+
+  self.counter1:inc(-1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+end
+function TestPrometheus:testConcurrentInit()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local workers = {}
+  for i = 1, 4 do
+    workers[i] = require('prometheus').init("metrics")
+  end
+  workers[1]:counter("metric1", "Metric 1"):inc(-1)
+  -- a worker starting later does not reset errors counted by others.
+  workers[5] = require('prometheus').init("metrics")
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+  luaunit.assertEquals(#ngx.logs, 1)
+
+  -- internal metrics are only added to the index once.
+  for _, p in ipairs(workers) do
+    local keys = p.key_index:list()
+    table.sort(keys)
+    luaunit.assertEquals(keys, {"nginx_metric_errors_total",
+      "nginx_metric_last_error_timestamp_seconds"})
+  end
+end
+function TestPrometheus:testPrefixSharedDict()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local app = require('prometheus').init("metrics", {prefix = "app_"})
+  local internal = require('prometheus').init("metrics", {prefix = "nginx_"})
+  local app_requests = app:counter("requests", "App requests", {"host"})
+  local nginx_requests = internal:counter("requests", "Requests", {"host"})
+  local app_gauge = app:gauge("gauge", "Gauge")
+  app_requests:inc(1, {"a"})
+  nginx_requests:inc(2, {"a"})
+  app_gauge:set(5)
+  app:log_error("test error")
+  ngx.logs = nil
+
+  -- each object syncs its counters with its own timer (and checks for resets
+  -- of all metrics with another one).
+  luaunit.assertEquals(#ngx.timers, 4)
+  for _, timer in ipairs(ngx.timers) do
+    timer.fn(false, unpack(timer.args))
+  end
+  luaunit.assertEquals(self.dict:get('app_requests{host="a"}'), 1)
+  luaunit.assertEquals(self.dict:get('nginx_requests{host="a"}'), 2)
+  luaunit.assertEquals(self.dict:get("app_nginx_metric_errors_total"), 1)
+  luaunit.assertEquals(self.dict:get("nginx_nginx_metric_errors_total"), 0)
+
+  app:collect()
+  assert(find_idx(ngx.printed, 'app_requests{host="a"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'app_gauge 5') ~= nil)
+  assert(find_idx(ngx.printed, 'app_nginx_metric_errors_total 1') ~= nil)
+  luaunit.assertEquals(find_idx(ngx.printed, 'app_requests{host="a"} 2'), nil)
+
+  ngx.printed = nil
+  internal:collect()
+  assert(find_idx(ngx.printed, 'nginx_requests{host="a"} 2') ~= nil)
+  assert(find_idx(ngx.printed, 'nginx_nginx_metric_errors_total 0') ~= nil)
+  luaunit.assertEquals(find_idx(ngx.printed, 'nginx_gauge 5'), nil)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testStorageBackend()
+  local data = {}
+  local backend = {
+    get = function(_, k) return data[k] end,
+    set = function(_, k, v)
+      data[k] = v
+      return true, nil, false
+    end,
+    incr = function(_, k, v, init)
+      if data[k] == nil then
+        if init == nil then return nil, "not found" end
+        data[k] = init
+      end
+      data[k] = data[k] + v
+      return data[k], nil
+    end,
+    get_keys = function()
+      local keys = {}
+      for k in pairs(data) do table.insert(keys, k) end
+      return keys
+    end,
+    delete = function(_, k) data[k] = nil end,
+  }
+  ngx.timers = nil
+  -- the shared dictionary does not need to exist.
+  local p = require('prometheus').init("missing", {backend = backend})
+  local requests = p:counter("requests", "Requests", {"host"})
+  local latency = p:histogram("latency", "Latency", nil, {buckets = {1}})
+  local temperature = p:gauge("temperature", "Temperature")
+  requests:inc(2, {"a"})
+  latency:observe(0.5)
+  temperature:set(20)
+  luaunit.assertEquals(data["temperature"], 20)
+
+  -- counters are synced to the backend by their own timer.
+  luaunit.assertEquals(data['requests{host="a"}'], nil)
+  ngx.timers[1].fn(false, unpack(ngx.timers[1].args))
+  luaunit.assertEquals(data['requests{host="a"}'], 2)
+
+  p:collect()
+  assert(find_idx(ngx.printed, 'requests{host="a"} 2') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_bucket{le="1"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_count 1') ~= nil)
+  assert(find_idx(ngx.printed, 'temperature 20') ~= nil)
+  assert(find_idx(ngx.printed, 'nginx_metric_errors_total 0') ~= nil)
+  luaunit.assertEquals(ngx.logs, nil)
+
+  luaunit.assertErrorMsgContains(
+    "Storage backend should implement method 'get_keys'",
+    require('prometheus').init, nil,
+    {backend = {get = backend.get, set = backend.set, incr = backend.incr,
+                delete = backend.delete}})
+  luaunit.assertErrorMsgContains(
+    "dict_metrics option is not supported with a storage backend",
+    require('prometheus').init, nil, {backend = backend, dict_metrics = true})
+  luaunit.assertErrorMsgContains("separate dictionaries",
+    require('prometheus').init, {default = "metrics"}, {backend = backend})
+end
+function TestPrometheus:testMetricNames()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {prefix = "app_"})
+  p:counter("requests", "Requests", {"host"})
+  p:histogram("latency", "Latency", nil, {bucket_bounds = true})
+  p:gauge("temperature")
+  -- another worker registering a metric dynamically.
+  local other = require('prometheus').init("metrics", {prefix = "app_"})
+  other:summary("sizes", "Response sizes")
+
+  luaunit.assertEquals(p:metric_names(), {
+    {name = "app_latency", type = "histogram", help = "Latency"},
+    {name = "app_latency_bucket_bounds", type = "gauge",
+      help = "Bucket boundaries of app_latency"},
+    {name = "app_nginx_metric_errors_total", type = "counter",
+      help = "Number of nginx-lua-prometheus errors"},
+    {name = "app_nginx_metric_last_error_timestamp_seconds", type = "gauge",
+      help = "Time of the last nginx-lua-prometheus error, in unixtime"},
+    {name = "app_requests", type = "counter", help = "Requests"},
+    {name = "app_sizes", type = "summary", help = "Response sizes"},
+    {name = "app_temperature", type = "gauge"},
+  })
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testCollectTable()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {prefix = "app_"})
+  local counter = p:counter("requests", "Requests", {"host"})
+  local hist = p:histogram("latency", "Latency", nil, {buckets = {1}})
+  p:gauge("temperature", nil, nil, {collect_fn = function() return 20 end})
+  counter:inc(2, {"a\"b"})
+  hist:observe(0.5)
+
+  luaunit.assertEquals(p:collect_table(), {
+    {name = "app_latency", type = "histogram", help = "Latency", samples = {
+      {name = "app_latency_bucket", labels = {le = "1"}, value = 1},
+      {name = "app_latency_bucket", labels = {le = "+Inf"}, value = 1},
+      {name = "app_latency_count", labels = {}, value = 1},
+      {name = "app_latency_sum", labels = {}, value = 0.5},
+    }},
+    {name = "app_nginx_metric_errors_total", type = "counter",
+      help = "Number of nginx-lua-prometheus errors", samples = {
+        {name = "app_nginx_metric_errors_total", labels = {}, value = 0},
+    }},
+    {name = "app_nginx_metric_last_error_timestamp_seconds", type = "gauge",
+      help = "Time of the last nginx-lua-prometheus error, in unixtime",
+      samples = {
+        {name = "app_nginx_metric_last_error_timestamp_seconds", labels = {},
+          value = 0},
+    }},
+    {name = "app_requests", type = "counter", help = "Requests", samples = {
+      {name = "app_requests", labels = {host = 'a"b'}, value = 2},
+    }},
+    {name = "app_temperature", type = "gauge", samples = {
+      {name = "app_temperature", labels = {}, value = 20},
+    }},
+  })
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testInitOptions()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+
+  local p1 = require('prometheus').init("metrics")
+  assert(p1.prefix == "")
+  assert(p1.sync_interval == 1)
+  assert(p1.error_metric_name == "nginx_metric_errors_total")
+
+  local p2 = require('prometheus').init("metrics", "test_pref_")
+  assert(p2.prefix == "test_pref_")
+  assert(p2.sync_interval == 1)
+  assert(p2.error_metric_name == "nginx_metric_errors_total")
+
+  local p3 = require('prometheus').init("metrics", {sync_interval=3})
+  assert(p3.prefix == "")
+  assert(p3.sync_interval == 3)
+  assert(p3.error_metric_name == "nginx_metric_errors_total")
+
+  local p4 = require('prometheus').init("metrics", {
+    prefix="foo", sync_interval=3, error_metric_name="foobar"})
+  assert(p4.prefix == "foo")
+  assert(p4.sync_interval == 3)
+  assert(p4.error_metric_name == "foobar")
+
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testDisabledErrorMetric()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {error_metric_name = false,
+    up_metric = true})
+  p:counter("requests", "Requests"):inc(1, {"extra"})
+  luaunit.assertEquals(#ngx.logs, 1)
+  luaunit.assertStrContains(ngx.logs[1], "inconsistent labels count")
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), nil)
+
+  p:collect()
+  luaunit.assertNil(find_idx(ngx.printed,
+    "# TYPE nginx_metric_errors_total counter"))
+  luaunit.assertNil(find_idx(ngx.printed, "nginx_metric_errors_total 1"))
+  assert(find_idx(ngx.printed, "nginx_lua_prometheus_up 1") ~= nil)
+  p:reset_errors()
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), nil)
+
+  luaunit.assertErrorMsgContains(
+    "error_metric_name should be a non-empty string or false",
+    require('prometheus').init, "metrics", {error_metric_name = ""})
+end
+function TestPrometheus:testInitWorker()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+
+  local p1 = require('prometheus').init("metrics")
+  p1:init_worker(3)
+
+  luaunit.assertEquals(#ngx.logs, 1)
+  luaunit.assertStrContains(ngx.logs[1], "do not explicitly call init_worker")
+end
+function TestPrometheus.testErrorUnitialized()
+  local p = require('prometheus')
+  p:counter("metric1")
+  p:histogram("metric2")
+  p:gauge("metric3")
+  p:metric_data()
+
+  luaunit.assertEquals(#ngx.logs, 4)
+end
+function TestPrometheus.testErrorUnknownDict()
+  local pok, perr = pcall(require('prometheus').init, "nonexistent")
+  luaunit.assertEquals(pok, false)
+  luaunit.assertStrContains(perr, "does not seem to exist")
+end
+function TestPrometheus:testErrorNoMemory()
+  local gauge3 = self.p:gauge("willnotfit")
+  self.counter1:inc(5)
+  gauge3:inc(1)
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get("metric1"), 5)
+  -- the metric family can't be recorded either.
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  luaunit.assertEquals(self.dict:get("willnotfit"), nil)
+  luaunit.assertEquals(#ngx.logs, 2)
+end
+function TestPrometheus:testErrorInvalidMetricName()
+  self.p:histogram("name with a space", "Histogram")
+  self.p:gauge("nonprintable\004characters", "Gauge")
+  self.p:counter("0startswithadigit", "Counter")
+  self.p:counter("__ngx_prom__usesinternalprefix", "Counter no.2")
+
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 4)
+  luaunit.assertEquals(#ngx.logs, 4)
+end
+function TestPrometheus:testErrorInvalidLabels()
+  self.p:histogram("hist1", "Histogram", {"le"})
+  self.p:gauge("count1", "Gauge", {"le"})
+  self.p:counter("count1", "Counter", {"foo\002"})
+
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+  luaunit.assertEquals(#ngx.logs, 3)
+end
+function TestPrometheus:testErrorDuplicateMetrics()
+  self.p:counter("metric1", "Another metric 1")
+  self.p:counter("l1_count", "Conflicts with Histogram 1")
+  self.p:counter("l2_sum", "Conflicts with Histogram 2")
+  self.p:counter("l2_bucket", "Conflicts with Histogram 2")
+  self.p:gauge("metric1", "Conflicts with Metric 1")
+  self.p:histogram("l1", "Conflicts with Histogram 1")
+  self.p:histogram("metric2", "Conflicts with Metric 2")
+  self.p:counter("metric_A_count", "Metric ending with _count")
+  self.p:histogram("metric_A", "Conflicts with metric_A_count")
+  self.p:counter("metric_B_sum", "Metric ending with _sum")
+  self.p:histogram("metric_B", "Conflicts with metric_B_sum")
+  self.p:counter("metric_C_bucket", "Metric ending with _bucket")
+  self.p:histogram("metric_C", "Conflicts with metric_C_bucket")
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 10)
+  luaunit.assertEquals(#ngx.logs, 10)
+end
+function TestPrometheus:testErrorNegativeValue()
+  self.counter1:inc(-5)
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get("metric1"), nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+  luaunit.assertEquals(#ngx.logs, 1)
+  luaunit.assertStrContains(ngx.logs[1], "metric1")
+  luaunit.assertStrContains(ngx.logs[1], "non-negative number")
+end
+function TestPrometheus:testCounterInvalidIncrement()
+  self.counter2:inc(3, {"f2value", "f1value"})
+  self.p._counter:sync()
+
+  self.counter2:inc(-1, {"f2value", "f1value"})
+  self.counter2:inc(0 / 0, {"f2value", "f1value"})
+  self.counter2:inc("2", {"f2value", "f1value"})
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('metric2{f2="f2value",f1="f1value"}'), 3)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+
+  -- zero is not an error, and leaves the value unchanged.
+  self.counter2:inc(0, {"f2value", "f1value"})
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('metric2{f2="f2value",f1="f1value"}'), 3)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+end
+function TestPrometheus:testErrorIncorrectLabels()
+  self.counter1:inc(1, {"should-be-no-labels"})
+  self.counter2:inc(1, {"too-few-labels"})
+  self.counter2:inc(1, {nil, "v"})
+  self.counter2:inc(1, {"v", nil})
+  self.counter2:inc(1)
+  self.counter3:inc(1, {nil})
+  self.gauge1:set(1, {"should-be-no-labels"})
+  self.gauge2:set(1, {"too-few-labels"})
+  self.gauge2:set(1)
+  self.hist2:observe(1, {"too", "many", "labels"})
+  self.hist2:observe(1, {nil, "label"})
+  self.hist2:observe(1, {"label", nil})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get("metric1"), nil)
+  luaunit.assertEquals(self.dict:get("l1_count"), nil)
+  luaunit.assertEquals(self.dict:get("gauge1"), nil)
+  luaunit.assertEquals(self.dict:get("gauge2"), nil)
+  luaunit.assertEquals(self.dict:get("l1_count"), nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 12)
+  luaunit.assertEquals(#ngx.logs, 12)
+end
+function TestPrometheus:testNumericLabelValues()
+  self.counter2:inc(1, {0, 15.5})
+  self.gauge2:set(1, {0, 15.5})
+  self.hist2:observe(1, {-3, 90000})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('metric2{f2="0",f1="15.5"}'), 1)
+  luaunit.assertEquals(self.dict:get('gauge2{f2="0",f1="15.5"}'), 1)
+  luaunit.assertEquals(self.dict:get('l2_sum{var="-3",site="90000"}'), 1)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testMultibyteLabelValues()
+  self.counter2:inc(1, {"foo", "baz\189\166qux"})
+  self.counter2:inc(1, {"bad1\195\195bad", "bad2\224\161\209bad"})
+  self.counter2:inc(1, {"bad3\240\144\129\192bad", "bad4\242\129\210bad"})
+  self.counter2:inc(1, {"¢€𤭢", "Pay in €. Thanks."})
+  self.gauge2:set(1, {"z\001", "\002"})
+  self.gauge2:set(1, {"\224\143\175", "\237\129\128"})
+  self.hist2:observe(1, {"\166omg", "fooшbar"})
+  self.hist2:observe(1, {"\244\143\143\143", "\244"})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('metric2{f2="foo",f1="baz"}'), 1)
+  luaunit.assertEquals(self.dict:get('metric2{f2="bad1",f1="bad2"}'), 1)
+  luaunit.assertEquals(self.dict:get('metric2{f2="bad3",f1="bad4"}'), 1)
+  luaunit.assertEquals(self.dict:get('metric2{f2="¢€𤭢",f1="Pay in €. Thanks."}'), 1)
+  luaunit.assertEquals(self.dict:get('gauge2{f2="z\001",f1="\002"}'), 1)
+  luaunit.assertEquals(self.dict:get('gauge2{f2="",f1="\237\129\128"}'), 1)
+  luaunit.assertEquals(self.dict:get('l2_sum{var="",site="fooшbar"}'), 1)
+  luaunit.assertEquals(self.dict:get('l2_sum{var="\244\143\143\143",site=""}'), 1)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testInvalidUtf8Policies()
+  local bad = {
+    "bad1\195\195bad",        -- missing continuation byte
+    "bad2\224\161\209bad",    -- truncated 3-byte sequence
+    "bad3\240\144\129\192bad", -- invalid last byte of a 4-byte sequence
+    "\166omg",                -- unexpected continuation byte
+    "\237\160\128",           -- utf16 surrogate
+    "end\244",                -- truncated at the end of the string
+  }
+  local want = {
+    replace = {"bad1��bad", "bad2���bad", "bad3����bad", "�omg", "���",
+      "end�"},
+    -- escaped bytes are exposed with escaped backslashes.
+    escape = {[[bad1\\xC3\\xC3bad]], [[bad2\\xE0\\xA1\\xD1bad]],
+      [[bad3\\xF0\\x90\\x81\\xC0bad]], [[\\xA6omg]], [[\\xED\\xA0\\x80]],
+      [[end\\xF4]]},
+  }
+  for policy, values in pairs(want) do
+    self.dict = setmetatable({}, SimpleDict)
+    ngx.shared.metrics = self.dict
+    ngx.logs = nil
+    local p = require('prometheus').init("metrics", {invalid_utf8 = policy})
+    local gauge = p:gauge("utf8", "Gauge", {"value"})
+    local hist = p:histogram("utf8_hist", "Histogram", {"value"},
+      {buckets = {1}})
+    for i, value in ipairs(bad) do
+      gauge:set(i, {value})
+      hist:observe(0.5, {value})
+    end
+    gauge:set(10, {"valid €"})
+    p._counter:sync()
+    for i, value in ipairs(values) do
+      luaunit.assertEquals(self.dict:get('utf8{value="' .. value .. '"}'), i)
+      luaunit.assertEquals(
+        self.dict:get('utf8_hist_count{value="' .. value .. '"}'), 1)
+    end
+    luaunit.assertEquals(self.dict:get('utf8{value="valid €"}'), 10)
+    -- each sanitized series is counted as an error once.
+    luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 12)
+    luaunit.assertStrContains(ngx.logs[1], "not valid utf8")
+  end
+  luaunit.assertErrorMsgContains("invalid_utf8 should be one of",
+    require('prometheus').init, "metrics", {invalid_utf8 = "drop"})
+end
+function TestPrometheus:testLabelPatterns()
+  local counter = self.p:counter("version_total", "Versions", {"host", "version"},
+    {label_patterns = {version = "^[0-9]+%.[0-9]+$"}})
+  local hist = self.p:histogram("version_hist", "Versions", {"version", "host"},
+    {buckets = {1}, label_patterns = {
+      version = {pattern = "^[0-9]+$", fallback = "other"},
+      host = "^[a-z]+$"}})
+
+  counter:inc(1, {"h1", "1.2"})
+  counter:inc(1, {"h1", "1.2.3"})
+  counter:inc(1, {"h1", "foo"})
+  counter:inc(1, {"h1", "foo"})
+  hist:observe(0.5, {1, "a"})
+  hist:observe(0.5, {"x", "b"})
+  hist:observe(0.5, {"x", "C"})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('version_total{host="h1",version="1.2"}'), 1)
+  luaunit.assertEquals(self.dict:get('version_total{host="h1",version="invalid"}'), 3)
+  luaunit.assertEquals(self.dict:get('version_hist_count{version="1",host="a"}'), 1)
+  luaunit.assertEquals(self.dict:get('version_hist_count{version="other",host="b"}'), 1)
+  luaunit.assertEquals(self.dict:get('version_hist_count{version="other",host="invalid"}'), 1)
+  -- patterns are checked once for each new combination of label values.
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 5)
+  luaunit.assertEquals(#ngx.logs, 5)
+  luaunit.assertStrContains(ngx.logs[1], "value ' 1.2.3 ' does not match")
+end
+function TestPrometheus:testLabelPatternsInvalid()
+  luaunit.assertNil(self.p:counter("c1", "C1", {"f1"},
+    {label_patterns = {f2 = "^a$"}}))
+  luaunit.assertNil(self.p:gauge("g1", "G1", {"f1"},
+    {label_patterns = {f1 = "[a"}}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  luaunit.assertStrContains(ngx.logs[1], "pattern for unknown label")
+  luaunit.assertStrContains(ngx.logs[2], "pattern is invalid")
+end
+function TestPrometheus:testAllowedLabelValues()
+  local reject = self.p:counter("reject_total", "Reject", {"method", "host"},
+    {label_values = {method = {"GET", "POST"}}})
+  local other = self.p:histogram("other", "Other", {"host", "status"},
+    {buckets = {1}, label_values = {status = {200, 404}},
+     on_unknown_label_value = "bucket_as_other"})
+
+  reject:inc(1, {"GET", "a"})
+  reject:inc(1, {"FOO", "a"})
+  reject:inc(1, {"FOO", "a"})
+  other:observe(0.5, {"a", 200})
+  other:observe(0.5, {"a", "404"})
+  other:observe(0.5, {"a", 503})
+  other:observe(0.5, {"a", "x"})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('reject_total{method="GET",host="a"}'), 1)
+  luaunit.assertNil(self.dict:get('reject_total{method="FOO",host="a"}'))
+  luaunit.assertEquals(self.dict:get('other_count{host="a",status="200"}'), 1)
+  luaunit.assertEquals(self.dict:get('other_count{host="a",status="404"}'), 1)
+  luaunit.assertEquals(self.dict:get('other_count{host="a",status="other"}'), 2)
+  -- every rejected observation is counted, bucketed values are not errors.
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  luaunit.assertStrContains(ngx.logs[1], "value 'FOO' is not allowed")
+end
+function TestPrometheus:testAllowedLabelValuesInvalid()
+  luaunit.assertNil(self.p:counter("c1", "C1", {"f1"},
+    {label_values = {f2 = {"a"}}}))
+  luaunit.assertNil(self.p:counter("c2", "C2", {"f1"},
+    {label_values = {f1 = "a"}}))
+  luaunit.assertNil(self.p:counter("c3", "C3", {"f1"},
+    {label_values = {f1 = {"a"}}, on_unknown_label_value = "drop"}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+  luaunit.assertStrContains(ngx.logs[1], "allowed values for unknown label")
+  luaunit.assertStrContains(ngx.logs[2], "should be a non-empty array")
+  luaunit.assertStrContains(ngx.logs[3], "invalid on_unknown_label_value")
+end
+function TestPrometheus:testOnInvalidLabel()
+  local escape = self.p:counter("escape_total", "Escape", {"f1"})
+  local drop = self.p:counter("drop_total", "Drop", {"f1"},
+    {on_invalid_label = "drop"})
+  local replace = self.p:histogram("replace", "Replace", {"f1"},
+    {buckets = {1}, on_invalid_label = "replace"})
+
+  escape:inc(1, {"a\nb"})
+  escape:inc(1, {"a\nb"})
+  drop:inc(1, {"a\nb"})
+  drop:inc(1, {"a\nb"})
+  drop:inc(1, {"ab"})
+  replace:observe(0.5, {"a\nb"})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('escape_total{f1="a\\nb"}'), 2)
+  luaunit.assertEquals(self.dict:get('drop_total{f1="ab"}'), 1)
+  luaunit.assertEquals(self.dict:get('replace_count{f1="invalid"}'), 1)
+  -- escaped and replaced values are counted once per worker, dropped
+  -- observations are counted every time.
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 4)
+  luaunit.assertStrContains(ngx.logs[1], "value contains a newline")
+  luaunit.assertStrContains(ngx.logs[2], "dropping observation")
+
+  self.p:collect()
+  assert(find_idx(ngx.printed, 'escape_total{f1="a\\nb"} 2') ~= nil)
+end
+function TestPrometheus:testOnInvalidLabelInvalid()
+  luaunit.assertNil(self.p:counter("c1", "C1", {"f1"},
+    {on_invalid_label = "ignore"}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+  luaunit.assertStrContains(ngx.logs[1], "invalid on_invalid_label")
+end
+function TestPrometheus:testErrorLabel()
+  local counter = self.p:counter("requests_total", "Requests",
+    {"status", "host"}, {error_label = true})
+  local hist = self.p:histogram("latency", "Latency", {"host", "status"},
+    {buckets = {1}, error_label = true, error_label_threshold = 400})
+
+  counter:inc(1, {200, "a"})
+  counter:inc(1, {"503", "a"})
+  counter:inc(1, {"500", 'b"'})
+  counter:inc(1, {"-", "a"})
+  hist:observe(0.5, {"a", "404"})
+  hist:observe(0.5, {"a", 399})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('requests_total{status="200",host="a",error="false"}'), 1)
+  luaunit.assertEquals(self.dict:get('requests_total{status="503",host="a",error="true"}'), 1)
+  luaunit.assertEquals(self.dict:get('requests_total{status="500",host="b\\"",error="true"}'), 1)
+  luaunit.assertEquals(self.dict:get('requests_total{status="-",host="a",error="false"}'), 1)
+  luaunit.assertEquals(self.dict:get('latency_count{host="a",status="404",error="true"}'), 1)
+  luaunit.assertEquals(self.dict:get('latency_bucket{host="a",status="399",error="false",le="Inf"}'), 1)
+  luaunit.assertEquals(ngx.logs, nil)
+
+  self.p:collect()
+  assert(find_idx(ngx.printed, 'latency_bucket{host="a",status="404",error="true",le="1"} 1') ~= nil)
+end
+function TestPrometheus:testSortLabels()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {sort_labels = true,
+    default_labels = {region = "eu"}})
+  local counter = p:counter("requests_total", "Requests",
+    {"status", "host"}, {error_label = true})
+  local hist = p:histogram("latency", "Latency", {"site", "var"},
+    {buckets = {1}})
+  local good = p:counter("good_total", "Good", {"status", "host"})
+  p:ratio("good_ratio", "Good ratio", good, counter, {"status", "host"})
+
+  -- label values are still passed in declaration order.
+  counter:inc(1, {"503", "a"})
+  good:inc(1, {"200", "a"})
+  counter:inc(2, {"200", "a"})
+  hist:observe(0.5, {"s", "v"})
+  p._counter:sync()
+  luaunit.assertEquals(self.dict:get(
+    'requests_total{error="true",host="a",status="503"}'), 1)
+  luaunit.assertEquals(self.dict:get(
+    'latency_bucket{site="s",var="v",le="1.0"}'), 1)
+  luaunit.assertEquals(self.dict:get('good_total{host="a",status="200"}'), 1)
+
+  p:collect()
+  assert(find_idx(ngx.printed,
+    'requests_total{region="eu",error="false",host="a",status="200"} 2') ~= nil)
+  assert(find_idx(ngx.printed,
+    'good_ratio{region="eu",host="a",status="200"} 0.5') ~= nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+end
+function TestPrometheus:testHelpEscaping()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {protobuf = true})
+  local requests = p:counter("requests_total",
+    'Requests\nper host, see C:\\logs for "details"', {"host"})
+  requests:inc(1, {"a"})
+  p._counter:sync()
+
+  p:collect()
+  assert(find_idx(ngx.printed, '# HELP requests_total Requests\\nper host, ' ..
+    'see C:\\\\logs for "details"') ~= nil)
+
+  -- OpenMetrics additionally escapes double quotes.
+  ngx.var = {http_accept = "application/openmetrics-text"}
+  ngx.printed = nil
+  p:collect()
+  assert(find_idx(ngx.printed, '# HELP requests Requests\\nper host, ' ..
+    'see C:\\\\logs for \\"details\\"') ~= nil)
+
+  -- protobuf carries the original help text.
+  local print = Nginx.print
+  local raw
+  Nginx.print = function(chunk)
+    raw = table.concat(chunk)
+  end
+  ngx.var = {http_accept = "application/vnd.google.protobuf;" ..
+    "proto=io.prometheus.client.MetricFamily;encoding=delimited"}
+  p:collect()
+  Nginx.print = print
+  ngx.var = nil
+  luaunit.assertStrContains(raw,
+    '\18\44Requests\nper host, see C:\\logs for "details"\24\0')
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+end
+function TestPrometheus:testErrorLabelInvalid()
+  luaunit.assertNil(self.p:counter("c1", "C1", {"code"}, {error_label = true}))
+  luaunit.assertNil(self.p:counter("c2", "C2", {"status", "error"},
+    {error_label = true}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  luaunit.assertStrContains(ngx.logs[1], "needs a 'status' label")
+  luaunit.assertStrContains(ngx.logs[2], "already has an 'error' label")
+end
+function TestPrometheus:testNoValues()
+  self.counter1:inc()  -- defaults to 1
+  self.gauge1:set()  -- should produce an error
+  self.hist1:observe()  -- should produce an error
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get("metric1"), 1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  luaunit.assertEquals(#ngx.logs, 2)
+end
+function TestPrometheus:testCounters()
+  self.counter1:inc()
+  self.counter1:inc(4)
+  self.counter2:inc(1, {"v2", "v1"})
+  self.counter2:inc(3, {"v2", "v1"})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get("metric1"), 5)
+  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="v1"}'), 4)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testGaugeIncDec()
+  self.gauge1:inc(-1)
+  luaunit.assertEquals(self.dict:get("gauge1"), -1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge1:inc(3)
+  luaunit.assertEquals(self.dict:get("gauge1"), 2)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge1:inc()
+  luaunit.assertEquals(self.dict:get("gauge1"), 3)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge2:inc(1, {"f2value", "f1value"})
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), 1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge2:inc(5, {"f2value", "f1value"})
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), 6)
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="othervalue"}'), nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge2:inc(-2, {"f2value", "f1value"})
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), 4)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge2:inc(-5, {"f2value", "f1value"})
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), -1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge1:inc(1, {"should-be-no-labels"})
+  self.gauge2:inc(1, {"too-few-labels"})
+  luaunit.assertEquals(self.dict:get("gauge1"), 3)
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), -1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+
+  self.gauge1:dec()
+  luaunit.assertEquals(self.dict:get("gauge1"), 2)
+  self.gauge2:dec(3, {"f2value", "f1value"})
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), -4)
+  self.gauge2:dec(1, {"too-few-labels"})
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+end
+function TestPrometheus:testInitialize()
+  luaunit.assertTrue(self.counter1:initialize())
+  luaunit.assertTrue(self.counter2:initialize({{"v2", "v1"}, {"v3", "v1"}}))
+  luaunit.assertTrue(self.gauge2:initialize({{"v2", "v1"}}))
+  luaunit.assertTrue(self.hist2:initialize({{"ok", "site1"}}))
+  luaunit.assertEquals(ngx.logs, nil)
+
+  self.p:collect()
+  assert(find_idx(ngx.printed, "metric1 0") ~= nil)
+  assert(find_idx(ngx.printed, 'metric2{f2="v2",f1="v1"} 0') ~= nil)
+  assert(find_idx(ngx.printed, 'metric2{f2="v3",f1="v1"} 0') ~= nil)
+  assert(find_idx(ngx.printed, 'gauge2{f2="v2",f1="v1"} 0') ~= nil)
+  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site1",le="0.005"} 0') ~= nil)
+  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site1",le="+Inf"} 0') ~= nil)
+  assert(find_idx(ngx.printed, 'l2_count{var="ok",site="site1"} 0') ~= nil)
+  assert(find_idx(ngx.printed, 'l2_sum{var="ok",site="site1"} 0') ~= nil)
+
+  -- initializing series again does not reset them.
+  self.counter1:inc(5)
+  self.gauge2:set(3, {"v2", "v1"})
+  self.hist2:observe(1, {"ok", "site1"})
+  self.p._counter:sync()
+  luaunit.assertTrue(self.counter1:initialize())
+  luaunit.assertTrue(self.gauge2:initialize({{"v2", "v1"}}))
+  luaunit.assertTrue(self.hist2:initialize({{"ok", "site1"}}))
+  luaunit.assertEquals(self.dict:get("metric1"), 5)
+  luaunit.assertEquals(self.dict:get('gauge2{f2="v2",f1="v1"}'), 3)
+  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site1"}'), 1)
+
+  luaunit.assertNil(self.counter2:initialize())
+  luaunit.assertNil(self.counter2:initialize({{"v2"}}))
+  luaunit.assertEquals(#ngx.logs, 2)
+  luaunit.assertStrContains(ngx.logs[2], "inconsistent labels count")
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+end
+function TestPrometheus:testGaugeCas()
+  luaunit.assertEquals({self.gauge1:cas(0, 5)}, {true})
+  luaunit.assertEquals(self.dict:get("gauge1"), 5)
+  luaunit.assertEquals({self.gauge1:cas(0, 7)}, {false, 5})
+  luaunit.assertEquals(self.dict:get("gauge1"), 5)
+  luaunit.assertEquals({self.gauge1:cas(5, 7)}, {true})
+  luaunit.assertEquals(self.dict:get("gauge1"), 7)
+  luaunit.assertEquals({self.gauge2:cas(0, 1, {"a", "b"})}, {true})
+  luaunit.assertEquals(self.dict:get('gauge2{f2="a",f1="b"}'), 1)
+  luaunit.assertNil(self.dict:get('__ngx_prom__cas_lock_gauge1'))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  -- lock held by another worker.
+  self.dict:set('__ngx_prom__cas_lock_gauge1', true)
+  luaunit.assertNil(self.gauge1:cas(7, 8))
+  luaunit.assertEquals(self.dict:get("gauge1"), 7)
+  luaunit.assertStrContains(ngx.logs[1], "failed to lock 'gauge1': exists")
+  luaunit.assertNil(self.gauge1:cas(nil, 8))
+  luaunit.assertNil(self.gauge2:cas(0, 1, {"too-few-labels"}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+end
+function TestPrometheus:testInfo()
+  local info = self.p:info("app_info", "Application", {version = "1.0",
+    commit = "abc"})
+  assert(info ~= nil)
+  luaunit.assertEquals(self.dict:get('app_info{commit="abc",version="1.0"}'), 1)
+
+  -- another worker with the previous version.
+  local other = require('prometheus').init("metrics")
+  local other_info = other:info("app_info", "Application", {version = "0.9",
+    commit = "123"})
+  info:set({version = "1.1", commit = "def"})
+  luaunit.assertEquals(self.dict:get('app_info{commit="def",version="1.1"}'), 1)
+  luaunit.assertNil(self.dict:get('app_info{commit="abc",version="1.0"}'))
+  luaunit.assertNil(self.dict:get('app_info{commit="123",version="0.9"}'))
+  self.p:collect()
+  assert(find_idx(ngx.printed, "# TYPE app_info gauge") ~= nil)
+  assert(find_idx(ngx.printed, 'app_info{commit="def",version="1.1"} 1') ~= nil)
+  luaunit.assertEquals(find_idx(ngx.printed,
+    'app_info{commit="123",version="0.9"} 1'), nil)
+  local data = table.concat(self.p:metric_data(nil, true))
+  luaunit.assertStrContains(data, "# HELP app Application\n" ..
+    '# TYPE app info\napp_info{commit="def",version="1.1"} 1\n')
+
+  -- values that were removed can be set again.
+  other_info:set({version = "0.9", commit = "123"})
+  luaunit.assertEquals(self.dict:get('app_info{commit="123",version="0.9"}'), 1)
+  luaunit.assertNil(self.dict:get('app_info{commit="def",version="1.1"}'))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  info:set({version = "2.0"})
+  info:inc(1)
+  luaunit.assertNil(self.p:info("app", "App", {version = "1"}))
+  luaunit.assertNil(self.p:info("other_info", "Other", {}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 4)
+  luaunit.assertStrContains(ngx.logs[2], "can only be updated with set()")
+end
+function TestPrometheus:testGaugeAsync()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {async=true})
+  local gauge1 = p:gauge("gauge1", "Gauge 1")
+  local gauge2 = p:gauge("gauge2", "Gauge 2", {"f1"})
+
+  gauge1:set(5)
+  gauge1:inc(2)
+  gauge2:inc(-1, {"f1value"})
+  gauge2:inc(nil, {"f1value"})
+  gauge2:inc(3, {"f1value"})
+  luaunit.assertEquals(self.dict:get("gauge1"), nil)
+  luaunit.assertEquals(self.dict:get('gauge2{f1="f1value"}'), nil)
+
+  p:metric_data()
+  luaunit.assertEquals(self.dict:get("gauge1"), 7)
+  luaunit.assertEquals(self.dict:get('gauge2{f1="f1value"}'), 3)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  gauge1:set(1)
+  p:metric_data()
+  luaunit.assertEquals(self.dict:get("gauge1"), 1)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testGaugeAsyncQueueFull()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics",
+    {async=true, async_queue_size=2})
+  local gauge1 = p:gauge("gauge1", "Gauge 1")
+
+  gauge1:set(5)
+  gauge1:inc(1)
+  gauge1:inc(1)
+  gauge1:inc(1)
+  p:metric_data()
+  luaunit.assertEquals(self.dict:get("gauge1"), 6)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  luaunit.assertEquals(#ngx.logs, 1)
+  luaunit.assertStrContains(ngx.logs[1], "Async queue is full")
+
+  gauge1:inc(1)
+  p:metric_data()
+  luaunit.assertEquals(self.dict:get("gauge1"), 7)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+end
+function TestPrometheus:testLockWaitMetric()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {lock_wait_sample_rate=1})
+  local gauge1 = p:gauge("gauge1", "Gauge 1", {"f1"})
+  ngx.clock_step = 0.003
+
+  gauge1:set(1, {"v1"})
+  gauge1:set(2, {"v1"})
+  gauge1:inc(1, {"v1"})
+  p._counter:sync()
+  luaunit.assertEquals(self.dict:get('gauge1{f1="v1"}'), 3)
+  -- Three writes to record the registered metric family (before the clock
+  -- started advancing), two writes to add a new key to the index, and three
+  -- gauge updates.
+  luaunit.assertEquals(
+    self.dict:get("nginx_metric_dict_lock_wait_seconds_count"), 8)
+  luaunit.assertEquals(self.dict:get(
+    'nginx_metric_dict_lock_wait_seconds_bucket{le="0.00100"}'), 3)
+  luaunit.assertEquals(self.dict:get(
+    'nginx_metric_dict_lock_wait_seconds_bucket{le="0.00500"}'), 8)
+  luaunit.assertAlmostEquals(
+    self.dict:get("nginx_metric_dict_lock_wait_seconds_sum"), 0.015, 1e-6)
+
+  p:collect()
+  assert(find_idx(ngx.printed,
+    "# TYPE nginx_metric_dict_lock_wait_seconds histogram") ~= nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testGaugeDel()
+  self.gauge1:inc(1)
+  luaunit.assertEquals(self.dict:get("gauge1"), 1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge1:del()
+  luaunit.assertEquals(self.dict:get("gauge1"), nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge2:inc(1, {"f2value", "f1value"})
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), 1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge2:del({"f2value"})
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), 1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+
+  self.gauge2:del({"f2value", "f1value"})
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+end
+function TestPrometheus:testCounterDel()
+  self.counter1:inc(1)
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get("metric1"), 1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.counter1:del()
+  luaunit.assertEquals(self.dict:get("metric1"), nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.counter2:inc(1, {"f2value", "f1value"})
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('metric2{f2="f2value",f1="f1value"}'), 1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.counter2:del()
+  luaunit.assertEquals(self.dict:get('metric2{f2="f2value",f1="f1value"}'), 1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+
+  self.counter2:del({"f2value", "f1value"})
+  luaunit.assertEquals(self.dict:get('metric2{f2="f2value",f1="f1value"}'), nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+end
+function TestPrometheus:testDelForgetsCachedNames()
+  self.counter2:inc(1, {"f2value", "f1value"})
+  self.gauge2:set(1, {"f2value", "f1value"})
+  self.p._counter:sync()
+  self.counter2:del({"f2value", "f1value"})
+  self.gauge2:del({"f2value", "f1value"})
+
+  -- deleted series are exposed again once updated.
+  self.counter2:inc(3, {"f2value", "f1value"})
+  self.gauge2:set(2, {"f2value", "f1value"})
+  self.p._counter:sync()
+  self.p:collect()
+  assert(find_idx(ngx.printed, 'metric2{f2="f2value",f1="f1value"} 3') ~= nil)
+  assert(find_idx(ngx.printed, 'gauge2{f2="f2value",f1="f1value"} 2') ~= nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+end
+function TestPrometheus:testCounterResetSeries()
+  self.counter1:inc(3)
+  self.counter2:inc(1, {"f2value", "f1value"})
+  self.counter2:inc(2, {"f2value", "f1value2"})
+  self.p._counter:sync()
+
+  self.counter1:reset({})
+  self.counter2:reset({"f2value", "f1value"})
+  luaunit.assertEquals(self.dict:get("metric1"), 0)
+  luaunit.assertEquals(self.dict:get('metric2{f2="f2value",f1="f1value"}'), 0)
+  luaunit.assertEquals(self.dict:get('metric2{f2="f2value",f1="f1value2"}'), 2)
+
+  -- zeroed series are still exposed, and can be incremented again.
+  self.counter2:inc(5, {"f2value", "f1value"})
+  self.p:collect()
+  assert(find_idx(ngx.printed, "metric1 0") ~= nil)
+  assert(find_idx(ngx.printed, 'metric2{f2="f2value",f1="f1value"} 5') ~= nil)
+
+  ngx.logs = nil
+  self.counter2:reset({"f2value"})
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+  luaunit.assertStrContains(ngx.logs[1], "inconsistent labels count")
+end
+function TestPrometheus:testHistogramDel()
+  self.hist2:observe(0.15, {"ok", "site1"})
+  self.hist2:observe(0.15, {"ok", "site2"})
+  self.p._counter:sync()
+  local keys = #self.p.key_index:list()
+
+  self.hist2:del({"ok", "site1"})
+  luaunit.assertNil(self.dict:get('l2_count{var="ok",site="site1"}'))
+  luaunit.assertNil(self.dict:get('l2_sum{var="ok",site="site1"}'))
+  luaunit.assertNil(self.dict:get('l2_bucket{var="ok",site="site1",le="Inf"}'))
+  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site2"}'), 1)
+  luaunit.assertEquals(#self.p.key_index:list(), keys - 22)
+
+  -- deleting a series that does not exist is a no-op.
+  self.hist2:del({"ok", "site1"})
+  self.hist2:del({"ok", "site3"})
+  luaunit.assertEquals(#self.p.key_index:list(), keys - 22)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  self.hist2:del({"ok"})
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+
+  -- the series is created again by new observations.
+  self.hist2:observe(0.15, {"ok", "site1"})
+  self.p:collect()
+  assert(find_idx(ngx.printed, 'l2_count{var="ok",site="site1"} 1') ~= nil)
+end
+function TestPrometheus:testReset()
+  self.gauge1:inc(1)
+  luaunit.assertEquals(self.dict:get("gauge1"), 1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge1:reset()
+  self.p.key_index:sync()
+  luaunit.assertEquals(self.dict:get("gauge1"), nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge1:inc(3)
+  luaunit.assertEquals(self.dict:get("gauge1"), 3)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge2:inc(1, {"f2value", "f1value"})
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), 1)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge2:inc(4, {"f2value", "f1value2"})
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value2"}'), 4)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.gauge2:reset()
+  self.p.key_index:sync()
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), nil)
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value2"}'), nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  luaunit.assertEquals(self.dict:get("gauge1"), 3)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.counter1:inc()
+  self.counter1:inc(4)
+  self.counter2:inc(1, {"v2", "v1"})
+  self.counter2:inc(3, {"v2", "v2"})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get("metric1"), 5)
+  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="v1"}'), 1)
+  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="v2"}'), 3)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.counter1:reset()
+  self.p.key_index:sync()
+  luaunit.assertEquals(self.dict:get("metric1"), nil)
+  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="v1"}'), 1)
+  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="v2"}'), 3)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.counter1:inc(4)
+  self.p._counter:sync()
+  self.counter2:reset()
+  self.p.key_index:sync()
+  luaunit.assertEquals(self.dict:get("metric1"), 4)
+  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="v1"}'), nil)
+  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="v2"}'), nil)
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), nil)
+  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value2"}'), nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  luaunit.assertEquals(self.dict:get("gauge1"), 3)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.hist1:observe(0.35)
+  self.hist1:observe(0.4)
+  self.hist2:observe(0.001, {"ok", "site1"})
+  self.hist2:observe(0.15, {"ok", "site1"})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get("metric1"), 4)
+  luaunit.assertEquals(self.dict:get("gauge1"), 3)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.300"}'), nil)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.400"}'), 2)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.500"}'), 2)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="Inf"}'), 2)
+  luaunit.assertEquals(self.dict:get('l1_count'), 2)
+  luaunit.assertEquals(self.dict:get('l1_sum'), 0.75)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.005"}'), 1)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.100"}'), 1)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.200"}'), 2)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="Inf"}'), 2)
+  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site1"}'), 2)
+  luaunit.assertEquals(self.dict:get('l2_sum{var="ok",site="site1"}'), 0.151)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.hist1:reset()
+  self.p.key_index:sync()
+  luaunit.assertEquals(self.dict:get("metric1"), 4)
+  luaunit.assertEquals(self.dict:get("gauge1"), 3)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.400"}'), 0)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.500"}'), 0)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="Inf"}'), 0)
+  luaunit.assertEquals(self.dict:get('l1_count'), 0)
+  luaunit.assertEquals(self.dict:get('l1_sum'), 0)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.005"}'), 1)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.100"}'), 1)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.200"}'), 2)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="Inf"}'), 2)
+  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site1"}'), 2)
+  luaunit.assertEquals(self.dict:get('l2_sum{var="ok",site="site1"}'), 0.151)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  self.hist1:observe(0.35)
+  self.p._counter:sync()
+  self.hist2:reset()
+  self.p.key_index:sync()
+  luaunit.assertEquals(self.dict:get("metric1"), 4)
+  luaunit.assertEquals(self.dict:get("gauge1"), 3)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.400"}'), 1)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.500"}'), 1)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="Inf"}'), 1)
+  luaunit.assertEquals(self.dict:get('l1_count'), 1)
+  luaunit.assertEquals(self.dict:get('l1_sum'), 0.35)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.005"}'), 0)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.100"}'), 0)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.200"}'), 0)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="Inf"}'), 0)
+  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site1"}'), 0)
+  luaunit.assertEquals(self.dict:get('l2_sum{var="ok",site="site1"}'), 0)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  -- key not exist
+  self.gauge2:inc(4, {"key_not_exist", "key_not_exist"})
+  self.gauge2:reset()
+  self.p.key_index:sync()
+  luaunit.assertEquals(self.dict:get('gauge2{f2="key_not_exist",f1="key_not_exist"}'), nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  -- error get from dict
+  self.gauge2:inc(4, {"dict_error", "dict_error"})
+  self.gauge2:reset()
+  self.p.key_index:sync()
+  luaunit.assertEquals(self.dict:get('gauge2{f2="dict_error",f1="dict_error"}'), nil)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+end
+function TestPrometheus:testHistogramResetSeries()
+  self.hist2:observe(0.15, {"ok", "site1"})
+  self.hist2:observe(2, {"ok", "site2"})
+  self.p._counter:sync()
+  self.hist2:reset({"ok", "site1"})
+  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site1"}'), 0)
+  luaunit.assertEquals(self.dict:get('l2_sum{var="ok",site="site1"}'), 0)
+  luaunit.assertEquals(
+    self.dict:get('l2_bucket{var="ok",site="site1",le="00.200"}'), 0)
+  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site2"}'), 1)
+  luaunit.assertEquals(self.dict:get('l2_sum{var="ok",site="site2"}'), 2)
+
+  -- the series is still exposed.
+  self.p:collect()
+  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site1",le="0.2"} 0') ~= nil)
+  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site1",le="+Inf"} 0') ~= nil)
+  assert(find_idx(ngx.printed, 'l2_count{var="ok",site="site1"} 0') ~= nil)
+  assert(find_idx(ngx.printed, 'l2_count{var="ok",site="site2"} 1') ~= nil)
+
+  self.hist2:observe(0.5, {"ok", "site1"})
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site1"}'), 1)
+  luaunit.assertEquals(self.dict:get('l2_sum{var="ok",site="site1"}'), 0.5)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  -- series that don't exist are not created.
+  self.hist2:reset({"ok", "site3"})
+  luaunit.assertNil(self.dict:get('l2_count{var="ok",site="site3"}'))
+  luaunit.assertNil(self.dict:get('l2_bucket{var="ok",site="site3",le="Inf"}'))
+  luaunit.assertNil(find_idx(self.p.key_index:list(),
+    'l2_count{var="ok",site="site3"}'))
+
+  ngx.logs = nil
+  self.hist2:reset({"ok"})
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+  luaunit.assertStrContains(ngx.logs[1], "inconsistent labels count")
+
+  -- a scrape overlapping with a reset is generated again, and returns partial
+  -- data if the reset does not finish in time.
+  ngx.logs = nil
+  ngx.printed = nil
+  self.dict:set("__ngx_prom__histogram_reset_generation", 3)
+  self.p:collect()
+  luaunit.assertStrContains(ngx.logs[1], "returned data might be partial")
+  assert(find_idx(ngx.printed, 'l2_count{var="ok",site="site1"} 1') ~= nil)
+end
+function TestPrometheus:testLatencyHistogram()
+  self.hist1:observe(0.35)
+  self.hist1:observe(0.4)
+  self.hist2:observe(0.001, {"ok", "site1"})
+  self.hist2:observe(0.15, {"ok", "site1"})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.300"}'), nil)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.400"}'), 2)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.500"}'), 2)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="Inf"}'), 2)
+  luaunit.assertEquals(self.dict:get('l1_count'), 2)
+  luaunit.assertEquals(self.dict:get('l1_sum'), 0.75)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.005"}'), 1)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.100"}'), 1)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.200"}'), 2)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="Inf"}'), 2)
+  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site1"}'), 2)
+  luaunit.assertEquals(self.dict:get('l2_sum{var="ok",site="site1"}'), 0.151)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testHistogramObserveBucket()
+  local hist = self.p:histogram("b1", "Buckets", nil, {1, 2, 3})
+  local idx, bound = hist:observe(0.5)
+  luaunit.assertEquals({idx, bound}, {1, 1})
+  idx, bound = hist:observe(2)
+  luaunit.assertEquals({idx, bound}, {2, 2})
+  idx, bound = hist:observe(2.5)
+  luaunit.assertEquals({idx, bound}, {3, 3})
+  idx, bound = hist:observe(10)
+  luaunit.assertEquals({idx, bound}, {4, math.huge})
+  luaunit.assertNil(hist:observe())
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('b1_bucket{le="2.0"}'), 2)
+  luaunit.assertEquals(self.dict:get('b1_bucket{le="Inf"}'), 4)
+end
+function TestPrometheus:testHistogramBucketCache()
+  local buckets = {0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+  local plain = self.p:histogram("plain", "Plain", nil, {buckets = buckets})
+  local cached = self.p:histogram("cached", "Cached", nil,
+    {buckets = buckets, bucket_cache = true})
+  local values = {0.3, 0.3, 0.4, 0.06, 0.1, 0.1000001, 0.5, 0.7, 100, 5, 0,
+    -1, 0.005, 0.0051, 1/0, -1/0, 0/0, 0.3, 0.01}
+  for _, value in ipairs(values) do
+    luaunit.assertEquals({cached:observe(value)}, {plain:observe(value)})
+  end
+
+  self.p._counter:sync()
+  local count = 0
+  for key, value in pairs(self.dict.dict) do
+    if key:find("^cached_") then
+      luaunit.assertEquals(value, self.dict:get("plain_" .. key:sub(8)))
+      count = count + 1
+    end
+  end
+  -- all buckets, _count and _sum.
+  luaunit.assertEquals(count, #buckets + 3)
+  luaunit.assertEquals(self.dict:get("cached_count"), #values)
+end
+function TestPrometheus:testHistogramBucketBounds()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {prefix = "test_",
+    verify_output = true})
+  local hist = p:histogram("latency", "Latency", {"path"},
+    {buckets = {0.5, 1, 2.5}, bucket_bounds = true})
+  p:collect()
+  luaunit.assertEquals(find_idx(ngx.printed, "# TYPE test_latency histogram"),
+    nil)
+  local idx = find_idx(ngx.printed,
+    "# HELP test_latency_bucket_bounds Bucket boundaries of test_latency")
+  assert(idx ~= nil)
+  luaunit.assertEquals({unpack(ngx.printed, idx + 1)}, {
+    "# TYPE test_latency_bucket_bounds gauge",
+    'test_latency_bucket_bounds{le="0.5"} 1',
+    'test_latency_bucket_bounds{le="1"} 1',
+    'test_latency_bucket_bounds{le="2.5"} 1',
+  })
+
+  hist:observe(0.7, {"/"})
+  p:collect()
+  assert(find_idx(ngx.printed, 'test_latency_bucket{path="/",le="1"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'test_latency_bucket_bounds{le="1"} 1') ~= nil)
+  luaunit.assertEquals(self.dict:get("test_nginx_metric_errors_total"), 0)
+
+  -- boundaries are formatted like the le labels of bucket series.
+  local ratio = p:histogram("ratio", "Ratio", nil,
+    {buckets = {1/3, 1}, bucket_bounds = true})
+  ratio:observe(0.2)
+  p:collect()
+  assert(find_idx(ngx.printed, 'test_ratio_bucket{le="0.333333"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'test_ratio_bucket_bounds{le="0.333333"} 1') ~= nil)
+
+  luaunit.assertNil(p:gauge("latency_bucket_bounds", "Gauge"))
+  p:gauge("other_bucket_bounds", "Gauge")
+  luaunit.assertNil(p:histogram("other", "Other", nil, {bucket_bounds = true}))
+  luaunit.assertEquals(self.dict:get("test_nginx_metric_errors_total"), 2)
+end
+function TestPrometheus:testObserveLatency()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {verify_output = true})
+  local latency = p:histogram("latency", "Latency", {"status", "path"},
+    {buckets = {0.1, 1}})
+  ngx.clock = 1600000000.5
+  luaunit.assertEquals({latency:observe_latency("0.050", {200, "/"}, "abc")},
+    {1, 0.1})
+  -- times of several upstream responses are added up.
+  luaunit.assertEquals(
+    {latency:observe_latency("0.200, 0.300 : -", {"502", "/"}, "def")},
+    {2, 1})
+  -- unset trace ids are not kept as exemplars.
+  latency:observe_latency(0.07, {200, "/"}, "")
+  latency:observe_latency(5, {200, "/"}, "-")
+  luaunit.assertEquals(ngx.logs, nil)
+
+  -- invalid values are not recorded, and neither are observations with wrong
+  -- number of label values.
+  luaunit.assertNil(latency:observe_latency("abc", {200, "/"}))
+  luaunit.assertNil(latency:observe_latency(nil, {200, "/"}))
+  luaunit.assertNil(latency:observe_latency(1, {200}, "ghi"))
+  luaunit.assertEquals(#ngx.logs, 3)
+  luaunit.assertStrContains(ngx.logs[1], "Invalid latency")
+  luaunit.assertStrContains(ngx.logs[3], "inconsistent labels count")
+  p._counter:sync()
+  luaunit.assertEquals(self.dict:get('latency_count{status="200",path="/"}'),
+    3)
+  luaunit.assertEquals(self.dict:get('latency_count{status="502",path="/"}'),
+    1)
+  luaunit.assertEquals(self.dict:get(
+    'latency_bucket{status="200",path="/",le="0.1"}'), 2)
+  luaunit.assertEquals(self.dict:get(
+    'latency_bucket{status="502",path="/",le="1.0"}'), 1)
+
+  ngx.logs = nil
+  ngx.var = {http_accept = "application/openmetrics-text"}
+  p:collect()
+  assert(find_idx(ngx.printed, 'latency_bucket{status="200",path="/",' ..
+    'le="0.1"} 2 # {trace_id="abc"} 0.05 1600000000.500') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_bucket{status="502",path="/",' ..
+    'le="1"} 1 # {trace_id="def"} 0.5 1600000000.500') ~= nil)
+  assert(find_idx(ngx.printed,
+    'latency_bucket{status="200",path="/",le="+Inf"} 3') ~= nil)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testHistogramEmitQuantiles()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {prefix = "test_",
+    verify_output = true})
+  local hist = p:histogram("latency", "Latency", {"path"},
+    {buckets = {1, 2, 4}, emit_quantiles = {0.25, 0.5, 0.9}})
+  p:collect()
+  luaunit.assertNil(find_idx(ngx.printed, "# TYPE test_latency_quantile gauge"))
+
+  for _, value in ipairs({0.5, 0.5, 0.5, 0.5, 1.5, 1.5, 1.5, 1.5, 5, 5}) do
+    hist:observe(value, {"/"})
+  end
+  hist:observe(1, {"/other"})
+  ngx.printed = nil
+  p:collect()
+  local idx = find_idx(ngx.printed, "# HELP test_latency_quantile " ..
+    "Quantiles of test_latency estimated from its buckets")
+  assert(idx ~= nil)
+  luaunit.assertEquals({unpack(ngx.printed, idx + 1, idx + 7)}, {
+    "# TYPE test_latency_quantile gauge",
+    -- linear interpolation within the matched bucket.
+    'test_latency_quantile{path="/",quantile="0.25"} 0.625',
+    'test_latency_quantile{path="/",quantile="0.5"} 1.25',
+    -- the highest finite boundary for the +Inf bucket.
+    'test_latency_quantile{path="/",quantile="0.9"} 4',
+    'test_latency_quantile{path="/other",quantile="0.25"} 0.25',
+    'test_latency_quantile{path="/other",quantile="0.5"} 0.5',
+    'test_latency_quantile{path="/other",quantile="0.9"} 0.9',
+  })
+
+  -- quantiles can be requested without the histogram.
+  ngx.printed = nil
+  ngx.uri_args = {["name[]"] = "test_latency_quantile"}
+  p:collect()
+  assert(find_idx(ngx.printed,
+    'test_latency_quantile{path="/",quantile="0.5"} 1.25') ~= nil)
+  assert(find_idx(ngx.printed, 'test_latency_count{path="/"} 10') == nil)
+  luaunit.assertEquals(self.dict:get("test_nginx_metric_errors_total"), 0)
+
+  luaunit.assertNil(p:gauge("latency_quantile", "Gauge"))
+  luaunit.assertNil(p:histogram("other", "Other", nil, {emit_quantiles = {}}))
+  luaunit.assertNil(p:histogram("other", "Other", nil,
+    {emit_quantiles = {1.5}}))
+  luaunit.assertNil(p:gauge("other", "Other", nil, {emit_quantiles = {0.5}}))
+  luaunit.assertNil(p:histogram("other", "Other", {"quantile"},
+    {emit_quantiles = {0.5}}))
+  luaunit.assertEquals(self.dict:get("test_nginx_metric_errors_total"), 5)
+end
+function TestPrometheus:testHistogramClamp()
+  local hist = self.p:histogram("latency", "Latency", {"path"},
+    {buckets = {1, 10}, clamp = {min = 0, max = 100, count = true}})
+  local open = self.p:histogram("sizes", "Sizes", nil,
+    {buckets = {1}, clamp = {min = 0}})
+  hist:observe(-5, {"/"})
+  hist:observe(5, {"/"})
+  hist:observe(1e9, {"/"})
+  self.p:observe_many(-1, {{hist, {"/"}}, {open}})
+  open:observe(1e9)
+  self.p:collect()
+  assert(find_idx(ngx.printed, 'latency_bucket{path="/",le="1"} 2') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_bucket{path="/",le="10"} 3') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_count{path="/"} 4') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_sum{path="/"} 105') ~= nil)
+  assert(find_idx(ngx.printed, "# HELP latency_clamped_total Number of " ..
+    "observations of latency clamped to its range") ~= nil)
+  assert(find_idx(ngx.printed, 'latency_clamped_total{bound="min"} 2') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_clamped_total{bound="max"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'sizes_bucket{le="1"} 1') ~= nil)
+  assert(find_idx(ngx.printed, "sizes_sum 1000000000") ~= nil)
+  luaunit.assertNil(find_idx(ngx.printed, "# TYPE sizes_clamped_total counter"))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  luaunit.assertNil(self.p:histogram("other", "Other", nil, {clamp = {}}))
+  luaunit.assertNil(self.p:histogram("other", "Other", nil,
+    {clamp = {min = 10, max = 1}}))
+  luaunit.assertNil(self.p:histogram("other", "Other", nil,
+    {clamp = {max = "1"}}))
+  luaunit.assertNil(self.p:gauge("other", "Other", nil, {clamp = {min = 0}}))
+  self.p:gauge("other_clamped_total", "Gauge")
+  luaunit.assertNil(self.p:histogram("other", "Other", nil,
+    {clamp = {min = 0, count = true}}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 5)
+end
+function TestPrometheus:testHistogramTrackExtremes()
+  local latency = self.p:histogram("latency", "Latency", {"site"},
+    {buckets = {1, 2}, track_extremes = true})
+  latency:observe(3, {"a"})
+  latency:observe(-1, {"a"})
+  latency:observe(2, {"a"})
+  latency:observe(0.5, {"b"})
+  luaunit.assertEquals(self.dict:get('latency_min{site="a"}'), -1)
+  luaunit.assertEquals(self.dict:get('latency_max{site="a"}'), 3)
+  luaunit.assertEquals(self.dict:get('latency_last{site="a"}'), 2)
+  luaunit.assertEquals(self.dict:get('latency_max{site="b"}'), 0.5)
+
+  -- extremes recorded by other workers are not overwritten.
+  self.dict:set('latency_max{site="a"}', 10)
+  latency:observe(4, {"a"})
+  luaunit.assertEquals(self.dict:get('latency_max{site="a"}'), 10)
+  luaunit.assertEquals(self.dict:get('latency_last{site="a"}'), 4)
+
+  self.p._counter:sync()
+  self.p:collect()
+  assert(find_idx(ngx.printed, "# TYPE latency_min gauge") ~= nil)
+  assert(find_idx(ngx.printed,
+    "# HELP latency_max Maximum observed value of latency") ~= nil)
+  assert(find_idx(ngx.printed, 'latency_min{site="a"} -1') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_last{site="b"} 0.5') ~= nil)
+
+  -- extremes are reset along with the histogram.
+  latency:reset({"a"})
+  luaunit.assertNil(self.dict:get('latency_min{site="a"}'))
+  luaunit.assertEquals(self.dict:get('latency_min{site="b"}'), 0.5)
+  latency:observe(7, {"a"})
+  luaunit.assertEquals(self.dict:get('latency_min{site="a"}'), 7)
+  latency:reset()
+  luaunit.assertNil(self.dict:get('latency_max{site="a"}'))
+  luaunit.assertNil(self.dict:get('latency_last{site="b"}'))
+  latency:observe(1, {"b"})
+  latency:del({"b"})
+  luaunit.assertNil(self.dict:get('latency_max{site="b"}'))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  luaunit.assertNil(self.p:counter("requests_total", "Requests", nil,
+    {track_extremes = true}))
+  luaunit.assertNil(self.p:histogram("other", "Other", nil,
+    {track_extremes = "yes"}))
+  self.p:gauge("size_max", "Size")
+  luaunit.assertNil(self.p:histogram("size", "Size", nil,
+    {track_extremes = true}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+end
+function TestPrometheus:testSummary()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {verify_output = true})
+  local summary = p:summary("latency", "Latency", {"path"},
+    {quantiles = {0.5, 0.9, 0.99}})
+  local empty = p:summary("empty", "Empty", nil, {0.5})
+  for i = 1, 1000 do
+    summary:observe(i / 1000, {"/"})
+  end
+  summary:observe(-2, {"/neg"})
+  summary:observe(-2, {"/neg"})
+  summary:observe(0, {"/neg"})
+  summary:observe(3, {"/neg"})
+  empty:observe(1)
+  p._counter:sync()
+  empty:reset()
+  p:collect()
+
+  local idx = find_idx(ngx.printed, "# TYPE latency summary")
+  assert(idx ~= nil)
+  local function quantile(line)
+    return tonumber(line:match(" (%S+)$"))
+  end
+  luaunit.assertStrMatches(ngx.printed[idx + 1], 'latency{path="/",quantile="0.5"} .*')
+  luaunit.assertAlmostEquals(quantile(ngx.printed[idx + 1]), 0.5, 0.01)
+  luaunit.assertAlmostEquals(quantile(ngx.printed[idx + 2]), 0.9, 0.018)
+  luaunit.assertAlmostEquals(quantile(ngx.printed[idx + 3]), 0.99, 0.02)
+  luaunit.assertEquals(ngx.printed[idx + 4], 'latency_count{path="/"} 1000')
+  luaunit.assertAlmostEquals(quantile(ngx.printed[idx + 5]), -2, 0.04)
+  luaunit.assertEquals(ngx.printed[idx + 6],
+    'latency{path="/neg",quantile="0.9"} 0')
+  luaunit.assertEquals(ngx.printed[idx + 7],
+    'latency{path="/neg",quantile="0.99"} 0')
+  luaunit.assertEquals(ngx.printed[idx + 8], 'latency_count{path="/neg"} 4')
+  luaunit.assertEquals(ngx.printed[idx + 9], 'latency_sum{path="/"} 500.5')
+  assert(find_idx(ngx.printed, "# TYPE empty summary") == nil)
+  for _, line in ipairs(ngx.printed) do
+    luaunit.assertNotStrContains(line, "__ngx_prom__")
+  end
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  -- reset deletes sketches as well.
+  summary:reset()
+  luaunit.assertNil(self.dict:get('latency_count{path="/"}'))
+  for key in pairs(self.dict.dict) do
+    luaunit.assertNotStrContains(key, "sketch_p")
+  end
+  summary:observe(5, {"/"})
+  ngx.printed = nil
+  p:collect()
+  idx = find_idx(ngx.printed, "# TYPE latency summary")
+  for i = 1, 3 do
+    luaunit.assertAlmostEquals(quantile(ngx.printed[idx + i]), 5, 0.05)
+  end
+  luaunit.assertEquals(ngx.printed[idx + 4], 'latency_count{path="/"} 1')
+  luaunit.assertEquals(ngx.printed[idx + 5], 'latency_sum{path="/"} 5')
+  luaunit.assertEquals(ngx.printed[idx + 6],
+    "# HELP nginx_metric_errors_total Number of nginx-lua-prometheus errors")
+end
+
+function TestPrometheus:testSummaryInvalid()
+  luaunit.assertNil(self.p:summary("s1", "S", {"quantile"}))
+  luaunit.assertNil(self.p:summary("s2", "S", nil, {0.5, 2}))
+  luaunit.assertNil(self.p:summary("s3", "S", nil, {epsilon = 0}))
+  luaunit.assertNil(self.p:summary("metric1", "S"))
+  luaunit.assertNil(self.p:counter("l1", "S"))
+  local summary = self.p:summary("s4", "S", {"f1"})
+  luaunit.assertNil(self.p:counter("s4_count", "C"))
+  summary:observe(1, {"a", "b"})
+  summary:observe(nil, {"a"})
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 8)
+end
+
+function TestPrometheus:testBatch()
+  local async = self.p:gauge("async_gauge", "Async", nil,
+    {min_update_interval = 1})
+  local b = self.p:batch()
+  local labels = {"a", "b"}
+  b:inc(self.counter1)
+  b:inc(self.counter1, 2)
+  b:inc(self.counter2, 3, labels)
+  b:inc(self.gauge1, 5)
+  b:set(self.gauge1, 1)
+  b:inc(self.gauge1, 2)
+  b:set(self.gauge2, 4, labels)
+  b:dec(self.gauge2, 1, labels)
+  labels[1] = "c"
+  b:set(async, 7)
+
+  -- nothing is applied before commit.
+  luaunit.assertNil(self.dict:get("gauge1"))
+  -- queued updates of each series are coalesced into a single write.
+  luaunit.assertEquals(b:commit(), 2)
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get("metric1"), 3)
+  luaunit.assertEquals(self.dict:get('metric2{f2="a",f1="b"}'), 3)
+  luaunit.assertEquals(self.dict:get("gauge1"), 3)
+  luaunit.assertEquals(self.dict:get('gauge2{f2="a",f1="b"}'), 3)
+  luaunit.assertNil(self.dict:get('gauge2{f2="c",f1="b"}'))
+
+  -- committed batches are empty.
+  luaunit.assertEquals(b:commit(), 0)
+  luaunit.assertEquals(ngx.logs, nil)
+
+  b:inc(self.counter1, -1)
+  b:dec(self.counter1)
+  b:set(self.counter1, 1)
+  b:inc(self.hist1, 1)
+  b:inc(self.counter2, 1, {"a"})
+  b:set(self.gauge1)
+  luaunit.assertEquals(b:commit(), 0)
+  luaunit.assertEquals(#ngx.logs, 6)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 6)
+end
+function TestPrometheus:testObserveMany()
+  local overall = self.p:histogram("overall", "Overall", nil, {1, 2, 3})
+  local by_path = self.p:histogram("by_path", "By path", {"path"}, {1, 2, 3})
+  local coarse = self.p:histogram("coarse", "Coarse", nil, {5})
+  self.p:observe_many(2.5, {{overall}, {by_path, {"/api"}}, {coarse}})
+  self.p:observe_many(7, {{overall}, {by_path, {"/"}}, {coarse}})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('overall_bucket{le="2.0"}'), nil)
+  luaunit.assertEquals(self.dict:get('overall_bucket{le="3.0"}'), 1)
+  luaunit.assertEquals(self.dict:get('overall_bucket{le="Inf"}'), 2)
+  luaunit.assertEquals(self.dict:get('overall_sum'), 9.5)
+  luaunit.assertEquals(self.dict:get('by_path_bucket{path="/api",le="3.0"}'), 1)
+  luaunit.assertEquals(self.dict:get('by_path_bucket{path="/",le="3.0"}'), nil)
+  luaunit.assertEquals(self.dict:get('by_path_count{path="/"}'), 1)
+  luaunit.assertEquals(self.dict:get('coarse_bucket{le="5.0"}'), 1)
+  luaunit.assertEquals(self.dict:get('coarse_count'), 2)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  -- invalid observations are counted as errors without affecting others.
+  self.p:observe_many(1, {{self.counter1}, {by_path, {"a", "b"}}, {overall}})
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('overall_count'), 3)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+end
+function TestPrometheus:testLabelEscaping()
+  self.counter2:inc(1, {"v2", "\""})
+  self.counter2:inc(5, {"v2", "\\"})
+  self.gauge2:set(1, {"v2", "\""})
+  self.gauge2:set(5, {"v2", "\\"})
+  self.hist2:observe(0.001, {"ok", "site\"1"})
+  self.hist2:observe(0.15, {"ok", "site\"1"})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="\\""}'), 1)
+  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="\\\\"}'), 5)
+  luaunit.assertEquals(self.dict:get('gauge2{f2="v2",f1="\\""}'), 1)
+  luaunit.assertEquals(self.dict:get('gauge2{f2="v2",f1="\\\\"}'), 5)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site\\"1",le="00.005"}'), 1)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site\\"1",le="00.100"}'), 1)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site\\"1",le="00.200"}'), 2)
+  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site\\"1",le="Inf"}'), 2)
+  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site\\"1"}'), 2)
+  luaunit.assertEquals(self.dict:get('l2_sum{var="ok",site="site\\"1"}'), 0.151)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testCustomBucketer1()
+  local hist3 = self.p:histogram("l3", "Histogram 3", {"var"}, {1,2,3})
+  self.hist1:observe(0.35)
+  hist3:observe(2, {"ok"})
+  hist3:observe(0.151, {"ok"})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.300"}'), nil)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.400"}'), 1)
+  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="1.0"}'), 1)
+  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="2.0"}'), 2)
+  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="3.0"}'), 2)
+  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="Inf"}'), 2)
+  luaunit.assertEquals(self.dict:get('l3_count{var="ok"}'), 2)
+  luaunit.assertEquals(self.dict:get('l3_sum{var="ok"}'), 2.151)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testCustomBucketer2()
+  local hist3 = self.p:histogram("l3", "Histogram 3", {"var"},
+    {0.000005,5,50000})
+  hist3:observe(0.000001, {"ok"})
+  hist3:observe(3, {"ok"})
+  hist3:observe(7, {"ok"})
+  hist3:observe(70000, {"ok"})
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="00000.000005"}'), 1)
+  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="00005.000000"}'), 2)
+  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="50000.000000"}'), 3)
+  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="Inf"}'), 4)
+  luaunit.assertEquals(self.dict:get('l3_count{var="ok"}'), 4)
+  luaunit.assertEquals(self.dict:get('l3_sum{var="ok"}'), 70010.000001)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testCompensatedSum()
+  local hist3 = self.p:histogram("l3", "Histogram 3", nil,
+    {buckets={1}, compensated_sum=true})
+  local hist4 = self.p:histogram("l4", "Histogram 4", nil, {buckets={1}})
+  for _ = 1, 100000 do
+    hist3:observe(0.1)
+    hist4:observe(0.1)
+  end
+
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get('l3_count'), 100000)
+  luaunit.assertEquals(self.dict:get('l3_bucket{le="1.0"}'), 100000)
+  luaunit.assertAlmostEquals(self.dict:get('l3_sum'), 10000, 1e-11)
+  -- naive summation drifts much further.
+  assert(math.abs(self.dict:get('l4_sum') - 10000) > 1e-9)
+
+  -- compensation is carried over counter syncs.
+  for i = 1, 100000 do
+    hist3:observe(0.1)
+    if i % 1000 == 0 then self.p._counter:sync() end
+  end
+  self.p._counter:sync()
+  luaunit.assertAlmostEquals(self.dict:get('l3_sum'), 20000, 1e-9)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testCollect()
+  local hist3 = self.p:histogram("b1", "Bytes", {"var", "stale"}, {0.1, 100, 2000})
+  local hist4 = self.p:histogram("b2", "Labels", {}, {100, 2000})
+  self.counter1:inc(5)
+  self.counter2:inc(2, {"v2", "v1"})
+  self.counter2:inc(2, {"v2", "v1"})
+  self.gauge1:set(3)
+  self.gauge2:set(2, {"v2", "v1"})
+  self.gauge2:set(5, {"v2", "v1"})
+  self.hist1:observe(0.000001)
+  self.hist2:observe(0.000001, {"ok", "site2"})
+  self.hist2:observe(3, {"ok", "site2"})
+  self.hist2:observe(7, {"ok", "site2"})
+  self.hist2:observe(70000, {"ok","site2"})
+  hist3:observe(0.01, {"ok", "true"})
+  hist3:observe(50, {"ok", "true"})
+  hist3:observe(50, {"ok", "true"})
+  hist3:observe(150, {"ok", "true"})
+  hist3:observe(5000, {"ok", "true"})
+  hist4:observe(50, {})
+  hist4:observe(50, {})
+  hist4:observe(150, {})
+  hist4:observe(5000, {})
+  self.p:collect()
+
+  assert(find_idx(ngx.printed, "# HELP metric1 Metric 1") ~= nil)
+  assert(find_idx(ngx.printed, "# TYPE metric1 counter") ~= nil)
+  assert(find_idx(ngx.printed, "metric1 5") ~= nil)
+
+  assert(find_idx(ngx.printed, "# TYPE metric2 counter") ~= nil)
+  assert(find_idx(ngx.printed, 'metric2{f2="v2",f1="v1"} 4') ~= nil)
+
+  assert(find_idx(ngx.printed, "# TYPE gauge1 gauge") ~= nil)
+  assert(find_idx(ngx.printed, 'gauge1 3') ~= nil)
+
+  assert(find_idx(ngx.printed, "# TYPE gauge2 gauge") ~= nil)
+  assert(find_idx(ngx.printed, 'gauge2{f2="v2",f1="v1"} 5') ~= nil)
+
+  assert(find_idx(ngx.printed, "# TYPE b1 histogram") ~= nil)
+  assert(find_idx(ngx.printed, "# HELP b1 Bytes") ~= nil)
+  assert(find_idx(ngx.printed, 'b1_bucket{var="ok",stale="true",le="0.1"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'b1_bucket{var="ok",stale="true",le="100"} 3') ~= nil)
+  assert(find_idx(ngx.printed, 'b1_sum{var="ok",stale="true"} 5250.01') ~= nil)
+  assert(find_idx(ngx.printed, 'b2_bucket{le="100"} 2') ~= nil)
+  assert(find_idx(ngx.printed, 'b2_sum 5250') ~= nil)
+
+  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site2",le="4"} 2') ~= nil)
+  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site2",le="+Inf"} 4') ~= nil)
+
+  -- check that type comment exists and is before any samples for the metric.
+  local type_idx = find_idx(ngx.printed, '# TYPE l1 histogram')
+  assert (type_idx ~= nil)
+  assert (ngx.printed[type_idx-1]:find("^l1") == nil)
+  assert (ngx.printed[type_idx+1]:find("^l1") ~= nil)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+
+function TestPrometheus:testCollectBucketSubset()
+  self.hist2:observe(0.001, {"ok", "site1"})
+  self.hist2:observe(0.15, {"ok", "site1"})
+  ngx.uri_args = {["buckets[]"] = {"0.005", "0.2", "0.123"}}
+  self.p:collect()
+
+  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site1",le="0.005"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site1",le="0.2"} 2') ~= nil)
+  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site1",le="+Inf"} 2') ~= nil)
+  assert(find_idx(ngx.printed, 'l2_count{var="ok",site="site1"} 2') ~= nil)
+  assert(find_idx(ngx.printed, 'l2_sum{var="ok",site="site1"} 0.151') ~= nil)
+  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site1",le="0.1"} 1') == nil)
+  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site1",le="0.3"} 2') == nil)
+  luaunit.assertEquals(#ngx.logs, 1)
+  luaunit.assertStrContains(ngx.logs[1], "Ignoring unknown histogram bucket")
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  -- a single value is passed as a string.
+  ngx.printed = nil
+  ngx.uri_args = {["buckets[]"] = "0.1"}
+  self.p:collect()
+  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site1",le="0.1"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site1",le="0.005"} 1') == nil)
+end
+function TestPrometheus:testCollectFamilySubset()
+  self.counter1:inc(1)
+  self.counter2:inc(2, {"v2", "v1"})
+  self.gauge1:set(3)
+  self.hist1:observe(0.5)
+  local hits = self.p:counter("hits", "Hits")
+  local lookups = self.p:counter("lookups", "Lookups")
+  self.p:ratio("hit_ratio", "Hit ratio", hits, lookups)
+  hits:inc(1)
+  lookups:inc(4)
+
+  ngx.uri_args = {prefix = "metric"}
+  self.p:collect()
+  assert(find_idx(ngx.printed, "metric1 1") ~= nil)
+  assert(find_idx(ngx.printed, 'metric2{f2="v2",f1="v1"} 2') ~= nil)
+  assert(find_idx(ngx.printed, "# TYPE gauge1 gauge") == nil)
+  assert(find_idx(ngx.printed, "# TYPE l1 histogram") == nil)
+  assert(find_idx(ngx.printed, "nginx_metric_errors_total 0") == nil)
+
+  -- ratios are computed from counters that are not returned.
+  ngx.printed = nil
+  ngx.uri_args = {["name[]"] = {"gauge1", "l1", "hit_ratio"}}
+  self.p:collect()
+  assert(find_idx(ngx.printed, "gauge1 3") ~= nil)
+  assert(find_idx(ngx.printed, 'l1_bucket{le="+Inf"} 1') ~= nil)
+  assert(find_idx(ngx.printed, "l1_count 1") ~= nil)
+  assert(find_idx(ngx.printed, "hit_ratio 0.25") ~= nil)
+  assert(find_idx(ngx.printed, "hits 1") == nil)
+  assert(find_idx(ngx.printed, "metric1 1") == nil)
+  luaunit.assertNil(ngx.logs)
+
+  -- unknown and empty filters return everything.
+  ngx.printed = nil
+  ngx.uri_args = {prefix = "", ["name[]"] = "unknown"}
+  self.p:collect()
+  assert(find_idx(ngx.printed, "metric1 1") ~= nil)
+  assert(find_idx(ngx.printed, "gauge1 3") ~= nil)
+  assert(find_idx(ngx.printed, "nginx_metric_errors_total 0") ~= nil)
+  luaunit.assertEquals(#ngx.logs, 1)
+  luaunit.assertStrContains(ngx.logs[1], "Ignoring unknown metric")
+end
+function TestPrometheus:testCollectView()
+  self.counter1:inc(1)
+  self.counter2:inc(2, {"v2", "v1"})
+  self.gauge1:set(3)
+  self.hist1:observe(0.1)
+  luaunit.assertTrue(self.p:register_view("lite", {include = {"metric1", "l1"},
+                                                   prefixes = {"gauge"}}))
+
+  self.p:collect({view = "lite"})
+  assert(find_idx(ngx.printed, "metric1 1") ~= nil)
+  assert(find_idx(ngx.printed, "gauge1 3") ~= nil)
+  assert(find_idx(ngx.printed, "l1_count 1") ~= nil)
+  assert(find_idx(ngx.printed, 'metric2{f2="v2",f1="v1"} 2') == nil)
+  assert(find_idx(ngx.printed, "nginx_metric_errors_total 0") == nil)
+  luaunit.assertNil(ngx.logs)
+
+  -- query parameters can only narrow the view down.
+  ngx.printed = nil
+  ngx.uri_args = {["name[]"] = {"gauge1", "metric2"}}
+  self.p:collect({view = "lite"})
+  assert(find_idx(ngx.printed, "gauge1 3") ~= nil)
+  assert(find_idx(ngx.printed, "metric1 1") == nil)
+  assert(find_idx(ngx.printed, 'metric2{f2="v2",f1="v1"} 2') == nil)
+
+  ngx.printed = nil
+  ngx.uri_args = {format = "graphite"}
+  self.p:collect({view = "lite"})
+  luaunit.assertStrContains(table.concat(ngx.printed), "metric1 1 ")
+  luaunit.assertNotStrContains(table.concat(ngx.printed), "metric2")
+
+  -- metrics registered later are included, and views matching nothing yet
+  -- return nothing.
+  ngx.printed = nil
+  ngx.uri_args = nil
+  luaunit.assertTrue(self.p:register_view("later", {include = {"later1"}}))
+  self.p:collect({view = "later"})
+  luaunit.assertEquals(ngx.printed, {})
+  self.p:counter("later1", "Later"):inc(5)
+  ngx.printed = nil
+  self.p:collect({view = "later"})
+  assert(find_idx(ngx.printed, "later1 5") ~= nil)
+  assert(find_idx(ngx.printed, "metric1 1") == nil)
+  luaunit.assertNil(ngx.logs)
+
+  ngx.printed = nil
+  self.p:collect({view = "unknown"})
+  luaunit.assertEquals(ngx.status, 500)
+  luaunit.assertNil(ngx.printed)
+  luaunit.assertStrContains(ngx.logs[1], "Unknown view ' unknown '")
+  ngx.status = nil
+
+  ngx.logs = nil
+  luaunit.assertNil(self.p:register_view("lite", {include = {"metric2"}}))
+  luaunit.assertNil(self.p:register_view("empty", {}))
+  luaunit.assertNil(self.p:register_view("bad", {include = "metric2"}))
+  luaunit.assertNil(self.p:register_view("", {include = {"metric2"}}))
+  luaunit.assertEquals(#ngx.logs, 4)
+  luaunit.assertStrContains(ngx.logs[1], "Duplicate view ' lite '")
+  luaunit.assertStrContains(ngx.logs[2],
+    "should include at least  one metric name or prefix")
+  luaunit.assertStrContains(ngx.logs[3], "has invalid  include")
+  luaunit.assertStrContains(ngx.logs[4], "should be a non-empty string")
 end
-function TestPrometheus:testCounterDel()
+function TestPrometheus:testVerifyOutput()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {verify_output = true})
+  local counter = p:counter("c1", "Counter 1", {"f1"})
+  local hist = p:histogram("h1", "Histogram 1", {"f1"})
+  counter:inc(1, {'a "quoted"\\ value\nwith newline'})
+  hist:observe(0.5, {"b"})
+  p:gauge("g1", ""):set(1 / 0)
+  p:collect()
+  luaunit.assertNil(ngx.status)
+  -- only the newline in the label value is reported.
+  luaunit.assertEquals(#ngx.logs, 1)
+  assert(find_idx(ngx.printed, 'h1_count{f1="b"} 1') ~= nil)
+
+  -- a deliberately malformed value.
+  ngx.printed = nil
+  self.dict:set('h1_sum{f1="b"}', "0,5")
+  p:collect()
+  luaunit.assertEquals(ngx.status, 500)
+  luaunit.assertEquals(ngx.printed, {"Invalid metric output"})
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  luaunit.assertStrContains(ngx.logs[2], "malformed value")
+  luaunit.assertStrContains(ngx.logs[2], 'h1_sum{f1="b"} 0,5')
+end
+function TestPrometheus:testVerifyOutputErrors()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {verify_output = true})
+  local function verify(output)
+    ngx.logs = nil
+    ngx.status = nil
+    p.metric_data = function() return output end
+    p:collect()
+    return ngx.status == 500 and ngx.logs[1]
+  end
+
+  luaunit.assertFalse(verify({"# TYPE c1 counter\n", 'c1{f1="a"} 1\n'}))
+  luaunit.assertStrContains(verify({'c1{f1="a"b"} 1\n'}), "malformed labels")
+  luaunit.assertStrContains(verify({'c1{f1="a\\b"} 1\n'}), "malformed labels")
+  luaunit.assertStrContains(verify({'c1{f1="a",} 1\n'}), "malformed labels")
+  luaunit.assertStrContains(verify({'c1 0x10\n'}), "malformed value")
+  luaunit.assertStrContains(verify({'c1\n'}), "malformed sample")
+  luaunit.assertStrContains(verify({"# TYPE c1 counter\n", "# TYPE c1 counter\n"}),
+    "duplicate TYPE comment")
+  luaunit.assertStrContains(verify({"c1 1\n", "# HELP c1 Counter\n"}),
+    "HELP comment after samples")
+  luaunit.assertStrContains(verify({"c1 1\n", "c2 1\n", "c1{f1=\"a\"} 1\n"}),
+    "not contiguous")
+  luaunit.assertStrContains(verify({"# TYPE h1 histogram\n", 'h1_bucket{le="1"} 1\n',
+    "h1_cache 1\n", "h1_count 1\n"}), "not contiguous")
+end
+function TestPrometheus:testCollectStreaming()
+  for i = 1, 20 do
+    self.counter2:inc(i, {"f2", tostring(i)})
+  end
+  self.hist2:observe(0.1, {"a", "b"})
+  self.p:collect()
+  local buffered = ngx.printed
+
+  self.p.stream_chunk_size = 200
+  local print = Nginx.print
+  local chunks = {}
+  Nginx.print = function(chunk)
+    local size = #table.concat(chunk)
+    table.insert(chunks, size)
+    print(chunk)
+  end
+  ngx.printed = nil
+  self.p:collect()
+  Nginx.print = print
+
+  -- output is the same, but sent in several chunks.
+  luaunit.assertEquals(ngx.printed, buffered)
+  assert(#chunks > 5)
+  for i = 1, #chunks - 1 do
+    assert(chunks[i] >= 200)
+    assert(chunks[i] < 400)
+  end
+end
+function TestPrometheus:testCollectGzip()
+  luaunit.assertErrorMsgContains("gzip option requires the lua-zlib module",
+    function() require('prometheus').init("metrics", {gzip = true}) end)
+
+  -- Fake compression, marking each compressed chunk and the end of stream.
+  local streams = {}
+  package.loaded.zlib = {deflate = function(level, window_bits)
+    local stream = {level = level, window_bits = window_bits, flushes = {}}
+    table.insert(streams, stream)
+    return function(input, flush)
+      table.insert(stream.flushes, flush)
+      return "<" .. input .. (flush == "finish" and "EOF" or ">"), true
+    end
+  end}
+  self.p = require('prometheus').init("metrics", {gzip = true})
+  package.loaded.zlib = nil
+  self.p:counter("metric1", "Metric 1"):inc(1)
+  ngx.header = {}
+
+  ngx.var = {http_accept_encoding = "deflate, gzip;q=0.5"}
+  self.p:collect()
+  luaunit.assertEquals(ngx.header.content_encoding, "gzip")
+  luaunit.assertEquals(ngx.header["Vary"], "Accept-Encoding")
+  luaunit.assertEquals(#streams, 1)
+  luaunit.assertEquals(streams[1].level, 6)
+  luaunit.assertEquals(streams[1].window_bits, 31)
+  luaunit.assertEquals(streams[1].flushes, {"finish"})
+  luaunit.assertStrContains(ngx.printed[1], "<# HELP")
+  luaunit.assertStrContains(ngx.printed[#ngx.printed], "EOF")
+  assert(find_idx(ngx.printed, "metric1 1") ~= nil)
+  local length = 0
+  for _, line in ipairs(ngx.printed) do
+    length = length + #line + 1
+  end
+  -- the last line has no newline after the fake end of stream.
+  luaunit.assertEquals(ngx.header.content_length, length - 1)
+
+  -- streamed chunks are compressed as well.
+  ngx.printed = nil
+  self.p.stream_chunk_size = 100
+  self.p:collect()
+  luaunit.assertEquals(#streams, 2)
+  assert(#streams[2].flushes > 1)
+  luaunit.assertEquals(streams[2].flushes[#streams[2].flushes], "finish")
+  luaunit.assertEquals(streams[2].flushes[1], "sync")
+  self.p.stream_chunk_size = nil
+
+  -- clients not accepting gzip get uncompressed output.
+  ngx.header = {}
+  ngx.printed = nil
+  for _, encoding in ipairs({"gzip;q=0", "br", ""}) do
+    ngx.var = {http_accept_encoding = encoding}
+    self.p:collect()
+    luaunit.assertNil(ngx.header.content_encoding)
+  end
+  luaunit.assertEquals(#streams, 2)
+  assert(find_idx(ngx.printed, "# HELP metric1 Metric 1") ~= nil)
+  ngx.header = nil
+end
+function TestPrometheus:testCollectEmptyLabelSet()
+  local gauge = self.p:gauge("nginx_active", "Active connections", {})
+  local counter = self.p:counter("nolabels_total", "No labels", {})
+  local labelled = self.p:gauge("labelled", "Labelled", {"f1"})
+  gauge:set(3)
+  counter:inc(2)
+  labelled:set(1, {"v1"})
+  self.p:collect()
+
+  assert(find_idx(ngx.printed, "nginx_active 3") ~= nil)
+  assert(find_idx(ngx.printed, "nolabels_total 2") ~= nil)
+  assert(find_idx(ngx.printed, 'labelled{f1="v1"} 1') ~= nil)
+  for _, line in ipairs(ngx.printed) do
+    assert(line:find("{}", 1, true) == nil, line)
+  end
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testRatio()
+  local good = self.p:counter("good_total", "Good", {"host", "status"})
+  local total = self.p:counter("all_total", "All", {"host", "status"})
+  local ratio = self.p:ratio("good_ratio", "Good ratio", good, total, {"host"})
+  assert(ratio ~= nil)
+  good:inc(3, {"a.com", "200"})
+  good:inc(1, {"a.com", "204"})
+  total:inc(4, {"a.com", "200"})
+  total:inc(1, {"a.com", "204"})
+  total:inc(3, {"a.com", "500"})
+  total:inc(2, {"b.com", "500"})
+  good:inc(1, {"c.com", "200"})
+  self.p:collect()
+
+  local idx = find_idx(ngx.printed, "# TYPE good_ratio gauge")
+  luaunit.assertEquals(ngx.printed[idx - 1], "# HELP good_ratio Good ratio")
+  luaunit.assertEquals(ngx.printed[idx + 1], 'good_ratio{host="a.com"} 0.5')
+  luaunit.assertEquals(ngx.printed[idx + 2], 'good_ratio{host="b.com"} 0')
+  -- label sets without denominator values are omitted.
+  luaunit.assertEquals(#ngx.printed, idx + 2)
+  luaunit.assertNil(self.dict:get('good_ratio{host="a.com"}'))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+end
+
+function TestPrometheus:testRatioInvalid()
+  local good = self.p:counter("good_total", "Good", {"host"})
+  local total = self.p:counter("all_total", "All", {"host", "status"})
+  luaunit.assertNil(self.p:ratio("r1", "R", good, self.gauge1))
+  luaunit.assertNil(self.p:ratio("r2", "R", good, total, {"status"}))
+  luaunit.assertNil(self.p:ratio("gauge1", "R", good, total))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+  luaunit.assertStrContains(ngx.logs[2], "good_total")
+
+  assert(self.p:ratio("r3", "R", good, total) ~= nil)
+  luaunit.assertNil(self.p:gauge("r3", "Gauge"))
+  self.p:collect()
+  assert(find_idx(ngx.printed, "# TYPE r3 gauge") == nil)
+end
+
+function TestPrometheus:testSkipZero()
+  local sparse = self.p:counter("sparse_total", "Sparse", {"id"},
+    {skip_zero = true})
+  sparse:inc(0, {"a"})
+  sparse:inc(2, {"b"})
+  self.counter3:inc(0, {"c"})
+  self.p._counter:sync()
+  self.p:collect()
+
+  luaunit.assertEquals(self.dict:get('sparse_total{id="a"}'), 0)
+  luaunit.assertEquals(find_idx(ngx.printed, 'sparse_total{id="a"} 0'), nil)
+  assert(find_idx(ngx.printed, 'sparse_total{id="b"} 2') ~= nil)
+  -- other counters are not affected.
+  assert(find_idx(ngx.printed, 'metric3{f3="c"} 0') ~= nil)
+
+  luaunit.assertNil(self.p:gauge("g1", "G1", nil, {skip_zero = true}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+end
+function TestPrometheus:testAlias()
+  assert(self.p:alias("metric2", "requests", {labels = {f1 = "host",
+    f2 = false}}))
+  assert(self.p:alias("l2", "latency_seconds"))
+  self.counter2:inc(3, {"a", "b"})
+  self.hist2:observe(0.5, {"ok", "site1"})
+  self.p:collect()
+
+  local idx = find_idx(ngx.printed, "# TYPE latency_seconds histogram")
+  luaunit.assertEquals(ngx.printed[idx - 1],
+    "# HELP latency_seconds Histogram 2")
+  luaunit.assertEquals(ngx.printed[idx + 1],
+    'latency_seconds_bucket{var="ok",site="site1",le="0.5"} 1')
+  assert(find_idx(ngx.printed,
+    'latency_seconds_count{var="ok",site="site1"} 1') ~= nil)
+  assert(find_idx(ngx.printed,
+    'latency_seconds_sum{var="ok",site="site1"} 0.5') ~= nil)
+  idx = find_idx(ngx.printed, "# TYPE requests counter")
+  luaunit.assertEquals(ngx.printed[idx - 1], "# HELP requests Metric 2")
+  luaunit.assertEquals(ngx.printed[idx + 1], 'requests{host="b"} 3')
+  luaunit.assertEquals(find_idx(ngx.printed, "# TYPE metric2 counter"), nil)
+  luaunit.assertEquals(find_idx(ngx.printed, "# TYPE l2 histogram"), nil)
+  -- stored keys don't change.
+  luaunit.assertEquals(self.dict:get('metric2{f2="a",f1="b"}'), 3)
+  local data = table.concat(self.p:metric_data(nil, true))
+  luaunit.assertStrContains(data, "# TYPE requests counter\n" ..
+    'requests_total{host="b"} 3\n')
+end
+function TestPrometheus:testAliasInvalid()
+  luaunit.assertNil(self.p:alias("unknown", "foo"))
+  luaunit.assertNil(self.p:alias("metric1", "metric3"))
+  luaunit.assertNil(self.p:alias("metric1", "l1_count"))
+  luaunit.assertNil(self.p:alias("metric2", "foo", {labels = {f3 = "x"}}))
+  luaunit.assertNil(self.p:alias("metric2", "foo", {labels = {f1 = "f2"}}))
+  luaunit.assertNil(self.p:alias("metric2", "foo", {labels = {f1 = "le"}}))
+  luaunit.assertNil(self.p:alias("nginx_metric_errors_total", "errors"))
+  assert(self.p:alias("metric1", "foo"))
+  luaunit.assertNil(self.p:alias("metric3", "foo"))
+  luaunit.assertNil(self.p:alias("metric1", "bar"))
+  luaunit.assertNil(self.p:counter("foo", "Foo"))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 10)
+  luaunit.assertStrContains(ngx.logs[1], "aliased: only counters")
+  luaunit.assertStrContains(ngx.logs[2], "would collide with metric  metric3")
+  luaunit.assertStrContains(ngx.logs[3], "would collide with metric  l1")
+  luaunit.assertStrContains(ngx.logs[5], "duplicate label ' f2 '")
+  luaunit.assertStrContains(ngx.logs[8], "would collide with metric  foo")
+  luaunit.assertStrContains(ngx.logs[9], "already aliased")
+  luaunit.assertStrContains(ngx.logs[10], "collides with an alias")
+end
+function TestPrometheus:testCollectUpMetric()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {prefix = "test_",
+    up_metric = true, verify_output = true})
+  local gauge = p:gauge("gauge2", "Gauge", {"f2", "f1"})
+  gauge:set(1, {"a", "b"})
+  p:collect()
+  local idx = find_idx(ngx.printed, "test_nginx_lua_prometheus_up 1")
+  luaunit.assertEquals(idx, #ngx.printed)
+  luaunit.assertEquals(ngx.printed[idx - 1],
+    "# TYPE test_nginx_lua_prometheus_up gauge")
+
+  -- errors while reading metrics are reported in the same response.
+  gauge:set(1, {"dict_error", "dict_error"})
+  p:collect()
+  assert(find_idx(ngx.printed, "test_nginx_lua_prometheus_up 0") ~= nil)
+  luaunit.assertNil(self.dict:get("test_nginx_lua_prometheus_up"))
+
+  gauge:del({"dict_error", "dict_error"})
+  p:collect()
+  assert(find_idx(ngx.printed, "test_nginx_lua_prometheus_up 1") ~= nil)
+end
+function TestPrometheus:testCollectBuildInfo()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  ngx.config = {nginx_version = 1019003, ngx_lua_version = 10019}
+  local p = require('prometheus').init("metrics", {build_info = true,
+    default_labels = {region = "eu"}, verify_output = true})
+  ngx.config = nil
+  p:gauge("temperature", "Temperature"):set(20)
+  p:collect()
+
+  local version = require('prometheus').VERSION
+  local idx = find_idx(ngx.printed,
+    "# TYPE nginx_lua_prometheus_build_info gauge")
+  assert(idx ~= nil)
+  -- luajit_version label is only added when running under LuaJIT.
+  luaunit.assertStrContains(ngx.printed[idx + 1],
+    'nginx_lua_prometheus_build_info{region="eu",version="' .. version ..
+    '",nginx_version="1.19.3",ngx_lua_version="0.10.19"')
+  luaunit.assertEquals(ngx.printed[idx + 1]:sub(-2), " 1")
+  luaunit.assertEquals(ngx.logs, nil)
+
+  -- the version should match the rockspec.
+  luaunit.assertEquals(version, "0.20210206")
+  ngx.printed = nil
+  self.p:collect()
+  luaunit.assertEquals(find_idx(ngx.printed,
+    "# TYPE nginx_lua_prometheus_build_info gauge"), nil)
+end
+function TestPrometheus:testCollectOpenMetrics()
+  local requests = self.p:counter("requests_total", "Requests", {"host"})
+  local latency = self.p:histogram("latency_seconds", "Latency", nil,
+    {buckets = {1}, unit = "seconds"})
   self.counter1:inc(1)
+  requests:inc(2, {"a"})
+  latency:observe(0.5)
   self.p._counter:sync()
-  luaunit.assertEquals(self.dict:get("metric1"), 1)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
 
-  self.counter1:del()
-  luaunit.assertEquals(self.dict:get("metric1"), nil)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  ngx.var = {http_accept = "application/openmetrics-text;version=1.0.0," ..
+    "text/plain;version=0.0.4;q=0.5,*/*;q=0.1"}
+  ngx.printed = nil
+  self.p:collect()
+  luaunit.assertStrContains(ngx.header.content_type,
+    "application/openmetrics-text")
+  luaunit.assertEquals(ngx.printed[#ngx.printed], "# EOF")
+  -- counter families are named without the _total suffix of their samples.
+  assert(find_idx(ngx.printed, "# TYPE metric1 counter") ~= nil)
+  assert(find_idx(ngx.printed, "metric1_total 1") ~= nil)
+  assert(find_idx(ngx.printed, "# HELP requests Requests") ~= nil)
+  assert(find_idx(ngx.printed, "# TYPE requests counter") ~= nil)
+  assert(find_idx(ngx.printed, 'requests_total{host="a"} 2') ~= nil)
+  local idx = find_idx(ngx.printed, "# TYPE latency_seconds histogram")
+  luaunit.assertEquals(ngx.printed[idx + 1], "# UNIT latency_seconds seconds")
+  assert(find_idx(ngx.printed, 'latency_seconds_bucket{le="+Inf"} 1') ~= nil)
 
-  self.counter2:inc(1, {"f2value", "f1value"})
+  -- older scrapers get the classic format.
+  ngx.var = {http_accept = "text/plain;version=0.0.4"}
+  ngx.printed = nil
+  self.p:collect()
+  luaunit.assertEquals(ngx.header.content_type, "text/plain")
+  assert(find_idx(ngx.printed, "# TYPE metric1 counter") ~= nil)
+  assert(find_idx(ngx.printed, "metric1 1") ~= nil)
+  assert(find_idx(ngx.printed, "# EOF") == nil)
+  assert(find_idx(ngx.printed, "# UNIT latency_seconds seconds") == nil)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testHistogramObserveCount()
+  luaunit.assertEquals(self.hist1:observe(0.15, nil, {count = 10}), 8)
+  self.hist1:observe(7, nil, {count = 2})
+  self.hist1:observe(0.02)
   self.p._counter:sync()
-  luaunit.assertEquals(self.dict:get('metric2{f2="f2value",f1="f1value"}'), 1)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  luaunit.assertEquals(self.dict:get("l1_count"), 13)
+  luaunit.assertAlmostEquals(self.dict:get("l1_sum"), 15.52, 1e-9)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.100"}'), 1)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.200"}'), 11)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="05.000"}'), 11)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="10.000"}'), 13)
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="Inf"}'), 13)
 
-  self.counter2:del()
-  luaunit.assertEquals(self.dict:get('metric2{f2="f2value",f1="f1value"}'), 1)
+  for _, count in ipairs({0, -1, 1.5, "2", 0/0, 1/0}) do
+    luaunit.assertNil(self.hist1:observe(1, nil, {count = count}))
+  end
+  self.p._counter:sync()
+  luaunit.assertEquals(self.dict:get("l1_count"), 13)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 6)
+  luaunit.assertStrContains(ngx.logs[1], "should be a positive integer")
+end
+function TestPrometheus:testExemplars()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {verify_output = true})
+  local requests = p:counter("requests", "Requests", {"host"})
+  local latency = p:histogram("latency", "Latency", nil, {buckets = {1, 2}})
+  ngx.clock = 1600000000.5
+  requests:inc(1, {"a"}, {exemplar = {trace_id = "abc"}})
+  requests:inc(2, {"a"}, {exemplar = {trace_id = "def", span_id = 7}})
+  requests:inc(1, {"b"})
+  latency:observe(1.5, nil, {exemplar = {trace_id = "ghi"}})
+  latency:observe(0.5)
+  latency:observe(5, nil, {exemplar = {trace_id = "jkl"}})
+  p._counter:sync()
+
+  ngx.var = {http_accept = "application/openmetrics-text"}
+  p:collect()
+  -- only the latest exemplar of each series or bucket is exposed.
+  assert(find_idx(ngx.printed, 'requests_total{host="a"} 3 # ' ..
+    '{span_id="7",trace_id="def"} 2 1600000000.500') ~= nil)
+  assert(find_idx(ngx.printed, 'requests_total{host="b"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_bucket{le="1"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_bucket{le="2"} 2 # ' ..
+    '{trace_id="ghi"} 1.5 1600000000.500') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_bucket{le="+Inf"} 3 # ' ..
+    '{trace_id="jkl"} 5 1600000000.500') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_count 3') ~= nil)
+
+  -- other formats don't support exemplars.
+  ngx.var = nil
+  ngx.printed = nil
+  p:collect()
+  assert(find_idx(ngx.printed, 'requests{host="a"} 3') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_bucket{le="+Inf"} 3') ~= nil)
+  luaunit.assertEquals(ngx.logs, nil)
+
+  -- invalid exemplars are counted as errors, the value is still recorded.
+  requests:inc(1, {"b"}, {exemplar = "abc"})
+  requests:inc(1, {"b"}, {exemplar = {}})
+  requests:inc(1, {"b"}, {exemplar = {["trace-id"] = "abc"}})
+  latency:observe(1, nil, {exemplar = {trace_id = string.rep("x", 121)}})
+  p._counter:sync()
+  luaunit.assertEquals(self.dict:get('requests{host="b"}'), 4)
+  luaunit.assertEquals(self.dict:get("latency_count"), 4)
+  luaunit.assertEquals(#ngx.logs, 4)
+  luaunit.assertStrContains(ngx.logs[4], "longer than 128 characters")
+
+  requests:del({"a"})
+  luaunit.assertEquals(requests.exemplars, {})
+end
+function TestPrometheus:testCollectAllowlist()
+  self.counter1:inc(1)
+  local allow = {"10.0.0.0/8", "192.168.1.128/25", "127.0.0.1",
+    "2001:db8::/32", "::1/128", "not-a-range", "10.0.0.0/33"}
+  local function collect(addr)
+    ngx.var = {remote_addr = addr}
+    ngx.printed = nil
+    ngx.status = nil
+    self.p:collect({allow = allow})
+    return ngx.status ~= 403 and find_idx(ngx.printed, "metric1 1") ~= nil
+  end
+
+  luaunit.assertTrue(collect("10.1.2.3"))
+  luaunit.assertTrue(collect("192.168.1.200"))
+  luaunit.assertTrue(collect("127.0.0.1"))
+  luaunit.assertTrue(collect("2001:db8:1::5"))
+  luaunit.assertTrue(collect("::1"))
+  luaunit.assertTrue(collect("::ffff:10.0.0.1"))
+  luaunit.assertTrue(collect("0:0:0:0:0:ffff:a00:1"))
+  -- invalid ranges are counted as errors once.
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  luaunit.assertStrContains(ngx.logs[1], "not-a-range")
+
+  luaunit.assertFalse(collect("11.0.0.1"))
+  luaunit.assertFalse(collect("192.168.1.127"))
+  luaunit.assertFalse(collect("127.0.0.2"))
+  luaunit.assertFalse(collect("2001:db9::1"))
+  luaunit.assertFalse(collect("::2"))
+  luaunit.assertFalse(collect("unix:"))
+  luaunit.assertFalse(collect("10.0.0.256"))
+  luaunit.assertFalse(collect("1::2::3"))
+  luaunit.assertEquals(ngx.status, 403)
+  luaunit.assertNil(ngx.printed)
+  -- rejected clients are not errors.
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+end
+function TestPrometheus:testCollectProtected()
+  local users = {
+    alice = "secret",
+    bob = "{SHA}" .. ngx.encode_base64(ngx.sha1_bin("hunter2")),
+  }
+  self.counter1:inc(1)
+  local function collect(user, password)
+    ngx.var = {http_authorization = user and
+      "Basic " .. ngx.encode_base64(user .. ":" .. password)}
+    ngx.printed = nil
+    ngx.status = nil
+    ngx.header = {}
+    self.p:collect_protected(users)
+    return ngx.status ~= 401 and find_idx(ngx.printed, "metric1 1") ~= nil
+  end
+
+  luaunit.assertTrue(collect("alice", "secret"))
+  luaunit.assertTrue(collect("bob", "hunter2"))
+  luaunit.assertFalse(collect("alice", "secret2"))
+  luaunit.assertFalse(collect("alice", ""))
+  luaunit.assertFalse(collect("bob", "{SHA}" ..
+    ngx.encode_base64(ngx.sha1_bin("hunter2"))))
+  luaunit.assertFalse(collect("carol", "secret"))
+  luaunit.assertFalse(collect(nil))
+  luaunit.assertEquals(ngx.status, 401)
+  luaunit.assertEquals(ngx.header["WWW-Authenticate"], 'Basic realm="metrics"')
+  luaunit.assertNil(ngx.printed)
+
+  ngx.var = {http_authorization = "Basic !!!"}
+  luaunit.assertFalse(require('prometheus').basic_auth(users, "internal"))
+  luaunit.assertEquals(ngx.header["WWW-Authenticate"], 'Basic realm="internal"')
+  ngx.header = nil
+end
+function TestPrometheus:testCollectProtobuf()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {protobuf = true})
+  local requests = p:counter("requests_total", "Requests", {"host"})
+  local in_flight = p:gauge("in_flight", "In flight")
+  requests:inc(2, {"a"})
+  in_flight:set(-1.5)
+  p._counter:sync()
+
+  local print = Nginx.print
+  local raw
+  Nginx.print = function(chunk)
+    raw = table.concat(chunk)
+  end
+  ngx.var = {http_accept = "application/vnd.google.protobuf;" ..
+    "proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7," ..
+    "text/plain;version=0.0.4;q=0.3"}
+  p:collect()
+  Nginx.print = print
+  luaunit.assertStrContains(ngx.header.content_type, "encoding=delimited")
+  -- length-delimited MetricFamily with name, help, type (COUNTER) and a
+  -- Metric with a label and a Counter value of 2.
+  luaunit.assertStrContains(raw, "\52\10\14requests_total\18\8Requests\24\0" ..
+    "\34\22\10\9\10\4host\18\1a\26\9\9\0\0\0\0\0\0\0\64")
+  -- Gauge value of -1.5.
+  luaunit.assertStrContains(raw, "\24\1\34\11\18\9\9\0\0\0\0\0\0\248\191")
+
+  -- clients that prefer other formats don't get protobuf.
+  ngx.var = {http_accept = "application/vnd.google.protobuf;" ..
+    "proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.5," ..
+    "application/openmetrics-text;version=1.0.0"}
+  ngx.printed = nil
+  p:collect()
+  luaunit.assertStrContains(ngx.header.content_type,
+    "application/openmetrics-text")
+  ngx.var = {http_accept = "application/vnd.google.protobuf;" ..
+    "proto=io.prometheus.client.MetricFamily;encoding=text"}
+  ngx.printed = nil
+  p:collect()
+  luaunit.assertEquals(ngx.header.content_type, "text/plain")
+  assert(find_idx(ngx.printed, 'requests_total{host="a"} 2') ~= nil)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testNativeHistogram()
+  local protobuf = "application/vnd.google.protobuf;" ..
+    "proto=io.prometheus.client.MetricFamily;encoding=delimited"
+  -- without native histograms, the text format is used.
+  ngx.var = {http_accept = protobuf .. ",text/plain;q=0.5"}
+  self.p:collect()
+  luaunit.assertEquals(ngx.header.content_type, "text/plain")
+
+  local h = self.p:histogram("native", "Native", {"f1"},
+    {buckets = {1}, native_schema = 0})
+  h:observe(1, {"a"})
+  h:observe(3, {"a"})
+  h:observe(3.5, {"a"})
+  h:observe(-3, {"a"})
+  h:observe(0, {"a"})
+  self.p._counter:sync()
+  local prefix = "__ngx_prom__sketch_"
+  luaunit.assertEquals(self.dict:get(prefix .. 'p0_native{f1="a"}'), 1)
+  luaunit.assertEquals(self.dict:get(prefix .. 'p2_native{f1="a"}'), 2)
+  luaunit.assertEquals(self.dict:get(prefix .. 'n2_native{f1="a"}'), 1)
+  luaunit.assertEquals(self.dict:get(prefix .. 'z_native{f1="a"}'), 1)
+
+  -- native buckets are not exposed in the text format.
+  ngx.var = {http_accept = "text/plain"}
+  ngx.printed = nil
+  self.p:collect()
+  luaunit.assertEquals(ngx.header.content_type, "text/plain")
+  assert(find_idx(ngx.printed, 'native_count{f1="a"} 5') ~= nil)
+  assert(find_idx(ngx.printed, 'native_bucket{f1="a",le="1"} 3') ~= nil)
+  for _, line in ipairs(ngx.printed) do
+    luaunit.assertNotStrContains(line, "sketch")
+  end
+
+  local print = Nginx.print
+  local raw
+  Nginx.print = function(chunk)
+    raw = table.concat(chunk)
+  end
+  ngx.var = {http_accept = protobuf .. ",text/plain;q=0.5"}
+  self.p:collect()
+  Nginx.print = print
+  luaunit.assertStrContains(ngx.header.content_type,
+    "application/vnd.google.protobuf")
+  -- MetricFamily name and label of the series.
+  luaunit.assertStrContains(raw, "\10\6native")
+  luaunit.assertStrContains(raw, "\10\7\10\2f1\18\1a")
+  -- schema 0, zero bucket with one observation, and positive buckets 0 and 2
+  -- (spans of length 1 with offsets 0 and 1, deltas of counts 1 and 1).
+  luaunit.assertStrContains(raw, "\40\0\49")
+  luaunit.assertStrContains(raw, "\56\1")
+  luaunit.assertStrContains(raw, "\98\4\8\0\16\1\98\4\8\2\16\1\104\2\104\2")
+  -- negative bucket 2.
+  luaunit.assertStrContains(raw, "\74\4\8\4\16\1\80\2")
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testNativeHistogramInvalid()
+  luaunit.assertNil(self.p:histogram("h1", "H", nil, {native_schema = 9}))
+  luaunit.assertNil(self.p:histogram("h2", "H", nil, {native_schema = 0.5}))
+  luaunit.assertNil(self.p:gauge("g1", "G", nil, {native_schema = 0}))
+  luaunit.assertNil(self.p:histogram("h3", "H", nil,
+    {native_zero_threshold = 0.1}))
+  luaunit.assertNil(self.p:histogram("h4", "H", nil,
+    {native_schema = 0, sample_rate = 0.5}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 5)
+  luaunit.assertStrContains(ngx.logs[1], "invalid native_schema")
+end
+function TestPrometheus:testConstLabels()
+  local requests = self.p:counter("requests_total", "Requests", {"host"},
+    {const_labels = {service = "foo", region = "us-east"}})
+  local latency = self.p:histogram("latency", "Latency", nil,
+    {buckets = {1}, const_labels = {service = "foo"}})
+  local temperature = self.p:gauge("temperature", "Temperature", nil,
+    {const_labels = {unit = 'deg"C'}})
+  requests:inc(2, {"a"})
+  latency:observe(0.5)
+  temperature:set(21)
+  self.p._counter:sync()
+  -- const labels are not stored in the dictionary.
+  luaunit.assertEquals(self.dict:get('requests_total{host="a"}'), 2)
+
+  self.p:collect()
+  assert(find_idx(ngx.printed,
+    'requests_total{region="us-east",service="foo",host="a"} 2') ~= nil)
+  assert(find_idx(ngx.printed,
+    'latency_bucket{service="foo",le="1"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_count{service="foo"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_sum{service="foo"} 0.5') ~= nil)
+  assert(find_idx(ngx.printed, 'temperature{unit="deg\\"C"} 21') ~= nil)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testConstLabelsInvalid()
+  luaunit.assertNil(self.p:counter("c1", "C", {"host"},
+    {const_labels = {host = "a"}}))
+  luaunit.assertNil(self.p:counter("c2", "C", nil,
+    {const_labels = {["bad-name"] = "a"}}))
+  luaunit.assertNil(self.p:histogram("h1", "H", nil,
+    {const_labels = {le = "1"}}))
+  luaunit.assertNil(self.p:counter("c3", "C", {"status"},
+    {error_label = true, const_labels = {error = "a"}}))
+  luaunit.assertNil(self.p:counter("c4", "C", nil, {const_labels = "a"}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 5)
+  luaunit.assertStrContains(ngx.logs[1],
+    "const label 'host' is also a variable label")
+end
+function TestPrometheus:testDefaultLabels()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local labels = {pod = "pod-1", host = "h1"}
+  local p = require('prometheus').init("metrics",
+    {default_labels = labels, up_metric = true})
+  -- labels are only read during initialization.
+  labels.pod = "pod-2"
+  local requests = p:counter("requests_total", "Requests", {"host"})
+  local temperature = p:gauge("temperature", "Temperature", nil,
+    {const_labels = {pod = "sensor"}})
+  local latency = p:histogram("latency", "Latency", nil,
+    {buckets = {1}, bucket_bounds = true})
+  local sizes = p:summary("sizes", "Sizes", nil, {quantiles = {0.5}})
+  requests:inc(2, {"a"})
+  temperature:set(21)
+  latency:observe(0.5)
+  sizes:observe(10)
+  p._counter:sync()
+
+  p:collect()
+  -- labels of the metric take precedence over default ones.
+  assert(find_idx(ngx.printed, 'requests_total{pod="pod-1",host="a"} 2') ~= nil)
+  assert(find_idx(ngx.printed, 'temperature{host="h1",pod="sensor"} 21') ~= nil)
+  assert(find_idx(ngx.printed,
+    'latency_bucket{host="h1",pod="pod-1",le="1"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_count{host="h1",pod="pod-1"} 1') ~= nil)
+  assert(find_idx(ngx.printed,
+    'latency_bucket_bounds{host="h1",pod="pod-1",le="1"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'sizes_count{host="h1",pod="pod-1"} 1') ~= nil)
+  local quantile_found = false
+  for _, line in ipairs(ngx.printed) do
+    if line:find('sizes{host="h1",pod="pod-1",quantile="0.5"} ', 1, true) then
+      quantile_found = true
+    end
+  end
+  assert(quantile_found)
+  assert(find_idx(ngx.printed,
+    'nginx_metric_errors_total{host="h1",pod="pod-1"} 0') ~= nil)
+  assert(find_idx(ngx.printed,
+    'nginx_lua_prometheus_up{host="h1",pod="pod-1"} 1') ~= nil)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testDefaultLabelsInvalid()
+  local prometheus = require('prometheus')
+  luaunit.assertErrorMsgContains("default_labels should be a table", function()
+    prometheus.init("metrics", {default_labels = "pod"})
+  end)
+  luaunit.assertErrorMsgContains("Invalid default label name 'le'", function()
+    prometheus.init("metrics", {default_labels = {le = "1"}})
+  end)
+  luaunit.assertErrorMsgContains("Invalid default label name 'a-b'", function()
+    prometheus.init("metrics", {default_labels = {["a-b"] = "1"}})
+  end)
+  luaunit.assertErrorMsgContains("should be a string or a number", function()
+    prometheus.init("metrics", {default_labels = {pod = true}})
+  end)
+end
+function TestPrometheus:testInvalidUnit()
+  luaunit.assertNil(self.p:gauge("size", "Size", nil, {unit = "bytes/s"}))
+  luaunit.assertNotNil(self.p:counter("sent_bytes_total", "Sent", nil,
+    {unit = "bytes"}))
   luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+  luaunit.assertStrContains(ngx.logs[1], "invalid unit")
+  ngx.logs = nil
 
-  self.counter2:del({"f2value", "f1value"})
-  luaunit.assertEquals(self.dict:get('metric2{f2="f2value",f1="f1value"}'), nil)
+  -- units that are not the name suffix are left out with a warning.
+  local gauge = self.p:gauge("size_bytes", "Size", nil, {unit = "seconds"})
+  luaunit.assertNotNil(gauge)
+  luaunit.assertStrContains(ngx.logs[1], "not the suffix of the metric name")
   luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+  gauge:set(1)
+  ngx.var = {http_accept = "application/openmetrics-text; version=1.0.0"}
+  self.p:collect()
+  assert(find_idx(ngx.printed, "# TYPE size_bytes gauge") ~= nil)
+  luaunit.assertNil(find_idx(ngx.printed, "# UNIT size_bytes seconds"))
+
+  -- or rejected with strict_units option.
+  local p = require('prometheus').init("metrics", {strict_units = true})
+  luaunit.assertNil(p:gauge("size2_bytes", "Size", nil, {unit = "seconds"}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
 end
-function TestPrometheus:testReset()
-  self.gauge1:inc(1)
-  luaunit.assertEquals(self.dict:get("gauge1"), 1)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+function TestPrometheus:testGaugeCollectFn()
+  local memory = {10}
+  self.p:gauge("memory_bytes", "Memory", nil,
+    {collect_fn = function() return memory[1] end})
+  local conns = self.p:gauge("conns", "Connections", {"state"},
+    {collect_fn = function()
+      return {{{"writing"}, 2}, {{"reading"}, 1}, {{"a", "b"}, 3}}
+    end})
+  self.p:gauge("broken", "Broken", nil,
+    {collect_fn = function() error("no data") end})
 
-  self.gauge1:reset()
-  self.p.key_index:sync()
-  luaunit.assertEquals(self.dict:get("gauge1"), nil)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  self.p:collect()
+  assert(find_idx(ngx.printed, "# TYPE memory_bytes gauge") ~= nil)
+  assert(find_idx(ngx.printed, "memory_bytes 10") ~= nil)
+  local idx = find_idx(ngx.printed, '# TYPE conns gauge')
+  luaunit.assertEquals(ngx.printed[idx + 1], 'conns{state="reading"} 1')
+  luaunit.assertEquals(ngx.printed[idx + 2], 'conns{state="writing"} 2')
+  assert(find_idx(ngx.printed, "# TYPE broken gauge") == nil)
+  -- errors in callbacks are counted, and don't affect other metrics.
+  luaunit.assertEquals(#ngx.logs, 2)
+  luaunit.assertStrContains(ngx.logs[1], "no data")
+  luaunit.assertStrContains(ngx.logs[2], "inconsistent labels count")
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
 
-  self.gauge1:inc(3)
-  luaunit.assertEquals(self.dict:get("gauge1"), 3)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  -- values are computed during each collection, and never stored.
+  memory[1] = 20
+  ngx.printed = nil
+  self.p:collect()
+  assert(find_idx(ngx.printed, "memory_bytes 20") ~= nil)
+  conns:set(1, {"reading"})
+  luaunit.assertNil(self.dict:get('conns{state="reading"}'))
+  luaunit.assertNil(self.dict:get("memory_bytes"))
 
-  self.gauge2:inc(1, {"f2value", "f1value"})
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), 1)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  luaunit.assertNil(self.p:counter("c1", "C1", nil,
+    {collect_fn = function() return 1 end}))
+  luaunit.assertNil(self.p:gauge("g1", "G1", nil, {collect_fn = 1}))
+end
+function TestPrometheus:testHistogramSampleRate()
+  local hist = self.p:histogram("sampled", "Sampled", nil,
+    {buckets = {1, 2}, sample_rate = 0.5})
+  local random = math.random
+  local draws = {0.2, 0.7, 0.4, 0.9}
+  local draw = 0
+  math.random = function()
+    draw = draw % #draws + 1
+    return draws[draw]
+  end
+  for _ = 1, 4 do
+    hist:observe(1.5)
+  end
+  self.p:observe_many(1.5, {{hist}, {hist}})
+  math.random = random
+  self.p._counter:sync()
 
-  self.gauge2:inc(4, {"f2value", "f1value2"})
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value2"}'), 4)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  -- 3 of 6 observations are recorded, and scaled up during collection.
+  luaunit.assertEquals(self.dict:get("sampled_count"), 3)
+  self.p:collect()
+  assert(find_idx(ngx.printed, 'sampled_bucket{le="2"} 6') ~= nil)
+  assert(find_idx(ngx.printed, 'sampled_bucket{le="+Inf"} 6') ~= nil)
+  assert(find_idx(ngx.printed, 'sampled_count 6') ~= nil)
+  assert(find_idx(ngx.printed, 'sampled_sum 9') ~= nil)
+  luaunit.assertEquals(ngx.logs, nil)
 
-  self.gauge2:reset()
-  self.p.key_index:sync()
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), nil)
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value2"}'), nil)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
-  luaunit.assertEquals(self.dict:get("gauge1"), 3)
+  luaunit.assertNil(self.p:histogram("h1", "H1", nil, {sample_rate = 0}))
+  luaunit.assertNil(self.p:histogram("h2", "H2", nil, {sample_rate = 1.5}))
+  luaunit.assertNil(self.p:gauge("g1", "G1", nil, {sample_rate = 0.5}))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+end
+function TestPrometheus:testTimestamps()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {timestamps = true,
+    verify_output = true})
+  local counter = p:counter("requests", "Requests", {"host"})
+  local gauge = p:gauge("temperature", "Temperature")
+  local hist = p:histogram("latency", "Latency", {"host"}, {buckets = {1}})
+  local summary = p:summary("size", "Size", nil, {0.5})
+
+  ngx.clock = 1000.5
+  counter:inc(1, {"a"})
+  gauge:set(20)
+  hist:observe(0.5, {"a"})
+  summary:observe(3)
+  ngx.printed = nil
+  p:collect()
+  assert(find_idx(ngx.printed, 'requests{host="a"} 1 1000500') ~= nil)
+  assert(find_idx(ngx.printed, 'temperature 20 1000500') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_bucket{host="a",le="1"} 1 1000500') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_bucket{host="a",le="+Inf"} 1 1000500') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_count{host="a"} 1 1000500') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_sum{host="a"} 0.5 1000500') ~= nil)
+  assert(find_idx(ngx.printed, 'size_count 1 1000500') ~= nil)
+  local idx = find_idx(ngx.printed, 'size_count 1 1000500')
+  luaunit.assertStrContains(ngx.printed[idx - 1], 'size{quantile="0.5"} ')
+  luaunit.assertStrContains(ngx.printed[idx - 1], ' 1000500')
+  -- values not updated through metric objects have no timestamps.
+  assert(find_idx(ngx.printed, 'nginx_metric_errors_total 0') ~= nil)
+
+  -- only updated series get a new timestamp.
+  ngx.clock = 2000
+  gauge:set(21)
+  ngx.printed = nil
+  p:collect()
+  assert(find_idx(ngx.printed, 'temperature 21 2000000') ~= nil)
+  assert(find_idx(ngx.printed, 'requests{host="a"} 1 1000500') ~= nil)
+
+  -- OpenMetrics timestamps are in seconds.
+  ngx.var = {http_accept = "application/openmetrics-text"}
+  ngx.printed = nil
+  p:collect()
+  assert(find_idx(ngx.printed, 'temperature 21 2000.000') ~= nil)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testSeparateDicts()
+  local default = setmetatable({}, SimpleDict)
+  local counters = setmetatable({dict = {}}, SimpleDict)
+  local histograms = setmetatable({dict = {}}, SimpleDict)
+  ngx.shared.metrics = default
+  ngx.shared.counters = counters
+  ngx.shared.histograms = histograms
+  local p = require('prometheus').init({default = "metrics",
+    counters = "counters", histograms = "histograms"})
+  local counter = p:counter("requests", "Requests", {"host"})
+  local gauge = p:gauge("temperature", "Temperature")
+  local hist = p:histogram("latency", "Latency", nil, {buckets = {1}})
+  counter:inc(2, {"a"})
+  gauge:set(20)
+  hist:observe(0.5)
+  p._counter:sync()
+
+  -- each metric type is stored in its own dictionary.
+  luaunit.assertEquals(counters:get('requests{host="a"}'), 2)
+  luaunit.assertNil(default:get('requests{host="a"}'))
+  luaunit.assertEquals(default:get("temperature"), 20)
+  luaunit.assertEquals(histograms:get("latency_count"), 1)
+  luaunit.assertEquals(histograms:get('latency_bucket{le="Inf"}'), 1)
+  luaunit.assertNil(default:get("latency_count"))
+  luaunit.assertEquals(counters:get("nginx_metric_errors_total"), 0)
+
+  -- all dictionaries are merged in the output.
+  p:collect()
+  assert(find_idx(ngx.printed, 'requests{host="a"} 2') ~= nil)
+  assert(find_idx(ngx.printed, 'temperature 20') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_bucket{le="1"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'latency_count 1') ~= nil)
+
+  luaunit.assertEquals(ngx.logs, nil)
+
+  counter:del({"a"})
+  luaunit.assertNil(counters:get('requests{host="a"}'))
+
+  -- keys read before their metric is registered are routed once it is.
+  luaunit.assertNil(p.dict:get('late_total{host="a"}'))
+  p:counter("late_total", "Late", {"host"}):inc(1, {"a"})
+  p._counter:sync()
+  luaunit.assertEquals(counters:get('late_total{host="a"}'), 1)
+  luaunit.assertNil(default:get('late_total{host="a"}'))
+
+  luaunit.assertErrorMsgContains("default dictionary",
+    require('prometheus').init, {counters = "counters"})
+  luaunit.assertErrorMsgContains("Unknown category",
+    require('prometheus').init, {default = "metrics", timers = "counters"})
+  luaunit.assertErrorMsgContains("does not seem to exist",
+    require('prometheus').init, {default = "metrics", gauges = "nope"})
+end
+function TestPrometheus:testCollectScrapeMetrics()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {scrape_metrics = true})
+  -- gauges are exposed before the first scrape has finished.
+  p:collect()
+  assert(find_idx(ngx.printed, "nginx_metric_collect_duration_seconds 0") ~= nil)
+  assert(find_idx(ngx.printed, "nginx_metric_series_total 0") ~= nil)
+  luaunit.assertEquals(ngx.logs, {"No metrics have been registered"})
+  ngx.logs = nil
+
+  local requests = p:counter("requests", "Requests", {"host"})
+  requests:inc(1, {"a"})
+  requests:inc(1, {"b"})
+  p._counter:sync()
+  ngx.clock_step = 0.25
+  ngx.printed = nil
+  p:collect()
+  -- values of the previous scrape: the error counter, the last error
+  -- timestamp and both scrape gauges.
+  assert(find_idx(ngx.printed, "nginx_metric_collect_duration_seconds 0") ~= nil)
+  assert(find_idx(ngx.printed, "nginx_metric_series_total 4") ~= nil)
+
+  ngx.printed = nil
+  p:collect()
+  assert(find_idx(ngx.printed, "nginx_metric_collect_duration_seconds 0.25") ~= nil)
+  assert(find_idx(ngx.printed, "nginx_metric_series_total 6") ~= nil)
+  assert(find_idx(ngx.printed, "# TYPE nginx_metric_series_total gauge") ~= nil)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testMinDictSize()
+  local small = setmetatable({}, SimpleDict)
+  small.capacity = function() return 65536 end
+  ngx.shared.small = small
+  ngx.logs = nil
+  require('prometheus').init("small")
+  luaunit.assertEquals(#ngx.logs, 1)
+  luaunit.assertStrContains(ngx.logs[1],
+    "Dictionary 'small' is only 65536 bytes")
+  luaunit.assertNil(small:get("__ngx_prom__probe"))
+
+  ngx.logs = nil
+  require('prometheus').init("small", {min_dict_size = 65536})
+  require('prometheus').init("small", {min_dict_size = false})
+  luaunit.assertEquals(ngx.logs, nil)
+
+  luaunit.assertErrorMsgContains("Dictionary 'small' is only 65536 bytes",
+    require('prometheus').init, "small", {strict = true})
+  luaunit.assertErrorMsgContains("min_dict_size should be a number",
+    require('prometheus').init, "small", {min_dict_size = "1m"})
+
+  local readonly = setmetatable({}, SimpleDict)
+  readonly.safe_set = function() return false, "no memory" end
+  ngx.shared.readonly = readonly
+  luaunit.assertErrorMsgContains(
+    "Dictionary 'readonly' is not writable: no memory",
+    require('prometheus').init, "readonly", {strict = true})
+end
+function TestPrometheus:testOnError()
+  local reported = {}
+  local p = require('prometheus').init("metrics", {
+    on_error = function(err, context)
+      table.insert(reported, {err = err, context = context})
+    end})
+  local c = p:counter("errors_test", "Test counter", {"a"})
+  c:inc(1, {"x", "y"})
+  p:counter("errors_test", "Duplicate")
+  luaunit.assertEquals(ngx.logs, nil)
+  luaunit.assertEquals(#reported, 2)
+  luaunit.assertEquals(reported[1].err,
+    "inconsistent labels count, expected 1, got 2")
+  luaunit.assertEquals(reported[1].context, {metric = "errors_test"})
+  luaunit.assertStrContains(reported[2].err, "Duplicate metric errors_test")
+  luaunit.assertEquals(reported[2].context, {})
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+
+  -- A failing callback is logged together with the original error.
+  p = require('prometheus').init("metrics", {
+    on_error = function() error("callback is broken") end})
+  p:counter("errors_test2", "Test counter"):inc(1, {"x"})
+  luaunit.assertEquals(#ngx.logs, 1)
+  luaunit.assertStrContains(ngx.logs[1], "callback is broken")
+  luaunit.assertStrContains(ngx.logs[1],
+    "original error:  inconsistent labels count, expected 0, got 1")
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+
+  luaunit.assertErrorMsgContains("on_error should be a function",
+    require('prometheus').init, "metrics", {on_error = "log"})
+end
+function TestPrometheus:testCollectDictMetrics()
+  local default = setmetatable({}, SimpleDict)
+  local counters = setmetatable({dict = {}}, SimpleDict)
+  default.capacity = function() return 1048576 end
+  default.free_space = function() return 1040384 end
+  ngx.shared.metrics = default
+  ngx.shared.counters = counters
+  local p = require('prometheus').init({default = "metrics",
+    counters = "counters"}, {dict_metrics = true, up_metric = true})
+  local counter = p:counter("requests", "Requests", {"host"})
+  local gauge = p:gauge("temperature", "Temperature")
+  counter:inc(1, {"a"})
+  counter:inc(1, {"b"})
+  gauge:set(20)
+  p._counter:sync()
+
+  p:collect()
+  assert(find_idx(ngx.printed, "# TYPE nginx_metric_dict_bytes gauge") ~= nil)
+  assert(find_idx(ngx.printed,
+    'nginx_metric_dict_bytes{dict="metrics",state="capacity"} 1048576') ~= nil)
+  assert(find_idx(ngx.printed,
+    'nginx_metric_dict_bytes{dict="metrics",state="used"} 8192') ~= nil)
+  -- error metric and both series of the counter.
+  assert(find_idx(ngx.printed, 'nginx_metric_dict_keys{dict="counters"} 3') ~= nil)
+  -- the gauge and timestamp of the last error.
+  assert(find_idx(ngx.printed, 'nginx_metric_dict_keys{dict="metrics"} 2') ~= nil)
+  luaunit.assertNil(default:get('nginx_metric_dict_keys{dict="metrics"}'))
+
+  -- dictionaries that can't report usage are left out of the bytes gauge.
+  luaunit.assertEquals(find_idx(ngx.printed,
+    'nginx_metric_dict_bytes{dict="counters",state="capacity"}'), nil)
+  luaunit.assertStrContains(ngx.logs[1],
+    "Can't get memory usage of dictionary")
+  assert(find_idx(ngx.printed, "nginx_lua_prometheus_up 0") ~= nil)
+  ngx.logs = nil
+end
+function TestPrometheus:testMaxLabelValueLength()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics",
+    {max_label_value_length = 8})
+  local counter = p:counter("requests", "Requests", {"host", "path"})
+  local hist = p:histogram("latency", "Latency", {"path"}, {buckets = {1}})
+  local long = string.rep("x", 1024 * 1024)
+  counter:inc(1, {"short", long})
+  counter:inc(1, {"short", long})
+  hist:observe(0.5, {long})
+  -- multi-byte characters are not split.
+  counter:inc(1, {"short", "abcdefgéh"})
+  p._counter:sync()
+
+  luaunit.assertEquals(self.dict:get('requests{host="short",path="xxxxxxxx…"}'), 2)
+  luaunit.assertEquals(self.dict:get('latency_count{path="xxxxxxxx…"}'), 1)
+  luaunit.assertEquals(
+    self.dict:get('latency_bucket{path="xxxxxxxx…",le="1.0"}'), 1)
+  luaunit.assertEquals(self.dict:get('requests{host="short",path="abcdefg…"}'), 1)
+  for _, key in ipairs(p.key_index:list()) do
+    assert(#key < 100, key)
+  end
+  -- truncations are counted as errors once per series.
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+  luaunit.assertStrContains(ngx.logs[1], "truncated to")
+
+  luaunit.assertErrorMsgContains("max_label_value_length",
+    require('prometheus').init, "metrics", {max_label_value_length = 0})
+end
+function TestPrometheus:testBucketGenerators()
+  local prometheus = require('prometheus')
+  luaunit.assertEquals(prometheus.exponential_buckets(0.01, 10, 4),
+    {0.01, 0.1, 1, 10})
+  luaunit.assertEquals(prometheus.linear_buckets(0, 0.25, 5),
+    {0, 0.25, 0.5, 0.75, 1})
+  local hist = self.p:histogram("sizes", "Sizes", nil,
+    {buckets = prometheus.exponential_buckets(1024, 4, 3)})
+  hist:observe(5000)
+  self.p:collect()
+  assert(find_idx(ngx.printed, 'sizes_bucket{le="16384"} 1') ~= nil)
+
+  luaunit.assertErrorMsgContains("start should be a positive number",
+    prometheus.exponential_buckets, 0, 2, 3)
+  luaunit.assertErrorMsgContains("factor should be a number greater than 1",
+    prometheus.exponential_buckets, 1, 0.5, 3)
+  luaunit.assertErrorMsgContains("count should be a positive integer",
+    prometheus.linear_buckets, 0, 1, 2.5)
+  luaunit.assertErrorMsgContains("width should be a positive number",
+    prometheus.linear_buckets, 0, -1, 3)
+  luaunit.assertErrorMsgContains("not finite and strictly increasing",
+    prometheus.linear_buckets, 1e20, 1, 3)
+  luaunit.assertErrorMsgContains("not finite and strictly increasing",
+    prometheus.exponential_buckets, 1e300, 1e10, 3)
+end
+function TestPrometheus:testWriteRetries()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local failures = 0
+  local function flaky(method)
+    return function(dict, ...)
+      if failures > 0 then
+        failures = failures - 1
+        return nil, "busy"
+      end
+      return SimpleDict[method](dict, ...)
+    end
+  end
+  self.dict.safe_set = flaky("safe_set")
+  self.dict.incr = flaky("incr")
+  local p = require('prometheus').init("metrics", {write_retries = 2})
+  local gauge = p:gauge("gauge", "Gauge")
+  local counter = p:counter("counter", "Counter")
+
+  failures = 2
+  gauge:set(5)
+  luaunit.assertEquals(self.dict:get("gauge"), 5)
+  failures = 2
+  counter:inc(3)
+  p._counter:sync()
+  luaunit.assertEquals(self.dict:get("counter"), 3)
   luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
 
-  self.counter1:inc()
-  self.counter1:inc(4)
-  self.counter2:inc(1, {"v2", "v1"})
-  self.counter2:inc(3, {"v2", "v2"})
+  -- writes are dropped once retries are exhausted.
+  failures = 3
+  gauge:set(6)
+  luaunit.assertEquals(self.dict:get("gauge"), 5)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
 
-  self.p._counter:sync()
-  luaunit.assertEquals(self.dict:get("metric1"), 5)
-  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="v1"}'), 1)
-  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="v2"}'), 3)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  -- permanent errors are not retried.
+  local calls = 0
+  self.dict.safe_set = function(_, key)
+    -- the last error timestamp is set as well.
+    if key == "gauge" then
+      calls = calls + 1
+    end
+    return nil, "not found"
+  end
+  gauge:set(7)
+  luaunit.assertEquals(calls, 1)
 
-  self.counter1:reset()
-  self.p.key_index:sync()
-  luaunit.assertEquals(self.dict:get("metric1"), nil)
-  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="v1"}'), 1)
-  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="v2"}'), 3)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  luaunit.assertErrorMsgContains("write_retries", function()
+    require('prometheus').init("metrics", {write_retries = 100})
+  end)
+end
 
-  self.counter1:inc(4)
-  self.p._counter:sync()
-  self.counter2:reset()
-  self.p.key_index:sync()
-  luaunit.assertEquals(self.dict:get("metric1"), 4)
-  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="v1"}'), nil)
-  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="v2"}'), nil)
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value"}'), nil)
-  luaunit.assertEquals(self.dict:get('gauge2{f2="f2value",f1="f1value2"}'), nil)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
-  luaunit.assertEquals(self.dict:get("gauge1"), 3)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+function TestPrometheus:testWriteDeadline()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {write_deadline = 0.01})
+  local gauge = p:gauge("gauge", "Gauge", {"f1"})
+  ngx.clock = 1000
+  ngx.clock_step = 0.001
+  gauge:set(1, {"a"})
+  luaunit.assertEquals(self.dict:get('gauge{f1="a"}'), 1)
+  luaunit.assertNil(ngx.logs)
 
-  self.hist1:observe(0.35)
-  self.hist1:observe(0.4)
-  self.hist2:observe(0.001, {"ok", "site1"})
-  self.hist2:observe(0.15, {"ok", "site1"})
+  -- a slow update makes the following ones skipped.
+  ngx.clock_step = 0.1
+  gauge:set(2, {"a"})
+  luaunit.assertEquals(self.dict:get('gauge{f1="a"}'), 2)
+  luaunit.assertStrContains(ngx.logs[1], "skipping metric updates")
+  ngx.clock_step = 0
+  gauge:set(3, {"a"})
+  gauge:inc(1, {"a"})
+  luaunit.assertEquals(self.dict:get('gauge{f1="a"}'), 2)
+  luaunit.assertEquals({p._metric_dict:safe_set('gauge{f1="a"}', 5)},
+    {nil, "deadline exceeded"})
+  p._counter:sync()
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 3)
+  luaunit.assertEquals(#ngx.logs, 1)
 
-  self.p._counter:sync()
-  luaunit.assertEquals(self.dict:get("metric1"), 4)
-  luaunit.assertEquals(self.dict:get("gauge1"), 3)
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.300"}'), nil)
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.400"}'), 2)
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.500"}'), 2)
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="Inf"}'), 2)
-  luaunit.assertEquals(self.dict:get('l1_count'), 2)
-  luaunit.assertEquals(self.dict:get('l1_sum'), 0.75)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.005"}'), 1)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.100"}'), 1)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.200"}'), 2)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="Inf"}'), 2)
-  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site1"}'), 2)
-  luaunit.assertEquals(self.dict:get('l2_sum{var="ok",site="site1"}'), 0.151)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  -- deletions are never skipped.
+  gauge:del({"a"})
+  luaunit.assertNil(self.dict:get('gauge{f1="a"}'))
 
-  self.hist1:reset()
-  self.p.key_index:sync()
-  luaunit.assertEquals(self.dict:get("metric1"), 4)
-  luaunit.assertEquals(self.dict:get("gauge1"), 3)
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.400"}'), nil)
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.500"}'), nil)
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="Inf"}'), nil)
-  luaunit.assertEquals(self.dict:get('l1_count'), nil)
-  luaunit.assertEquals(self.dict:get('l1_sum'), nil)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.005"}'), 1)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.100"}'), 1)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.200"}'), 2)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="Inf"}'), 2)
-  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site1"}'), 2)
-  luaunit.assertEquals(self.dict:get('l2_sum{var="ok",site="site1"}'), 0.151)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  -- updates resume after the backoff.
+  ngx.clock = ngx.clock + 1
+  gauge:set(4, {"a"})
+  luaunit.assertEquals(self.dict:get('gauge{f1="a"}'), 4)
 
-  self.hist1:observe(0.35)
-  self.p._counter:sync()
-  self.hist2:reset()
-  self.p.key_index:sync()
-  luaunit.assertEquals(self.dict:get("metric1"), 4)
-  luaunit.assertEquals(self.dict:get("gauge1"), 3)
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.400"}'), 1)
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.500"}'), 1)
+  luaunit.assertErrorMsgContains("write_deadline", function()
+    require('prometheus').init("metrics", {write_deadline = 0})
+  end)
+end
+
+function TestPrometheus:testSnapshotRestore()
+  self.counter2:inc(5, {"v1", "v2"})
+  self.gauge2:set(1.5, {"v1", "with space"})
+  self.gauge1:set(1/3)
+  self.hist1:observe(0.25)
+  self.hist2:observe(2, {"a", "b"})
+  local blob = self.p:snapshot()
+  luaunit.assertStrContains(blob, 'metric2{f2="v1",f1="v2"} 5\n')
+  luaunit.assertStrContains(blob, 'gauge2{f2="v1",f1="with space"} 1.5\n')
+  luaunit.assertNotStrContains(blob, "__ngx_prom__")
+
+  -- a new dictionary, with some metrics changed.
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics")
+  local counter = p:counter("metric2", "Counter", {"f2", "f1"})
+  p:gauge("gauge2", "Gauge", {"f2", "f1"})
+  p:gauge("gauge1", "Gauge")
+  p:histogram("l1", "Histogram", nil, {0.1, 0.5})
+  p:histogram("l2", "Histogram", {"var", "site"})
+  counter:inc(1, {"v1", "v2"})
+  p._counter:sync()
+  self.dict:set('l2_count{var="a",site="b"}', 7)
+
+  local restored = p:restore(blob .. "invalid\n")
+  -- the counter has been updated already, so it's not restored.
+  luaunit.assertEquals(self.dict:get('metric2{f2="v1",f1="v2"}'), 1)
+  luaunit.assertEquals(self.dict:get('gauge2{f2="v1",f1="with space"}'), 1.5)
+  -- only buckets that still exist are restored.
+  luaunit.assertEquals(self.dict:get('l1_bucket{le="0.5"}'), 1)
+  luaunit.assertNil(self.dict:get('l1_bucket{le="0.1"}'))
   luaunit.assertEquals(self.dict:get('l1_bucket{le="Inf"}'), 1)
   luaunit.assertEquals(self.dict:get('l1_count'), 1)
-  luaunit.assertEquals(self.dict:get('l1_sum'), 0.35)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.005"}'), nil)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.100"}'), nil)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.200"}'), nil)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="Inf"}'), nil)
-  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site1"}'), nil)
-  luaunit.assertEquals(self.dict:get('l2_sum{var="ok",site="site1"}'), nil)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  luaunit.assertEquals(self.dict:get('l1_sum'), 0.25)
+  -- values are restored exactly.
+  luaunit.assertEquals(self.dict:get('gauge1'), 1/3)
+  -- a series with any of its values updated already is not restored at all.
+  luaunit.assertEquals(self.dict:get('l2_count{var="a",site="b"}'), 7)
+  luaunit.assertNil(self.dict:get('l2_sum{var="a",site="b"}'))
+  luaunit.assertNil(self.dict:get('l2_bucket{var="a",site="b",le="Inf"}'))
+  luaunit.assertEquals(restored, 6)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
 
-  -- key not exist
-  self.gauge2:inc(4, {"key_not_exist", "key_not_exist"})
-  self.gauge2:reset()
-  self.p.key_index:sync()
-  luaunit.assertEquals(self.dict:get('gauge2{f2="key_not_exist",f1="key_not_exist"}'), nil)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+  p:collect()
+  assert(find_idx(ngx.printed, 'gauge2{f2="v1",f1="with space"} 1.5') ~= nil)
+  assert(find_idx(ngx.printed, 'l1_bucket{le="0.5"} 1') ~= nil)
 
-  -- error get from dict
-  self.gauge2:inc(4, {"dict_error", "dict_error"})
-  self.gauge2:reset()
-  self.p.key_index:sync()
-  luaunit.assertEquals(self.dict:get('gauge2{f2="dict_error",f1="dict_error"}'), nil)
-  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 1)
+  -- values are only restored once.
+  luaunit.assertNil(p:restore(blob))
 end
-function TestPrometheus:testLatencyHistogram()
-  self.hist1:observe(0.35)
-  self.hist1:observe(0.4)
-  self.hist2:observe(0.001, {"ok", "site1"})
-  self.hist2:observe(0.15, {"ok", "site1"})
 
-  self.p._counter:sync()
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.300"}'), nil)
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.400"}'), 2)
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.500"}'), 2)
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="Inf"}'), 2)
-  luaunit.assertEquals(self.dict:get('l1_count'), 2)
-  luaunit.assertEquals(self.dict:get('l1_sum'), 0.75)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.005"}'), 1)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.100"}'), 1)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="00.200"}'), 2)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site1",le="Inf"}'), 2)
-  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site1"}'), 2)
-  luaunit.assertEquals(self.dict:get('l2_sum{var="ok",site="site1"}'), 0.151)
+function TestPrometheus:testCollectGroups()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {emit_groups = true,
+    verify_output = true})
+  p:counter("a_hits_total", "Hits", nil, {group = "cache"}):inc(1)
+  p:gauge("b_size", "Size", nil, {group = "cache"}):set(5)
+  p:histogram("a_latency", "Latency", nil, {buckets = {1}, group = "upstream"})
+    :observe(0.5)
+  p:counter("z_total", "Ungrouped"):inc(1)
+  p:collect()
+
+  luaunit.assertEquals(ngx.printed, {
+    "# HELP nginx_metric_errors_total Number of nginx-lua-prometheus errors",
+    "# TYPE nginx_metric_errors_total counter",
+    "nginx_metric_errors_total 0",
+    "# HELP nginx_metric_last_error_timestamp_seconds Time of the last nginx-lua-prometheus error, in unixtime",
+    "# TYPE nginx_metric_last_error_timestamp_seconds gauge",
+    "nginx_metric_last_error_timestamp_seconds 0",
+    "# HELP z_total Ungrouped",
+    "# TYPE z_total counter",
+    "z_total 1",
+    "# --- cache ---",
+    "# HELP a_hits_total Hits",
+    "# TYPE a_hits_total counter",
+    "a_hits_total 1",
+    "# HELP b_size Size",
+    "# TYPE b_size gauge",
+    "b_size 5",
+    "# --- upstream ---",
+    "# HELP a_latency Latency",
+    "# TYPE a_latency histogram",
+    'a_latency_bucket{le="1"} 1',
+    'a_latency_bucket{le="+Inf"} 1',
+    "a_latency_count 1",
+    "a_latency_sum 0.5",
+  })
   luaunit.assertEquals(ngx.logs, nil)
 end
-function TestPrometheus:testLabelEscaping()
-  self.counter2:inc(1, {"v2", "\""})
-  self.counter2:inc(5, {"v2", "\\"})
-  self.gauge2:set(1, {"v2", "\""})
-  self.gauge2:set(5, {"v2", "\\"})
-  self.hist2:observe(0.001, {"ok", "site\"1"})
-  self.hist2:observe(0.15, {"ok", "site\"1"})
+function TestPrometheus:testCollectNoMetrics()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {verify_output = true})
+  p:collect()
+  p:collect()
 
-  self.p._counter:sync()
-  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="\\""}'), 1)
-  luaunit.assertEquals(self.dict:get('metric2{f2="v2",f1="\\\\"}'), 5)
-  luaunit.assertEquals(self.dict:get('gauge2{f2="v2",f1="\\""}'), 1)
-  luaunit.assertEquals(self.dict:get('gauge2{f2="v2",f1="\\\\"}'), 5)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site\\"1",le="00.005"}'), 1)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site\\"1",le="00.100"}'), 1)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site\\"1",le="00.200"}'), 2)
-  luaunit.assertEquals(self.dict:get('l2_bucket{var="ok",site="site\\"1",le="Inf"}'), 2)
-  luaunit.assertEquals(self.dict:get('l2_count{var="ok",site="site\\"1"}'), 2)
-  luaunit.assertEquals(self.dict:get('l2_sum{var="ok",site="site\\"1"}'), 0.151)
+  luaunit.assertNil(ngx.status)
+  assert(find_idx(ngx.printed, "# TYPE nginx_metric_errors_total counter") ~= nil)
+  assert(find_idx(ngx.printed, "nginx_metric_errors_total 0") ~= nil)
+  -- the warning is only logged once, and is not counted as an error.
+  luaunit.assertEquals(ngx.logs, {"No metrics have been registered"})
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
+
+  ngx.logs = nil
+  self.p:collect()
   luaunit.assertEquals(ngx.logs, nil)
 end
-function TestPrometheus:testCustomBucketer1()
-  local hist3 = self.p:histogram("l3", "Histogram 3", {"var"}, {1,2,3})
-  self.hist1:observe(0.35)
-  hist3:observe(2, {"ok"})
-  hist3:observe(0.151, {"ok"})
+function TestPrometheus:testCollectNoHelp()
+  local counter = self.p:counter("nohelp", nil, {"f1"})
+  counter:inc(1, {"v1"})
+  self.p:collect()
 
-  self.p._counter:sync()
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.300"}'), nil)
-  luaunit.assertEquals(self.dict:get('l1_bucket{le="00.400"}'), 1)
-  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="1.0"}'), 1)
-  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="2.0"}'), 2)
-  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="3.0"}'), 2)
-  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="Inf"}'), 2)
-  luaunit.assertEquals(self.dict:get('l3_count{var="ok"}'), 2)
-  luaunit.assertEquals(self.dict:get('l3_sum{var="ok"}'), 2.151)
+  assert(find_idx(ngx.printed, "# TYPE nohelp counter") ~= nil)
+  assert(find_idx(ngx.printed, 'nohelp{f1="v1"} 1') ~= nil)
+  for _, line in ipairs(ngx.printed) do
+    assert(line:find("^# HELP nohelp") == nil)
+  end
   luaunit.assertEquals(ngx.logs, nil)
 end
-function TestPrometheus:testCustomBucketer2()
-  local hist3 = self.p:histogram("l3", "Histogram 3", {"var"},
-    {0.000005,5,50000})
-  hist3:observe(0.000001, {"ok"})
-  hist3:observe(3, {"ok"})
-  hist3:observe(7, {"ok"})
-  hist3:observe(70000, {"ok"})
+function TestPrometheus:testDefaultHelp()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {default_help = "TODO"})
+  p:counter("c1", nil, {"f1"}):inc(1, {"v1"})
+  p:gauge("g1", ""):set(1)
+  p:gauge("g2", "Gauge 2"):set(1)
+  p:collect()
 
-  self.p._counter:sync()
-  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="00000.000005"}'), 1)
-  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="00005.000000"}'), 2)
-  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="50000.000000"}'), 3)
-  luaunit.assertEquals(self.dict:get('l3_bucket{var="ok",le="Inf"}'), 4)
-  luaunit.assertEquals(self.dict:get('l3_count{var="ok"}'), 4)
-  luaunit.assertEquals(self.dict:get('l3_sum{var="ok"}'), 70010.000001)
+  assert(find_idx(ngx.printed, "# HELP c1 TODO") ~= nil)
+  assert(find_idx(ngx.printed, "# HELP g1 TODO") ~= nil)
+  assert(find_idx(ngx.printed, "# HELP g2 Gauge 2") ~= nil)
   luaunit.assertEquals(ngx.logs, nil)
 end
-function TestPrometheus:testCollect()
-  local hist3 = self.p:histogram("b1", "Bytes", {"var", "stale"}, {0.1, 100, 2000})
-  local hist4 = self.p:histogram("b2", "Labels", {}, {100, 2000})
-  self.counter1:inc(5)
-  self.counter2:inc(2, {"v2", "v1"})
-  self.counter2:inc(2, {"v2", "v1"})
-  self.gauge1:set(3)
-  self.gauge2:set(2, {"v2", "v1"})
-  self.gauge2:set(5, {"v2", "v1"})
-  self.hist1:observe(0.000001)
-  self.hist2:observe(0.000001, {"ok", "site2"})
-  self.hist2:observe(3, {"ok", "site2"})
-  self.hist2:observe(7, {"ok", "site2"})
-  self.hist2:observe(70000, {"ok","site2"})
-  hist3:observe(0.01, {"ok", "true"})
-  hist3:observe(50, {"ok", "true"})
-  hist3:observe(50, {"ok", "true"})
-  hist3:observe(150, {"ok", "true"})
-  hist3:observe(5000, {"ok", "true"})
-  hist4:observe(50, {})
-  hist4:observe(50, {})
-  hist4:observe(150, {})
-  hist4:observe(5000, {})
+function TestPrometheus:testEmptyHelp()
+  self.p:gauge("g3", ""):set(1)
   self.p:collect()
+  assert(find_idx(ngx.printed, "# HELP g3") ~= nil)
+  assert(find_idx(ngx.printed, "# TYPE g3 gauge") ~= nil)
+end
+function TestPrometheus:testRequireHelp()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics", {require_help = true})
+  luaunit.assertNil(p:counter("c1"))
+  luaunit.assertNil(p:histogram("h1", ""))
+  luaunit.assertNotNil(p:gauge("g1", "Gauge 1"))
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  luaunit.assertStrContains(ngx.logs[1], "Metric 'c1' has no help text")
+end
 
-  assert(find_idx(ngx.printed, "# HELP metric1 Metric 1") ~= nil)
-  assert(find_idx(ngx.printed, "# TYPE metric1 counter") ~= nil)
-  assert(find_idx(ngx.printed, "metric1 5") ~= nil)
-
-  assert(find_idx(ngx.printed, "# TYPE metric2 counter") ~= nil)
-  assert(find_idx(ngx.printed, 'metric2{f2="v2",f1="v1"} 4') ~= nil)
-
-  assert(find_idx(ngx.printed, "# TYPE gauge1 gauge") ~= nil)
-  assert(find_idx(ngx.printed, 'gauge1 3') ~= nil)
-
-  assert(find_idx(ngx.printed, "# TYPE gauge2 gauge") ~= nil)
-  assert(find_idx(ngx.printed, 'gauge2{f2="v2",f1="v1"} 5') ~= nil)
-
-  assert(find_idx(ngx.printed, "# TYPE b1 histogram") ~= nil)
-  assert(find_idx(ngx.printed, "# HELP b1 Bytes") ~= nil)
-  assert(find_idx(ngx.printed, 'b1_bucket{var="ok",stale="true",le="0.1"} 1') ~= nil)
-  assert(find_idx(ngx.printed, 'b1_bucket{var="ok",stale="true",le="100"} 3') ~= nil)
-  assert(find_idx(ngx.printed, 'b1_sum{var="ok",stale="true"} 5250.01') ~= nil)
-  assert(find_idx(ngx.printed, 'b2_bucket{le="100"} 2') ~= nil)
-  assert(find_idx(ngx.printed, 'b2_sum{} 5250') ~= nil)
+function TestPrometheus:testCollectNginxStatus()
+  ngx.var = {connections_active = "5", connections_reading = "1",
+             connections_writing = "3", connections_waiting = "1"}
+  ngx.captured = {["/status"] = {status = 200, body = "Active connections: 5 \n" ..
+    "server accepts handled requests\n 16 15 31 \n" ..
+    "Reading: 1 Writing: 3 Waiting: 1 \n"}}
+  self.p:collect_nginx_status({stub_status_location = "/status",
+    names = {requests = "nginx_requests_total"}})
+  self.p:collect()
 
-  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site2",le="4"} 2') ~= nil)
-  assert(find_idx(ngx.printed, 'l2_bucket{var="ok",site="site2",le="+Inf"} 4') ~= nil)
+  assert(find_idx(ngx.printed, "# TYPE nginx_connections gauge") ~= nil)
+  assert(find_idx(ngx.printed, 'nginx_connections{state="active"} 5') ~= nil)
+  assert(find_idx(ngx.printed, 'nginx_connections{state="reading"} 1') ~= nil)
+  assert(find_idx(ngx.printed, 'nginx_connections{state="writing"} 3') ~= nil)
+  assert(find_idx(ngx.printed, 'nginx_connections{state="waiting"} 1') ~= nil)
+  assert(find_idx(ngx.printed, "# TYPE nginx_connections_accepted_total counter") ~= nil)
+  assert(find_idx(ngx.printed, "nginx_connections_accepted_total 16") ~= nil)
+  assert(find_idx(ngx.printed, "nginx_connections_handled_total 15") ~= nil)
+  assert(find_idx(ngx.printed, "nginx_requests_total 31") ~= nil)
 
-  -- check that type comment exists and is before any samples for the metric.
-  local type_idx = find_idx(ngx.printed, '# TYPE l1 histogram')
-  assert (type_idx ~= nil)
-  assert (ngx.printed[type_idx-1]:find("^l1") == nil)
-  assert (ngx.printed[type_idx+1]:find("^l1") ~= nil)
+  -- values are updated on subsequent calls.
+  ngx.var.connections_active = "6"
+  ngx.captured["/status"].body = "server accepts handled requests\n 17 17 40"
+  self.p:collect_nginx_status({stub_status_location = "/status"})
+  luaunit.assertEquals(self.dict:get('nginx_connections{state="active"}'), 6)
+  luaunit.assertEquals(self.dict:get("nginx_requests_total"), 40)
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 0)
   luaunit.assertEquals(ngx.logs, nil)
 end
+function TestPrometheus:testCollectNginxStatusErrors()
+  ngx.var = {}
+  self.p:collect_nginx_status({stub_status_location = "/status"})
+  luaunit.assertEquals(self.dict:get("nginx_metric_errors_total"), 2)
+  luaunit.assertEquals(#ngx.logs, 2)
+  luaunit.assertStrContains(ngx.logs[1], "ngx_http_stub_status_module")
+  luaunit.assertStrContains(ngx.logs[2], "Could not get nginx status")
+end
 
 function TestPrometheus:testCollectWithPrefix()
   self.dict = setmetatable({}, SimpleDict)
@@ -660,6 +4294,43 @@ function TestPrometheus:testCollectWithPrefix()
   assert(find_idx(ngx.printed, 'test_pref_b1_sum{var="ok"} 5250') ~= nil)
 end
 
+function TestPrometheus:testCollectGraphite()
+  local hist3 = self.p:histogram("b1", "Bytes", {"var"}, {0.1, 100})
+  self.counter1:inc(5)
+  self.counter2:inc(2, {"v.2", "v 1"})
+  self.gauge2:set(5, {"", "v1"})
+  hist3:observe(50, {"ok"})
+  ngx.uri_args = {format="graphite"}
+  self.p:collect()
+
+  assert(find_idx(ngx.printed, "metric1 5 1600000000") ~= nil)
+  assert(find_idx(ngx.printed, "metric2.f2.v_2.f1.v_1 2 1600000000") ~= nil)
+  assert(find_idx(ngx.printed, "gauge2.f2._.f1.v1 5 1600000000") ~= nil)
+  assert(find_idx(ngx.printed, "b1_bucket.var.ok.le.100 1 1600000000") ~= nil)
+  assert(find_idx(ngx.printed, "b1_bucket.var.ok.le._Inf 1 1600000000") ~= nil)
+  assert(find_idx(ngx.printed, "b1_count.var.ok 1 1600000000") ~= nil)
+  assert(find_idx(ngx.printed, "b1_sum.var.ok 50 1600000000") ~= nil)
+  assert(find_idx(ngx.printed, "# TYPE metric1 counter") == nil)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+function TestPrometheus:testCollectGraphiteTemplate()
+  self.dict = setmetatable({}, SimpleDict)
+  ngx.shared.metrics = self.dict
+  local p = require('prometheus').init("metrics",
+    {prefix="pref_", graphite_template="nginx.{f1}.{name}.{missing}"})
+  local counter = p:counter("metric1", "Metric 1", {"f2", "f1"})
+  counter:inc(3, {"v2", "v\\1"})
+  counter:inc(1, {"v\"2", "v1"})
+
+  ngx.uri_args = {format="graphite"}
+  p:collect()
+  assert(find_idx(ngx.printed, "nginx.v_1.pref_metric1.f2.v2 3 1600000000") ~= nil)
+  assert(find_idx(ngx.printed, "nginx.v1.pref_metric1.f2.v_2 1 1600000000") ~= nil)
+  assert(find_idx(ngx.printed, "pref_nginx_metric_errors_total 0 1600000000") == nil)
+  assert(find_idx(ngx.printed, "nginx.pref_nginx_metric_errors_total 0 1600000000") ~= nil)
+  luaunit.assertEquals(ngx.logs, nil)
+end
+
 TestKeyIndex = {}
 function TestKeyIndex:setUp()
   self.dict = setmetatable({}, SimpleDict)
@@ -678,21 +4349,23 @@ function TestKeyIndex:testAdd()
   luaunit.assertEquals(self.dict:get("_prefix_key_count"), 1)
   luaunit.assertEquals(self.dict:get("_prefix_key_1"), "single")
 
-  self.key_index:add({"multiple", "keys"})
+  local _, added = self.key_index:add({"multiple", "keys"})
+  luaunit.assertEquals(added, 2)
   luaunit.assertEquals(ngx.logs, nil)
   luaunit.assertEquals(self.dict:get("_prefix_key_count"), 3)
   luaunit.assertEquals(self.dict:get("_prefix_key_2"), "multiple")
   luaunit.assertEquals(self.dict:get("_prefix_key_3"), "keys")
 
   -- adding already existing key should do nothing
-  self.key_index:add("single")
+  _, added = self.key_index:add({"single", "new"})
+  luaunit.assertEquals(added, 1)
   luaunit.assertEquals(ngx.logs, nil)
-  luaunit.assertEquals(self.dict:get("_prefix_key_count"), 3)
+  luaunit.assertEquals(self.dict:get("_prefix_key_count"), 4)
 
   -- error should be returned when memory is full
   local err = self.key_index:add("willnotfit")
   luaunit.assertEquals(err, "Unexpected error adding a key: no memory")
-  luaunit.assertEquals(self.dict:get("_prefix_key_count"), 3)
+  luaunit.assertEquals(self.dict:get("_prefix_key_count"), 4)
 end
 function TestKeyIndex:testRemove()
   self.key_index:add({"key1", "key2", "key3"})